@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/service/llm"
+)
+
+// providerResilience returns the retry policy and circuit breaker of provider calls.
+var providerResilience = llm.Default.Resilience
+
+// requireAdmin rejects users missing from the configured admin ids.
+func (h *Handler) requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := h.authorizedUserID(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if !h.assistant.IsAdmin(userID) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// providerHealth reports the retry policy and the circuit of every provider called so far.
+func (h *Handler) providerHealth(c *gin.Context) {
+	res := providerResilience()
+	if res == nil {
+		c.JSON(http.StatusOK, gin.H{"retry": nil, "circuit_breaker": gin.H{"enabled": false}, "circuits": []llm.CircuitState{}})
+		return
+	}
+	breaker := gin.H{"enabled": res.Breaker != nil}
+	if res.Breaker != nil {
+		// without a shared store the circuits are those of the instance answering
+		breaker["shared"] = res.Breaker.Shared()
+		breaker["failure_threshold"] = res.Breaker.Threshold()
+		breaker["open_seconds"] = int(res.Breaker.OpenFor().Seconds())
+	}
+	circuits := res.Breaker.States()
+	if circuits == nil {
+		circuits = []llm.CircuitState{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"retry": gin.H{
+			"max_attempts":       res.Retry.MaxAttempts,
+			"initial_backoff_ms": res.Retry.InitialBackoff.Milliseconds(),
+			"max_backoff_ms":     res.Retry.MaxBackoff.Milliseconds(),
+		},
+		"circuit_breaker": breaker,
+		"circuits":        circuits,
+	})
+}
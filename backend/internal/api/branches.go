@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/service/assistant"
+)
+
+type regenerateRequest struct {
+	ModelType      string `json:"model_type"`
+	Provider       string `json:"provider"`
+	ClientMsgID    string `json:"client_msg_id"`
+	StreamProtocol int    `json:"stream_protocol"`
+}
+
+// regenerateHash fingerprints a regenerate request for client_msg_id replays.
+func regenerateHash(sessionID int64, req regenerateRequest) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "regenerate\x00%d\x00%s\x00%s", sessionID, strings.TrimSpace(req.Provider), strings.TrimSpace(req.ModelType))
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// regenerateReply answers the last user message of a session again, optionally with a
+// different provider/model. The new reply is a sibling of the previous one and becomes
+// the active branch; the previous reply can be selected again.
+func (h *Handler) regenerateReply(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	var req regenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	if strings.TrimSpace(req.ClientMsgID) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client_msg_id is required"})
+		return
+	}
+	protocol, ok := streamProtocol(c, req.StreamProtocol)
+	if !ok {
+		return
+	}
+
+	entry, cacheKey, ok := h.claimStream(c, userID, sessionID, req.ClientMsgID, regenerateHash(sessionID, req))
+	if !ok {
+		return
+	}
+	budget, ok := h.checkBudget(c, cacheKey, entry, userID)
+	if !ok {
+		return
+	}
+	prompt, reply, err := h.assistant.LastExchange(c.Request.Context(), userID, sessionID)
+	if err != nil {
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", err)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		case errors.Is(err, assistant.ErrNoPrompt):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	token, err := h.assistant.EnsureAIReady(c.Request.Context(), userID, req.Provider)
+	if err != nil {
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	job := replyJob{
+		userID:     userID,
+		sessionID:  sessionID,
+		clientID:   req.ClientMsgID,
+		provider:   req.Provider,
+		model:      req.ModelType,
+		token:      token,
+		prompt:     prompt,
+		regenerate: true,
+		protocol:   protocol,
+		budget:     budget,
+	}
+	if reply != nil {
+		job.replaceID = reply.ID
+	}
+	h.streamReply(c, cacheKey, entry, job)
+}
+
+type editRequest struct {
+	Content        string `json:"content"`
+	ModelType      string `json:"model_type"`
+	Provider       string `json:"provider"`
+	ClientMsgID    string `json:"client_msg_id"`
+	StreamProtocol int    `json:"stream_protocol"`
+}
+
+func editHash(messageID int64, req editRequest) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "edit\x00%d\x00%s\x00%s\x00%s", messageID, strings.TrimSpace(req.Content), strings.TrimSpace(req.Provider), strings.TrimSpace(req.ModelType))
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// editMessage forks the conversation at a past user message: the new text becomes a
+// sibling branch and is answered right away with the same SSE events as captureInput.
+func (h *Handler) editMessage(c *gin.Context) {
+	userID, sessionID, messageID, ok := h.messageParams(c)
+	if !ok {
+		return
+	}
+	var req editRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	if strings.TrimSpace(req.ClientMsgID) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client_msg_id is required"})
+		return
+	}
+	protocol, ok := streamProtocol(c, req.StreamProtocol)
+	if !ok {
+		return
+	}
+
+	entry, cacheKey, ok := h.claimStream(c, userID, sessionID, req.ClientMsgID, editHash(messageID, req))
+	if !ok {
+		return
+	}
+	budget, ok := h.checkBudget(c, cacheKey, entry, userID)
+	if !ok {
+		return
+	}
+	token, err := h.assistant.EnsureAIReady(c.Request.Context(), userID, req.Provider)
+	if err != nil {
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	message, err := h.assistant.EditUserMessage(c.Request.Context(), userID, sessionID, messageID, req.Content)
+	if err != nil {
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// the worker's cached history belongs to the previous branch
+	h.workers.Purge(userID, sessionID)
+	h.streamReply(c, cacheKey, entry, replyJob{
+		userID:     userID,
+		sessionID:  sessionID,
+		clientID:   req.ClientMsgID,
+		provider:   req.Provider,
+		model:      req.ModelType,
+		token:      token,
+		prompt:     message,
+		regenerate: true,
+		protocol:   protocol,
+		budget:     budget,
+	})
+}
+
+// listSiblings returns the alternatives at a node of the conversation tree: other
+// edits of a user message or other variants of a reply.
+func (h *Handler) listSiblings(c *gin.Context) {
+	h.respondSiblings(c, "siblings")
+}
+
+// listVariants keeps the route regenerated replies were listed with before the
+// conversation tree; it answers like listSiblings under the old "variants" key.
+func (h *Handler) listVariants(c *gin.Context) {
+	h.respondSiblings(c, "variants")
+}
+
+func (h *Handler) respondSiblings(c *gin.Context, listKey string) {
+	userID, sessionID, messageID, ok := h.messageParams(c)
+	if !ok {
+		return
+	}
+	siblings, activeID, err := h.assistant.ListSiblings(c.Request.Context(), userID, sessionID, messageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		listKey:     siblings,
+		"active_id": activeID,
+	})
+}
+
+// selectBranch switches the branch shown in the conversation and drops the worker's
+// cached history so the next message continues the chosen branch.
+func (h *Handler) selectBranch(c *gin.Context) {
+	userID, sessionID, messageID, ok := h.messageParams(c)
+	if !ok {
+		return
+	}
+	msg, err := h.assistant.SelectBranch(c.Request.Context(), userID, sessionID, messageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.workers.Purge(userID, sessionID)
+	c.JSON(http.StatusOK, gin.H{"message": messagePayload(msg)})
+}
+
+func (h *Handler) messageParams(c *gin.Context) (int64, int64, int64, bool) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return 0, 0, 0, false
+	}
+	messageID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil || messageID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid message id"})
+		return 0, 0, 0, false
+	}
+	return userID, sessionID, messageID, true
+}
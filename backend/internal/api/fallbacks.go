@@ -0,0 +1,65 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+// getFallbacks returns the user's default fallback chain; sessions with their own chain
+// in their settings use that one instead.
+func (h *Handler) getFallbacks(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	chain, err := h.assistant.GetUserFallbacks(c.Request.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if chain == nil {
+		chain = []models.ProviderModel{}
+	}
+	c.JSON(http.StatusOK, gin.H{"fallbacks": chain})
+}
+
+// setFallbacks replaces the user's default fallback chain; an empty list removes it.
+func (h *Handler) setFallbacks(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Fallbacks []models.ProviderModel `json:"fallbacks"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	chain, err := h.assistant.SetUserFallbacks(c.Request.Context(), userID, req.Fallbacks)
+	if err != nil {
+		switch {
+		case errors.Is(err, assistant.ErrInvalidFallbacks):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if chain == nil {
+		chain = []models.ProviderModel{}
+	}
+	c.JSON(http.StatusOK, gin.H{"fallbacks": chain})
+}
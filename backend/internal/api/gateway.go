@@ -0,0 +1,513 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/config"
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/ai"
+	"unichatgo/internal/service/assistant"
+	"unichatgo/internal/service/llm"
+)
+
+// recordSessionHeader asks the gateway to store the exchange in a session: a session id,
+// or "new" to start one. The response echoes the session id in the same header.
+const recordSessionHeader = "X-Unichat-Session"
+
+// completer is the part of ai.Completer the gateway uses.
+type completer interface {
+	Complete(ctx context.Context, messages []*models.Message, opts ai.CompletionOptions) (*ai.Completion, error)
+	Stream(ctx context.Context, messages []*models.Message, opts ai.CompletionOptions, onDelta func(string) error) (*ai.Completion, error)
+}
+
+// for mock test
+var (
+	completerFactory = func(provider, model, token string) (completer, error) {
+		return ai.NewCompleter(provider, model, token)
+	}
+	providerConfigs = ai.ConfiguredProviders
+)
+
+// modelPrefixes maps well-known model name prefixes to the provider serving them.
+var modelPrefixes = []struct{ prefix, provider string }{
+	{"gpt-", "openai"},
+	{"chatgpt-", "openai"},
+	{"o1", "openai"},
+	{"o3", "openai"},
+	{"o4", "openai"},
+	{"gemini-", "gemini"},
+	{"claude-", "claude"},
+}
+
+type chatCompletionMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model         string                  `json:"model"`
+	Messages      []chatCompletionMessage `json:"messages"`
+	Stream        bool                    `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	Temperature         *float32        `json:"temperature"`
+	TopP                *float32        `json:"top_p"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Stop                json.RawMessage `json:"stop"`
+	N                   *int            `json:"n"`
+}
+
+type chatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// openAIError answers in the error shape OpenAI clients parse.
+func openAIError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"message": message, "type": errType, "code": nil}})
+}
+
+// listModels returns the default model of every configured provider, in the OpenAI format.
+func (h *Handler) listModels(c *gin.Context) {
+	providers, err := providerConfigs()
+	if err != nil {
+		openAIError(c, http.StatusInternalServerError, "server_error", "load providers failed")
+		return
+	}
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		for _, model := range providerModels(providers[name]) {
+			data = append(data, gin.H{"id": model, "object": "model", "created": 0, "owned_by": name})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+// chatCompletions is an OpenAI-compatible chat endpoint. The provider is picked from the
+// model name and called with the user's stored API key for it.
+func (h *Handler) chatCompletions(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req chatCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid request body")
+		return
+	}
+	if req.N != nil && *req.N != 1 {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "only n=1 is supported")
+		return
+	}
+	messages, err := gatewayMessages(req.Messages)
+	if err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	opts := ai.CompletionOptions{Temperature: req.Temperature, TopP: req.TopP, MaxTokens: req.MaxTokens}
+	if req.MaxCompletionTokens != nil {
+		opts.MaxTokens = req.MaxCompletionTokens
+	}
+	if opts.Stop, err = parseStop(req.Stop); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	providers, err := providerConfigs()
+	if err != nil {
+		openAIError(c, http.StatusInternalServerError, "server_error", "load providers failed")
+		return
+	}
+	provider, model, err := resolveModel(req.Model, providers)
+	if err != nil {
+		openAIError(c, http.StatusNotFound, "invalid_request_error", err.Error())
+		return
+	}
+	ctx := c.Request.Context()
+	token, err := h.assistant.EnsureAIReady(ctx, userID, provider)
+	if err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("%s: %v", provider, err))
+		return
+	}
+	budget, err := h.assistant.BudgetStatus(ctx, userID)
+	if err != nil {
+		openAIError(c, http.StatusInternalServerError, "server_error", "load budget failed")
+		return
+	}
+	if budget.Exhausted {
+		openAIError(c, http.StatusTooManyRequests, "insufficient_quota", assistant.ErrBudgetExhausted.Error())
+		return
+	}
+	session, newSession, err := h.gatewaySession(ctx, userID, c.GetHeader(recordSessionHeader), messages)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			openAIError(c, http.StatusNotFound, "invalid_request_error", "session not found")
+			return
+		}
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	recorded := false
+	if session != nil {
+		c.Header(recordSessionHeader, strconv.FormatInt(session.ID, 10))
+		if newSession {
+			// a failed call should not leave an empty session behind
+			defer func() {
+				if !recorded {
+					if err := h.assistant.DeleteSession(context.Background(), userID, session.ID); err != nil {
+						log.Printf("drop unused gateway session %d: %v", session.ID, err)
+					}
+				}
+			}()
+		}
+	}
+	client, err := completerFactory(provider, model, token)
+	if err != nil {
+		openAIError(c, http.StatusBadGateway, "server_error", err.Error())
+		return
+	}
+
+	id := "chatcmpl-" + randomHex(12)
+	created := time.Now().Unix()
+	var completion *ai.Completion
+	if req.Stream {
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		completion, err = streamCompletion(c, client, messages, opts, id, created, model, includeUsage)
+		if err != nil {
+			log.Printf("gateway stream for user %d failed: %v", userID, err)
+			// what the provider generated before the stream broke off is still billed
+			if completion != nil && completion.Content != "" {
+				estimateUsage(completion, messages)
+				h.recordUsage(context.Background(), userID, 0, provider, model, completion.PromptTokens, completion.CompletionTokens)
+			}
+			return
+		}
+	} else {
+		if completion, err = client.Complete(ctx, messages, opts); err != nil {
+			openAIError(c, http.StatusBadGateway, "upstream_error", err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": created,
+			"model":   model,
+			"choices": []gin.H{{
+				"index":         0,
+				"message":       gin.H{"role": "assistant", "content": completion.Content},
+				"finish_reason": finishReason(completion),
+			}},
+			"usage": completionUsage(completion),
+		})
+	}
+	var sessionID int64
+	if session != nil {
+		sessionID = session.ID
+		recorded = h.recordExchange(userID, session.ID, messages[len(messages)-1], completion, provider, model)
+	}
+	h.recordUsage(context.Background(), userID, sessionID, provider, model, completion.PromptTokens, completion.CompletionTokens)
+}
+
+// estimateUsage fills in the token counts a stream cut off before the provider
+// reported its usage.
+func estimateUsage(completion *ai.Completion, messages []*models.Message) {
+	if completion.PromptTokens == 0 {
+		for _, msg := range messages {
+			completion.PromptTokens += llm.EstimateTokens(msg.Content) + llm.MessageTokenOverhead
+		}
+	}
+	if completion.CompletionTokens == 0 {
+		completion.CompletionTokens = llm.EstimateTokens(completion.Content)
+	}
+}
+
+// streamCompletion writes the reply as OpenAI chat.completion.chunk events ending in
+// [DONE]. On failure it returns what was generated so far along with the error.
+func streamCompletion(c *gin.Context, client completer, messages []*models.Message, opts ai.CompletionOptions, id string, created int64, model string, includeUsage bool) (*ai.Completion, error) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		openAIError(c, http.StatusInternalServerError, "server_error", "streaming not supported")
+		return nil, errors.New("streaming not supported")
+	}
+	// the stream starts with the first chunk so that an upstream failure before it can
+	// still be answered with an error status
+	started := false
+	write := func(payload any) error {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		if !started {
+			started = true
+			c.Writer.Header().Set("Content-Type", "text/event-stream")
+			c.Writer.Header().Set("Cache-Control", "no-cache")
+			c.Writer.Header().Set("Connection", "keep-alive")
+			c.Writer.Header().Set("X-Accel-Buffering", "no")
+			c.Status(http.StatusOK)
+		}
+		if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	chunk := func(delta gin.H, finish any) gin.H {
+		return gin.H{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []gin.H{{"index": 0, "delta": delta, "finish_reason": finish}},
+		}
+	}
+
+	completion, err := client.Stream(c.Request.Context(), messages, opts, func(delta string) error {
+		if !started {
+			if err := write(chunk(gin.H{"role": "assistant", "content": ""}, nil)); err != nil {
+				return err
+			}
+		}
+		return write(chunk(gin.H{"content": delta}, nil))
+	})
+	if err != nil {
+		if !started {
+			openAIError(c, http.StatusBadGateway, "upstream_error", err.Error())
+			return completion, err
+		}
+		// headers are sent; report the failure in-band like OpenAI does
+		_ = write(gin.H{"error": gin.H{"message": err.Error(), "type": "upstream_error", "code": nil}})
+		return completion, err
+	}
+	if !started {
+		if err := write(chunk(gin.H{"role": "assistant", "content": ""}, nil)); err != nil {
+			return completion, err
+		}
+	}
+	if err := write(chunk(gin.H{}, finishReason(completion))); err != nil {
+		return completion, err
+	}
+	if includeUsage {
+		usage := chunk(gin.H{}, nil)
+		usage["choices"] = []gin.H{}
+		usage["usage"] = completionUsage(completion)
+		if err := write(usage); err != nil {
+			return completion, err
+		}
+	}
+	if _, err := fmt.Fprint(c.Writer, "data: [DONE]\n\n"); err != nil {
+		return completion, err
+	}
+	flusher.Flush()
+	return completion, nil
+}
+
+// gatewaySession resolves the recording header: nil when the call is not recorded, and
+// whether the session was created for this call.
+func (h *Handler) gatewaySession(ctx context.Context, userID int64, header string, messages []*models.Message) (*models.Session, bool, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil, false, nil
+	}
+	if messages[len(messages)-1].Role != models.RoleUser {
+		return nil, false, errors.New("a recorded call must end with a user message")
+	}
+	if strings.EqualFold(header, "new") {
+		title := []rune(strings.Join(strings.Fields(messages[len(messages)-1].Content), " "))
+		if len(title) > 50 {
+			title = append(title[:50], '…')
+		}
+		session, err := h.assistant.CreateSession(ctx, userID, string(title))
+		return session, err == nil, err
+	}
+	sessionID, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || sessionID <= 0 {
+		return nil, false, fmt.Errorf("%s must be a session id or \"new\"", recordSessionHeader)
+	}
+	session, err := h.assistant.GetSession(ctx, userID, sessionID)
+	return session, false, err
+}
+
+// recordExchange stores the last user message of the call and the reply in the session,
+// both or neither, and reports whether they were stored. The client already has the
+// reply, so failures are only logged.
+func (h *Handler) recordExchange(userID, sessionID int64, prompt *models.Message, completion *ai.Completion, provider, model string) bool {
+	if prompt.Role != models.RoleUser {
+		log.Printf("record gateway exchange in session %d: the call does not end with a user message", sessionID)
+		return false
+	}
+	if _, err := h.assistant.AddMessages(context.Background(), models.Message{
+		UserID:    userID,
+		SessionID: sessionID,
+		Role:      models.RoleUser,
+		Content:   prompt.Content,
+	}, models.Message{
+		UserID:           userID,
+		SessionID:        sessionID,
+		Role:             models.RoleAssistant,
+		Content:          completion.Content,
+		Provider:         provider,
+		Model:            model,
+		PromptTokens:     completion.PromptTokens,
+		CompletionTokens: completion.CompletionTokens,
+		FinishReason:     completion.FinishReason,
+	}); err != nil {
+		log.Printf("record gateway exchange in session %d: %v", sessionID, err)
+		return false
+	}
+	// the worker caches session history; make it reload the new messages
+	h.workers.Purge(userID, sessionID)
+	return true
+}
+
+// resolveModel finds the provider of a model. "provider/model" and a bare provider name
+// (its default model) are accepted besides the configured and well-known model names.
+func resolveModel(requested string, providers map[string]config.ProviderConfig) (string, string, error) {
+	requested = strings.TrimSpace(requested)
+	if requested == "" {
+		return "", "", errors.New("model is required")
+	}
+	if provider, model, ok := strings.Cut(requested, "/"); ok {
+		if _, configured := providers[provider]; configured && model != "" {
+			return provider, model, nil
+		}
+	}
+	if cfg, ok := providers[requested]; ok && llm.DefaultModel(cfg) != "" {
+		return requested, llm.DefaultModel(cfg), nil
+	}
+	for name, cfg := range providers {
+		if slices.Contains(providerModels(cfg), requested) {
+			return name, requested, nil
+		}
+	}
+	for _, p := range modelPrefixes {
+		if _, configured := providers[p.provider]; configured && strings.HasPrefix(requested, p.prefix) {
+			return p.provider, requested, nil
+		}
+	}
+	return "", "", fmt.Errorf("model %q is not served by any configured provider", requested)
+}
+
+// providerModels returns the models a provider offers, its default first.
+func providerModels(cfg config.ProviderConfig) []string {
+	var out []string
+	if cfg.Model != "" {
+		out = append(out, cfg.Model)
+	}
+	for _, m := range cfg.Models {
+		if m != "" && !slices.Contains(out, m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// gatewayMessages converts OpenAI messages; content may be a string or a list of parts,
+// of which only text parts are kept.
+func gatewayMessages(in []chatCompletionMessage) ([]*models.Message, error) {
+	if len(in) == 0 {
+		return nil, errors.New("messages is required")
+	}
+	messages := make([]*models.Message, 0, len(in))
+	for i, m := range in {
+		var role models.Role
+		switch m.Role {
+		case "system", "developer":
+			role = models.RoleSystem
+		case "user":
+			role = models.RoleUser
+		case "assistant":
+			role = models.RoleAssistant
+		default:
+			return nil, fmt.Errorf("messages[%d]: role %q is not supported", i, m.Role)
+		}
+		content, err := messageText(m.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		messages = append(messages, &models.Message{Role: role, Content: content})
+	}
+	return messages, nil
+}
+
+func messageText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", errors.New("content must be a string or a list of parts")
+	}
+	var texts []string
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func parseStop(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, errors.New("stop must be a string or a list of strings")
+	}
+	return many, nil
+}
+
+func finishReason(c *ai.Completion) string {
+	if c.FinishReason == "" {
+		return "stop"
+	}
+	return c.FinishReason
+}
+
+func completionUsage(c *ai.Completion) chatCompletionUsage {
+	return chatCompletionUsage{
+		PromptTokens:     c.PromptTokens,
+		CompletionTokens: c.CompletionTokens,
+		TotalTokens:      c.PromptTokens + c.CompletionTokens,
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
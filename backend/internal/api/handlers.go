@@ -2,10 +2,13 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -26,19 +29,22 @@ import (
 type WorkerManager interface {
 	InitSession(worker.SessionRequest) (*models.Session, error)
 	Stream(worker.StreamRequest) (*models.Message, string, error)
+	Cancel(userID, sessionID int64, clientMsgID string) int
 	ResetUser(userID int64)
 	Purge(userID, sessionID int64)
 	InvalidateTempFiles(userID, sessionID int64)
+	InvalidateSettings(userID, sessionID int64)
+	InvalidateProvider(userID int64, provider string)
 }
 
+// idempotencyEntry coalesces concurrent requests for one client_msg_id on this
+// instance; the durable record in the database is what retries replay from.
 type idempotencyEntry struct {
 	done chan struct{}
 	once sync.Once
 
-	userMsg *models.Message
-	aiMsg   *models.Message
-	title   string
-	err     error
+	record *models.IdempotencyRecord
+	err    error
 }
 
 func newIdempotencyEntry() *idempotencyEntry {
@@ -54,21 +60,28 @@ type Handler struct {
 	assistant *assistant.Service
 	auth      *auth.Service
 	workers   WorkerManager
+	streams   *sseHub
 	fileBase  string
 	fileTTL   time.Duration
+	idemTTL   time.Duration
 
 	clientMessageMu    sync.Mutex
 	clientMessageTable map[string]*idempotencyEntry
 }
 
 // NewHandler constructs a Handler instance.
-func NewHandler(service *assistant.Service, authService *auth.Service, cfg worker.DispatcherConfig, fileBase string, fileTTL time.Duration, cacheClient *redis.Client) *Handler {
+func NewHandler(service *assistant.Service, authService *auth.Service, cfg worker.DispatcherConfig, fileBase string, fileTTL, idempotencyTTL time.Duration, cacheClient *redis.Client) *Handler {
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = assistant.DefaultIdempotencyRetention
+	}
 	return &Handler{
 		assistant:          service,
 		auth:               authService,
 		workers:            worker.NewManager(service, cfg, cacheClient),
+		streams:            newSSEHub(cacheClient, sseBufferTTL),
 		fileBase:           fileBase,
 		fileTTL:            fileTTL,
+		idemTTL:            idempotencyTTL,
 		clientMessageTable: make(map[string]*idempotencyEntry),
 	}
 }
@@ -108,20 +121,72 @@ func (h *Handler) RegisterRoutes(router *gin.Engine) {
 	api := router.Group("/api")
 	api.POST("/users/register", h.registerUser)
 	api.POST("/users/login", h.loginUser)
+	api.GET("/share/:token", h.getSharedSession)
 	authMW := h.auth.Middleware()
 	userRoutes := api.Group("/users/:id")
 	userRoutes.Use(authMW, h.requirePathUser(), h.auth.CSRFMiddleware())
 	userRoutes.POST("/token", h.setToken)
 	userRoutes.GET("/token", h.listTokens)
 	userRoutes.DELETE("/token", h.deleteToken)
+	userRoutes.GET("/providers", h.listUserProviders)
+	userRoutes.POST("/providers", h.saveUserProvider)
+	userRoutes.DELETE("/providers/:name", h.deleteUserProvider)
+	userRoutes.GET("/fallbacks", h.getFallbacks)
+	userRoutes.PUT("/fallbacks", h.setFallbacks)
 	userRoutes.POST("/conversation/session-list", h.getSessionList)
+	userRoutes.GET("/conversation/sessions", h.getSessionList)
 	userRoutes.POST("/conversation/start", h.startConversation)
+	userRoutes.DELETE("/conversation/sessions", h.deleteSessions)
+	userRoutes.PATCH("/conversation/sessions/:session_id", h.updateSession)
 	userRoutes.DELETE("/conversation/sessions/:session_id", h.deleteSession)
 	userRoutes.GET("/conversation/sessions/:session_id/messages", h.getSessionMessages)
+	userRoutes.GET("/conversation/sessions/:session_id/export", h.exportSession)
+	userRoutes.GET("/conversation/sessions/:session_id/settings", h.getSessionSettings)
+	userRoutes.PUT("/conversation/sessions/:session_id/settings", h.updateSessionSettings)
+	userRoutes.DELETE("/conversation/sessions/:session_id/settings", h.deleteSessionSettings)
+	userRoutes.POST("/conversation/sessions/:session_id/shares", h.createShareLink)
+	userRoutes.GET("/conversation/sessions/:session_id/shares", h.listShareLinks)
+	userRoutes.DELETE("/conversation/sessions/:session_id/shares/:share_id", h.revokeShareLink)
+	userRoutes.GET("/conversation/sessions/:session_id/stream", h.resumeSessionStream)
+	userRoutes.POST("/conversation/sessions/:session_id/cancel", h.cancelGeneration)
+	userRoutes.POST("/conversation/sessions/:session_id/regenerate", h.regenerateReply)
+	userRoutes.GET("/conversation/sessions/:session_id/messages/:message_id/siblings", h.listSiblings)
+	userRoutes.GET("/conversation/sessions/:session_id/messages/:message_id/variants", h.listVariants)
+	userRoutes.POST("/conversation/sessions/:session_id/messages/:message_id/select", h.selectBranch)
+	userRoutes.POST("/conversation/sessions/:session_id/messages/:message_id/edit", h.editMessage)
 	userRoutes.POST("/conversation/msg", h.captureInput)
+	userRoutes.GET("/search", h.searchConversations)
+	userRoutes.GET("/usage", h.getUsage)
+	userRoutes.PUT("/usage/budget", h.setBudget)
+	userRoutes.GET("/personas", h.listPersonas)
+	userRoutes.POST("/personas", h.createPersona)
+	userRoutes.GET("/personas/:persona_id", h.getPersona)
+	userRoutes.PUT("/personas/:persona_id", h.updatePersona)
+	userRoutes.DELETE("/personas/:persona_id", h.deletePersona)
+	userRoutes.POST("/personas/:persona_id/files", h.uploadPersonaFile)
+	userRoutes.DELETE("/personas/:persona_id/files/:file_id", h.deletePersonaFile)
+	userRoutes.GET("/prompt-templates", h.listPromptTemplates)
+	userRoutes.POST("/prompt-templates", h.createPromptTemplate)
+	userRoutes.GET("/prompt-templates/export", h.exportPromptTemplates)
+	userRoutes.POST("/prompt-templates/import", h.importPromptTemplates)
+	userRoutes.GET("/prompt-templates/:template_id", h.getPromptTemplate)
+	userRoutes.PUT("/prompt-templates/:template_id", h.updatePromptTemplate)
+	userRoutes.DELETE("/prompt-templates/:template_id", h.deletePromptTemplate)
+	userRoutes.POST("/imports", h.startImport)
+	userRoutes.GET("/imports/:job_id", h.getImportJob)
 	userRoutes.POST("/uploads", h.filesUpload)
 	userRoutes.POST("/logout", h.logoutUser)
 	userRoutes.DELETE("", h.deleteUser)
+
+	adminRoutes := api.Group("/admin")
+	adminRoutes.Use(authMW, h.requireAdmin(), h.auth.CSRFMiddleware())
+	adminRoutes.GET("/providers/health", h.providerHealth)
+
+	// OpenAI-compatible gateway; clients authenticate with a bearer token
+	v1 := router.Group("/v1")
+	v1.Use(authMW, h.auth.CSRFMiddleware())
+	v1.GET("/models", h.listModels)
+	v1.POST("/chat/completions", h.chatCompletions)
 }
 
 // User create&login interface
@@ -182,24 +247,53 @@ func (h *Handler) loginUser(c *gin.Context) {
 	})
 }
 
+// pageQuery carries the cursor pagination parameters shared by the list endpoints.
+type pageQuery struct {
+	Limit  int    `json:"limit" form:"limit"`
+	Before string `json:"before" form:"before"`
+	After  string `json:"after" form:"after"`
+}
+
+func (q pageQuery) request() assistant.PageRequest {
+	return assistant.PageRequest{Limit: q.Limit, Before: q.Before, After: q.After}
+}
+
+// getSessionList serves both GET (query parameters) and the older POST (optional JSON body).
 func (h *Handler) getSessionList(c *gin.Context) {
 	userID, ok := h.authorizedUserID(c)
 	if !ok {
 		return
 	}
-	seList, err := h.assistant.ListSessions(c.Request.Context(), userID)
+	var req struct {
+		pageQuery
+		Archived bool  `json:"archived" form:"archived"`
+		Pinned   *bool `json:"pinned" form:"pinned"`
+	}
+	// without filters the first page of sessions that are not archived is listed
+	if c.Request.Method == http.MethodGet || c.Request.ContentLength != 0 {
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request parameters"})
+			return
+		}
+	}
+	seList, page, err := h.assistant.ListSessions(c.Request.Context(), userID, assistant.SessionFilter{
+		Archived: req.Archived,
+		Pinned:   req.Pinned,
+	}, req.request())
 	if err != nil {
+		if errors.Is(err, assistant.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	if len(seList) == 0 {
-		c.JSON(http.StatusOK, gin.H{
-			"session_list": make([]models.Session, 0),
-		})
-		return
+		seList = make([]models.Session, 0)
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"session_list": seList,
+		"page":         page,
 	})
 }
 
@@ -234,22 +328,46 @@ func (h *Handler) startConversation(c *gin.Context) {
 		Provider  string `json:"provider"`
 		SessionID int64  `json:"session_id"`
 		ModelType string `json:"model_type"`
+		// PersonaID starts the new session from one of the user's or a shared persona
+		PersonaID int64 `json:"persona_id"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 		return
 	}
-	provider := strings.TrimSpace(req.Provider)
-	if provider == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "provider is required"})
-		return
-	}
 	sessionID := req.SessionID
 	if sessionID < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "session_id cannot be negative"})
 		return
 	}
+	provider := strings.TrimSpace(req.Provider)
 	modelType := strings.TrimSpace(req.ModelType)
+	var persona *models.Persona
+	if req.PersonaID != 0 {
+		if sessionID != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "persona_id only applies to new sessions"})
+			return
+		}
+		var err error
+		if persona, err = h.assistant.GetPersona(c.Request.Context(), userID, req.PersonaID); err != nil {
+			respondPersonaError(c, err)
+			return
+		}
+		// the persona's model only applies with its own provider
+		if provider == "" {
+			provider = persona.Provider
+		}
+		if modelType == "" && provider == persona.Provider {
+			modelType = persona.Model
+		}
+		if !h.starterFilesFit(c, userID, persona) {
+			return
+		}
+	}
+	if provider == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "provider is required"})
+		return
+	}
 	if modelType == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model_type is required"})
 		return
@@ -276,13 +394,26 @@ func (h *Handler) startConversation(c *gin.Context) {
 		}
 		return
 	}
-	c.JSON(http.StatusAccepted, gin.H{
+	resp := gin.H{
 		"sessionId": session.ID,
 		"userId":    session.UserID,
 		"title":     session.Title,
 		"createdAt": session.CreatedAt,
 		"updatedAt": session.UpdatedAt,
-	})
+	}
+	if persona != nil {
+		if err := h.applyPersona(c.Request.Context(), userID, session.ID, persona); err != nil {
+			// drop the half-configured session along with the starter files copied so far
+			if err := h.assistant.DeleteSession(context.Background(), userID, session.ID); err != nil {
+				log.Printf("drop session %d of a failed persona: %v", session.ID, err)
+			}
+			h.workers.Purge(userID, session.ID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp["personaId"] = persona.ID
+	}
+	c.JSON(http.StatusAccepted, resp)
 }
 
 func (h *Handler) logoutUser(c *gin.Context) {
@@ -316,6 +447,9 @@ func (h *Handler) deleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := os.RemoveAll(h.personaFileDir(id)); err != nil {
+		log.Printf("remove persona files of user %d: %v", id, err)
+	}
 	h.clearAuthCookies(c)
 	c.Status(http.StatusNoContent)
 }
@@ -330,7 +464,15 @@ func (h *Handler) getSessionMessages(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
 		return
 	}
-	session, messages, err := h.assistant.GetSessionWithMessages(c.Request.Context(), userID, sessionID)
+	var query struct {
+		pageQuery
+		IncludeReasoning bool `form:"include_reasoning"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid query parameters"})
+		return
+	}
+	session, err := h.assistant.GetSession(c.Request.Context(), userID, sessionID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
@@ -339,9 +481,28 @@ func (h *Handler) getSessionMessages(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	messages, page, err := h.assistant.ListMessages(c.Request.Context(), userID, sessionID, query.request())
+	if err != nil {
+		if errors.Is(err, assistant.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if query.IncludeReasoning {
+		if err := h.assistant.LoadReasoning(c.Request.Context(), messages); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if messages == nil {
+		messages = make([]*models.Message, 0)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"session":  session,
 		"messages": messages,
+		"page":     page,
 	})
 }
 
@@ -353,6 +514,11 @@ type inputRequest struct {
 	Provider    string  `json:"provider"`
 	FileIDs     []int64 `json:"file_ids"`
 	ClientMsgID string  `json:"client_msg_id"`
+	// StreamProtocol selects the SSE event protocol, see streamEventSender.
+	StreamProtocol int `json:"stream_protocol"`
+	// TemplateID sends a prompt template filled with Variables instead of Content.
+	TemplateID int64             `json:"template_id"`
+	Variables  map[string]string `json:"variables"`
 }
 
 func (h *Handler) captureInput(c *gin.Context) {
@@ -374,11 +540,30 @@ func (h *Handler) captureInput(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "client_msg_id is required"})
 		return
 	}
+	protocol, ok := streamProtocol(c, req.StreamProtocol)
+	if !ok {
+		return
+	}
+	if req.TemplateID != 0 {
+		if strings.TrimSpace(req.Content) != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "content and template_id are mutually exclusive"})
+			return
+		}
+		// rendered before the request is claimed, so a missing variable stores nothing
+		content, err := h.assistant.RenderPromptTemplate(c.Request.Context(), userID, req.TemplateID, req.Variables)
+		if err != nil {
+			respondTemplateError(c, err)
+			return
+		}
+		req.Content = content
+	}
 
-	entry, cacheKey, isNew := h.beginIdempotencyEntry(req.SessionID, req.ClientMsgID)
-	if !isNew {
-		// we have a previous response, return that
-		h.respondWithCachedResult(c, entry)
+	entry, cacheKey, ok := h.claimStream(c, userID, req.SessionID, req.ClientMsgID, requestHash(req))
+	if !ok {
+		return
+	}
+	budget, ok := h.checkBudget(c, cacheKey, entry, userID)
+	if !ok {
 		return
 	}
 	files, err := h.resolveTempFiles(c.Request.Context(), userID, req.SessionID, req.FileIDs)
@@ -403,17 +588,154 @@ func (h *Handler) captureInput(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	h.streamReply(c, cacheKey, entry, replyJob{
+		userID:    userID,
+		sessionID: req.SessionID,
+		clientID:  req.ClientMsgID,
+		provider:  req.Provider,
+		model:     req.ModelType,
+		token:     token,
+		files:     files,
+		prompt:    message,
+		protocol:  protocol,
+		budget:    budget,
+	})
+}
+
+// claimStream resumes a buffered stream or replays a finished request for the
+// client_msg_id. When it returns true the caller owns the claimed idempotency entry
+// and must complete it.
+func (h *Handler) claimStream(c *gin.Context, userID, sessionID int64, clientID, reqHash string) (*idempotencyEntry, string, bool) {
+	// a reconnecting client (or a retry while the buffer is alive) resumes the buffered stream
+	if h.resumeStream(c, streamKey(userID, sessionID, clientID)) {
+		return nil, "", false
+	}
+	entry, cacheKey, isNew := h.beginIdempotencyEntry(sessionID, clientID)
+	if !isNew {
+		// we have a previous response, return that
+		h.respondWithCachedResult(c, entry, userID, sessionID, clientID, reqHash)
+		return nil, "", false
+	}
+	record, claimed, err := h.assistant.ClaimIdempotencyKey(c.Request.Context(), userID, sessionID, clientID, reqHash, h.idemTTL)
+	if err != nil {
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return nil, "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	if !claimed {
+		// handled before (possibly by another instance), replay the stored outcome
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", nil)
+		if record.RequestHash != reqHash {
+			c.JSON(http.StatusConflict, gin.H{"error": errIdempotencyMismatch.Error()})
+			return nil, "", false
+		}
+		h.respondWithCachedResult(c, nil, userID, sessionID, clientID, reqHash)
+		return nil, "", false
+	}
+	entry.record = record
+	return entry, cacheKey, true
+}
+
+// replyJob describes one assistant reply to generate for a stored user prompt.
+type replyJob struct {
+	userID    int64
+	sessionID int64
+	clientID  string
+	provider  string
+	model     string
+	token     string
+	files     []*models.TempFile
+	prompt    *models.Message
+	// replaceID is the reply being regenerated; the new reply is stored as its variant.
+	replaceID  int64
+	regenerate bool
+	protocol   int
+	// budget is the user's spending before the reply, to detect crossing the soft limit
+	budget *models.BudgetStatus
+}
 
-	streamCtx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Minute)
+// Stream protocols of the conversation endpoints. Version 1 resends the whole answer
+// so far in every `stream` event and stays the default for existing clients; version 2
+// sends typed incremental events.
+const (
+	streamProtocolCumulative = 1
+	streamProtocolDelta      = 2
+)
+
+// streamProtocol validates the requested protocol, defaulting to the cumulative one.
+func streamProtocol(c *gin.Context, requested int) (int, bool) {
+	switch requested {
+	case 0:
+		return streamProtocolCumulative, true
+	case streamProtocolCumulative, streamProtocolDelta:
+		return requested, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported stream_protocol"})
+	return 0, false
+}
+
+// streamEventSender translates the worker's events into SSE events of the protocol.
+//
+// With the delta protocol every event carries a seq number counting from 1:
+// `delta` and `reasoning` hold only the new text, `tool_call`/`tool_result` describe
+// the agent's tool use and a final `usage` event reports the token counts. With the
+// cumulative protocol only answer text is sent, as `stream` events holding the whole
+// answer so far. Both protocols announce a trimmed history with `context_trimmed`.
+func streamEventSender(protocol int, sendEvent func(string, interface{}) error) func(models.StreamEvent) error {
+	if protocol == streamProtocolDelta {
+		var seq int64
+		return func(event models.StreamEvent) error {
+			payload := gin.H{}
+			switch event.Type {
+			case models.StreamDelta, models.StreamReasoning:
+				payload["content"] = event.Text
+			case models.StreamToolCall, models.StreamToolResult:
+				payload["tool"] = event.Tool
+			case models.StreamUsage:
+				payload["usage"] = event.Usage
+			case models.StreamContextTrimmed:
+				payload["context"] = event.Trim
+			default:
+				return nil
+			}
+			seq++
+			payload["seq"] = seq
+			return sendEvent(string(event.Type), payload)
+		}
+	}
+	var content strings.Builder
+	return func(event models.StreamEvent) error {
+		if event.Type == models.StreamContextTrimmed {
+			return sendEvent(string(event.Type), gin.H{"context": event.Trim})
+		}
+		if event.Type != models.StreamDelta {
+			return nil
+		}
+		content.WriteString(event.Text)
+		return sendEvent("stream", gin.H{"content": content.String()})
+	}
+}
+
+// streamReply runs the generation for job and streams ack/stream/done (or error/cancelled)
+// events, storing the reply once it is complete.
+func (h *Handler) streamReply(c *gin.Context, cacheKey string, entry *idempotencyEntry, job replyJob) {
+	message := job.prompt
+	// detach from the request so a dropped connection does not abort the generation;
+	// the client can reconnect with Last-Event-ID and pick up the buffered events.
+	streamCtx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), 2*time.Minute)
 	defer cancel()
 	// SSE Request construction
-	sendEvent, ok := prepareSSE(c)
+	sendEvent, ok := h.openStream(c, streamKey(job.userID, job.sessionID, job.clientID))
 	if !ok {
 		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", errors.New("streaming not supported"))
 		return
 	}
 	// Send request
-	if err := sendEvent("ack", gin.H{"message": messagePayload(message)}); err != nil {
+	if err := sendEvent("ack", gin.H{"message": messagePayload(message), "stream_protocol": job.protocol}); err != nil {
 		h.completeIdempotencyEntry(cacheKey, entry, message, nil, "", err)
 		return
 	}
@@ -421,19 +743,33 @@ func (h *Handler) captureInput(c *gin.Context) {
 	streamReq := worker.StreamRequest{
 		SessionRequest: worker.SessionRequest{
 			Context:   streamCtx,
-			UserID:    userID,
-			SessionID: req.SessionID,
-			Provider:  req.Provider,
-			Model:     req.ModelType,
-			Token:     token,
-			Files:     files,
+			UserID:    job.userID,
+			SessionID: job.sessionID,
+			Provider:  job.provider,
+			Model:     job.model,
+			Token:     job.token,
+			Files:     job.files,
 			Message:   message,
 		},
-		ChunkFn: func(chunk string) error {
-			return sendEvent("stream", gin.H{"content": chunk})
-		},
+		ClientMsgID: job.clientID,
+		Regenerate:  job.regenerate,
+		EventFn:     streamEventSender(job.protocol, sendEvent),
 	}
 	aiMessage, title, err := h.workers.Stream(streamReq)
+	if aiMessage != nil {
+		// the AI service reports the model it resolved; fall back to the requested one
+		if aiMessage.Provider == "" {
+			aiMessage.Provider = job.provider
+		}
+		if aiMessage.Model == "" {
+			aiMessage.Model = job.model
+		}
+	}
+	if errors.Is(err, worker.ErrStreamCancelled) {
+		h.recordReplyUsage(streamCtx, job, aiMessage, sendEvent)
+		h.finishCancelled(streamCtx, cacheKey, entry, message, aiMessage, job.replaceID, title, sendEvent)
+		return
+	}
 	if err != nil {
 		msg := err.Error()
 		if errors.Is(err, worker.ErrDispatcherBusy) {
@@ -443,15 +779,22 @@ func (h *Handler) captureInput(c *gin.Context) {
 		_ = sendEvent("error", gin.H{"message": msg})
 		return
 	}
-	_, err = h.assistant.AppendMessageToSession(c.Request.Context(), aiMessage.UserID, aiMessage.SessionID, aiMessage.Role, aiMessage.Content)
+	storedAI, err := h.storeReply(streamCtx, job.replaceID, *aiMessage)
 	if err != nil {
 		h.completeIdempotencyEntry(cacheKey, entry, message, nil, "", err)
 		_ = sendEvent("error", gin.H{"message": err.Error()})
 		return
 	}
+	aiMessage = storedAI
+	h.recordReplyUsage(streamCtx, job, aiMessage, sendEvent)
 	payload := gin.H{
 		"user_message": messagePayload(message),
 		"ai_message":   messagePayload(aiMessage),
+		// the provider and model that answered; they differ from the requested ones
+		// after a failover
+		"provider": aiMessage.Provider,
+		"model":    aiMessage.Model,
+		"fallback": aiMessage.Provider != job.provider || (job.model != "" && aiMessage.Model != job.model),
 	}
 	if title != "" {
 		payload["title"] = title
@@ -461,10 +804,77 @@ func (h *Handler) captureInput(c *gin.Context) {
 		return
 	}
 	h.completeIdempotencyEntry(cacheKey, entry, message, aiMessage, title, nil)
-	return
 }
 
-func prepareSSE(c *gin.Context) (func(string, interface{}) error, bool) {
+// storeReply persists a generated reply, as a new variant when it replaces an earlier one.
+func (h *Handler) storeReply(ctx context.Context, replaceID int64, msg models.Message) (*models.Message, error) {
+	if replaceID > 0 {
+		return h.assistant.AddReplyVariant(ctx, msg.UserID, replaceID, msg)
+	}
+	if msg.Status != models.MessageStatusCancelled {
+		msg.Content = strings.TrimSpace(msg.Content)
+		if msg.Content == "" {
+			return nil, errors.New("content cannot be empty")
+		}
+	}
+	return h.assistant.AddMessage(ctx, msg)
+}
+
+// finishCancelled stores the partial reply of a cancelled generation and ends the stream
+// with a cancelled event.
+func (h *Handler) finishCancelled(ctx context.Context, cacheKey string, entry *idempotencyEntry, userMsg, partial *models.Message, replaceID int64, title string, sendEvent func(string, interface{}) error) {
+	var stored *models.Message
+	if partial != nil && strings.TrimSpace(partial.Content) != "" {
+		reply := *partial
+		reply.Status = models.MessageStatusCancelled
+		var err error
+		stored, err = h.storeReply(ctx, replaceID, reply)
+		if err != nil {
+			h.completeIdempotencyEntry(cacheKey, entry, userMsg, nil, "", err)
+			_ = sendEvent("error", gin.H{"message": err.Error()})
+			return
+		}
+	}
+	h.completeIdempotencyEntry(cacheKey, entry, userMsg, stored, title, worker.ErrStreamCancelled)
+	_ = sendEvent("cancelled", cancelledPayload(userMsg, stored, title))
+}
+
+func cancelledPayload(userMsg, aiMsg *models.Message, title string) gin.H {
+	payload := gin.H{
+		"user_message": messagePayload(userMsg),
+		"ai_message":   messagePayload(aiMsg),
+	}
+	if title != "" {
+		payload["title"] = title
+	}
+	return payload
+}
+
+func (h *Handler) cancelGeneration(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	var req struct {
+		ClientMsgID string `json:"client_msg_id"`
+	}
+	// the body is optional: without client_msg_id every stream of the session is cancelled
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+	n := h.workers.Cancel(userID, sessionID, req.ClientMsgID)
+	c.JSON(http.StatusAccepted, gin.H{"cancelled": n})
+}
+
+func prepareSSE(c *gin.Context) (func(streamEvent) error, bool) {
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming not supported"})
@@ -476,30 +886,33 @@ func prepareSSE(c *gin.Context) (func(string, interface{}) error, bool) {
 	c.Writer.Header().Set("X-Accel-Buffering", "no")
 	c.Status(http.StatusOK)
 
-	sendEvent := func(event string, payload interface{}) error {
-		var data []byte
-		switch v := payload.(type) {
-		case string:
-			data = []byte(v)
-		default:
-			var err error
-			data, err = json.Marshal(v)
-			if err != nil {
+	writeEvent := func(evt streamEvent) error {
+		if evt.ID > 0 {
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\n", evt.ID); err != nil {
 				return err
 			}
 		}
-		if event != "" {
-			if _, err := fmt.Fprintf(c.Writer, "event: %s\n", event); err != nil {
+		if evt.Event != "" {
+			if _, err := fmt.Fprintf(c.Writer, "event: %s\n", evt.Event); err != nil {
 				return err
 			}
 		}
-		if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+		if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", evt.Data); err != nil {
 			return err
 		}
 		flusher.Flush()
 		return nil
 	}
-	return sendEvent, true
+	return writeEvent, true
+}
+
+// sendUnbuffered writes a one-off event that is not part of a resumable stream.
+func sendUnbuffered(write func(streamEvent) error, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return write(streamEvent{Event: event, Data: data})
 }
 
 func messagePayload(msg *models.Message) gin.H {
@@ -512,10 +925,35 @@ func messagePayload(msg *models.Message) gin.H {
 		"session_id": msg.SessionID,
 		"role":       msg.Role,
 		"content":    msg.Content,
+		"status":     msg.Status,
+		"provider":   msg.Provider,
+		"model":      msg.Model,
+		"parent_id":  msg.ParentID,
+		"variant_of": msg.VariantOf,
 		"created_at": msg.CreatedAt,
+		// generation metadata, zero for user messages
+		"prompt_tokens":     msg.PromptTokens,
+		"completion_tokens": msg.CompletionTokens,
+		"ttft_ms":           msg.TTFTMs,
+		"latency_ms":        msg.LatencyMs,
+		"finish_reason":     msg.FinishReason,
 	}
 }
 
+var errIdempotencyMismatch = errors.New("client_msg_id was already used for a different request")
+
+const idempotencyPollInterval = 500 * time.Millisecond
+
+// requestHash fingerprints the parts of a message request that must match on retry.
+func requestHash(req inputRequest) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%d\x00%s\x00%s\x00%s", req.SessionID, strings.TrimSpace(req.Content), strings.TrimSpace(req.Provider), strings.TrimSpace(req.ModelType))
+	for _, id := range req.FileIDs {
+		fmt.Fprintf(sum, "\x00%d", id)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
 func (h *Handler) beginIdempotencyEntry(sessionID int64, clientID string) (*idempotencyEntry, string, bool) {
 	key := fmt.Sprintf("%d:%s", sessionID, clientID)
 	h.clientMessageMu.Lock()
@@ -528,14 +966,37 @@ func (h *Handler) beginIdempotencyEntry(sessionID int64, clientID string) (*idem
 	return entry, key, true
 }
 
+// completeIdempotencyEntry persists the outcome of a claimed key and wakes local waiters.
+// Failures that happened before the user message was stored release the key so the
+// client can retry with the same client_msg_id.
 func (h *Handler) completeIdempotencyEntry(key string, entry *idempotencyEntry, userMsg, aiMsg *models.Message, title string, err error) {
 	if entry == nil {
 		return
 	}
 	entry.once.Do(func() {
-		entry.userMsg = userMsg
-		entry.aiMsg = aiMsg
-		entry.title = title
+		if rec := entry.record; rec != nil {
+			ctx := context.Background()
+			var persistErr error
+			if userMsg == nil && err != nil {
+				persistErr = h.assistant.ReleaseIdempotencyKey(ctx, rec.ID)
+			} else {
+				var userMsgID, aiMsgID int64
+				if userMsg != nil {
+					userMsgID = userMsg.ID
+				}
+				if aiMsg != nil {
+					aiMsgID = aiMsg.ID
+				}
+				errMsg := ""
+				if err != nil {
+					errMsg = err.Error()
+				}
+				persistErr = h.assistant.CompleteIdempotencyKey(ctx, rec.ID, userMsgID, aiMsgID, title, errMsg, h.idemTTL)
+			}
+			if persistErr != nil {
+				log.Printf("persist idempotency key %s failed: %v", key, persistErr)
+			}
+		}
 		entry.err = err
 		close(entry.done)
 	})
@@ -544,29 +1005,87 @@ func (h *Handler) completeIdempotencyEntry(key string, entry *idempotencyEntry,
 	h.clientMessageMu.Unlock()
 }
 
-func (h *Handler) respondWithCachedResult(c *gin.Context, entry *idempotencyEntry) {
-	sendEvent, ok := prepareSSE(c)
+// respondWithCachedResult replays a finished request from the durable idempotency store,
+// waiting for the local entry (if any) or polling while another instance is still working.
+func (h *Handler) respondWithCachedResult(c *gin.Context, entry *idempotencyEntry, userID, sessionID int64, clientID, hash string) {
+	write, ok := prepareSSE(c)
 	if !ok {
 		return
 	}
-	entry.wait()
-	if entry.err != nil {
-		_ = sendEvent("error", gin.H{"message": entry.err.Error()})
+	sendEvent := func(event string, payload interface{}) error {
+		return sendUnbuffered(write, event, payload)
+	}
+	if entry != nil {
+		entry.wait()
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), sseResumeTimeout)
+	defer cancel()
+	record, err := h.waitIdempotencyRecord(ctx, userID, sessionID, clientID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) && entry != nil && entry.err != nil {
+			err = entry.err
+		}
+		_ = sendEvent("error", gin.H{"message": err.Error()})
+		return
+	}
+	if record.RequestHash != hash {
+		_ = sendEvent("error", gin.H{"message": errIdempotencyMismatch.Error()})
 		return
 	}
-	if entry.userMsg != nil {
-		_ = sendEvent("ack", gin.H{"message": messagePayload(entry.userMsg)})
+	var userMsg, aiMsg *models.Message
+	if record.UserMessageID > 0 {
+		if userMsg, err = h.assistant.GetMessage(ctx, userID, record.UserMessageID); err != nil {
+			_ = sendEvent("error", gin.H{"message": err.Error()})
+			return
+		}
+		_ = sendEvent("ack", gin.H{"message": messagePayload(userMsg)})
+	}
+	cancelled := record.Error == worker.ErrStreamCancelled.Error()
+	if record.Error != "" && !cancelled {
+		_ = sendEvent("error", gin.H{"message": record.Error})
+		return
+	}
+	if record.AIMessageID > 0 {
+		if aiMsg, err = h.assistant.GetMessage(ctx, userID, record.AIMessageID); err != nil {
+			_ = sendEvent("error", gin.H{"message": err.Error()})
+			return
+		}
+	}
+	if cancelled {
+		_ = sendEvent("cancelled", cancelledPayload(userMsg, aiMsg, record.Title))
+		return
 	}
 	payload := gin.H{
-		"user_message": messagePayload(entry.userMsg),
-		"ai_message":   messagePayload(entry.aiMsg),
+		"user_message": messagePayload(userMsg),
+		"ai_message":   messagePayload(aiMsg),
+	}
+	if aiMsg != nil {
+		payload["provider"] = aiMsg.Provider
+		payload["model"] = aiMsg.Model
 	}
-	if entry.title != "" {
-		payload["title"] = entry.title
+	if record.Title != "" {
+		payload["title"] = record.Title
 	}
 	_ = sendEvent("done", payload)
 }
 
+func (h *Handler) waitIdempotencyRecord(ctx context.Context, userID, sessionID int64, clientID string) (*models.IdempotencyRecord, error) {
+	for {
+		record, err := h.assistant.GetIdempotencyKey(ctx, userID, sessionID, clientID)
+		if err != nil {
+			return nil, err
+		}
+		if record.Status != models.IdempotencyPending {
+			return record, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("request is still in progress, please retry later")
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
 // handle api token
 func (h *Handler) setToken(c *gin.Context) {
 	userID, ok := h.authorizedUserID(c)
@@ -758,7 +1277,7 @@ func (h *Handler) filesUpload(c *gin.Context) {
 		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
 		return
 	}
-	usage, err := h.assistant.TempStorageUsage(c.Request.Context(), userID)
+	usage, err := h.assistant.StorageUsage(c.Request.Context(), userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "calculate usage failed"})
 		return
@@ -813,18 +1332,24 @@ func (h *Handler) getFilePath(userID, sessionID int64, filename string) (string,
 }
 
 func (h *Handler) getUniqueFilePath(userID, sessionID int64, filename string) (string, string, string) {
-	destDir, destPath := h.getFilePath(userID, sessionID, filename)
-	if _, err := os.Stat(destPath); os.IsNotExist(err) {
-		return destDir, destPath, filename
+	destDir, _ := h.getFilePath(userID, sessionID, filename)
+	destPath, finalName := uniquePath(destDir, filename)
+	return destDir, destPath, finalName
+}
+
+// uniquePath returns a path in dir for filename, numbering the name when it is taken.
+func uniquePath(dir, filename string) (string, string) {
+	if _, err := os.Stat(filepath.Join(dir, filename)); os.IsNotExist(err) {
+		return filepath.Join(dir, filename), filename
 	}
 	ext := filepath.Ext(filename)
 	base := strings.TrimSuffix(filename, ext)
 	for idx := 1; idx <= 1000; idx++ {
 		candidate := fmt.Sprintf("%s (%d)%s", base, idx, ext)
-		dir, path := h.getFilePath(userID, sessionID, candidate)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			return dir, path, candidate
+		if _, err := os.Stat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return filepath.Join(dir, candidate), candidate
 		}
 	}
-	return destDir, filepath.Join(destDir, fmt.Sprintf("%s-%d%s", base, time.Now().UnixNano(), ext)), fmt.Sprintf("%s-%d%s", base, time.Now().UnixNano(), ext)
+	candidate := fmt.Sprintf("%s-%d%s", base, time.Now().UnixNano(), ext)
+	return filepath.Join(dir, candidate), candidate
 }
@@ -1,14 +1,17 @@
 package api
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -18,10 +21,13 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"unichatgo/internal/archive"
 	"unichatgo/internal/auth"
 	"unichatgo/internal/config"
 	"unichatgo/internal/models"
+	"unichatgo/internal/service/ai"
 	"unichatgo/internal/service/assistant"
+	"unichatgo/internal/service/llm"
 	"unichatgo/internal/storage"
 	"unichatgo/internal/worker"
 )
@@ -427,57 +433,2140 @@ func TestCaptureInputBackpressure(t *testing.T) {
 	}
 }
 
+func TestCaptureInputResumeWithLastEventID(t *testing.T) {
+	router, db, _ := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+
+	startResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/start", userID),
+		map[string]any{"provider": "openai", "session_id": 0, "model_type": "gpt"},
+		nil)
+	assertStatus(t, startResp, http.StatusAccepted)
+	var body struct {
+		SessionID int64 `json:"sessionId"`
+	}
+	decodeJSON(t, startResp.Body.Bytes(), &body)
+
+	msgReq := map[string]any{
+		"session_id":    body.SessionID,
+		"content":       "resume me",
+		"provider":      "openai",
+		"model_type":    "gpt",
+		"client_msg_id": "client-msg-resume",
+	}
+	resp := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), msgReq, nil)
+	assertStatus(t, resp, http.StatusOK)
+	events := parseSSE(t, resp.Body.String())
+	if len(events) != 3 {
+		t.Fatalf("expected 3 SSE events, got %#v", events)
+	}
+	for idx, evt := range events {
+		if evt.ID != strconv.Itoa(idx+1) {
+			t.Fatalf("expected event id %d, got %q", idx+1, evt.ID)
+		}
+	}
+
+	// Reconnect after the ack: only stream + done are replayed.
+	resumed := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/stream?client_msg_id=client-msg-resume", userID, body.SessionID),
+		nil,
+		map[string]string{"Last-Event-ID": "1"})
+	assertStatus(t, resumed, http.StatusOK)
+	replayed := parseSSE(t, resumed.Body.String())
+	if len(replayed) != 2 || replayed[0].Name != "stream" || replayed[1].Name != "done" || replayed[0].ID != "2" {
+		t.Fatalf("unexpected replay: %#v", replayed)
+	}
+
+	// Retrying the POST with the same client_msg_id replays instead of generating again.
+	retry := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), msgReq, map[string]string{"Last-Event-ID": "2"})
+	assertStatus(t, retry, http.StatusOK)
+	retried := parseSSE(t, retry.Body.String())
+	if len(retried) != 1 || retried[0].Name != "done" {
+		t.Fatalf("unexpected retry replay: %#v", retried)
+	}
+	if count := countMessages(t, db, body.SessionID); count != 2 {
+		t.Fatalf("expected 2 messages after resume, got %d", count)
+	}
+
+	missing := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/stream?client_msg_id=unknown", userID, body.SessionID),
+		nil, nil)
+	assertStatus(t, missing, http.StatusNotFound)
+}
+
+func TestCaptureInputCancelled(t *testing.T) {
+	router, db, _ := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+
+	startResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/start", userID),
+		map[string]any{"provider": "openai", "session_id": 0, "model_type": "gpt"},
+		nil)
+	assertStatus(t, startResp, http.StatusAccepted)
+	var body struct {
+		SessionID int64 `json:"sessionId"`
+	}
+	decodeJSON(t, startResp.Body.Bytes(), &body)
+
+	cancelResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/cancel", userID, body.SessionID),
+		map[string]any{"client_msg_id": "client-msg-cancel"},
+		nil)
+	assertStatus(t, cancelResp, http.StatusAccepted)
+
+	resp := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+		"session_id":    body.SessionID,
+		"content":       "stop me",
+		"provider":      "openai",
+		"model_type":    "gpt",
+		"client_msg_id": "client-msg-cancel",
+	}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	events := parseSSE(t, resp.Body.String())
+	if len(events) != 3 || events[2].Name != "cancelled" {
+		t.Fatalf("expected ack, stream and cancelled events, got %#v", events)
+	}
+	if !strings.Contains(events[2].Data, "Mock partial") {
+		t.Fatalf("cancelled event missing partial reply: %s", events[2].Data)
+	}
+
+	var (
+		status, finish     string
+		promptTokens, ttft int
+	)
+	if err := db.QueryRow(`SELECT status, prompt_tokens, ttft_ms, finish_reason FROM messages WHERE session_id = ? AND role = ?`,
+		body.SessionID, models.RoleAssistant).Scan(&status, &promptTokens, &ttft, &finish); err != nil {
+		t.Fatalf("load partial message: %v", err)
+	}
+	if status != models.MessageStatusCancelled || promptTokens != 9 || ttft != 5 || finish != "cancelled" {
+		t.Fatalf("unexpected partial message: status=%q prompt_tokens=%d ttft=%d finish=%q", status, promptTokens, ttft, finish)
+	}
+}
+
+func TestCaptureInputStreamProtocols(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	handler.workers.(*mockWorker).events = []models.StreamEvent{
+		{Type: models.StreamReasoning, Text: "The user greets me."},
+		{Type: models.StreamToolCall, Tool: &models.ToolEvent{ID: "call-1", Name: "list_todos", Arguments: "{}"}},
+		{Type: models.StreamToolResult, Tool: &models.ToolEvent{ID: "call-1", Name: "list_todos", Result: "[]"}},
+		{Type: models.StreamDelta, Text: "Hel"},
+		{Type: models.StreamDelta, Text: "lo"},
+		{Type: models.StreamUsage, Usage: &models.TokenUsage{PromptTokens: 12, CompletionTokens: 2, TotalTokens: 14}},
+	}
+
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Protocols")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	send := func(clientID string, protocol int) *httptest.ResponseRecorder {
+		return client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+			"session_id":      session.ID,
+			"content":         "hi",
+			"provider":        "openai",
+			"model_type":      "gpt",
+			"client_msg_id":   clientID,
+			"stream_protocol": protocol,
+		}, nil)
+	}
+
+	resp := send("client-msg-bad-protocol", 7)
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	// the default protocol only resends the accumulated answer
+	resp = send("client-msg-cumulative", 0)
+	assertStatus(t, resp, http.StatusOK)
+	events := parseSSE(t, resp.Body.String())
+	if len(events) != 4 || events[1].Name != "stream" || events[2].Name != "stream" || events[3].Name != "done" {
+		t.Fatalf("unexpected cumulative events: %#v", events)
+	}
+	if !strings.Contains(events[2].Data, `"content":"Hello"`) {
+		t.Fatalf("expected cumulative content, got %s", events[2].Data)
+	}
+
+	resp = send("client-msg-delta", 2)
+	assertStatus(t, resp, http.StatusOK)
+	events = parseSSE(t, resp.Body.String())
+	wantNames := []string{"ack", "reasoning", "tool_call", "tool_result", "delta", "delta", "usage", "done"}
+	if len(events) != len(wantNames) {
+		t.Fatalf("expected %d delta events, got %#v", len(wantNames), events)
+	}
+	for i, name := range wantNames {
+		if events[i].Name != name {
+			t.Fatalf("event %d: want %s, got %s", i, name, events[i].Name)
+		}
+	}
+	var ack struct {
+		StreamProtocol int `json:"stream_protocol"`
+	}
+	decodeJSON(t, []byte(events[0].Data), &ack)
+	if ack.StreamProtocol != 2 {
+		t.Fatalf("expected protocol 2 in ack, got %d", ack.StreamProtocol)
+	}
+	var delta struct {
+		Seq     int64  `json:"seq"`
+		Content string `json:"content"`
+	}
+	decodeJSON(t, []byte(events[5].Data), &delta)
+	if delta.Seq != 5 || delta.Content != "lo" {
+		t.Fatalf("unexpected delta event: %+v", delta)
+	}
+	var toolCall struct {
+		Tool models.ToolEvent `json:"tool"`
+	}
+	decodeJSON(t, []byte(events[2].Data), &toolCall)
+	if toolCall.Tool.ID != "call-1" || toolCall.Tool.Name != "list_todos" {
+		t.Fatalf("unexpected tool call event: %s", events[2].Data)
+	}
+	var usage struct {
+		Seq   int64             `json:"seq"`
+		Usage models.TokenUsage `json:"usage"`
+	}
+	decodeJSON(t, []byte(events[6].Data), &usage)
+	if usage.Seq != 6 || usage.Usage.TotalTokens != 14 {
+		t.Fatalf("unexpected usage event: %s", events[6].Data)
+	}
+
+	// the reply's metadata is part of done and stored with the message
+	var done struct {
+		AI models.Message `json:"ai_message"`
+	}
+	decodeJSON(t, []byte(events[7].Data), &done)
+	if done.AI.PromptTokens != 12 || done.AI.CompletionTokens != 2 || done.AI.FinishReason != "stop" || done.AI.LatencyMs != 20 || done.AI.Provider != "openai" {
+		t.Fatalf("unexpected reply metadata: %+v", done.AI)
+	}
+	var stored models.Message
+	if err := db.QueryRow(`SELECT prompt_tokens, completion_tokens, ttft_ms, latency_ms, finish_reason FROM messages WHERE id = ?`, done.AI.ID).
+		Scan(&stored.PromptTokens, &stored.CompletionTokens, &stored.TTFTMs, &stored.LatencyMs, &stored.FinishReason); err != nil {
+		t.Fatalf("load reply metadata: %v", err)
+	}
+	if stored.PromptTokens != 12 || stored.CompletionTokens != 2 || stored.TTFTMs != 5 || stored.FinishReason != "stop" {
+		t.Fatalf("unexpected stored metadata: %+v", stored)
+	}
+}
+
+func TestContextTrimmedEvent(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	handler.workers.(*mockWorker).events = []models.StreamEvent{
+		{Type: models.StreamContextTrimmed, Trim: &models.ContextTrim{DroppedMessages: 6, CompressedMessages: 2, EstimatedTokens: 7000, ContextWindow: 8192}},
+		{Type: models.StreamDelta, Text: "Hi"},
+	}
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Long chat")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	for _, tc := range []struct {
+		protocol int
+		names    []string
+	}{
+		{0, []string{"ack", "context_trimmed", "stream", "done"}},
+		{2, []string{"ack", "context_trimmed", "delta", "done"}},
+	} {
+		resp := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+			"session_id":      session.ID,
+			"content":         "hi",
+			"provider":        "openai",
+			"model_type":      "gpt",
+			"client_msg_id":   fmt.Sprintf("client-msg-trim-%d", tc.protocol),
+			"stream_protocol": tc.protocol,
+		}, nil)
+		assertStatus(t, resp, http.StatusOK)
+		events := parseSSE(t, resp.Body.String())
+		if len(events) != len(tc.names) {
+			t.Fatalf("protocol %d: unexpected events %#v", tc.protocol, events)
+		}
+		for i, name := range tc.names {
+			if events[i].Name != name {
+				t.Fatalf("protocol %d event %d: want %s, got %s", tc.protocol, i, name, events[i].Name)
+			}
+		}
+		var trimmed struct {
+			Context models.ContextTrim `json:"context"`
+		}
+		decodeJSON(t, []byte(events[1].Data), &trimmed)
+		if trimmed.Context.DroppedMessages != 6 || trimmed.Context.CompressedMessages != 2 || trimmed.Context.ContextWindow != 8192 {
+			t.Fatalf("protocol %d: unexpected trim payload %s", tc.protocol, events[1].Data)
+		}
+	}
+}
+
+func TestReasoningStoredApart(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	handler.workers.(*mockWorker).events = []models.StreamEvent{
+		{Type: models.StreamReasoning, Text: "Greeting, "},
+		{Type: models.StreamReasoning, Text: "answer briefly."},
+		{Type: models.StreamDelta, Text: "Hi"},
+	}
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Thinking")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	resp := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+		"session_id":    session.ID,
+		"content":       "hello",
+		"provider":      "openai",
+		"model_type":    "gpt",
+		"client_msg_id": "client-msg-reasoning",
+	}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	events := parseSSE(t, resp.Body.String())
+	if last := events[len(events)-1]; last.Name != "done" || strings.Contains(last.Data, "answer briefly") {
+		t.Fatalf("unexpected final event: %#v", last)
+	}
+
+	var body struct {
+		Messages []models.Message `json:"messages"`
+	}
+	messagesURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages", userID, session.ID)
+	resp = client.DoJSON(http.MethodGet, messagesURL, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	if strings.Contains(resp.Body.String(), "reasoning") {
+		t.Fatalf("reasoning returned without include_reasoning: %s", resp.Body.String())
+	}
+	resp = client.DoJSON(http.MethodGet, messagesURL+"?include_reasoning=true", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	if len(body.Messages) != 2 || body.Messages[1].Reasoning != "Greeting, answer briefly." || body.Messages[1].Content == body.Messages[1].Reasoning {
+		t.Fatalf("unexpected messages: %+v", body.Messages)
+	}
+	if body.Messages[0].Reasoning != "" {
+		t.Fatalf("user message has reasoning: %+v", body.Messages[0])
+	}
+}
+
+func TestUsageBudget(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	// every mock reply costs 12*1000/1e6 + 2*2000/1e6 = 0.016 USD
+	handler.assistant.ConfigureUsage(config.UsageConfig{
+		Prices:        map[string]config.ModelPrice{"openai/*": {Input: 1000, Output: 2000}},
+		MonthlyBudget: 0.03,
+		SoftLimit:     0.5,
+	})
+	handler.workers.(*mockWorker).events = []models.StreamEvent{
+		{Type: models.StreamDelta, Text: "ok"},
+		{Type: models.StreamUsage, Usage: &models.TokenUsage{PromptTokens: 12, CompletionTokens: 2, TotalTokens: 14}},
+	}
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Budget")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	budgetURL := fmt.Sprintf("/api/users/%d/usage/budget", userID)
+	setBudget := func(budget any) models.BudgetStatus {
+		t.Helper()
+		resp := client.DoJSON(http.MethodPut, budgetURL, map[string]any{"monthly_budget": budget}, nil)
+		assertStatus(t, resp, http.StatusOK)
+		var payload struct {
+			Budget models.BudgetStatus `json:"budget"`
+		}
+		decodeJSON(t, resp.Body.Bytes(), &payload)
+		return payload.Budget
+	}
+	// users may lower the default but neither raise nor remove it
+	for _, budget := range []any{-1, 0} {
+		resp := client.DoJSON(http.MethodPut, budgetURL, map[string]any{"monthly_budget": budget}, nil)
+		assertStatus(t, resp, http.StatusBadRequest)
+	}
+	if got := setBudget(0.01).MonthlyBudget; got != 0.01 {
+		t.Fatalf("expected the lowered budget, got %v", got)
+	}
+	if got := setBudget(1000).MonthlyBudget; got != 0.03 {
+		t.Fatalf("expected the budget capped at the default, got %v", got)
+	}
+
+	send := func(clientID string) *httptest.ResponseRecorder {
+		return client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+			"session_id":    session.ID,
+			"content":       "spend",
+			"provider":      "openai",
+			"model_type":    "gpt",
+			"client_msg_id": clientID,
+		}, nil)
+	}
+	eventNames := func(resp *httptest.ResponseRecorder) []string {
+		var names []string
+		for _, ev := range parseSSE(t, resp.Body.String()) {
+			names = append(names, ev.Name)
+		}
+		return names
+	}
+
+	// the first reply crosses the soft limit (0.015) and is warned about
+	resp := send("client-msg-budget-1")
+	assertStatus(t, resp, http.StatusOK)
+	if names := strings.Join(eventNames(resp), ","); names != "ack,stream,budget_warning,done" {
+		t.Fatalf("unexpected events: %s", names)
+	}
+	// above the soft limit already: no second warning; this reply exhausts the budget
+	resp = send("client-msg-budget-2")
+	assertStatus(t, resp, http.StatusOK)
+	if names := strings.Join(eventNames(resp), ","); names != "ack,stream,done" {
+		t.Fatalf("unexpected events: %s", names)
+	}
+	resp = send("client-msg-budget-3")
+	assertStatus(t, resp, http.StatusPaymentRequired)
+	var rejected struct {
+		Code string `json:"code"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &rejected)
+	if rejected.Code != "budget_exhausted" {
+		t.Fatalf("unexpected rejection: %s", resp.Body.String())
+	}
+
+	var usage struct {
+		Period string               `json:"period"`
+		Usage  []models.UsageBucket `json:"usage"`
+		Total  struct {
+			Requests int     `json:"requests"`
+			Cost     float64 `json:"cost"`
+		} `json:"total"`
+		Budget models.BudgetStatus `json:"budget"`
+	}
+	resp = client.DoJSON(http.MethodGet, fmt.Sprintf("/api/users/%d/usage?period=monthly", userID), nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &usage)
+	month := time.Now().UTC().Format("2006-01")
+	if len(usage.Usage) != 1 || usage.Usage[0].Period != month || usage.Usage[0].Provider != "openai" || usage.Usage[0].Model != "gpt" || usage.Usage[0].Requests != 2 || usage.Usage[0].PromptTokens != 24 {
+		t.Fatalf("unexpected usage: %+v", usage.Usage)
+	}
+	if usage.Total.Requests != 2 || usage.Total.Cost < 0.0319 || usage.Total.Cost > 0.0321 || !usage.Budget.Exhausted {
+		t.Fatalf("unexpected totals: %s", resp.Body.String())
+	}
+	resp = client.DoJSON(http.MethodGet, fmt.Sprintf("/api/users/%d/usage?period=hourly", userID), nil, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	// dropping the user's budget falls back to the default, which is spent as well
+	if got := setBudget(nil); got.MonthlyBudget != 0.03 || !got.Exhausted {
+		t.Fatalf("expected the exhausted default, got %+v", got)
+	}
+	resp = send("client-msg-budget-4")
+	assertStatus(t, resp, http.StatusPaymentRequired)
+
+	// without a default, 0 removes the limit
+	handler.assistant.ConfigureUsage(config.UsageConfig{})
+	if got := setBudget(0); got.MonthlyBudget != 0 || got.Exhausted {
+		t.Fatalf("expected an unlimited budget, got %+v", got)
+	}
+	resp = send("client-msg-budget-5")
+	assertStatus(t, resp, http.StatusOK)
+}
+
+func TestUserProviders(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	handler.assistant.ConfigureUserProviders(config.UserProvidersConfig{
+		AllowedBaseURLs: []string{"https://*.openai.azure.com", "https://llm.corp.example/v1"},
+	})
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	providersURL := fmt.Sprintf("/api/users/%d/providers", userID)
+
+	corp := map[string]any{
+		"name":        "corp",
+		"type":        "azure-openai",
+		"base_url":    "https://team.openai.azure.com",
+		"api_version": "2024-06-01",
+		"model":          "gpt-4o",
+		"context_window": 128000,
+		"headers":        map[string]string{"X-Team": "ml"},
+		"api_key":        "corp-secret",
+	}
+	with := func(key string, value any) map[string]any {
+		out := make(map[string]any, len(corp))
+		for k, v := range corp {
+			out[k] = v
+		}
+		out[key] = value
+		return out
+	}
+	for _, tc := range []struct {
+		body   map[string]any
+		status int
+	}{
+		{with("base_url", "https://evil.example.com"), http.StatusForbidden},
+		{with("base_url", "https://llm.corp.example/v2"), http.StatusForbidden},
+		{with("base_url", "https://llm.corp.example/v1/../admin"), http.StatusForbidden},
+		{with("base_url", "https://llm.corp.example/v1/%2e%2e/admin"), http.StatusForbidden},
+		{with("base_url", "https://openai.azure.com.evil.example"), http.StatusForbidden},
+		{with("type", "gemini"), http.StatusBadRequest},
+		{with("api_version", ""), http.StatusBadRequest},
+		{with("name", "bad name"), http.StatusBadRequest},
+		{with("headers", map[string]string{"X-Bad": "a\r\nb"}), http.StatusBadRequest},
+		{with("context_window", -1), http.StatusBadRequest},
+	} {
+		resp := client.DoJSON(http.MethodPost, providersURL, tc.body, nil)
+		assertStatus(t, resp, tc.status)
+	}
+
+	resp := client.DoJSON(http.MethodPost, providersURL, corp, nil)
+	assertStatus(t, resp, http.StatusOK)
+	if strings.Contains(resp.Body.String(), "corp-secret") || strings.Contains(resp.Body.String(), `"ml"`) {
+		t.Fatalf("secrets leaked in response: %s", resp.Body.String())
+	}
+	var body struct {
+		Provider models.UserProvider `json:"provider"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	if body.Provider.Name != "corp" || !body.Provider.HasKey || len(body.Provider.HeaderNames) != 1 || body.Provider.HeaderNames[0] != "X-Team" {
+		t.Fatalf("unexpected provider: %s", resp.Body.String())
+	}
+	var stored string
+	if err := db.QueryRow(`SELECT api_key FROM user_providers WHERE user_id = ? AND name = ?`, userID, "corp").Scan(&stored); err != nil {
+		t.Fatalf("query stored key: %v", err)
+	}
+	if stored == "corp-secret" {
+		t.Fatalf("key stored in plaintext")
+	}
+
+	// an update without api_key and headers keeps them
+	update := with("model", "gpt-4o-mini")
+	delete(update, "api_key")
+	delete(update, "headers")
+	resp = client.DoJSON(http.MethodPost, providersURL, update, nil)
+	assertStatus(t, resp, http.StatusOK)
+	cfg, key, err := handler.assistant.UserProviderConfig(context.Background(), userID, "corp")
+	if err != nil {
+		t.Fatalf("resolve provider: %v", err)
+	}
+	if key != "corp-secret" || cfg.Model != "gpt-4o-mini" || cfg.Headers["X-Team"] != "ml" || cfg.APIVersion != "2024-06-01" || cfg.ContextWindow != 128000 {
+		t.Fatalf("unexpected resolved provider: %+v key=%q", cfg, key)
+	}
+
+	resp = client.DoJSON(http.MethodGet, providersURL, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	var list struct {
+		Providers []models.UserProvider `json:"providers"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &list)
+	if len(list.Providers) != 1 || list.Providers[0].Model != "gpt-4o-mini" {
+		t.Fatalf("unexpected providers: %s", resp.Body.String())
+	}
+
+	// the provider brings its own key, so no token is needed to chat
+	resp = client.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/start", userID), map[string]any{
+		"provider":   "corp",
+		"model_type": "gpt-4o-mini",
+	}, nil)
+	assertStatus(t, resp, http.StatusAccepted)
+
+	resp = client.DoJSON(http.MethodDelete, providersURL+"/corp", nil, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	resp = client.DoJSON(http.MethodDelete, providersURL+"/corp", nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+	resp = client.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/start", userID), map[string]any{
+		"provider":   "corp",
+		"model_type": "gpt-4o-mini",
+	}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+	if got := handler.workers.(*mockWorker).invalidatedProviders; len(got) != 3 || got[2] != "corp" {
+		t.Fatalf("expected worker invalidated on every change, got %v", got)
+	}
+}
+
+func TestFallbackChains(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	fallbacksURL := fmt.Sprintf("/api/users/%d/fallbacks", userID)
+	var body struct {
+		Fallbacks []models.ProviderModel `json:"fallbacks"`
+	}
+
+	resp := client.DoJSON(http.MethodGet, fallbacksURL, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	if body.Fallbacks == nil || len(body.Fallbacks) != 0 {
+		t.Fatalf("expected an empty chain, got %s", resp.Body.String())
+	}
+
+	resp = client.DoJSON(http.MethodPut, fallbacksURL, map[string]any{"fallbacks": []map[string]string{{"provider": " "}}}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+	tooLong := make([]map[string]string, assistant.MaxFallbacks+1)
+	for i := range tooLong {
+		tooLong[i] = map[string]string{"provider": "claude"}
+	}
+	resp = client.DoJSON(http.MethodPut, fallbacksURL, map[string]any{"fallbacks": tooLong}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	resp = client.DoJSON(http.MethodPut, fallbacksURL, map[string]any{"fallbacks": []map[string]string{
+		{"provider": "claude", "model": "claude-haiku-4-5"},
+		{"provider": " gemini "},
+	}}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	chain, err := handler.assistant.GetUserFallbacks(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("load fallbacks: %v", err)
+	}
+	if len(chain) != 2 || chain[0].Model != "claude-haiku-4-5" || chain[1].Provider != "gemini" {
+		t.Fatalf("unexpected stored chain: %#v", chain)
+	}
+
+	// sessions keep their own chain in their settings
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Failover")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	settingsURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/settings", userID, session.ID)
+	resp = client.DoJSON(http.MethodPut, settingsURL, map[string]any{"fallbacks": []map[string]string{{"provider": "gemini"}}}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	var settings struct {
+		Settings models.SessionSettings `json:"settings"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &settings)
+	if len(settings.Settings.Fallbacks) != 1 || settings.Settings.Fallbacks[0].Provider != "gemini" {
+		t.Fatalf("unexpected session chain: %s", resp.Body.String())
+	}
+	resp = client.DoJSON(http.MethodPut, settingsURL, map[string]any{"temperature": 0.5}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	settings.Settings = models.SessionSettings{}
+	decodeJSON(t, resp.Body.Bytes(), &settings)
+	if settings.Settings.Fallbacks != nil {
+		t.Fatalf("expected the user's chain without a session chain: %s", resp.Body.String())
+	}
+
+	resp = client.DoJSON(http.MethodPut, fallbacksURL, map[string]any{"fallbacks": []map[string]string{}}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	if chain, _ := handler.assistant.GetUserFallbacks(context.Background(), userID); chain != nil {
+		t.Fatalf("expected chain removed, got %#v", chain)
+	}
+}
+
+func TestProviderHealthRequiresAdmin(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	restore := providerResilience
+	defer func() { providerResilience = restore }()
+	res := llm.NewResilience(config.ResilienceConfig{Retry: config.RetryConfig{MaxAttempts: 4}}, nil)
+	res.Breaker.Record("openai", context.DeadlineExceeded)
+	providerResilience = func() *llm.Resilience { return res }
+
+	resp := client.DoJSON(http.MethodGet, "/api/admin/providers/health", nil, nil)
+	assertStatus(t, resp, http.StatusForbidden)
+
+	handler.assistant.ConfigureAdmins(config.AdminConfig{UserIDs: []int64{userID}})
+	resp = client.DoJSON(http.MethodGet, "/api/admin/providers/health", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	var body struct {
+		Retry struct {
+			MaxAttempts int `json:"max_attempts"`
+		} `json:"retry"`
+		CircuitBreaker struct {
+			Enabled          bool `json:"enabled"`
+			Shared           bool `json:"shared"`
+			FailureThreshold int  `json:"failure_threshold"`
+		} `json:"circuit_breaker"`
+		Circuits []llm.CircuitState `json:"circuits"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	if body.Retry.MaxAttempts != 4 || !body.CircuitBreaker.Enabled || body.CircuitBreaker.Shared || body.CircuitBreaker.FailureThreshold != llm.DefaultFailureThreshold {
+		t.Fatalf("unexpected policy: %s", resp.Body.String())
+	}
+	if len(body.Circuits) != 1 || body.Circuits[0].Provider != "openai" || body.Circuits[0].State != llm.CircuitClosed || body.Circuits[0].Failures != 1 {
+		t.Fatalf("unexpected circuits: %s", resp.Body.String())
+	}
+}
+
+func TestSessionSettingsCRUD(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Settings")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	settingsURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/settings", userID, session.ID)
+	var body struct {
+		Settings models.SessionSettings `json:"settings"`
+	}
+
+	// without saved settings the provider defaults apply and every tool is enabled
+	resp := client.DoJSON(http.MethodGet, settingsURL, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	if body.Settings.SessionID != session.ID || body.Settings.Temperature != nil || body.Settings.Tools != nil {
+		t.Fatalf("unexpected default settings: %s", resp.Body.String())
+	}
+
+	for _, invalid := range []map[string]any{
+		{"temperature": 2.5},
+		{"top_p": -0.1},
+		{"max_tokens": 0},
+		{"stop": []string{"a", "b", "c", "d", "e"}},
+		{"tools": []string{"shell"}},
+	} {
+		resp = client.DoJSON(http.MethodPut, settingsURL, invalid, nil)
+		assertStatus(t, resp, http.StatusBadRequest)
+	}
+
+	resp = client.DoJSON(http.MethodPut, settingsURL, map[string]any{
+		"system_prompt": "  Answer briefly.  ",
+		"temperature":   0.2,
+		"max_tokens":    512,
+		"stop":          []string{"END"},
+		"tools":         []string{},
+	}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	resp = client.DoJSON(http.MethodGet, settingsURL, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	body.Settings = models.SessionSettings{}
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	got := body.Settings
+	if got.SystemPrompt != "Answer briefly." || got.Temperature == nil || *got.Temperature != 0.2 || got.TopP != nil ||
+		got.MaxTokens == nil || *got.MaxTokens != 512 || len(got.Stop) != 1 || got.Tools == nil || len(got.Tools) != 0 || got.UpdatedAt == nil {
+		t.Fatalf("unexpected stored settings: %s", resp.Body.String())
+	}
+
+	resp = client.DoJSON(http.MethodDelete, settingsURL, nil, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	resp = client.DoJSON(http.MethodGet, settingsURL, nil, nil)
+	body.Settings = models.SessionSettings{}
+	decodeJSON(t, resp.Body.Bytes(), &body)
+	if body.Settings.SystemPrompt != "" || body.Settings.UpdatedAt != nil {
+		t.Fatalf("expected defaults after delete: %s", resp.Body.String())
+	}
+	if got := handler.workers.(*mockWorker).invalidatedSettings; len(got) != 2 || got[0] != session.ID {
+		t.Fatalf("expected worker invalidated on update and delete, got %v", got)
+	}
+
+	resp = client.DoJSON(http.MethodGet, fmt.Sprintf("/api/users/%d/conversation/sessions/%d/settings", userID, session.ID+100), nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestPersonas(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	owner := newAPITestClient(t, router)
+	ownerID, _ := registerAndLogin(t, owner)
+	other := newAPITestClient(t, router)
+	otherID, _ := registerAndLogin(t, other)
+
+	resp := owner.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/personas", ownerID), map[string]any{"name": " "}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+	resp = owner.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/personas", ownerID), map[string]any{
+		"name":          "Go reviewer",
+		"system_prompt": "You are a senior Go reviewer.",
+		"provider":      "openai",
+		"model":         "gpt-review",
+		"tools":         []string{"temp_file_reader"},
+	}, nil)
+	assertStatus(t, resp, http.StatusCreated)
+	var created struct {
+		Persona models.Persona `json:"persona"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &created)
+	personaURL := fmt.Sprintf("/api/users/%d/personas/%d", ownerID, created.Persona.ID)
+	resp = owner.UploadForm(personaURL+"/files", nil, "style.md", []byte("Prefer early returns."))
+	assertStatus(t, resp, http.StatusCreated)
+
+	// private personas are invisible to other users
+	otherURL := fmt.Sprintf("/api/users/%d/personas/%d", otherID, created.Persona.ID)
+	resp = other.DoJSON(http.MethodGet, otherURL, nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+
+	update := map[string]any{
+		"name":          "Go reviewer",
+		"system_prompt": "You are a senior Go reviewer.",
+		"provider":      "openai",
+		"model":         "gpt-review",
+		"tools":         []string{"temp_file_reader"},
+		"shared":        true,
+	}
+	resp = owner.DoJSON(http.MethodPut, personaURL, update, nil)
+	assertStatus(t, resp, http.StatusOK)
+
+	// shared personas are listed and usable but read-only for others
+	var listed struct {
+		Personas []models.Persona `json:"personas"`
+	}
+	resp = other.DoJSON(http.MethodGet, fmt.Sprintf("/api/users/%d/personas", otherID), nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &listed)
+	if len(listed.Personas) != 1 || listed.Personas[0].UserID != ownerID || len(listed.Personas[0].Files) != 1 {
+		t.Fatalf("unexpected shared personas: %s", resp.Body.String())
+	}
+	resp = other.DoJSON(http.MethodPut, otherURL, update, nil)
+	assertStatus(t, resp, http.StatusForbidden)
+	resp = other.DoJSON(http.MethodDelete, otherURL, nil, nil)
+	assertStatus(t, resp, http.StatusForbidden)
+
+	resp = other.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/token", otherID), map[string]string{"provider": "openai", "token": "mock"}, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	resp = other.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/start", otherID), map[string]any{
+		"session_id": 7,
+		"persona_id": created.Persona.ID,
+	}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+	resp = other.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/start", otherID), map[string]any{
+		"persona_id": created.Persona.ID,
+	}, nil)
+	assertStatus(t, resp, http.StatusAccepted)
+	var started struct {
+		SessionID int64 `json:"sessionId"`
+		PersonaID int64 `json:"personaId"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &started)
+	if started.PersonaID != created.Persona.ID {
+		t.Fatalf("unexpected start response: %s", resp.Body.String())
+	}
+	ctx := context.Background()
+	settings, err := handler.assistant.GetSessionSettings(ctx, otherID, started.SessionID)
+	if err != nil {
+		t.Fatalf("load settings: %v", err)
+	}
+	if settings.SystemPrompt != "You are a senior Go reviewer." || len(settings.Tools) != 1 || settings.Tools[0] != "temp_file_reader" {
+		t.Fatalf("session did not inherit the persona: %+v", settings)
+	}
+	files, err := handler.assistant.ListSessionTempFiles(ctx, otherID, started.SessionID)
+	if err != nil {
+		t.Fatalf("list session files: %v", err)
+	}
+	if len(files) != 1 || files[0].FileName != "style.md" {
+		t.Fatalf("starter file not copied: %+v", files)
+	}
+	if content, err := os.ReadFile(files[0].StoredPath); err != nil || string(content) != "Prefer early returns." {
+		t.Fatalf("unexpected starter file copy: %q, %v", content, err)
+	}
+
+	// a persona that cannot be applied leaves no session behind
+	persona, err := handler.assistant.GetPersona(ctx, otherID, created.Persona.ID)
+	if err != nil || len(persona.Files) != 1 {
+		t.Fatalf("load persona: %+v, %v", persona, err)
+	}
+	starter, err := os.ReadFile(persona.Files[0].StoredPath)
+	if err != nil {
+		t.Fatalf("read starter file: %v", err)
+	}
+	if err := os.Remove(persona.Files[0].StoredPath); err != nil {
+		t.Fatalf("remove starter file: %v", err)
+	}
+	resp = other.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/start", otherID), map[string]any{
+		"persona_id": created.Persona.ID,
+	}, nil)
+	assertStatus(t, resp, http.StatusInternalServerError)
+	var sessions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE user_id = ?`, otherID).Scan(&sessions); err != nil || sessions != 1 {
+		t.Fatalf("expected only the first session kept, got %d (%v)", sessions, err)
+	}
+	if err := os.WriteFile(persona.Files[0].StoredPath, starter, 0o644); err != nil {
+		t.Fatalf("restore starter file: %v", err)
+	}
+
+	// deleting the persona keeps the sessions started from it
+	resp = owner.DoJSON(http.MethodDelete, personaURL, nil, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	resp = owner.DoJSON(http.MethodGet, personaURL, nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+	if _, err := os.Stat(files[0].StoredPath); err != nil {
+		t.Fatalf("session copy removed with the persona: %v", err)
+	}
+
+	// starter files count toward the storage quota and go with their owner
+	resp = owner.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/personas", ownerID), map[string]any{"name": "Writer"}, nil)
+	assertStatus(t, resp, http.StatusCreated)
+	decodeJSON(t, resp.Body.Bytes(), &created)
+	resp = owner.UploadForm(fmt.Sprintf("/api/users/%d/personas/%d/files", ownerID, created.Persona.ID), nil, "tone.md", []byte("Be brief."))
+	assertStatus(t, resp, http.StatusCreated)
+	if used, err := handler.assistant.StorageUsage(ctx, ownerID); err != nil || used != int64(len("Be brief.")) {
+		t.Fatalf("unexpected storage usage: %d, %v", used, err)
+	}
+	resp = owner.DoJSON(http.MethodDelete, fmt.Sprintf("/api/users/%d", ownerID), nil, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	if _, err := os.Stat(handler.personaFileDir(ownerID)); !os.IsNotExist(err) {
+		t.Fatalf("persona files kept after the user was deleted: %v", err)
+	}
+}
+
+func TestPromptTemplates(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	templatesURL := fmt.Sprintf("/api/users/%d/prompt-templates", userID)
+
+	resp := client.DoJSON(http.MethodPost, templatesURL, map[string]any{"name": "Empty", "content": " "}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+	resp = client.DoJSON(http.MethodPost, templatesURL, map[string]any{
+		"name":        "Review",
+		"description": "Code review request",
+		"content":     "Review this {{ language }} code for {{focus}}:\n{{code}}\nFocus on {{focus}}.",
+		"tags":        []string{"review", " go ", "review"},
+	}, nil)
+	assertStatus(t, resp, http.StatusCreated)
+	var created struct {
+		Template models.PromptTemplate `json:"template"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &created)
+	if got := strings.Join(created.Template.Variables, ","); got != "language,focus,code" {
+		t.Fatalf("unexpected variables: %s", got)
+	}
+	if got := strings.Join(created.Template.Tags, ","); got != "review,go" {
+		t.Fatalf("unexpected tags: %s", got)
+	}
+	resp = client.DoJSON(http.MethodPost, templatesURL, map[string]any{"name": "Review", "content": "again"}, nil)
+	assertStatus(t, resp, http.StatusConflict)
+	resp = client.DoJSON(http.MethodPost, templatesURL, map[string]any{"name": "Haiku", "content": "Write a haiku about {{topic}}.", "tags": []string{"fun"}}, nil)
+	assertStatus(t, resp, http.StatusCreated)
+
+	var listed struct {
+		Templates []models.PromptTemplate `json:"templates"`
+	}
+	resp = client.DoJSON(http.MethodGet, templatesURL+"?tag=go", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &listed)
+	if len(listed.Templates) != 1 || listed.Templates[0].Name != "Review" {
+		t.Fatalf("unexpected tag filter result: %s", resp.Body.String())
+	}
+
+	// a missing variable is rejected before the message or the client_msg_id is stored
+	setTokenResp := client.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/token", userID), map[string]string{"provider": "openai", "token": "mock"}, nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Templates")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	send := func(body map[string]any) *httptest.ResponseRecorder {
+		body["session_id"] = session.ID
+		body["provider"] = "openai"
+		body["model_type"] = "gpt"
+		body["client_msg_id"] = "client-msg-template"
+		return client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), body, nil)
+	}
+	resp = send(map[string]any{"template_id": created.Template.ID, "variables": map[string]string{"language": "Go"}})
+	assertStatus(t, resp, http.StatusBadRequest)
+	var missing struct {
+		Missing []string `json:"missing_variables"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &missing)
+	if strings.Join(missing.Missing, ",") != "focus,code" {
+		t.Fatalf("unexpected missing variables: %s", resp.Body.String())
+	}
+	_, messages, err := handler.assistant.GetSessionWithMessages(context.Background(), userID, session.ID)
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("expected nothing stored, got %d messages (%v)", len(messages), err)
+	}
+	resp = send(map[string]any{"template_id": created.Template.ID, "content": "hi"})
+	assertStatus(t, resp, http.StatusBadRequest)
+	resp = send(map[string]any{"template_id": created.Template.ID, "variables": map[string]string{
+		"language": "Go", "focus": "{{code}}", "code": "x := 1",
+	}})
+	assertStatus(t, resp, http.StatusOK)
+	_, messages, err = handler.assistant.GetSessionWithMessages(context.Background(), userID, session.ID)
+	if err != nil || len(messages) == 0 {
+		t.Fatalf("expected stored messages, got %v", err)
+	}
+	if want := "Review this Go code for {{code}}:\nx := 1\nFocus on {{code}}."; messages[0].Content != want {
+		t.Fatalf("unexpected rendered prompt: %q", messages[0].Content)
+	}
+
+	// export, then import into another user's library
+	resp = client.DoJSON(http.MethodGet, templatesURL+"/export", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	exported := resp.Body.Bytes()
+	var lib models.PromptLibrary
+	decodeJSON(t, exported, &lib)
+	if lib.Format != "unichatgo.prompt_templates" || lib.Version != 1 || len(lib.Templates) != 2 {
+		t.Fatalf("unexpected export: %s", exported)
+	}
+	other := newAPITestClient(t, router)
+	otherID, _ := registerAndLogin(t, other)
+	otherURL := fmt.Sprintf("/api/users/%d/prompt-templates", otherID)
+	resp = other.DoJSON(http.MethodPost, otherURL, map[string]any{"name": "Haiku", "content": "Mine: {{topic}}"}, nil)
+	assertStatus(t, resp, http.StatusCreated)
+	var result struct {
+		Created, Updated, Skipped int
+	}
+	resp = other.DoJSON(http.MethodPost, otherURL+"/import", lib, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &result)
+	if result.Created != 1 || result.Skipped != 1 || result.Updated != 0 {
+		t.Fatalf("unexpected import result: %s", resp.Body.String())
+	}
+	resp = other.DoJSON(http.MethodPost, otherURL+"/import?overwrite=true", lib, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &result)
+	if result.Created != 0 || result.Updated != 2 {
+		t.Fatalf("unexpected overwrite result: %s", resp.Body.String())
+	}
+	lib.Templates = append(lib.Templates, models.PromptLibraryEntry{Name: "Broken"})
+	resp = other.DoJSON(http.MethodPost, otherURL+"/import", lib, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	resp = client.DoJSON(http.MethodDelete, fmt.Sprintf("%s/%d", templatesURL, created.Template.ID), nil, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	resp = client.DoJSON(http.MethodGet, fmt.Sprintf("%s/%d", templatesURL, created.Template.ID), nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestRegenerateKeepsVariants(t *testing.T) {
+	router, db, _ := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+
+	startResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/start", userID),
+		map[string]any{"provider": "openai", "session_id": 0, "model_type": "gpt"},
+		nil)
+	assertStatus(t, startResp, http.StatusAccepted)
+	var body struct {
+		SessionID int64 `json:"sessionId"`
+	}
+	decodeJSON(t, startResp.Body.Bytes(), &body)
+
+	regenURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/regenerate", userID, body.SessionID)
+	empty := client.PostSSE(regenURL, map[string]any{"provider": "openai", "model_type": "gpt", "client_msg_id": "regen-empty"}, nil)
+	assertStatus(t, empty, http.StatusConflict)
+
+	resp := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+		"session_id":    body.SessionID,
+		"content":       "try me",
+		"provider":      "openai",
+		"model_type":    "gpt",
+		"client_msg_id": "client-msg-regen",
+	}, nil)
+	assertStatus(t, resp, http.StatusOK)
+	var first struct {
+		AI struct {
+			ID int64 `json:"id"`
+		} `json:"ai_message"`
+	}
+	events := parseSSE(t, resp.Body.String())
+	decodeJSON(t, []byte(events[len(events)-1].Data), &first)
+
+	regen := client.PostSSE(regenURL, map[string]any{"provider": "openai", "model_type": "gpt-other", "client_msg_id": "regen-1"}, nil)
+	assertStatus(t, regen, http.StatusOK)
+	events = parseSSE(t, regen.Body.String())
+	if len(events) != 3 || events[0].Name != "ack" || events[2].Name != "done" {
+		t.Fatalf("unexpected regenerate SSE sequence: %#v", events)
+	}
+	var second struct {
+		AI struct {
+			ID        int64 `json:"id"`
+			VariantOf int64 `json:"variant_of"`
+		} `json:"ai_message"`
+	}
+	decodeJSON(t, []byte(events[2].Data), &second)
+	if second.AI.ID == first.AI.ID || second.AI.VariantOf != first.AI.ID {
+		t.Fatalf("expected new variant of %d, got %#v", first.AI.ID, second.AI)
+	}
+
+	activeReply := func() int64 {
+		t.Helper()
+		msgsResp := client.DoJSON(http.MethodGet,
+			fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages", userID, body.SessionID), nil, nil)
+		assertStatus(t, msgsResp, http.StatusOK)
+		var listed struct {
+			Messages []struct {
+				ID   int64  `json:"id"`
+				Role string `json:"role"`
+			} `json:"messages"`
+		}
+		decodeJSON(t, msgsResp.Body.Bytes(), &listed)
+		if len(listed.Messages) != 2 || listed.Messages[1].Role != string(models.RoleAssistant) {
+			t.Fatalf("expected prompt and one active reply, got %#v", listed.Messages)
+		}
+		return listed.Messages[1].ID
+	}
+	if got := activeReply(); got != second.AI.ID {
+		t.Fatalf("expected regenerated reply to be active, got %d", got)
+	}
+
+	variantsResp := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/siblings", userID, body.SessionID, second.AI.ID), nil, nil)
+	assertStatus(t, variantsResp, http.StatusOK)
+	var variants struct {
+		Siblings []struct {
+			ID int64 `json:"id"`
+		} `json:"siblings"`
+		ActiveID int64 `json:"active_id"`
+	}
+	decodeJSON(t, variantsResp.Body.Bytes(), &variants)
+	if len(variants.Siblings) != 2 || variants.ActiveID != second.AI.ID {
+		t.Fatalf("unexpected variants: %#v", variants)
+	}
+	// the route of the first variants API keeps working
+	legacyResp := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/variants", userID, body.SessionID, second.AI.ID), nil, nil)
+	assertStatus(t, legacyResp, http.StatusOK)
+	var legacy struct {
+		Variants []struct {
+			ID int64 `json:"id"`
+		} `json:"variants"`
+		ActiveID int64 `json:"active_id"`
+	}
+	decodeJSON(t, legacyResp.Body.Bytes(), &legacy)
+	if len(legacy.Variants) != 2 || legacy.ActiveID != second.AI.ID {
+		t.Fatalf("unexpected legacy variants: %s", legacyResp.Body.String())
+	}
+
+	selectResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/select", userID, body.SessionID, first.AI.ID), nil, nil)
+	assertStatus(t, selectResp, http.StatusOK)
+	if got := activeReply(); got != first.AI.ID {
+		t.Fatalf("expected original reply to be active again, got %d", got)
+	}
+}
+
+func TestEditMessageForksBranch(t *testing.T) {
+	router, db, _ := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+
+	startResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/start", userID),
+		map[string]any{"provider": "openai", "session_id": 0, "model_type": "gpt"},
+		nil)
+	assertStatus(t, startResp, http.StatusAccepted)
+	var body struct {
+		SessionID int64 `json:"sessionId"`
+	}
+	decodeJSON(t, startResp.Body.Bytes(), &body)
+
+	type messageList struct {
+		Session struct {
+			ActiveLeafID int64 `json:"active_leaf_id"`
+		} `json:"session"`
+		Messages []struct {
+			ID       int64  `json:"id"`
+			ParentID int64  `json:"parent_id"`
+			Content  string `json:"content"`
+		} `json:"messages"`
+	}
+	listMessages := func() messageList {
+		t.Helper()
+		resp := client.DoJSON(http.MethodGet,
+			fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages", userID, body.SessionID), nil, nil)
+		assertStatus(t, resp, http.StatusOK)
+		var listed messageList
+		decodeJSON(t, resp.Body.Bytes(), &listed)
+		return listed
+	}
+
+	for i, content := range []string{"first question", "second question"} {
+		resp := client.PostSSE(fmt.Sprintf("/api/users/%d/conversation/msg", userID), map[string]any{
+			"session_id":    body.SessionID,
+			"content":       content,
+			"provider":      "openai",
+			"model_type":    "gpt",
+			"client_msg_id": fmt.Sprintf("client-msg-branch-%d", i),
+		}, nil)
+		assertStatus(t, resp, http.StatusOK)
+	}
+	original := listMessages()
+	if len(original.Messages) != 4 || original.Messages[1].ParentID != original.Messages[0].ID {
+		t.Fatalf("expected a linked chain of 4 messages, got %#v", original.Messages)
+	}
+	firstPrompt := original.Messages[0].ID
+	secondPrompt := original.Messages[2].ID
+
+	// Edit the second prompt: the new branch keeps the first exchange only.
+	editResp := client.PostSSE(
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/edit", userID, body.SessionID, secondPrompt),
+		map[string]any{"content": "second question, rephrased", "provider": "openai", "model_type": "gpt", "client_msg_id": "client-msg-edit"},
+		nil)
+	assertStatus(t, editResp, http.StatusOK)
+	events := parseSSE(t, editResp.Body.String())
+	if len(events) != 3 || events[0].Name != "ack" || events[2].Name != "done" {
+		t.Fatalf("unexpected edit SSE sequence: %#v", events)
+	}
+	edited := listMessages()
+	if len(edited.Messages) != 4 || edited.Messages[2].Content != "second question, rephrased" {
+		t.Fatalf("unexpected edited branch: %#v", edited.Messages)
+	}
+	if edited.Messages[2].ParentID != original.Messages[1].ID || edited.Session.ActiveLeafID != edited.Messages[3].ID {
+		t.Fatalf("edited prompt should fork after the first reply: %#v", edited)
+	}
+
+	siblingsResp := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/siblings", userID, body.SessionID, secondPrompt), nil, nil)
+	assertStatus(t, siblingsResp, http.StatusOK)
+	var siblings struct {
+		Siblings []struct {
+			ID int64 `json:"id"`
+		} `json:"siblings"`
+		ActiveID int64 `json:"active_id"`
+	}
+	decodeJSON(t, siblingsResp.Body.Bytes(), &siblings)
+	if len(siblings.Siblings) != 2 || siblings.ActiveID != edited.Messages[2].ID {
+		t.Fatalf("unexpected siblings: %#v", siblings)
+	}
+
+	// Editing a reply is rejected, editing the root forks a new tree.
+	badEdit := client.PostSSE(
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/edit", userID, body.SessionID, edited.Messages[1].ID),
+		map[string]any{"content": "nope", "provider": "openai", "model_type": "gpt", "client_msg_id": "client-msg-edit-bad"},
+		nil)
+	assertStatus(t, badEdit, http.StatusBadRequest)
+
+	selectResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages/%d/select", userID, body.SessionID, secondPrompt), nil, nil)
+	assertStatus(t, selectResp, http.StatusOK)
+	restored := listMessages()
+	if len(restored.Messages) != 4 || restored.Messages[2].ID != secondPrompt || restored.Messages[0].ID != firstPrompt {
+		t.Fatalf("expected original branch after select, got %#v", restored.Messages)
+	}
+}
+
+func TestCaptureInputIdempotentAcrossInstances(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	setTokenResp := client.DoJSON(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, setTokenResp, http.StatusNoContent)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "idempotent")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	msgReq := map[string]any{
+		"session_id":    session.ID,
+		"content":       "only once",
+		"provider":      "openai",
+		"model_type":    "gpt",
+		"client_msg_id": "client-msg-durable",
+	}
+	path := fmt.Sprintf("/api/users/%d/conversation/msg", userID)
+	first := client.PostSSE(path, msgReq, nil)
+	assertStatus(t, first, http.StatusOK)
+	firstEvents := parseSSE(t, first.Body.String())
+	if len(firstEvents) != 3 || firstEvents[2].Name != "done" {
+		t.Fatalf("unexpected first response: %#v", firstEvents)
+	}
+
+	// A second replica shares the database but not the in-memory stream buffer.
+	other := NewHandler(handler.assistant, handler.auth, worker.DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 1}, t.TempDir(), assistant.DefaultTempFileTTL, assistant.DefaultIdempotencyRetention, nil)
+	other.workers = newMockWorker(handler.assistant)
+	otherRouter := gin.New()
+	other.RegisterRoutes(otherRouter)
+	otherClient := newAPITestClient(t, otherRouter)
+	otherClient.cookies = client.cookies
+
+	retry := otherClient.PostSSE(path, msgReq, nil)
+	assertStatus(t, retry, http.StatusOK)
+	events := parseSSE(t, retry.Body.String())
+	if len(events) != 2 || events[0].Name != "ack" || events[1].Name != "done" {
+		t.Fatalf("expected replayed ack + done, got %#v", events)
+	}
+	var done struct {
+		Title string `json:"title"`
+		AI    struct {
+			ID      int64  `json:"id"`
+			Content string `json:"content"`
+		} `json:"ai_message"`
+	}
+	decodeJSON(t, []byte(events[1].Data), &done)
+	if done.Title != "Mock Title" || done.AI.ID == 0 || !strings.Contains(done.AI.Content, "only once") {
+		t.Fatalf("unexpected replayed payload: %s", events[1].Data)
+	}
+	if count := countMessages(t, db, session.ID); count != 2 {
+		t.Fatalf("expected no duplicate messages, got %d", count)
+	}
+
+	msgReq["content"] = "something else"
+	conflict := otherClient.PostSSE(path, msgReq, nil)
+	assertStatus(t, conflict, http.StatusConflict)
+}
+
 func TestCSRFMiddlewareRejectsMissingHeader(t *testing.T) {
 	router, db, _ := newTestServer(t)
 	defer db.Close()
 	client := newAPITestClient(t, router)
-
+
+	userID, _ := registerAndLogin(t, client)
+
+	resp := client.DoJSONNoCSRF(http.MethodPost,
+		fmt.Sprintf("/api/users/%d/token", userID),
+		map[string]string{"provider": "openai", "token": "mock"},
+		nil)
+	assertStatus(t, resp, http.StatusForbidden)
+}
+
+func TestGetSessionMessages(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+
+	userID, _ := registerAndLogin(t, client)
+	session, err := handler.assistant.CreateSession(context.Background(), userID, "Test Session")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	msg, err := handler.assistant.AddMessage(context.Background(), models.Message{
+		UserID:    userID,
+		SessionID: session.ID,
+		Role:      models.RoleUser,
+		Content:   "Hello history",
+	})
+	if err != nil {
+		t.Fatalf("add message: %v", err)
+	}
+
+	resp := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages", userID, session.ID),
+		nil,
+		nil,
+	)
+	assertStatus(t, resp, http.StatusOK)
+	var payload struct {
+		Session  models.Session   `json:"session"`
+		Messages []models.Message `json:"messages"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &payload)
+	if payload.Session.ID != session.ID {
+		t.Fatalf("expected session %d, got %d", session.ID, payload.Session.ID)
+	}
+	if len(payload.Messages) != 1 || payload.Messages[0].ID != msg.ID {
+		t.Fatalf("expected single message in history")
+	}
+}
+
+func TestSessionManagement(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+
+	var ids []int64
+	for _, title := range []string{"first", "second", "third"} {
+		session, err := handler.assistant.CreateSession(context.Background(), userID, title)
+		if err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+		ids = append(ids, session.ID)
+	}
+	listSessions := func(filter map[string]any) []models.Session {
+		t.Helper()
+		resp := client.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/session-list", userID), filter, nil)
+		assertStatus(t, resp, http.StatusOK)
+		var payload struct {
+			Sessions []models.Session `json:"session_list"`
+		}
+		decodeJSON(t, resp.Body.Bytes(), &payload)
+		return payload.Sessions
+	}
+	patch := func(id int64, body map[string]any) *httptest.ResponseRecorder {
+		return client.DoJSON(http.MethodPatch, fmt.Sprintf("/api/users/%d/conversation/sessions/%d", userID, id), body, nil)
+	}
+
+	renamed := patch(ids[0], map[string]any{"title": "  My notes  ", "pinned": true})
+	assertStatus(t, renamed, http.StatusOK)
+	var updated struct {
+		Session models.Session `json:"session"`
+	}
+	decodeJSON(t, renamed.Body.Bytes(), &updated)
+	if updated.Session.Title != "My notes" || !updated.Session.TitleLocked || !updated.Session.Pinned {
+		t.Fatalf("unexpected updated session: %#v", updated.Session)
+	}
+	assertStatus(t, patch(ids[1], map[string]any{"archived": true}), http.StatusOK)
+	assertStatus(t, patch(ids[1], map[string]any{}), http.StatusBadRequest)
+	assertStatus(t, patch(ids[1], map[string]any{"title": " "}), http.StatusBadRequest)
+	assertStatus(t, patch(999, map[string]any{"pinned": true}), http.StatusNotFound)
+
+	// generated titles no longer replace a title the user chose
+	if err := handler.assistant.UpdateSessionTitle(context.Background(), userID, ids[0], "Generated"); err != nil {
+		t.Fatalf("update title: %v", err)
+	}
+
+	listed := listSessions(nil)
+	if len(listed) != 2 || listed[0].ID != ids[0] || listed[0].Title != "My notes" || listed[1].ID != ids[2] {
+		t.Fatalf("expected pinned session first and archived one hidden, got %#v", listed)
+	}
+	if archived := listSessions(map[string]any{"archived": true}); len(archived) != 1 || archived[0].ID != ids[1] {
+		t.Fatalf("unexpected archived list: %#v", archived)
+	}
+	if pinned := listSessions(map[string]any{"pinned": true}); len(pinned) != 1 || pinned[0].ID != ids[0] {
+		t.Fatalf("unexpected pinned list: %#v", pinned)
+	}
+
+	deleteResp := client.DoJSON(http.MethodDelete, fmt.Sprintf("/api/users/%d/conversation/sessions", userID),
+		map[string]any{"session_ids": []int64{ids[1], ids[2], 999}}, nil)
+	assertStatus(t, deleteResp, http.StatusOK)
+	var deleted struct {
+		Deleted []int64 `json:"deleted"`
+	}
+	decodeJSON(t, deleteResp.Body.Bytes(), &deleted)
+	if len(deleted.Deleted) != 2 || deleted.Deleted[0] != ids[1] || deleted.Deleted[1] != ids[2] {
+		t.Fatalf("unexpected bulk delete result: %#v", deleted)
+	}
+	if remaining := listSessions(nil); len(remaining) != 1 || remaining[0].ID != ids[0] {
+		t.Fatalf("unexpected sessions after bulk delete: %#v", remaining)
+	}
+	if archived := listSessions(map[string]any{"archived": true}); len(archived) != 0 {
+		t.Fatalf("archived session should be deleted, got %#v", archived)
+	}
+}
+
+func TestCursorPagination(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
 	userID, _ := registerAndLogin(t, client)
+	ctx := context.Background()
 
-	resp := client.DoJSONNoCSRF(http.MethodPost,
-		fmt.Sprintf("/api/users/%d/token", userID),
-		map[string]string{"provider": "openai", "token": "mock"},
-		nil)
-	assertStatus(t, resp, http.StatusForbidden)
+	var sessionIDs []int64
+	for i := 0; i < 5; i++ {
+		session, err := handler.assistant.CreateSession(ctx, userID, fmt.Sprintf("session %d", i))
+		if err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+		sessionIDs = append(sessionIDs, session.ID)
+	}
+	if _, err := handler.assistant.UpdateSession(ctx, userID, sessionIDs[0], assistant.SessionUpdate{Pinned: boolPtr(true)}); err != nil {
+		t.Fatalf("pin session: %v", err)
+	}
+
+	type page struct {
+		HasMore bool   `json:"has_more"`
+		Before  string `json:"before_cursor"`
+		After   string `json:"after_cursor"`
+	}
+	var sessionsPage struct {
+		Sessions []models.Session `json:"session_list"`
+		Page     page             `json:"page"`
+	}
+	// pinned first, then newest first
+	want := []int64{sessionIDs[0], sessionIDs[4], sessionIDs[3], sessionIDs[2], sessionIDs[1]}
+	var got []int64
+	cursor := ""
+	for {
+		resp := client.DoJSON(http.MethodGet,
+			fmt.Sprintf("/api/users/%d/conversation/sessions?limit=2&before=%s", userID, cursor), nil, nil)
+		assertStatus(t, resp, http.StatusOK)
+		decodeJSON(t, resp.Body.Bytes(), &sessionsPage)
+		for _, s := range sessionsPage.Sessions {
+			got = append(got, s.ID)
+		}
+		if !sessionsPage.Page.HasMore {
+			break
+		}
+		cursor = sessionsPage.Page.Before
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected session order: got %v want %v", got, want)
+	}
+	// paging back from the last page returns the page before it
+	resp := client.DoJSON(http.MethodGet,
+		fmt.Sprintf("/api/users/%d/conversation/sessions?limit=2&after=%s", userID, sessionsPage.Page.After), nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &sessionsPage)
+	if len(sessionsPage.Sessions) != 2 || sessionsPage.Sessions[0].ID != want[2] || sessionsPage.Sessions[1].ID != want[3] || !sessionsPage.Page.HasMore {
+		t.Fatalf("unexpected previous page: %#v", sessionsPage)
+	}
+
+	var messageIDs []int64
+	for i := 0; i < 5; i++ {
+		msg, err := handler.assistant.AddMessage(ctx, models.Message{
+			UserID: userID, SessionID: sessionIDs[1], Role: models.RoleUser, Content: fmt.Sprintf("message %d", i),
+		})
+		if err != nil {
+			t.Fatalf("add message: %v", err)
+		}
+		messageIDs = append(messageIDs, msg.ID)
+	}
+	var messagesPage struct {
+		Messages []models.Message `json:"messages"`
+		Page     page             `json:"page"`
+	}
+	messagesURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages", userID, sessionIDs[1])
+	resp = client.DoJSON(http.MethodGet, messagesURL+"?limit=2", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &messagesPage)
+	if len(messagesPage.Messages) != 2 || messagesPage.Messages[0].ID != messageIDs[3] || messagesPage.Messages[1].ID != messageIDs[4] || !messagesPage.Page.HasMore {
+		t.Fatalf("expected the latest messages in order, got %#v", messagesPage)
+	}
+	resp = client.DoJSON(http.MethodGet, messagesURL+"?limit=2&before="+messagesPage.Page.Before, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &messagesPage)
+	if len(messagesPage.Messages) != 2 || messagesPage.Messages[0].ID != messageIDs[1] || messagesPage.Messages[1].ID != messageIDs[2] {
+		t.Fatalf("unexpected earlier page: %#v", messagesPage.Messages)
+	}
+	resp = client.DoJSON(http.MethodGet, messagesURL+"?limit=10&after="+messagesPage.Page.After, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &messagesPage)
+	if len(messagesPage.Messages) != 2 || messagesPage.Messages[0].ID != messageIDs[3] || messagesPage.Page.HasMore {
+		t.Fatalf("unexpected later page: %#v", messagesPage)
+	}
+
+	assertStatus(t, client.DoJSON(http.MethodGet, messagesURL+"?before=not-a-cursor", nil, nil), http.StatusBadRequest)
 }
 
-func TestGetSessionMessages(t *testing.T) {
+func TestSearchConversations(t *testing.T) {
 	router, db, handler := newTestServer(t)
 	defer db.Close()
 	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	ctx := context.Background()
+
+	kafka, err := handler.assistant.CreateSession(ctx, userID, "Kafka notes")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	other, err := handler.assistant.CreateSession(ctx, userID, "Lunch")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	var retryMsg *models.Message
+	for _, m := range []struct {
+		sessionID int64
+		content   string
+	}{
+		{kafka.ID, "What <b>retry</b> policy should the Kafka consumer use?"},
+		{other.ID, "Pizza or sushi?"},
+		{other.ID, "We should retry the kafka topic later"},
+	} {
+		stored, err := handler.assistant.AddMessage(ctx, models.Message{UserID: userID, SessionID: m.sessionID, Role: models.RoleUser, Content: m.content})
+		if err != nil {
+			t.Fatalf("add message: %v", err)
+		}
+		if retryMsg == nil {
+			retryMsg = stored
+		}
+	}
+
+	search := func(q string, extra string) (int, []models.SearchResult, bool) {
+		t.Helper()
+		resp := client.DoJSON(http.MethodGet, fmt.Sprintf("/api/users/%d/search?q=%s%s", userID, url.QueryEscape(q), extra), nil, nil)
+		var payload struct {
+			Results []models.SearchResult `json:"results"`
+			HasMore bool                  `json:"has_more"`
+		}
+		if resp.Code == http.StatusOK {
+			decodeJSON(t, resp.Body.Bytes(), &payload)
+		}
+		return resp.Code, payload.Results, payload.HasMore
+	}
+
+	code, results, _ := search("kafka retry policy", "")
+	if code != http.StatusOK || len(results) != 1 {
+		t.Fatalf("expected one hit, got %d %#v", code, results)
+	}
+	hit := results[0]
+	if hit.SessionID != kafka.ID || hit.MessageID != retryMsg.ID || hit.SessionTitle != "Kafka notes" {
+		t.Fatalf("unexpected hit: %#v", hit)
+	}
+	if !strings.Contains(hit.Snippet, "<mark>retry</mark>") || !strings.Contains(hit.Snippet, "&lt;b&gt;") {
+		t.Fatalf("snippet should be escaped and highlighted: %q", hit.Snippet)
+	}
+
+	// the title of the first session and both messages mention kafka
+	code, results, hasMore := search("kafka", "&limit=2")
+	if code != http.StatusOK || len(results) != 2 || !hasMore {
+		t.Fatalf("expected a full first page, got %d %#v", code, results)
+	}
+	code, rest, hasMore := search("kafka", "&limit=2&offset=2")
+	if code != http.StatusOK || len(rest) != 1 || hasMore {
+		t.Fatalf("expected the last hit on the second page, got %d %#v", code, rest)
+	}
+	var titleHits int
+	for _, r := range append(results, rest...) {
+		if r.MessageID == 0 {
+			titleHits++
+		}
+	}
+	if titleHits != 1 {
+		t.Fatalf("expected one title hit, got %d", titleHits)
+	}
+
+	// only the active branch is searched: an edited-away prompt no longer matches
+	edited, err := handler.assistant.EditUserMessage(ctx, userID, kafka.ID, retryMsg.ID, "Which backoff should the consumer use?")
+	if err != nil {
+		t.Fatalf("edit message: %v", err)
+	}
+	if _, results, _ := search("retry policy", ""); len(results) != 0 {
+		t.Fatalf("inactive branch should not be found: %#v", results)
+	}
+	if _, results, _ := search("backoff", ""); len(results) != 1 || results[0].MessageID != edited.ID {
+		t.Fatalf("expected the edited prompt, got %#v", results)
+	}
+	if _, err := handler.assistant.SelectBranch(ctx, userID, kafka.ID, retryMsg.ID); err != nil {
+		t.Fatalf("select branch: %v", err)
+	}
+	if _, results, _ := search("kafka retry policy", ""); len(results) != 1 || results[0].MessageID != retryMsg.ID {
+		t.Fatalf("expected the reselected prompt, got %#v", results)
+	}
+
+	if err := handler.assistant.DeleteSession(ctx, userID, other.ID); err != nil {
+		t.Fatalf("delete session: %v", err)
+	}
+	if _, results, _ := search("sushi", ""); len(results) != 0 {
+		t.Fatalf("deleted session should not be found: %#v", results)
+	}
+	if code, _, _ := search("  ", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for empty query, got %d", code)
+	}
+}
 
+func TestExportSession(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
 	userID, _ := registerAndLogin(t, client)
-	session, err := handler.assistant.CreateSession(context.Background(), userID, "Test Session")
+	ctx := context.Background()
+
+	session, err := handler.assistant.CreateSession(ctx, userID, "Retry <policy>")
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
-	msg, err := handler.assistant.AddMessage(context.Background(), models.Message{
-		UserID:    userID,
-		SessionID: session.ID,
-		Role:      models.RoleUser,
-		Content:   "Hello history",
-	})
+	prompt, err := handler.assistant.AddMessage(ctx, models.Message{UserID: userID, SessionID: session.ID, Role: models.RoleUser, Content: "How should <script> retries work?"})
+	if err != nil {
+		t.Fatalf("add prompt: %v", err)
+	}
+	reply, err := handler.assistant.AddMessage(ctx, models.Message{UserID: userID, SessionID: session.ID, Role: models.RoleAssistant, Content: "Back off exponentially.", Provider: "openai", Model: "gpt-4o"})
+	if err != nil {
+		t.Fatalf("add reply: %v", err)
+	}
+	fileID, err := handler.assistant.RecordTempFile(ctx, userID, session.ID, "notes.txt", filepath.Join(t.TempDir(), "notes.txt"), "text/plain", 42, time.Hour)
+	if err != nil {
+		t.Fatalf("record temp file: %v", err)
+	}
+	if err := handler.assistant.UpdateTempFileSummary(ctx, fileID, "Notes about retries", prompt.ID); err != nil {
+		t.Fatalf("update summary: %v", err)
+	}
+
+	exportURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/export", userID, session.ID)
+	resp := client.DoJSON(http.MethodGet, exportURL+"?format=json", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	if cd := resp.Header().Get("Content-Disposition"); !strings.Contains(cd, "attachment") || !strings.Contains(cd, "Retry-policy.json") {
+		t.Fatalf("unexpected content disposition %q", cd)
+	}
+	var doc archive.Document
+	decodeJSON(t, resp.Body.Bytes(), &doc)
+	if doc.Format != archive.FormatName || doc.Version != archive.FormatVersion || doc.Session.Title != "Retry <policy>" {
+		t.Fatalf("unexpected document header: %#v", doc)
+	}
+	if len(doc.Messages) != 2 || doc.Messages[1].ParentID != prompt.ID || doc.Messages[1].Model != "gpt-4o" || doc.Session.ActiveLeafID != reply.ID {
+		t.Fatalf("unexpected document messages: %#v", doc)
+	}
+	if len(doc.Files) != 1 || doc.Files[0].Summary != "Notes about retries" {
+		t.Fatalf("unexpected document files: %#v", doc.Files)
+	}
+
+	resp = client.DoJSON(http.MethodGet, exportURL+"?format=md", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	md := resp.Body.String()
+	for _, want := range []string{"# Retry <policy>", "## User", "## Assistant", "openai / gpt-4o", "Back off exponentially.", "### notes.txt", "Notes about retries"} {
+		if !strings.Contains(md, want) {
+			t.Fatalf("markdown export misses %q:\n%s", want, md)
+		}
+	}
+
+	resp = client.DoJSON(http.MethodGet, exportURL+"?format=html", nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	page := resp.Body.String()
+	if !strings.Contains(page, "&lt;script&gt;") || strings.Contains(page, "<script>") || !strings.Contains(page, "<style>") {
+		t.Fatalf("html export should be escaped and self-contained:\n%s", page)
+	}
+
+	assertStatus(t, client.DoJSON(http.MethodGet, exportURL+"?format=pdf", nil, nil), http.StatusBadRequest)
+	assertStatus(t, client.DoJSON(http.MethodGet, fmt.Sprintf("/api/users/%d/conversation/sessions/999/export", userID), nil, nil), http.StatusNotFound)
+}
+
+func TestImportConversations(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	ctx := context.Background()
+
+	// one ChatGPT conversation with an edited prompt (two branches) and a hidden system
+	// message, plus one that cannot be converted
+	chatGPT := `[
+		{"title": "Trip plan", "create_time": 1700000000, "update_time": 1700000300, "current_node": "a2",
+		 "mapping": {
+			"root": {"id": "root", "children": ["sys"]},
+			"sys": {"id": "sys", "parent": "root", "children": ["u1", "u2"],
+				"message": {"author": {"role": "system"}, "content": {"parts": ["You are ChatGPT"]}, "metadata": {"is_visually_hidden_from_conversation": true}}},
+			"u1": {"id": "u1", "parent": "sys", "children": ["a1"],
+				"message": {"author": {"role": "user"}, "create_time": 1700000010, "content": {"parts": ["Plan a trip to Rome"]}}},
+			"a1": {"id": "a1", "parent": "u1",
+				"message": {"author": {"role": "assistant"}, "create_time": 1700000020, "content": {"parts": ["Day 1: Colosseum"]}, "metadata": {"model_slug": "gpt-4o"}}},
+			"u2": {"id": "u2", "parent": "sys", "children": ["a2"],
+				"message": {"author": {"role": "user"}, "create_time": 1700000100, "content": {"parts": ["Plan a trip to Lisbon"]}}},
+			"a2": {"id": "a2", "parent": "u2",
+				"message": {"author": {"role": "assistant"}, "create_time": 1700000200, "content": {"parts": ["Day 1: Alfama"]}, "metadata": {"model_slug": "gpt-4o"}}}
+		 }},
+		{"title": "Broken", "mapping": "not a mapping"}
+	]`
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.Create("export/conversations.json")
+	if err != nil {
+		t.Fatalf("create zip entry: %v", err)
+	}
+	if _, err := w.Write([]byte(chatGPT)); err != nil {
+		t.Fatalf("write zip entry: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+
+	importURL := fmt.Sprintf("/api/users/%d/imports", userID)
+	resp := client.UploadForm(importURL, map[string]string{"source": "dropbox"}, "export.zip", zipped.Bytes())
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	resp = client.UploadForm(importURL, nil, "export.zip", zipped.Bytes())
+	assertStatus(t, resp, http.StatusAccepted)
+	job := waitForImport(t, client, importURL, resp)
+	if job.Total != 2 || job.Succeeded != 1 || job.Failed != 1 || len(job.Results) != 2 {
+		t.Fatalf("unexpected import job: %#v", job)
+	}
+	if job.Results[1].Title != "Broken" || job.Results[1].Error == "" || job.Results[1].SessionID != 0 {
+		t.Fatalf("expected the broken conversation to be reported: %#v", job.Results[1])
+	}
+
+	session, err := handler.assistant.GetSession(ctx, userID, job.Results[0].SessionID)
+	if err != nil {
+		t.Fatalf("get imported session: %v", err)
+	}
+	if session.Title != "Trip plan" || !session.CreatedAt.Equal(time.Unix(1700000000, 0)) || !session.UpdatedAt.Equal(time.Unix(1700000300, 0)) {
+		t.Fatalf("imported session lost its metadata: %#v", session)
+	}
+	messages, _, err := handler.assistant.ListMessages(ctx, userID, session.ID, assistant.PageRequest{})
+	if err != nil {
+		t.Fatalf("list imported messages: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Content != "Plan a trip to Lisbon" || messages[1].Content != "Day 1: Alfama" {
+		t.Fatalf("expected the current branch without the system prompt, got %#v", messages)
+	}
+	if !messages[1].CreatedAt.Equal(time.Unix(1700000200, 0)) || messages[1].Model != "gpt-4o" || session.ActiveLeafID != messages[1].ID {
+		t.Fatalf("imported reply lost its metadata: %#v", messages[1])
+	}
+
+	claude := `[{"name": "Haiku", "created_at": "2024-03-01T10:00:00Z", "updated_at": "2024-03-01T10:05:00Z", "chat_messages": [
+		{"sender": "human", "text": "Write a haiku", "created_at": "2024-03-01T10:00:00Z"},
+		{"sender": "assistant", "content": [{"type": "text", "text": "Autumn moonlight"}], "created_at": "2024-03-01T10:00:05Z"}
+	]}]`
+	resp = client.UploadForm(importURL, map[string]string{"source": "claude"}, "conversations.json", []byte(claude))
+	assertStatus(t, resp, http.StatusAccepted)
+	job = waitForImport(t, client, importURL, resp)
+	if job.Source != archive.SourceClaude || job.Succeeded != 1 || job.Failed != 0 {
+		t.Fatalf("unexpected claude import: %#v", job)
+	}
+	messages, _, err = handler.assistant.ListMessages(ctx, userID, job.Results[0].SessionID, assistant.PageRequest{})
+	if err != nil {
+		t.Fatalf("list imported messages: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Role != models.RoleUser || messages[1].Content != "Autumn moonlight" || messages[1].Provider != "claude" {
+		t.Fatalf("unexpected claude messages: %#v", messages)
+	}
+
+	resp = client.UploadForm(importURL, nil, "notes.json", []byte("{not json"))
+	assertStatus(t, resp, http.StatusAccepted)
+	job = waitForImport(t, client, importURL, resp)
+	if job.Status != models.ImportFailed || job.Error == "" {
+		t.Fatalf("expected an unreadable file to fail the job: %#v", job)
+	}
+
+	resp = client.DoJSON(http.MethodGet, fmt.Sprintf("%s/%d", importURL, job.ID+100), nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+// waitForImport polls the job created by resp until it finishes.
+func waitForImport(t *testing.T, client *apiTestClient, importURL string, resp *httptest.ResponseRecorder) models.ImportJob {
+	t.Helper()
+	var created struct {
+		Job models.ImportJob `json:"job"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &created)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := client.DoJSON(http.MethodGet, fmt.Sprintf("%s/%d", importURL, created.Job.ID), nil, nil)
+		assertStatus(t, resp, http.StatusOK)
+		var polled struct {
+			Job models.ImportJob `json:"job"`
+		}
+		decodeJSON(t, resp.Body.Bytes(), &polled)
+		if polled.Job.Status == models.ImportDone || polled.Job.Status == models.ImportFailed {
+			return polled.Job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("import job did not finish: %#v", polled.Job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, _ := registerAndLogin(t, client)
+	ctx := context.Background()
+
+	session, err := handler.assistant.CreateSession(ctx, userID, "Shared plan")
 	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	for _, msg := range []models.Message{
+		{Role: models.RoleUser, Content: "Outline the rollout"},
+		{Role: models.RoleSystem, Content: "Summary of secrets.txt (file_id=1):\ninternal only"},
+		{Role: models.RoleAssistant, Content: "Start with 5% of traffic.", Provider: "openai", Model: "gpt-4o"},
+	} {
+		msg.UserID, msg.SessionID = userID, session.ID
+		if _, err := handler.assistant.AddMessage(ctx, msg); err != nil {
+			t.Fatalf("add message: %v", err)
+		}
+	}
+
+	sharesURL := fmt.Sprintf("/api/users/%d/conversation/sessions/%d/shares", userID, session.ID)
+	resp := client.DoJSON(http.MethodPost, sharesURL, map[string]any{"expires_at": time.Now().Add(-time.Minute)}, nil)
+	assertStatus(t, resp, http.StatusBadRequest)
+	resp = client.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/conversation/sessions/%d/shares", userID, session.ID+100), nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+
+	var created struct {
+		Share models.ShareLink `json:"share"`
+	}
+	resp = client.DoJSON(http.MethodPost, sharesURL, nil, nil)
+	assertStatus(t, resp, http.StatusCreated)
+	decodeJSON(t, resp.Body.Bytes(), &created)
+	live := created.Share
+	resp = client.DoJSON(http.MethodPost, sharesURL, map[string]any{"snapshot": true, "expires_at": time.Now().Add(time.Hour)}, nil)
+	assertStatus(t, resp, http.StatusCreated)
+	decodeJSON(t, resp.Body.Bytes(), &created)
+	snapshot := created.Share
+	if len(live.Token) < 40 || live.Token == snapshot.Token || !snapshot.Snapshot || snapshot.ExpiresAt == nil {
+		t.Fatalf("unexpected share links: %#v %#v", live, snapshot)
+	}
+
+	// a new message shows up through the live link only
+	if _, err := handler.assistant.AddMessage(ctx, models.Message{UserID: userID, SessionID: session.ID, Role: models.RoleUser, Content: "And after that?"}); err != nil {
 		t.Fatalf("add message: %v", err)
 	}
+	anonymous := newAPITestClient(t, router)
+	fetch := func(token string) (*httptest.ResponseRecorder, models.SharedSession) {
+		resp := anonymous.DoJSON(http.MethodGet, "/api/share/"+token, nil, nil)
+		var body struct {
+			Session models.SharedSession `json:"session"`
+		}
+		if resp.Code == http.StatusOK {
+			decodeJSON(t, resp.Body.Bytes(), &body)
+		}
+		return resp, body.Session
+	}
+	resp, shared := fetch(live.Token)
+	assertStatus(t, resp, http.StatusOK)
+	if shared.Title != "Shared plan" || shared.Snapshot || len(shared.Messages) != 3 || shared.Messages[1].Model != "gpt-4o" {
+		t.Fatalf("unexpected live share: %#v", shared)
+	}
+	for _, leak := range []string{"user_id", "session_id", "internal only", "stored_path"} {
+		if strings.Contains(resp.Body.String(), leak) {
+			t.Fatalf("shared session leaks %q: %s", leak, resp.Body.String())
+		}
+	}
+	resp, shared = fetch(snapshot.Token)
+	assertStatus(t, resp, http.StatusOK)
+	if !shared.Snapshot || len(shared.Messages) != 2 || shared.Messages[1].Content != "Start with 5% of traffic." {
+		t.Fatalf("unexpected snapshot share: %#v", shared)
+	}
 
-	resp := client.DoJSON(http.MethodGet,
-		fmt.Sprintf("/api/users/%d/conversation/sessions/%d/messages", userID, session.ID),
-		nil,
-		nil,
+	var listed struct {
+		Shares []models.ShareLink `json:"shares"`
+	}
+	resp = client.DoJSON(http.MethodGet, sharesURL, nil, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decodeJSON(t, resp.Body.Bytes(), &listed)
+	if len(listed.Shares) != 2 || listed.Shares[0].ID != snapshot.ID || !listed.Shares[0].Snapshot || listed.Shares[1].Snapshot {
+		t.Fatalf("unexpected share list: %#v", listed.Shares)
+	}
+
+	resp = client.DoJSON(http.MethodDelete, fmt.Sprintf("%s/%d", sharesURL, live.ID), nil, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	resp, _ = fetch(live.Token)
+	assertStatus(t, resp, http.StatusNotFound)
+	resp = client.DoJSON(http.MethodDelete, fmt.Sprintf("%s/%d", sharesURL, live.ID), nil, nil)
+	assertStatus(t, resp, http.StatusNotFound)
+
+	if _, err := db.Exec(`UPDATE share_links SET expires_at = ? WHERE id = ?`, time.Now().Add(-time.Second).UTC(), snapshot.ID); err != nil {
+		t.Fatalf("expire share link: %v", err)
+	}
+	resp, _ = fetch(snapshot.Token)
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestChatCompletionsGateway(t *testing.T) {
+	router, db, handler := newTestServer(t)
+	defer db.Close()
+	client := newAPITestClient(t, router)
+	userID, authToken := registerAndLogin(t, client)
+	ctx := context.Background()
+
+	restoreProviders, restoreFactory := providerConfigs, completerFactory
+	defer func() { providerConfigs, completerFactory = restoreProviders, restoreFactory }()
+	providerConfigs = func() (map[string]config.ProviderConfig, error) {
+		return map[string]config.ProviderConfig{
+			"openai": {Model: "gpt-4o-mini"},
+			"claude": {Model: "claude-haiku-4-5"},
+		}, nil
+	}
+	mock := &mockCompleter{reply: []string{"Hel", "lo!"}}
+	completerFactory = func(provider, model, token string) (completer, error) {
+		mock.provider, mock.model, mock.token = provider, model, token
+		return mock, nil
+	}
+
+	// API clients send only the bearer token, no cookies or CSRF header
+	apiClient := newAPITestClient(t, router)
+	bearer := map[string]string{"Authorization": "Bearer " + authToken}
+	resp := apiClient.DoJSON(http.MethodGet, "/v1/models", nil, nil)
+	assertStatus(t, resp, http.StatusUnauthorized)
+	resp = apiClient.DoJSON(http.MethodGet, "/v1/models", nil, bearer)
+	assertStatus(t, resp, http.StatusOK)
+	var modelList struct {
+		Data []struct {
+			ID      string `json:"id"`
+			OwnedBy string `json:"owned_by"`
+		} `json:"data"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &modelList)
+	if len(modelList.Data) != 2 || modelList.Data[0].ID != "claude-haiku-4-5" || modelList.Data[1].OwnedBy != "openai" {
+		t.Fatalf("unexpected model list: %#v", modelList)
+	}
+
+	body := map[string]any{
+		"model":       "gpt-4o",
+		"temperature": 0.2,
+		"messages": []map[string]any{
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": []map[string]string{{"type": "text", "text": "Say hello"}}},
+		},
+	}
+	resp = apiClient.DoJSON(http.MethodPost, "/v1/chat/completions", body, bearer)
+	assertStatus(t, resp, http.StatusBadRequest)
+	if !strings.Contains(resp.Body.String(), "api token not configured") {
+		t.Fatalf("expected missing key error, got %s", resp.Body.String())
+	}
+	resp = client.DoJSON(http.MethodPost, fmt.Sprintf("/api/users/%d/token", userID), map[string]string{"provider": "openai", "token": "sk-test"}, nil)
+	assertStatus(t, resp, http.StatusNoContent)
+
+	resp = apiClient.DoJSON(http.MethodPost, "/v1/chat/completions", body, bearer)
+	assertStatus(t, resp, http.StatusOK)
+	var completion struct {
+		Object  string `json:"object"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	decodeJSON(t, resp.Body.Bytes(), &completion)
+	if completion.Object != "chat.completion" || completion.Model != "gpt-4o" || len(completion.Choices) != 1 ||
+		completion.Choices[0].Message.Content != "Hello!" || completion.Choices[0].FinishReason != "stop" || completion.Usage.TotalTokens != 12 {
+		t.Fatalf("unexpected completion: %#v", completion)
+	}
+	if mock.provider != "openai" || mock.token != "sk-test" || len(mock.messages) != 2 || mock.messages[1].Content != "Say hello" || *mock.opts.Temperature != 0.2 {
+		t.Fatalf("unexpected upstream call: %#v", mock)
+	}
+
+	body["model"] = "llama-3"
+	resp = apiClient.DoJSON(http.MethodPost, "/v1/chat/completions", body, bearer)
+	assertStatus(t, resp, http.StatusNotFound)
+
+	body["model"] = "openai/gpt-4.1"
+	body["stream"] = true
+	body["stream_options"] = map[string]bool{"include_usage": true}
+	headers := map[string]string{"Authorization": "Bearer " + authToken, recordSessionHeader: "new"}
+	resp = apiClient.DoJSON(http.MethodPost, "/v1/chat/completions", body, headers)
+	assertStatus(t, resp, http.StatusOK)
+	if resp.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", resp.Header().Get("Content-Type"))
+	}
+	var (
+		deltas  []string
+		usage   bool
+		done    bool
+		finish  string
+		payload = strings.TrimSpace(resp.Body.String())
 	)
+	for _, line := range strings.Split(payload, "\n\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk struct {
+			Object  string `json:"object"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *struct {
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}
+		decodeJSON(t, []byte(data), &chunk)
+		if chunk.Object != "chat.completion.chunk" {
+			t.Fatalf("unexpected chunk: %s", data)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.CompletionTokens == 5
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				deltas = append(deltas, choice.Delta.Content)
+			}
+			if choice.FinishReason != nil {
+				finish = *choice.FinishReason
+			}
+		}
+	}
+	if strings.Join(deltas, "|") != "Hel|lo!" || finish != "stop" || !usage || !done || mock.model != "gpt-4.1" {
+		t.Fatalf("unexpected stream:\n%s", payload)
+	}
+
+	sessionID, err := strconv.ParseInt(resp.Header().Get(recordSessionHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("expected the recorded session id, got %q", resp.Header().Get(recordSessionHeader))
+	}
+	session, messages, err := handler.assistant.GetSessionWithMessages(ctx, userID, sessionID)
+	if err != nil {
+		t.Fatalf("load recorded session: %v", err)
+	}
+	if session.Title != "Say hello" || len(messages) != 2 || messages[0].Content != "Say hello" ||
+		messages[1].Content != "Hello!" || messages[1].Provider != "openai" || messages[1].Model != "gpt-4.1" {
+		t.Fatalf("unexpected recorded exchange: %#v %#v", session, messages)
+	}
+
+	// a failed call drops the session it created
+	mock.err = errors.New("upstream unavailable")
+	resp = apiClient.DoJSON(http.MethodPost, "/v1/chat/completions", body, headers)
+	assertStatus(t, resp, http.StatusBadGateway)
+	failedID, _ := strconv.ParseInt(resp.Header().Get(recordSessionHeader), 10, 64)
+	if _, err := handler.assistant.GetSession(ctx, userID, failedID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected the unused session to be removed, got %v", err)
+	}
+
+	// a stream breaking off still records the tokens generated so far
+	mock.err, mock.midErr = nil, errors.New("client went away")
+	delete(headers, recordSessionHeader)
+	if _, err := db.Exec(`DELETE FROM usage_records WHERE user_id = ?`, userID); err != nil {
+		t.Fatalf("clear usage: %v", err)
+	}
+	resp = apiClient.DoJSON(http.MethodPost, "/v1/chat/completions", body, headers)
 	assertStatus(t, resp, http.StatusOK)
-	var payload struct {
-		Session  models.Session   `json:"session"`
-		Messages []models.Message `json:"messages"`
+	var completionTokens, count int
+	if err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(completion_tokens), 0) FROM usage_records WHERE user_id = ?`, userID).Scan(&count, &completionTokens); err != nil {
+		t.Fatalf("load usage: %v", err)
 	}
-	decodeJSON(t, resp.Body.Bytes(), &payload)
-	if payload.Session.ID != session.ID {
-		t.Fatalf("expected session %d, got %d", session.ID, payload.Session.ID)
+	if count != 1 || completionTokens == 0 {
+		t.Fatalf("expected the partial stream billed, got %d records of %d tokens", count, completionTokens)
 	}
-	if len(payload.Messages) != 1 || payload.Messages[0].ID != msg.ID {
-		t.Fatalf("expected single message in history")
+}
+
+type mockCompleter struct {
+	reply    []string
+	err      error
+	midErr   error // returned with the partial reply once it was streamed
+	provider string
+	model    string
+	token    string
+	messages []*models.Message
+	opts     ai.CompletionOptions
+}
+
+func (m *mockCompleter) Complete(ctx context.Context, messages []*models.Message, opts ai.CompletionOptions) (*ai.Completion, error) {
+	return m.Stream(ctx, messages, opts, func(string) error { return nil })
+}
+
+func (m *mockCompleter) Stream(_ context.Context, messages []*models.Message, opts ai.CompletionOptions, onDelta func(string) error) (*ai.Completion, error) {
+	m.messages, m.opts = messages, opts
+	if m.err != nil {
+		return nil, m.err
+	}
+	completion := &ai.Completion{PromptTokens: 7, CompletionTokens: 5}
+	for _, part := range m.reply {
+		if err := onDelta(part); err != nil {
+			return nil, err
+		}
+		completion.Content += part
+	}
+	if m.midErr != nil {
+		// usage arrives with the last chunk, so a broken stream has none
+		return &ai.Completion{Content: completion.Content}, m.midErr
 	}
+	return completion, nil
+}
+
+func boolPtr(v bool) *bool {
+	return &v
 }
 
 func TestFilesUploadSuccess(t *testing.T) {
@@ -536,6 +2625,7 @@ func TestFilesUploadRejectsInvalidInput(t *testing.T) {
 }
 
 type sseEvent struct {
+	ID   string
 	Name string
 	Data string
 }
@@ -556,6 +2646,8 @@ func parseSSE(t *testing.T, payload string) []sseEvent {
 		var evt sseEvent
 		for _, line := range lines {
 			switch {
+			case strings.HasPrefix(line, "id:"):
+				evt.ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
 			case strings.HasPrefix(line, "event:"):
 				evt.Name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
 			case strings.HasPrefix(line, "data:"):
@@ -594,7 +2686,7 @@ func newTestServer(t *testing.T) (*gin.Engine, *sql.DB, *Handler) {
 		t.Fatalf("assistant service: %v", err)
 	}
 	authSvc := auth.NewService(db, nil, time.Hour)
-	handler := NewHandler(asst, authSvc, worker.DispatcherConfig{MinWorkers: 2, MaxWorkers: 2, QueueSize: 10}, t.TempDir(), assistant.DefaultTempFileTTL, nil)
+	handler := NewHandler(asst, authSvc, worker.DispatcherConfig{MinWorkers: 2, MaxWorkers: 2, QueueSize: 10}, t.TempDir(), assistant.DefaultTempFileTTL, assistant.DefaultIdempotencyRetention, nil)
 	handler.workers = newMockWorker(asst)
 
 	router := gin.New()
@@ -658,10 +2750,17 @@ type mockWorker struct {
 	assistant *assistant.Service
 	streamErr error
 	initErr   error
+	cancelled map[int64]bool
+	// events replaces the single "mock-chunk" delta when set
+	events []models.StreamEvent
+	// invalidatedSettings lists the sessions whose settings changed
+	invalidatedSettings []int64
+	// invalidatedProviders lists the user providers that changed
+	invalidatedProviders []string
 }
 
 func newMockWorker(asst *assistant.Service) *mockWorker {
-	return &mockWorker{assistant: asst}
+	return &mockWorker{assistant: asst, cancelled: make(map[int64]bool)}
 }
 
 func (m *mockWorker) InitSession(req worker.SessionRequest) (*models.Session, error) {
@@ -685,24 +2784,74 @@ func (m *mockWorker) Stream(req worker.StreamRequest) (*models.Message, string,
 		m.streamErr = nil
 		return nil, "", err
 	}
-	if req.ChunkFn != nil {
-		if err := req.ChunkFn("mock-chunk"); err != nil {
-			return nil, "", err
+	events := m.events
+	if events == nil {
+		events = []models.StreamEvent{{Type: models.StreamDelta, Text: "mock-chunk"}}
+	}
+	var (
+		reasoning strings.Builder
+		usage     models.TokenUsage
+	)
+	for _, event := range events {
+		switch event.Type {
+		case models.StreamReasoning:
+			reasoning.WriteString(event.Text)
+		case models.StreamUsage:
+			usage = *event.Usage
+		}
+		if req.EventFn != nil {
+			if err := req.EventFn(event); err != nil {
+				return nil, "", err
+			}
 		}
 	}
+	if m.cancelled[req.SessionID] {
+		delete(m.cancelled, req.SessionID)
+		partial := &models.Message{
+			UserID:           req.UserID,
+			SessionID:        req.SessionID,
+			Role:             models.RoleAssistant,
+			Content:          "Mock partial",
+			PromptTokens:     9,
+			CompletionTokens: 2,
+			TTFTMs:           5,
+			FinishReason:     "cancelled",
+		}
+		return partial, "", worker.ErrStreamCancelled
+	}
 	resp := &models.Message{
 		UserID:    req.UserID,
 		SessionID: req.SessionID,
 		Role:      models.RoleAssistant,
 		Content:   fmt.Sprintf("Mock response to %q", req.Message.Content),
+		Reasoning: reasoning.String(),
+
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TTFTMs:           5,
+		LatencyMs:        20,
+		FinishReason:     "stop",
 	}
 	return resp, "Mock Title", nil
 }
 
+func (m *mockWorker) Cancel(userID, sessionID int64, clientMsgID string) int {
+	m.cancelled[sessionID] = true
+	return 1
+}
+
 func (m *mockWorker) ResetUser(int64)                  {}
 func (m *mockWorker) Purge(int64, int64)               {}
 func (m *mockWorker) InvalidateTempFiles(int64, int64) {}
 
+func (m *mockWorker) InvalidateSettings(userID, sessionID int64) {
+	m.invalidatedSettings = append(m.invalidatedSettings, sessionID)
+}
+
+func (m *mockWorker) InvalidateProvider(userID int64, provider string) {
+	m.invalidatedProviders = append(m.invalidatedProviders, provider)
+}
+
 type apiTestClient struct {
 	t       *testing.T
 	router  *gin.Engine
@@ -735,11 +2884,17 @@ func (c *apiTestClient) PostSSE(path string, body interface{}, headers map[strin
 }
 
 func (c *apiTestClient) UploadFile(path string, sessionID int64, filename string, content []byte) *httptest.ResponseRecorder {
+	return c.UploadForm(path, map[string]string{"session_id": strconv.FormatInt(sessionID, 10)}, filename, content)
+}
+
+func (c *apiTestClient) UploadForm(path string, fields map[string]string, filename string, content []byte) *httptest.ResponseRecorder {
 	c.t.Helper()
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
-	if err := writer.WriteField("session_id", strconv.FormatInt(sessionID, 10)); err != nil {
-		c.t.Fatalf("write session field: %v", err)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			c.t.Fatalf("write %s field: %v", name, err)
+		}
 	}
 	part, err := writer.CreateFormFile("file", filename)
 	if err != nil {
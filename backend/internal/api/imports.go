@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/archive"
+	"unichatgo/internal/models"
+)
+
+const (
+	maxImportBytes = 512 << 20 // 512 MB, full ChatGPT exports get large
+	// importFlushEvery and importFlushInterval bound how stale the progress seen by a poller is.
+	importFlushEvery    = 50
+	importFlushInterval = 5 * time.Second
+)
+
+// startImport accepts a ChatGPT, Claude or unichatgo export (JSON or zip) and imports its
+// conversations in the background. Poll getImportJob for progress.
+func (h *Handler) startImport(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	file, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	source := strings.ToLower(strings.TrimSpace(c.DefaultPostForm("source", archive.SourceAuto)))
+	if !archive.ValidSource(source) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source must be auto, chatgpt, claude or unichatgo"})
+		return
+	}
+
+	job, err := h.assistant.CreateImportJob(c.Request.Context(), userID, source)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// the job exists from here on, so a failure must end it rather than leave it pending
+	fail := func(message string) {
+		job.Status = models.ImportFailed
+		job.Error = message
+		if err := h.assistant.SaveImportJob(context.Background(), job); err != nil {
+			log.Printf("import job %d: %v", job.ID, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+	destDir := filepath.Join(h.fileBase, "imports")
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		fail("create directory failed")
+		return
+	}
+	destPath := filepath.Join(destDir, strconv.FormatInt(job.ID, 10))
+	if err := c.SaveUploadedFile(file, destPath); err != nil {
+		os.Remove(destPath)
+		fail("save file failed")
+		return
+	}
+	go h.runImport(job, destPath)
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+// getImportJob reports the progress of an import and the outcome of every conversation so far.
+func (h *Handler) getImportJob(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	jobID, err := strconv.ParseInt(c.Param("job_id"), 10, 64)
+	if err != nil || jobID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid job id"})
+		return
+	}
+	job, err := h.assistant.GetImportJob(c.Request.Context(), userID, jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "import job not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// runImport imports every conversation of the saved file, one session each. A
+// conversation that fails is recorded and skipped; the rest still get imported.
+func (h *Handler) runImport(job *models.ImportJob, path string) {
+	ctx := context.Background()
+	defer os.Remove(path)
+	save := func() {
+		if err := h.assistant.SaveImportJob(ctx, job); err != nil {
+			log.Printf("import job %d: %v", job.ID, err)
+		}
+	}
+
+	fail := func(err error) {
+		job.Status = models.ImportFailed
+		job.Error = err.Error()
+		save()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fail(err)
+		return
+	}
+	// a first pass counts the conversations so that progress has a total; the second
+	// converts and stores them one at a time
+	total, err := archive.Count(f, info.Size())
+	if err != nil {
+		fail(err)
+		return
+	}
+	job.Status = models.ImportRunning
+	job.Total = total
+	save()
+
+	lastFlush := time.Now()
+	err = archive.Parse(f, info.Size(), job.Source, func(conv archive.Conversation) error {
+		result := models.ImportResult{Index: job.Processed, Title: conv.Title}
+		err := conv.Err
+		if err == nil {
+			var session *models.Session
+			if session, err = h.assistant.ImportSession(ctx, job.UserID, conv.Document); err == nil {
+				result.SessionID = session.ID
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+			job.Failed++
+		} else {
+			job.Succeeded++
+		}
+		job.Processed++
+		job.Results = append(job.Results, result)
+		if job.Processed%importFlushEvery == 0 || time.Since(lastFlush) > importFlushInterval {
+			save()
+			lastFlush = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+	job.Status = models.ImportDone
+	save()
+}
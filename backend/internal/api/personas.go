@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+type personaRequest struct {
+	Name         string `json:"name"`
+	SystemPrompt string `json:"system_prompt"`
+	Provider     string `json:"provider"`
+	Model        string `json:"model"`
+	// Tools: omitted or null enables every tool, [] disables them all
+	Tools  []string `json:"tools"`
+	Shared bool     `json:"shared"`
+}
+
+func (r personaRequest) persona(id int64) models.Persona {
+	return models.Persona{
+		ID:           id,
+		Name:         r.Name,
+		SystemPrompt: r.SystemPrompt,
+		Provider:     r.Provider,
+		Model:        r.Model,
+		Tools:        r.Tools,
+		Shared:       r.Shared,
+	}
+}
+
+// listPersonas returns the user's personas and the ones other users share.
+func (h *Handler) listPersonas(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	personas, err := h.assistant.ListPersonas(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"personas": personas})
+}
+
+func (h *Handler) createPersona(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req personaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	persona, err := h.assistant.CreatePersona(c.Request.Context(), userID, req.persona(0))
+	if err != nil {
+		respondPersonaError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"persona": persona})
+}
+
+func (h *Handler) getPersona(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	personaID, ok := personaIDParam(c)
+	if !ok {
+		return
+	}
+	persona, err := h.assistant.GetPersona(c.Request.Context(), userID, personaID)
+	if err != nil {
+		respondPersonaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"persona": persona})
+}
+
+// updatePersona replaces a persona's fields. Sessions already started from it keep the
+// settings they were created with.
+func (h *Handler) updatePersona(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	personaID, ok := personaIDParam(c)
+	if !ok {
+		return
+	}
+	var req personaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	persona, err := h.assistant.UpdatePersona(c.Request.Context(), userID, req.persona(personaID))
+	if err != nil {
+		respondPersonaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"persona": persona})
+}
+
+func (h *Handler) deletePersona(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	personaID, ok := personaIDParam(c)
+	if !ok {
+		return
+	}
+	if err := h.assistant.DeletePersona(c.Request.Context(), userID, personaID); err != nil {
+		respondPersonaError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// uploadPersonaFile adds a starter file to a persona. Uploads follow the limits of
+// session attachments.
+func (h *Handler) uploadPersonaFile(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	personaID, ok := personaIDParam(c)
+	if !ok {
+		return
+	}
+	if err := c.Request.ParseMultipartForm(maxUploadBytes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if file.Size > maxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+		return
+	}
+	usage, err := h.assistant.StorageUsage(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "calculate usage failed"})
+		return
+	}
+	if usage+file.Size > userStorageLimit {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "storage quota exceeded"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "open file failed"})
+		return
+	}
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	_ = f.Close()
+	contentType := http.DetectContentType(buf[:n])
+	if !isAllowedContentType(contentType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported file type"})
+		return
+	}
+	destDir := filepath.Join(h.personaFileDir(userID), strconv.FormatInt(personaID, 10))
+	destPath, finalName := uniquePath(destDir, filepath.Base(file.Filename))
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "create directory failed"})
+		return
+	}
+	if err := c.SaveUploadedFile(file, destPath); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "save file failed"})
+		return
+	}
+	stored, err := h.assistant.AddPersonaFile(c.Request.Context(), userID, personaID, finalName, destPath, contentType, file.Size)
+	if err != nil {
+		_ = os.Remove(destPath)
+		respondPersonaError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"file": stored})
+}
+
+func (h *Handler) deletePersonaFile(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	personaID, ok := personaIDParam(c)
+	if !ok {
+		return
+	}
+	fileID, err := strconv.ParseInt(c.Param("file_id"), 10, 64)
+	if err != nil || fileID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+	if err := h.assistant.DeletePersonaFile(c.Request.Context(), userID, personaID, fileID); err != nil {
+		respondPersonaError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// applyPersona gives a session started from a persona the persona's system prompt and
+// tools, and copies its starter files into the session.
+func (h *Handler) applyPersona(ctx context.Context, userID, sessionID int64, persona *models.Persona) error {
+	if persona.SystemPrompt != "" || persona.Tools != nil {
+		if _, err := h.assistant.UpdateSessionSettings(ctx, userID, models.SessionSettings{
+			SessionID:    sessionID,
+			SystemPrompt: persona.SystemPrompt,
+			Tools:        persona.Tools,
+		}); err != nil {
+			return fmt.Errorf("apply persona settings: %w", err)
+		}
+		h.workers.InvalidateSettings(userID, sessionID)
+	}
+	if len(persona.Files) == 0 {
+		return nil
+	}
+	for _, starter := range persona.Files {
+		destDir, destPath, finalName := h.getUniqueFilePath(userID, sessionID, starter.FileName)
+		if err := os.MkdirAll(destDir, 0o755); err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+		if err := copyFile(starter.StoredPath, destPath); err != nil {
+			_ = os.Remove(destPath)
+			return fmt.Errorf("copy starter file %s: %w", starter.FileName, err)
+		}
+		if _, err := h.assistant.RecordTempFile(ctx, userID, sessionID, finalName, destPath, starter.MimeType, starter.Size, h.fileTTL); err != nil {
+			_ = os.Remove(destPath)
+			return err
+		}
+	}
+	h.workers.InvalidateTempFiles(userID, sessionID)
+	return nil
+}
+
+// starterFilesFit rejects a persona whose starter files would exceed the user's
+// storage quota.
+func (h *Handler) starterFilesFit(c *gin.Context, userID int64, persona *models.Persona) bool {
+	if len(persona.Files) == 0 {
+		return true
+	}
+	var size int64
+	for _, f := range persona.Files {
+		size += f.Size
+	}
+	usage, err := h.assistant.StorageUsage(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "calculate usage failed"})
+		return false
+	}
+	if usage+size > userStorageLimit {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "storage quota exceeded"})
+		return false
+	}
+	return true
+}
+
+// personaFileDir is where the starter files of the user's personas are stored.
+func (h *Handler) personaFileDir(userID int64) string {
+	return filepath.Join(h.fileBase, strconv.FormatInt(userID, 10), "personas")
+}
+
+func personaIDParam(c *gin.Context) (int64, bool) {
+	personaID, err := strconv.ParseInt(c.Param("persona_id"), 10, 64)
+	if err != nil || personaID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid persona id"})
+		return 0, false
+	}
+	return personaID, true
+}
+
+func respondPersonaError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, assistant.ErrInvalidPersona):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, assistant.ErrPersonaReadOnly):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, assistant.ErrPersonaFileLimit):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a persona holds at most %d starter files", assistant.MaxPersonaFiles)})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "persona not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
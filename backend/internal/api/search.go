@@ -0,0 +1,49 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+// searchConversations finds messages and session titles of the user matching q, best match first.
+func (h *Handler) searchConversations(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var query struct {
+		Q      string `form:"q"`
+		Limit  int    `form:"limit"`
+		Offset int    `form:"offset"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid query parameters"})
+		return
+	}
+	results, hasMore, err := h.assistant.Search(c.Request.Context(), userID, assistant.SearchRequest{
+		Query:  query.Q,
+		Limit:  query.Limit,
+		Offset: query.Offset,
+	})
+	if err != nil {
+		if errors.Is(err, assistant.ErrEmptyQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if results == nil {
+		results = make([]models.SearchResult, 0)
+	}
+	payload := gin.H{"results": results, "has_more": hasMore}
+	if hasMore {
+		payload["next_offset"] = max(query.Offset, 0) + len(results)
+	}
+	c.JSON(http.StatusOK, payload)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/archive"
+	"unichatgo/internal/service/assistant"
+)
+
+// maxBulkDelete caps how many sessions one bulk delete request may remove.
+const maxBulkDelete = 100
+
+type updateSessionRequest struct {
+	Title    *string `json:"title"`
+	Pinned   *bool   `json:"pinned"`
+	Archived *bool   `json:"archived"`
+}
+
+// updateSession renames, pins or archives a session. Only the fields present in the body change.
+func (h *Handler) updateSession(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	var req updateSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	session, err := h.assistant.UpdateSession(c.Request.Context(), userID, sessionID, assistant.SessionUpdate{
+		Title:    req.Title,
+		Pinned:   req.Pinned,
+		Archived: req.Archived,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// the worker caches the session; reload it so a locked title is respected
+	h.workers.Purge(userID, sessionID)
+	c.JSON(http.StatusOK, gin.H{"session": session})
+}
+
+// deleteSessions removes several sessions at once and reports which ids were deleted.
+func (h *Handler) deleteSessions(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		SessionIDs []int64 `json:"session_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	if len(req.SessionIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session_ids is required"})
+		return
+	}
+	if len(req.SessionIDs) > maxBulkDelete {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many session ids"})
+		return
+	}
+	for _, id := range req.SessionIDs {
+		if id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+			return
+		}
+	}
+	deleted, err := h.assistant.DeleteSessions(c.Request.Context(), userID, req.SessionIDs)
+	for _, id := range deleted {
+		h.workers.Purge(userID, id)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "deleted": deleted})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// exportSession streams the session as a download in the requested format (md, json or html).
+func (h *Handler) exportSession(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	format := strings.ToLower(c.DefaultQuery("format", archive.FormatMarkdown))
+	contentType := archive.ContentType(format)
+	if contentType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be md, json or html"})
+		return
+	}
+	ctx := c.Request.Context()
+	session, err := h.assistant.GetSession(ctx, userID, sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	messages, err := h.assistant.ListSessionTree(ctx, userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	files, err := h.assistant.ListSessionTempFiles(ctx, userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("%s.%s", exportFileName(session.Title, sessionID), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+	if err := archive.Write(c.Writer, format, archive.NewDocument(session, messages, files)); err != nil {
+		// headers are already sent; the client sees a truncated download
+		log.Printf("export session %d failed: %v", sessionID, err)
+	}
+}
+
+// exportFileName turns a session title into a safe file name.
+func exportFileName(title string, sessionID int64) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return '-'
+		default:
+			return -1
+		}
+	}, strings.TrimSpace(title))
+	if runes := []rune(name); len(runes) > 80 {
+		name = string(runes[:80])
+	}
+	if name == "" {
+		name = fmt.Sprintf("session-%d", sessionID)
+	}
+	return name
+}
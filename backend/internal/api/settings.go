@@ -0,0 +1,114 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+type sessionSettingsRequest struct {
+	SystemPrompt string   `json:"system_prompt"`
+	Temperature  *float32 `json:"temperature"`
+	TopP         *float32 `json:"top_p"`
+	MaxTokens    *int     `json:"max_tokens"`
+	Stop         []string `json:"stop"`
+	// Tools: omitted or null enables every tool, [] disables them all
+	Tools []string `json:"tools"`
+	// Fallbacks: omitted or null uses the user's chain, [] disables failover
+	Fallbacks []models.ProviderModel `json:"fallbacks"`
+}
+
+// getSessionSettings returns the session's generation settings; a session without
+// saved settings reports the provider defaults.
+func (h *Handler) getSessionSettings(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	settings, err := h.assistant.GetSessionSettings(c.Request.Context(), userID, sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
+
+// updateSessionSettings replaces the session's generation settings. The worker rebuilds
+// the session's model with them on the next message.
+func (h *Handler) updateSessionSettings(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	var req sessionSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	settings, err := h.assistant.UpdateSessionSettings(c.Request.Context(), userID, models.SessionSettings{
+		SessionID:    sessionID,
+		SystemPrompt: req.SystemPrompt,
+		Temperature:  req.Temperature,
+		TopP:         req.TopP,
+		MaxTokens:    req.MaxTokens,
+		Stop:         req.Stop,
+		Tools:        req.Tools,
+		Fallbacks:    req.Fallbacks,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, assistant.ErrInvalidSettings):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	h.workers.InvalidateSettings(userID, sessionID)
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
+
+// deleteSessionSettings restores the provider defaults of a session.
+func (h *Handler) deleteSessionSettings(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	if err := h.assistant.DeleteSessionSettings(c.Request.Context(), userID, sessionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.workers.InvalidateSettings(userID, sessionID)
+	c.Status(http.StatusNoContent)
+}
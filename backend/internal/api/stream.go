@@ -0,0 +1,378 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/redis"
+)
+
+const (
+	sseBufferTTL       = 10 * time.Minute
+	sseResumeTimeout   = 2 * time.Minute
+	sseEventsKeyPrefix = "sse:events:"
+	sseSeqKeyPrefix    = "sse:seq:"
+	sseLiveChanPrefix  = "sse:live:"
+)
+
+// streamEvent is one buffered server-sent event of a (session, client_msg_id) stream.
+type streamEvent struct {
+	ID    int64           `json:"id"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func isTerminalEvent(name string) bool {
+	switch name {
+	case "done", "error", "cancelled":
+		return true
+	default:
+		return false
+	}
+}
+
+// sseHub buffers stream events so dropped clients can resume with Last-Event-ID.
+// Events live in redis when available so any instance can replay them; otherwise
+// they are kept in process memory.
+type sseHub struct {
+	client *redis.Client
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	logs map[string]*sseLog
+}
+
+type sseLog struct {
+	events  []streamEvent
+	nextID  int64
+	subs    map[chan streamEvent]struct{}
+	expires time.Time
+}
+
+func newSSEHub(client *redis.Client, ttl time.Duration) *sseHub {
+	if ttl <= 0 {
+		ttl = sseBufferTTL
+	}
+	if client != nil && client.Raw() == nil {
+		client = nil
+	}
+	return &sseHub{client: client, ttl: ttl, logs: make(map[string]*sseLog)}
+}
+
+// append assigns the next event id for the stream, buffers the event and notifies live followers.
+func (h *sseHub) append(ctx context.Context, key, event string, data []byte) (streamEvent, error) {
+	if h.client != nil {
+		return h.appendRedis(ctx, key, event, data)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneLocked(time.Now())
+	lg, ok := h.logs[key]
+	if !ok {
+		lg = &sseLog{subs: make(map[chan streamEvent]struct{})}
+		h.logs[key] = lg
+	}
+	lg.nextID++
+	evt := streamEvent{ID: lg.nextID, Event: event, Data: data}
+	lg.events = append(lg.events, evt)
+	lg.expires = time.Now().Add(h.ttl)
+	for ch := range lg.subs {
+		select {
+		case ch <- evt:
+		default:
+			// slow follower, it will notice the gap and stop
+			delete(lg.subs, ch)
+			close(ch)
+		}
+	}
+	return evt, nil
+}
+
+func (h *sseHub) appendRedis(ctx context.Context, key, event string, data []byte) (streamEvent, error) {
+	raw := h.client.Raw()
+	id, err := raw.Incr(ctx, sseSeqKeyPrefix+key).Result()
+	if err != nil {
+		return streamEvent{}, fmt.Errorf("sse sequence: %w", err)
+	}
+	evt := streamEvent{ID: id, Event: event, Data: data}
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return streamEvent{}, err
+	}
+	pipe := raw.TxPipeline()
+	pipe.Expire(ctx, sseSeqKeyPrefix+key, h.ttl)
+	pipe.RPush(ctx, sseEventsKeyPrefix+key, payload)
+	pipe.Expire(ctx, sseEventsKeyPrefix+key, h.ttl)
+	pipe.Publish(ctx, sseLiveChanPrefix+key, payload)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return streamEvent{}, fmt.Errorf("sse buffer: %w", err)
+	}
+	return evt, nil
+}
+
+// exists reports whether a buffered stream is still available for the key.
+func (h *sseHub) exists(ctx context.Context, key string) bool {
+	if h.client != nil {
+		n, err := h.client.Raw().Exists(ctx, sseEventsKeyPrefix+key).Result()
+		if err != nil {
+			log.Printf("sse buffer lookup failed: %v", err)
+			return false
+		}
+		return n > 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneLocked(time.Now())
+	_, ok := h.logs[key]
+	return ok
+}
+
+// replay returns buffered events with an id greater than after.
+func (h *sseHub) replay(ctx context.Context, key string, after int64) ([]streamEvent, error) {
+	if h.client != nil {
+		items, err := h.client.Raw().LRange(ctx, sseEventsKeyPrefix+key, 0, -1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("sse replay: %w", err)
+		}
+		events := make([]streamEvent, 0, len(items))
+		for _, item := range items {
+			var evt streamEvent
+			if err := json.Unmarshal([]byte(item), &evt); err != nil {
+				return nil, fmt.Errorf("sse decode: %w", err)
+			}
+			if evt.ID > after {
+				events = append(events, evt)
+			}
+		}
+		return events, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lg, ok := h.logs[key]
+	if !ok {
+		return nil, nil
+	}
+	var events []streamEvent
+	for _, evt := range lg.events {
+		if evt.ID > after {
+			events = append(events, evt)
+		}
+	}
+	return events, nil
+}
+
+// subscribe registers a live follower; the returned cancel func must be called.
+func (h *sseHub) subscribe(ctx context.Context, key string) (<-chan streamEvent, func()) {
+	if h.client != nil {
+		pubsub := h.client.Raw().Subscribe(ctx, sseLiveChanPrefix+key)
+		// wait for the subscription to be confirmed so replay cannot miss events
+		if _, err := pubsub.Receive(ctx); err != nil {
+			log.Printf("sse live subscribe failed: %v", err)
+		}
+		out := make(chan streamEvent, 64)
+		// the forwarder stops with the follower even when it stopped reading
+		fwdCtx, stop := context.WithCancel(ctx)
+		go func() {
+			defer close(out)
+			for msg := range pubsub.Channel() {
+				var evt streamEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &evt); err != nil {
+					log.Printf("sse live decode failed: %v", err)
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-fwdCtx.Done():
+					return
+				}
+			}
+		}()
+		return out, func() {
+			stop()
+			_ = pubsub.Close()
+		}
+	}
+	ch := make(chan streamEvent, 64)
+	h.mu.Lock()
+	lg, ok := h.logs[key]
+	if !ok {
+		lg = &sseLog{subs: make(map[chan streamEvent]struct{}), expires: time.Now().Add(h.ttl)}
+		h.logs[key] = lg
+	}
+	lg.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		if _, ok := lg.subs[ch]; ok {
+			delete(lg.subs, ch)
+			close(ch)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// follow replays events after the given id and then tails the live stream
+// until a terminal event arrives or ctx ends.
+func (h *sseHub) follow(ctx context.Context, key string, after int64, fn func(streamEvent) error) error {
+	live, cancel := h.subscribe(ctx, key)
+	defer cancel()
+
+	backlog, err := h.replay(ctx, key, after)
+	if err != nil {
+		return err
+	}
+	last := after
+	for _, evt := range backlog {
+		if evt.ID <= last {
+			continue
+		}
+		if err := fn(evt); err != nil {
+			return err
+		}
+		last = evt.ID
+		if isTerminalEvent(evt.Event) {
+			return nil
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case evt, ok := <-live:
+			if !ok {
+				return fmt.Errorf("sse stream %s interrupted", key)
+			}
+			if evt.ID <= last {
+				continue
+			}
+			if err := fn(evt); err != nil {
+				return err
+			}
+			last = evt.ID
+			if isTerminalEvent(evt.Event) {
+				return nil
+			}
+		}
+	}
+}
+
+func (h *sseHub) pruneLocked(now time.Time) {
+	for key, lg := range h.logs {
+		if len(lg.subs) == 0 && !lg.expires.IsZero() && now.After(lg.expires) {
+			delete(h.logs, key)
+		}
+	}
+}
+
+// streamKey scopes buffered streams by user so a session id alone cannot be used
+// to read somebody else's reply.
+func streamKey(userID, sessionID int64, clientID string) string {
+	return fmt.Sprintf("%d:%d:%s", userID, sessionID, clientID)
+}
+
+// lastEventID reads the resume position from the Last-Event-ID header, falling
+// back to the last_event_id query parameter for clients that cannot set headers.
+func lastEventID(c *gin.Context) (int64, bool) {
+	raw := strings.TrimSpace(c.GetHeader("Last-Event-ID"))
+	if raw == "" {
+		raw = strings.TrimSpace(c.Query("last_event_id"))
+	}
+	if raw == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// openStream prepares the SSE response and returns an emitter that buffers each
+// event before writing it. Once the client disconnects, events are still buffered
+// so a reconnecting client can pick them up.
+func (h *Handler) openStream(c *gin.Context, key string) (func(string, interface{}) error, bool) {
+	write, ok := prepareSSE(c)
+	if !ok {
+		return nil, false
+	}
+	var detached bool
+	emit := func(event string, payload interface{}) error {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		evt, bufErr := h.streams.append(context.Background(), key, event, data)
+		if bufErr != nil {
+			log.Printf("buffer sse event failed: %v", bufErr)
+			evt = streamEvent{Event: event, Data: data}
+		}
+		if detached {
+			return bufErr
+		}
+		if err := write(evt); err != nil {
+			detached = true
+			if bufErr != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return emit, true
+}
+
+// resumeStream replays a buffered stream to a reconnecting client. It returns
+// false when nothing is buffered for the key.
+func (h *Handler) resumeStream(c *gin.Context, key string) bool {
+	ctx := c.Request.Context()
+	if !h.streams.exists(ctx, key) {
+		return false
+	}
+	after, _ := lastEventID(c)
+	write, ok := prepareSSE(c)
+	if !ok {
+		return true
+	}
+	followCtx, cancel := context.WithTimeout(ctx, sseResumeTimeout)
+	defer cancel()
+	if err := h.streams.follow(followCtx, key, after, write); err != nil && ctx.Err() == nil {
+		_ = write(streamEvent{Event: "error", Data: mustMarshal(gin.H{"message": err.Error()})})
+	}
+	return true
+}
+
+func (h *Handler) resumeSessionStream(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	clientID := strings.TrimSpace(c.Query("client_msg_id"))
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client_msg_id is required"})
+		return
+	}
+	if !h.resumeStream(c, streamKey(userID, sessionID, clientID)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stream not found"})
+	}
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage(`{}`)
+	}
+	return data
+}
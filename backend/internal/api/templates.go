@@ -0,0 +1,190 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+// maxTemplateImportBytes bounds the body of a prompt library import.
+const maxTemplateImportBytes = 8 << 20
+
+type promptTemplateRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Content     string   `json:"content"`
+	Tags        []string `json:"tags"`
+}
+
+func (r promptTemplateRequest) template(id int64) models.PromptTemplate {
+	return models.PromptTemplate{
+		ID:          id,
+		Name:        r.Name,
+		Description: r.Description,
+		Content:     r.Content,
+		Tags:        r.Tags,
+	}
+}
+
+// listPromptTemplates returns the user's prompt library, filtered by ?tag=.
+func (h *Handler) listPromptTemplates(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	templates, err := h.assistant.ListPromptTemplates(c.Request.Context(), userID, c.Query("tag"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+func (h *Handler) createPromptTemplate(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req promptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	tmpl, err := h.assistant.CreatePromptTemplate(c.Request.Context(), userID, req.template(0))
+	if err != nil {
+		respondTemplateError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"template": tmpl})
+}
+
+func (h *Handler) getPromptTemplate(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	templateID, ok := templateIDParam(c)
+	if !ok {
+		return
+	}
+	tmpl, err := h.assistant.GetPromptTemplate(c.Request.Context(), userID, templateID)
+	if err != nil {
+		respondTemplateError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"template": tmpl})
+}
+
+func (h *Handler) updatePromptTemplate(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	templateID, ok := templateIDParam(c)
+	if !ok {
+		return
+	}
+	var req promptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	tmpl, err := h.assistant.UpdatePromptTemplate(c.Request.Context(), userID, req.template(templateID))
+	if err != nil {
+		respondTemplateError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"template": tmpl})
+}
+
+func (h *Handler) deletePromptTemplate(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	templateID, ok := templateIDParam(c)
+	if !ok {
+		return
+	}
+	if err := h.assistant.DeletePromptTemplate(c.Request.Context(), userID, templateID); err != nil {
+		respondTemplateError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// exportPromptTemplates downloads the user's templates, filtered by ?tag=, as a prompt
+// library document that importPromptTemplates accepts.
+func (h *Handler) exportPromptTemplates(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	lib, err := h.assistant.ExportPromptTemplates(c.Request.Context(), userID, c.Query("tag"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	filename := fmt.Sprintf("prompt-templates-%s.json", lib.ExportedAt.Format(time.DateOnly))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.JSON(http.StatusOK, lib)
+}
+
+// importPromptTemplates adds the templates of a prompt library document. Templates
+// named like an existing one are skipped unless ?overwrite=true.
+func (h *Handler) importPromptTemplates(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	overwrite, err := strconv.ParseBool(c.DefaultQuery("overwrite", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "overwrite must be a boolean"})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTemplateImportBytes)
+	var lib models.PromptLibrary
+	if err := c.ShouldBindJSON(&lib); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid prompt library document"})
+		return
+	}
+	result, err := h.assistant.ImportPromptTemplates(c.Request.Context(), userID, lib, overwrite)
+	if err != nil {
+		respondTemplateError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func templateIDParam(c *gin.Context) (int64, bool) {
+	templateID, err := strconv.ParseInt(c.Param("template_id"), 10, 64)
+	if err != nil || templateID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid template id"})
+		return 0, false
+	}
+	return templateID, true
+}
+
+func respondTemplateError(c *gin.Context, err error) {
+	var missing *assistant.MissingVariablesError
+	switch {
+	case errors.As(err, &missing):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "missing_variables": missing.Names})
+	case errors.Is(err, assistant.ErrInvalidTemplate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, assistant.ErrTemplateNameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
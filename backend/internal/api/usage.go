@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+// errCodeBudgetExhausted is the machine-readable code of a request rejected by the budget.
+const errCodeBudgetExhausted = "budget_exhausted"
+
+type usageQuery struct {
+	Period string `form:"period"`
+	From   string `form:"from"`
+	To     string `form:"to"`
+}
+
+// getUsage aggregates the user's usage ledger per day (default: the last 30 days) or
+// per month (default: the last 12 months). from and to are inclusive dates.
+func (h *Handler) getUsage(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var query usageQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid query parameters"})
+		return
+	}
+	if query.Period == "" {
+		query.Period = assistant.UsagePeriodDaily
+	}
+	if query.Period != assistant.UsagePeriodDaily && query.Period != assistant.UsagePeriodMonthly {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be daily or monthly"})
+		return
+	}
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from, to := today.AddDate(0, 0, -29), today
+	if query.Period == assistant.UsagePeriodMonthly {
+		from = time.Date(now.Year(), now.Month()-11, 1, 0, 0, 0, 0, time.UTC)
+	}
+	var err error
+	if query.From != "" {
+		if from, err = time.Parse(time.DateOnly, query.From); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date (YYYY-MM-DD)"})
+			return
+		}
+	}
+	if query.To != "" {
+		if to, err = time.Parse(time.DateOnly, query.To); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date (YYYY-MM-DD)"})
+			return
+		}
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return
+	}
+	ctx := c.Request.Context()
+	buckets, err := h.assistant.UsageSummary(ctx, userID, query.Period, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	budget, err := h.assistant.BudgetStatus(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	total := models.UsageBucket{}
+	for _, b := range buckets {
+		total.Requests += b.Requests
+		total.PromptTokens += b.PromptTokens
+		total.CompletionTokens += b.CompletionTokens
+		total.Cost += b.Cost
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"period": query.Period,
+		"from":   from.Format(time.DateOnly),
+		"to":     to.Format(time.DateOnly),
+		"usage":  buckets,
+		"total": gin.H{
+			"requests":          total.Requests,
+			"prompt_tokens":     total.PromptTokens,
+			"completion_tokens": total.CompletionTokens,
+			"cost":              total.Cost,
+		},
+		"budget": budget,
+	})
+}
+
+// setBudget sets the user's monthly budget; null restores the configured default.
+func (h *Handler) setBudget(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		MonthlyBudget *float64 `json:"monthly_budget"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	ctx := c.Request.Context()
+	if err := h.assistant.SetMonthlyBudget(ctx, userID, req.MonthlyBudget); err != nil {
+		switch {
+		case errors.Is(err, assistant.ErrInvalidBudget):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	budget, err := h.assistant.BudgetStatus(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"budget": budget})
+}
+
+// checkBudget rejects a generation once the user's monthly budget is spent, completing
+// the claimed idempotency entry. It returns the budget before the generation.
+func (h *Handler) checkBudget(c *gin.Context, cacheKey string, entry *idempotencyEntry, userID int64) (*models.BudgetStatus, bool) {
+	budget, err := h.assistant.BudgetStatus(c.Request.Context(), userID)
+	if err == nil && budget.Exhausted {
+		err = assistant.ErrBudgetExhausted
+	}
+	if err != nil {
+		h.completeIdempotencyEntry(cacheKey, entry, nil, nil, "", err)
+		if errors.Is(err, assistant.ErrBudgetExhausted) {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error(), "code": errCodeBudgetExhausted, "budget": budget})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return budget, true
+}
+
+// recordUsage adds a generation to the usage ledger, also when the provider reported
+// no tokens so that the call is still counted.
+func (h *Handler) recordUsage(ctx context.Context, userID, sessionID int64, provider, model string, promptTokens, completionTokens int) {
+	if _, err := h.assistant.RecordUsage(ctx, models.UsageRecord{
+		UserID:           userID,
+		SessionID:        sessionID,
+		Provider:         provider,
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+	}); err != nil {
+		log.Printf("record usage of user %d: %v", userID, err)
+	}
+}
+
+// recordReplyUsage records a streamed reply and sends a budget_warning event when it
+// takes the user's spending past the soft limit.
+func (h *Handler) recordReplyUsage(ctx context.Context, job replyJob, reply *models.Message, sendEvent func(string, interface{}) error) {
+	if reply == nil {
+		return
+	}
+	h.recordUsage(ctx, job.userID, job.sessionID, reply.Provider, reply.Model, reply.PromptTokens, reply.CompletionTokens)
+	if job.budget == nil || job.budget.MonthlyBudget == 0 || job.budget.Warning {
+		return
+	}
+	budget, err := h.assistant.BudgetStatus(ctx, job.userID)
+	if err != nil {
+		log.Printf("load budget of user %d: %v", job.userID, err)
+		return
+	}
+	if budget.Warning {
+		_ = sendEvent("budget_warning", gin.H{"budget": budget})
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/assistant"
+)
+
+type userProviderRequest struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	BaseURL    string `json:"base_url"`
+	APIVersion string `json:"api_version"`
+	Model      string `json:"model"`
+	// ContextWindow in tokens; 0 leaves the history untrimmed
+	ContextWindow int `json:"context_window"`
+	// Headers: omitted or null keeps the stored headers, {} removes them
+	Headers map[string]string `json:"headers"`
+	// APIKey: omitted or null keeps the stored key, "" removes it
+	APIKey *string `json:"api_key"`
+}
+
+// listUserProviders returns the provider endpoints the user registered, without keys
+// or header values.
+func (h *Handler) listUserProviders(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	providers, err := h.assistant.ListUserProviders(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// saveUserProvider creates or replaces the user's provider of the given name. Sessions
+// using it pick up the change with their next message.
+func (h *Handler) saveUserProvider(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	var req userProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	provider, err := h.assistant.SaveUserProvider(c.Request.Context(), userID, models.UserProvider{
+		Name:          req.Name,
+		Type:          req.Type,
+		BaseURL:       req.BaseURL,
+		APIVersion:    req.APIVersion,
+		Model:         req.Model,
+		ContextWindow: req.ContextWindow,
+		Headers:       req.Headers,
+	}, req.APIKey)
+	if err != nil {
+		respondUserProviderError(c, err)
+		return
+	}
+	h.workers.InvalidateProvider(userID, provider.Name)
+	c.JSON(http.StatusOK, gin.H{"provider": provider})
+}
+
+func (h *Handler) deleteUserProvider(c *gin.Context) {
+	userID, ok := h.authorizedUserID(c)
+	if !ok {
+		return
+	}
+	name := c.Param("name")
+	if err := h.assistant.DeleteUserProvider(c.Request.Context(), userID, name); err != nil {
+		respondUserProviderError(c, err)
+		return
+	}
+	h.workers.InvalidateProvider(userID, name)
+	c.Status(http.StatusNoContent)
+}
+
+func respondUserProviderError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, assistant.ErrInvalidUserProvider):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, assistant.ErrBaseURLNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "provider not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
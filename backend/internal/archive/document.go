@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"slices"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+const (
+	// FormatName identifies a session document in the JSON export.
+	FormatName = "unichatgo.session"
+	// FormatVersion is bumped whenever a field changes meaning or is removed; adding
+	// optional fields keeps the version.
+	FormatVersion = 1
+)
+
+// Document is the versioned JSON form of one session. Messages hold the whole tree
+// (parent_id links every message to the one it answers or follows) so branches
+// survive a round-trip; active_leaf_id names the branch that was shown.
+type Document struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Session    Session   `json:"session"`
+	Messages   []Message `json:"messages"`
+	Files      []File    `json:"files,omitempty"`
+}
+
+// Session carries the session fields worth keeping outside the database.
+type Session struct {
+	ID           int64     `json:"id"`
+	Title        string    `json:"title"`
+	Pinned       bool      `json:"pinned,omitempty"`
+	Archived     bool      `json:"archived,omitempty"`
+	ActiveLeafID int64     `json:"active_leaf_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Message is one node of the conversation tree. Provider and model are set on replies.
+type Message struct {
+	ID        int64       `json:"id"`
+	ParentID  int64       `json:"parent_id,omitempty"`
+	Role      models.Role `json:"role"`
+	Content   string      `json:"content"`
+	Status    string      `json:"status,omitempty"`
+	Provider  string      `json:"provider,omitempty"`
+	Model     string      `json:"model,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// File is an uploaded document of the session and the summary generated for it.
+type File struct {
+	ID               int64     `json:"id"`
+	Name             string    `json:"name"`
+	MimeType         string    `json:"mime_type"`
+	Size             int64     `json:"size"`
+	Summary          string    `json:"summary,omitempty"`
+	SummaryMessageID int64     `json:"summary_message_id,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// NewDocument builds the export document of a session from its stored records.
+func NewDocument(session *models.Session, messages []*models.Message, files []*models.TempFile) *Document {
+	doc := &Document{
+		Format:     FormatName,
+		Version:    FormatVersion,
+		ExportedAt: time.Now().UTC(),
+		Session: Session{
+			ID:           session.ID,
+			Title:        session.Title,
+			Pinned:       session.Pinned,
+			Archived:     session.Archived,
+			ActiveLeafID: session.ActiveLeafID,
+			CreatedAt:    session.CreatedAt,
+			UpdatedAt:    session.UpdatedAt,
+		},
+		Messages: make([]Message, 0, len(messages)),
+	}
+	for _, m := range messages {
+		if m == nil {
+			continue
+		}
+		doc.Messages = append(doc.Messages, Message{
+			ID:        m.ID,
+			ParentID:  m.ParentID,
+			Role:      m.Role,
+			Content:   m.Content,
+			Status:    m.Status,
+			Provider:  m.Provider,
+			Model:     m.Model,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		doc.Files = append(doc.Files, File{
+			ID:               f.ID,
+			Name:             f.FileName,
+			MimeType:         f.MimeType,
+			Size:             f.Size,
+			Summary:          f.Summary,
+			SummaryMessageID: f.SummaryMessageID,
+			CreatedAt:        f.CreatedAt,
+		})
+	}
+	return doc
+}
+
+// ActivePath returns the messages from the root to the active leaf, the conversation as
+// it was shown. Without a leaf (or with an unknown one) every message is returned.
+func (d *Document) ActivePath() []Message {
+	byID := make(map[int64]Message, len(d.Messages))
+	for _, m := range d.Messages {
+		byID[m.ID] = m
+	}
+	leaf, ok := byID[d.Session.ActiveLeafID]
+	if !ok {
+		return d.Messages
+	}
+	var path []Message
+	for m, seen := leaf, make(map[int64]bool); ; {
+		if seen[m.ID] {
+			break
+		}
+		seen[m.ID] = true
+		path = append(path, m)
+		parent, ok := byID[m.ParentID]
+		if !ok {
+			break
+		}
+		m = parent
+	}
+	slices.Reverse(path)
+	return path
+}
@@ -0,0 +1,462 @@
+package archive
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+// Import sources accepted by Parse.
+const (
+	SourceAuto      = "auto"
+	SourceChatGPT   = "chatgpt"
+	SourceClaude    = "claude"
+	SourceUnichatGo = "unichatgo"
+)
+
+// ValidSource reports whether source can be passed to Parse.
+func ValidSource(source string) bool {
+	switch source {
+	case SourceAuto, SourceChatGPT, SourceClaude, SourceUnichatGo:
+		return true
+	default:
+		return false
+	}
+}
+
+// Conversation is one conversation found in an import file. Document is nil when the
+// conversation could not be converted, Err says why.
+type Conversation struct {
+	Title    string
+	Document *Document
+	Err      error
+}
+
+const defaultImportTitle = "Imported conversation"
+
+// Parse reads an export of another chat tool (or of this one) and converts its
+// conversations one at a time, passing each to fn, so that a large export is never held
+// in memory at once. data is either a JSON file or a zip archive holding
+// conversations.json, as the ChatGPT and Claude exports do. The error is set when the
+// file is unreadable or fn fails; per-conversation problems end up in Conversation.Err.
+func Parse(data io.ReaderAt, size int64, source string, fn func(Conversation) error) error {
+	if !ValidSource(source) {
+		return fmt.Errorf("unsupported import source %q", source)
+	}
+	return eachConversation(data, size, func(raw json.RawMessage) error {
+		return fn(convert(raw, source))
+	})
+}
+
+// Count returns the number of conversations in an export without converting them, so
+// that the progress of Parse can be reported against a total.
+func Count(data io.ReaderAt, size int64) (int, error) {
+	n := 0
+	err := eachConversation(data, size, func(json.RawMessage) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// eachConversation opens the JSON of an export, inside a zip archive or not, and passes
+// the raw conversations in it to fn.
+func eachConversation(data io.ReaderAt, size int64, fn func(json.RawMessage) error) error {
+	var magic [4]byte
+	if _, err := data.ReadAt(magic[:], 0); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read import file: %w", err)
+	}
+	var r io.Reader = io.NewSectionReader(data, 0, size)
+	if bytes.Equal(magic[:], []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(data, size)
+		if err != nil {
+			return fmt.Errorf("open zip: %w", err)
+		}
+		file := findConversationsFile(zr)
+		if file == nil {
+			return errors.New("zip archive has no conversations.json")
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("open %s: %w", file.Name, err)
+		}
+		defer rc.Close()
+		r = rc
+	}
+	return parseJSON(r, fn)
+}
+
+// findConversationsFile returns the conversations.json closest to the archive root.
+func findConversationsFile(zr *zip.Reader) *zip.File {
+	var found *zip.File
+	for _, f := range zr.File {
+		if path.Base(f.Name) != "conversations.json" {
+			continue
+		}
+		if found == nil || strings.Count(f.Name, "/") < strings.Count(found.Name, "/") {
+			found = f
+		}
+	}
+	return found
+}
+
+// parseJSON decodes a single conversation object or an array of them. Arrays are
+// streamed one conversation at a time, and each element is passed to fn on its own so
+// that a malformed conversation does not fail the others.
+func parseJSON(r io.Reader, fn func(json.RawMessage) error) error {
+	br := bufio.NewReader(r)
+	if !startsWithArray(br) {
+		var raw json.RawMessage
+		if err := json.NewDecoder(br).Decode(&raw); err != nil {
+			return fmt.Errorf("decode import file: %w", err)
+		}
+		return fn(raw)
+	}
+	dec := json.NewDecoder(br)
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("decode import file: %w", err)
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("decode import file: %w", err)
+		}
+		if err := fn(raw); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("decode import file: %w", err)
+	}
+	return nil
+}
+
+// startsWithArray skips the leading whitespace of br and reports whether a JSON array
+// follows.
+func startsWithArray(br *bufio.Reader) bool {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		_ = br.UnreadByte()
+		return b == '['
+	}
+}
+
+func convert(raw json.RawMessage, source string) Conversation {
+	if source == SourceAuto {
+		source = detectSource(raw)
+	}
+	var (
+		doc *Document
+		err error
+	)
+	switch source {
+	case SourceChatGPT:
+		doc, err = convertChatGPT(raw)
+	case SourceClaude:
+		doc, err = convertClaude(raw)
+	case SourceUnichatGo:
+		doc, err = convertUnichatGo(raw)
+	default:
+		err = errors.New("unrecognized conversation format")
+	}
+	if err != nil {
+		var probe struct {
+			Title string `json:"title"`
+			Name  string `json:"name"`
+		}
+		_ = json.Unmarshal(raw, &probe)
+		return Conversation{Title: firstNonEmpty(probe.Title, probe.Name), Err: err}
+	}
+	return Conversation{Title: doc.Session.Title, Document: doc}
+}
+
+func detectSource(raw json.RawMessage) string {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return ""
+	}
+	switch {
+	case probe["mapping"] != nil:
+		return SourceChatGPT
+	case probe["chat_messages"] != nil:
+		return SourceClaude
+	case probe["format"] != nil:
+		return SourceUnichatGo
+	default:
+		return ""
+	}
+}
+
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	UpdateTime  float64                `json:"update_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	ID       string          `json:"id"`
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+	Message  *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		Parts []json.RawMessage `json:"parts"`
+		Text  string            `json:"text"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// convertChatGPT keeps the main branch of a ChatGPT conversation: the path from the
+// root to current_node, or to the newest leaf when current_node is missing.
+func convertChatGPT(raw json.RawMessage) (*Document, error) {
+	var conv chatGPTConversation
+	if err := json.Unmarshal(raw, &conv); err != nil {
+		return nil, fmt.Errorf("decode chatgpt conversation: %w", err)
+	}
+	if len(conv.Mapping) == 0 {
+		return nil, errors.New("conversation has no messages")
+	}
+	leaf := conv.CurrentNode
+	if _, ok := conv.Mapping[leaf]; !ok {
+		leaf = newestLeaf(conv.Mapping)
+	}
+	var branch []chatGPTNode
+	for id, seen := leaf, make(map[string]bool); id != "" && !seen[id]; {
+		seen[id] = true
+		node, ok := conv.Mapping[id]
+		if !ok {
+			break
+		}
+		branch = append(branch, node)
+		id = node.Parent
+	}
+
+	created := epochTime(conv.CreateTime)
+	var messages []Message
+	for i := len(branch) - 1; i >= 0; i-- {
+		msg := branch[i].Message
+		if msg == nil || msg.Metadata.Hidden {
+			continue
+		}
+		var role models.Role
+		switch msg.Author.Role {
+		case "user":
+			role = models.RoleUser
+		case "assistant":
+			role = models.RoleAssistant
+		default:
+			// system prompts and tool calls are not part of the visible conversation
+			continue
+		}
+		content := chatGPTText(msg)
+		if content == "" {
+			continue
+		}
+		m := Message{Role: role, Content: content, CreatedAt: epochTime(msg.CreateTime)}
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = created
+		}
+		if role == models.RoleAssistant {
+			m.Provider = "openai"
+			m.Model = msg.Metadata.ModelSlug
+		}
+		messages = append(messages, m)
+	}
+	return linearDocument(conv.Title, created, epochTime(conv.UpdateTime), messages)
+}
+
+func chatGPTText(msg *chatGPTMessage) string {
+	var parts []string
+	for _, raw := range msg.Content.Parts {
+		var text string
+		// non-text parts (images, attachments) are objects and are skipped
+		if err := json.Unmarshal(raw, &text); err == nil && strings.TrimSpace(text) != "" {
+			parts = append(parts, text)
+		}
+	}
+	if len(parts) == 0 && strings.TrimSpace(msg.Content.Text) != "" {
+		parts = append(parts, msg.Content.Text)
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
+
+// newestLeaf picks the childless node with the latest message.
+func newestLeaf(mapping map[string]chatGPTNode) string {
+	ids := make([]string, 0, len(mapping))
+	for id := range mapping {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var (
+		best     string
+		bestTime = math.Inf(-1)
+	)
+	for _, id := range ids {
+		node := mapping[id]
+		if len(node.Children) > 0 {
+			continue
+		}
+		var ts float64
+		if node.Message != nil {
+			ts = node.Message.CreateTime
+		}
+		if ts > bestTime {
+			best, bestTime = id, ts
+		}
+	}
+	return best
+}
+
+func epochTime(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+type claudeConversation struct {
+	Name         string          `json:"name"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	ChatMessages []claudeMessage `json:"chat_messages"`
+}
+
+type claudeMessage struct {
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	Content   []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+}
+
+// convertClaude maps an Anthropic export conversation; its messages are already linear.
+func convertClaude(raw json.RawMessage) (*Document, error) {
+	var conv claudeConversation
+	if err := json.Unmarshal(raw, &conv); err != nil {
+		return nil, fmt.Errorf("decode claude conversation: %w", err)
+	}
+	var messages []Message
+	for _, msg := range conv.ChatMessages {
+		var role models.Role
+		switch msg.Sender {
+		case "human":
+			role = models.RoleUser
+		case "assistant":
+			role = models.RoleAssistant
+		default:
+			continue
+		}
+		var parts []string
+		for _, block := range msg.Content {
+			if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
+				parts = append(parts, block.Text)
+			}
+		}
+		content := strings.TrimSpace(strings.Join(parts, "\n"))
+		if content == "" {
+			content = strings.TrimSpace(msg.Text)
+		}
+		if content == "" {
+			continue
+		}
+		m := Message{Role: role, Content: content, CreatedAt: msg.CreatedAt.UTC()}
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = conv.CreatedAt.UTC()
+		}
+		if role == models.RoleAssistant {
+			m.Provider = "claude"
+		}
+		messages = append(messages, m)
+	}
+	return linearDocument(conv.Name, conv.CreatedAt.UTC(), conv.UpdatedAt.UTC(), messages)
+}
+
+func convertUnichatGo(raw json.RawMessage) (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("decode session document: %w", err)
+	}
+	if doc.Format != FormatName {
+		return nil, fmt.Errorf("unexpected document format %q", doc.Format)
+	}
+	if doc.Version < 1 || doc.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported document version %d", doc.Version)
+	}
+	if len(doc.Messages) == 0 {
+		return nil, errors.New("conversation has no messages")
+	}
+	if strings.TrimSpace(doc.Session.Title) == "" {
+		doc.Session.Title = defaultImportTitle
+	}
+	return &doc, nil
+}
+
+// linearDocument chains messages one after another; ids are local to the document.
+func linearDocument(title string, created, updated time.Time, messages []Message) (*Document, error) {
+	if len(messages) == 0 {
+		return nil, errors.New("conversation has no messages")
+	}
+	for i := range messages {
+		messages[i].ID = int64(i + 1)
+		messages[i].ParentID = int64(i)
+		messages[i].Status = models.MessageStatusComplete
+	}
+	if created.IsZero() {
+		created = messages[0].CreatedAt
+	}
+	if updated.IsZero() {
+		updated = messages[len(messages)-1].CreatedAt
+	}
+	return &Document{
+		Format:  FormatName,
+		Version: FormatVersion,
+		Session: Session{
+			Title:        firstNonEmpty(strings.TrimSpace(title), defaultImportTitle),
+			ActiveLeafID: int64(len(messages)),
+			CreatedAt:    created,
+			UpdatedAt:    updated,
+		},
+		Messages: messages,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
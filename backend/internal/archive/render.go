@@ -0,0 +1,172 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+// Export formats accepted by Write.
+const (
+	FormatMarkdown = "md"
+	FormatJSON     = "json"
+	FormatHTML     = "html"
+)
+
+// ContentType returns the MIME type of an export format, or "" when it is not supported.
+func ContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	default:
+		return ""
+	}
+}
+
+// Write renders doc to w in the given format. JSON keeps the whole message tree;
+// Markdown and HTML show the active branch, as the conversation was read.
+func Write(w io.Writer, format string, doc *Document) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	case FormatMarkdown:
+		return writeMarkdown(w, doc)
+	case FormatHTML:
+		return htmlTemplate.Execute(w, newHTMLView(doc))
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+const timeLayout = "2006-01-02 15:04 MST"
+
+func roleLabel(role models.Role) string {
+	switch role {
+	case models.RoleUser:
+		return "User"
+	case models.RoleAssistant:
+		return "Assistant"
+	case models.RoleSystem:
+		return "System"
+	default:
+		return string(role)
+	}
+}
+
+// messageMeta describes the model and state of a message, e.g. "openai / gpt-4o, cancelled".
+func messageMeta(m Message) string {
+	var parts []string
+	if model := strings.Trim(m.Provider+" / "+m.Model, " /"); model != "" {
+		parts = append(parts, model)
+	}
+	if m.Status != "" && m.Status != models.MessageStatusComplete {
+		parts = append(parts, m.Status)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func writeMarkdown(w io.Writer, doc *Document) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n\n", doc.Session.Title)
+	fmt.Fprintf(bw, "_Created %s · exported %s_\n", doc.Session.CreatedAt.UTC().Format(timeLayout), doc.ExportedAt.UTC().Format(timeLayout))
+	for _, m := range doc.ActivePath() {
+		fmt.Fprintf(bw, "\n## %s · %s", roleLabel(m.Role), m.CreatedAt.UTC().Format(timeLayout))
+		if meta := messageMeta(m); meta != "" {
+			fmt.Fprintf(bw, " · %s", meta)
+		}
+		fmt.Fprintf(bw, "\n\n%s\n", strings.TrimRight(m.Content, "\n"))
+	}
+	if len(doc.Files) > 0 {
+		bw.WriteString("\n## Attached files\n")
+		for _, f := range doc.Files {
+			fmt.Fprintf(bw, "\n### %s\n\n_%s, %d bytes_\n", f.Name, f.MimeType, f.Size)
+			if f.Summary != "" {
+				fmt.Fprintf(bw, "\n%s\n", strings.TrimRight(f.Summary, "\n"))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+type htmlMessage struct {
+	Role    string
+	Class   string
+	Time    string
+	Meta    string
+	Content string
+}
+
+type htmlView struct {
+	Title      string
+	Created    string
+	ExportedAt string
+	Messages   []htmlMessage
+	Files      []File
+}
+
+func newHTMLView(doc *Document) htmlView {
+	view := htmlView{
+		Title:      doc.Session.Title,
+		Created:    doc.Session.CreatedAt.UTC().Format(timeLayout),
+		ExportedAt: doc.ExportedAt.UTC().Format(time.RFC3339),
+		Files:      doc.Files,
+	}
+	for _, m := range doc.ActivePath() {
+		view.Messages = append(view.Messages, htmlMessage{
+			Role:    roleLabel(m.Role),
+			Class:   string(m.Role),
+			Time:    m.CreatedAt.UTC().Format(timeLayout),
+			Meta:    messageMeta(m),
+			Content: m.Content,
+		})
+	}
+	return view
+}
+
+// htmlTemplate renders a single page with inline styles and no external resources.
+var htmlTemplate = template.Must(template.New("session").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 860px; margin: 2rem auto; padding: 0 1rem; color: #1f2328; }
+header { border-bottom: 1px solid #d0d7de; margin-bottom: 1.5rem; }
+.meta { color: #656d76; font-size: .85rem; }
+.message { border: 1px solid #d0d7de; border-radius: 8px; padding: .75rem 1rem; margin: 1rem 0; }
+.message.user { background: #f6f8fa; }
+.message.system { background: #fff8c5; }
+.message h2 { font-size: .95rem; margin: 0 0 .5rem; }
+.content, .summary { white-space: pre-wrap; word-wrap: break-word; line-height: 1.5; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p class="meta">Created {{.Created}} · exported {{.ExportedAt}}</p>
+</header>
+{{range .Messages}}<section class="message {{.Class}}">
+<h2>{{.Role}} <span class="meta">{{.Time}}{{if .Meta}} · {{.Meta}}{{end}}</span></h2>
+<div class="content">{{.Content}}</div>
+</section>
+{{end}}{{if .Files}}<h2>Attached files</h2>
+{{range .Files}}<section class="message">
+<h2>{{.Name}} <span class="meta">{{.MimeType}}, {{.Size}} bytes</span></h2>
+{{if .Summary}}<div class="summary">{{.Summary}}</div>{{end}}
+</section>
+{{end}}{{end}}</body>
+</html>
+`))
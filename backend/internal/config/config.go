@@ -13,6 +13,12 @@ type Config struct {
 	Providers   map[string]ProviderConfig `json:"providers"`
 	Databases   map[string]DatabaseConfig `json:"databases"`
 	Redis       RedisConfig               `json:"redis"`
+	Usage       UsageConfig               `json:"usage"`
+	// UserProviders controls the provider endpoints users register themselves.
+	UserProviders UserProvidersConfig `json:"user_providers"`
+	// Resilience tunes retries and circuit breaking of provider calls.
+	Resilience ResilienceConfig `json:"resilience"`
+	Admin      AdminConfig      `json:"admin"`
 }
 
 type DatabaseConfig struct {
@@ -27,20 +33,104 @@ type DatabaseConfig struct {
 	Params   string `json:"params"`
 }
 type ProviderConfig struct {
+	// Type selects the provider implementation (openai, gemini, claude or
+	// openai-compatible); it defaults to the provider's name.
+	Type    string `json:"type"`
 	BaseURL string `json:"base_url"`
 	Model   string `json:"model"`
-	APIKey  string `json:"api_key"`
+	// APIKey is the key of an openai-compatible endpoint, used when the user stored none.
+	APIKey string `json:"api_key"`
+	// ReasoningEffort is passed to OpenAI reasoning models: low, medium or high.
+	ReasoningEffort string `json:"reasoning_effort"`
+	// MaxTokens caps the length of replies where the provider requires a limit
+	// (Claude); defaults to 3000.
+	MaxTokens int `json:"max_tokens"`
+	// ThinkingBudget enables Claude extended thinking with this many tokens (at least
+	// 1024) and caps Gemini's thinking; 0 keeps the provider default.
+	ThinkingBudget int `json:"thinking_budget"`
+	// APIVersion is the API version of an azure-openai deployment.
+	APIVersion string `json:"api_version"`
+	// Headers are sent with every request to openai, azure-openai and openai-compatible
+	// endpoints.
+	Headers map[string]string `json:"headers"`
+	// Models lists the models an openai-compatible endpoint serves; when set, other
+	// models are rejected and the first one is the default if Model is empty.
+	Models []string `json:"models"`
+	// ContextWindow is the context length in tokens of the provider's models; long
+	// histories are trimmed to fit it. ContextWindows overrides it per model and 0
+	// sends the whole history.
+	ContextWindow  int            `json:"context_window"`
+	ContextWindows map[string]int `json:"context_windows"`
 }
 
+// DefaultMaxTokens is the reply limit used when a provider needs one and none is configured.
+const DefaultMaxTokens = 3000
+
 type BasicConfig struct {
-	ServerAddress     string `json:"server_address"`
-	MinWorkers        int    `json:"min_workers"`
-	MaxWorkers        int    `json:"max_workers"`
-	QueueSize         int    `json:"queue_size"`
-	WorkerIdleTimeout int    `json:"worker_idle_timeout_minutes"`
-	FileBaseDir       string `json:"file_base_dir"`
-	TempFileTTL       int    `json:"temp_file_ttl_minutes"`
-	TempCleanInterval int    `json:"temp_file_clean_interval_minutes"`
+	ServerAddress        string `json:"server_address"`
+	MinWorkers           int    `json:"min_workers"`
+	MaxWorkers           int    `json:"max_workers"`
+	QueueSize            int    `json:"queue_size"`
+	WorkerIdleTimeout    int    `json:"worker_idle_timeout_minutes"`
+	FileBaseDir          string `json:"file_base_dir"`
+	TempFileTTL          int    `json:"temp_file_ttl_minutes"`
+	TempCleanInterval    int    `json:"temp_file_clean_interval_minutes"`
+	IdempotencyRetention int    `json:"idempotency_retention_minutes"`
+}
+
+// UsageConfig prices generations and limits what a user may spend per month.
+type UsageConfig struct {
+	// Prices are keyed by "provider/model"; "provider/*" covers the provider's other models.
+	Prices map[string]ModelPrice `json:"prices"`
+	// MonthlyBudget is the default limit per user in USD; 0 means unlimited.
+	MonthlyBudget float64 `json:"monthly_budget"`
+	// SoftLimit is the share of the budget (0-1) at which users are warned; defaults to 0.8.
+	SoftLimit float64 `json:"soft_limit"`
+}
+
+// UserProvidersConfig limits where user-registered providers may point.
+type UserProvidersConfig struct {
+	// AllowedBaseURLs are the URL prefixes a user provider's base_url must start with;
+	// a host may start with "*." to allow its subdomains. Empty disables user providers.
+	AllowedBaseURLs []string `json:"allowed_base_urls"`
+}
+
+// ResilienceConfig controls how failed provider calls are retried and when a
+// failing provider is short-circuited.
+type ResilienceConfig struct {
+	Retry          RetryConfig          `json:"retry"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+}
+
+// RetryConfig retries rate limits, server errors and dropped connections with
+// exponential backoff and jitter; a longer Retry-After than MaxBackoffMS is not waited for.
+type RetryConfig struct {
+	// MaxAttempts counts the first call; defaults to 3, 1 disables retries.
+	MaxAttempts      int `json:"max_attempts"`
+	InitialBackoffMS int `json:"initial_backoff_ms"`
+	MaxBackoffMS     int `json:"max_backoff_ms"`
+}
+
+// CircuitBreakerConfig opens a provider's circuit after consecutive failures so
+// further calls fail fast until OpenSeconds have passed.
+type CircuitBreakerConfig struct {
+	Disabled bool `json:"disabled"`
+	// FailureThreshold defaults to 5 consecutive failures.
+	FailureThreshold int `json:"failure_threshold"`
+	// OpenSeconds defaults to 30.
+	OpenSeconds int `json:"open_seconds"`
+}
+
+// AdminConfig lists the users allowed to use the admin endpoints. Admins are named by
+// id, as usernames of deleted or not yet registered accounts can be claimed by anyone.
+type AdminConfig struct {
+	UserIDs []int64 `json:"user_ids"`
+}
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
 }
 
 type RedisConfig struct {
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Idempotency record states.
+const (
+	IdempotencyPending = "pending"
+	IdempotencyDone    = "done"
+	IdempotencyFailed  = "failed"
+)
+
+// IdempotencyRecord stores the outcome of a client_msg_id so retries can be replayed.
+type IdempotencyRecord struct {
+	ID            int64     `json:"id"`
+	UserID        int64     `json:"user_id"`
+	SessionID     int64     `json:"session_id"`
+	ClientMsgID   string    `json:"client_msg_id"`
+	RequestHash   string    `json:"request_hash"`
+	Status        string    `json:"status"`
+	UserMessageID int64     `json:"user_message_id"`
+	AIMessageID   int64     `json:"ai_message_id"`
+	Title         string    `json:"title"`
+	Error         string    `json:"error"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Import job states.
+const (
+	ImportPending = "pending"
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportFailed  = "failed"
+)
+
+// ImportJob tracks a background import of conversations from an export file.
+type ImportJob struct {
+	ID        int64          `json:"id"`
+	UserID    int64          `json:"user_id"`
+	Source    string         `json:"source"`
+	Status    string         `json:"status"`
+	Total     int            `json:"total"`
+	Processed int            `json:"processed"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []ImportResult `json:"results"`
+	Error     string         `json:"error,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// ImportResult reports one conversation of an import: the session it became, or why it failed.
+type ImportResult struct {
+	Index     int    `json:"index"`
+	Title     string `json:"title"`
+	SessionID int64  `json:"session_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
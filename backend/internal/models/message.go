@@ -12,11 +12,31 @@ const (
 	RoleSystem    Role = "system"
 )
 
+// Message status values; cancelled marks a partial reply stopped by the user.
+const (
+	MessageStatusComplete  = "complete"
+	MessageStatusCancelled = "cancelled"
+)
+
 type Message struct {
 	ID        int64     `json:"id"`
 	UserID    int64     `json:"user_id"`
 	SessionID int64     `json:"session_id"`
 	Role      Role      `json:"role"`
 	Content   string    `json:"content"`
+	Status    string    `json:"status,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	ParentID  int64     `json:"parent_id,omitempty"`
+	VariantOf int64     `json:"variant_of,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
+	// Generation metadata of assistant replies; zero when the provider did not report it.
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
+	TTFTMs           int64  `json:"ttft_ms,omitempty"`
+	LatencyMs        int64  `json:"latency_ms,omitempty"`
+	FinishReason     string `json:"finish_reason,omitempty"`
+	// Reasoning is the model's thinking behind an assistant reply. It is stored apart
+	// from the content, only loaded on request and never sent back to a provider.
+	Reasoning string `json:"reasoning,omitempty"`
 }
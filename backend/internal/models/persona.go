@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Persona is a reusable assistant setup. Sessions started from it copy its system
+// prompt, tools and starter files; a shared persona can be used, but not changed, by
+// every user of the server.
+type Persona struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"user_id"`
+	Name         string `json:"name"`
+	SystemPrompt string `json:"system_prompt"`
+	// Provider and Model are used when a conversation is started without them.
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// Tools lists the tools the model may call; nil enables every available tool.
+	Tools     []string      `json:"tools"`
+	Shared    bool          `json:"shared"`
+	Files     []PersonaFile `json:"files"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// PersonaFile is a starter file copied into every session started from its persona.
+type PersonaFile struct {
+	ID         int64     `json:"id"`
+	PersonaID  int64     `json:"persona_id"`
+	FileName   string    `json:"file_name"`
+	StoredPath string    `json:"-"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"created_at"`
+}
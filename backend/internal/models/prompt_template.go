@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// PromptTemplate is a reusable message of a user's prompt library. Content holds
+// {{variable}} placeholders that are filled in when the template is sent.
+type PromptTemplate struct {
+	ID          int64    `json:"id"`
+	UserID      int64    `json:"user_id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Content     string   `json:"content"`
+	Tags        []string `json:"tags"`
+	// Variables lists the placeholders of Content in order of first use.
+	Variables []string  `json:"variables"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PromptLibrary is the portable JSON form of prompt templates, used to share them
+// between users and servers.
+type PromptLibrary struct {
+	Format     string               `json:"format"`
+	Version    int                  `json:"version"`
+	ExportedAt time.Time            `json:"exported_at"`
+	Templates  []PromptLibraryEntry `json:"templates"`
+}
+
+// PromptLibraryEntry is one template of a PromptLibrary.
+type PromptLibraryEntry struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Content     string   `json:"content"`
+	Tags        []string `json:"tags,omitempty"`
+}
@@ -0,0 +1,12 @@
+package models
+
+// SearchResult is one hit of a full-text search. MessageID is 0 when the session title matched.
+// Snippet is HTML-escaped with the matched terms wrapped in <mark>.
+type SearchResult struct {
+	SessionID    int64   `json:"session_id"`
+	MessageID    int64   `json:"message_id,omitempty"`
+	SessionTitle string  `json:"session_title"`
+	Role         string  `json:"role,omitempty"`
+	Snippet      string  `json:"snippet"`
+	Rank         float64 `json:"rank"`
+}
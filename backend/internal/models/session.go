@@ -4,11 +4,15 @@ import "time"
 
 // Session groups a sequence of user inputs.
 type Session struct {
-	ID        int64     `json:"id"`
-	UserID    int64     `json:"user_id"`
-	Title     string    `json:"title"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           int64     `json:"id"`
+	UserID       int64     `json:"user_id"`
+	Title        string    `json:"title"`
+	TitleLocked  bool      `json:"title_locked"`
+	Pinned       bool      `json:"pinned"`
+	Archived     bool      `json:"archived"`
+	ActiveLeafID int64     `json:"active_leaf_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // SessionChan is a helper channel type for streaming sessions.
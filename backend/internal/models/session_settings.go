@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// SessionSettings customise how replies are generated in one session. Nil fields keep
+// the provider's defaults.
+type SessionSettings struct {
+	SessionID    int64    `json:"session_id"`
+	SystemPrompt string   `json:"system_prompt"`
+	Temperature  *float32 `json:"temperature"`
+	TopP         *float32 `json:"top_p"`
+	MaxTokens    *int     `json:"max_tokens"`
+	Stop         []string `json:"stop"`
+	// Tools lists the tools the model may call; nil enables every available tool.
+	Tools []string `json:"tools"`
+	// Fallbacks are tried in order when the session's provider fails before answering;
+	// nil uses the user's chain and an empty list disables failover.
+	Fallbacks []ProviderModel `json:"fallbacks"`
+	UpdatedAt *time.Time      `json:"updated_at,omitempty"`
+}
+
+// ProviderModel names a model of a provider; an empty Model uses the provider's default.
+type ProviderModel struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// ShareLink grants read-only access to a session to anyone holding its token. A snapshot
+// link shows the session as it was when the link was created; otherwise it follows the
+// session as it changes.
+type ShareLink struct {
+	ID        int64      `json:"id"`
+	SessionID int64      `json:"session_id"`
+	Token     string     `json:"token"`
+	Snapshot  bool       `json:"snapshot"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// SharedSession is the public view of a shared session. It carries no user or message
+// ids, no stored paths and no file summaries.
+type SharedSession struct {
+	Title     string          `json:"title"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	SharedAt  time.Time       `json:"shared_at"`
+	Snapshot  bool            `json:"snapshot"`
+	Messages  []SharedMessage `json:"messages"`
+	Files     []SharedFile    `json:"files,omitempty"`
+}
+
+// SharedMessage is one message of the active branch of a shared session.
+type SharedMessage struct {
+	Role      Role      `json:"role"`
+	Content   string    `json:"content"`
+	Status    string    `json:"status,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SharedFile names a file uploaded to a shared session.
+type SharedFile struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+}
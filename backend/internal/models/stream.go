@@ -0,0 +1,55 @@
+package models
+
+// StreamEventType identifies what a StreamEvent carries.
+type StreamEventType string
+
+const (
+	// StreamDelta carries newly generated answer text.
+	StreamDelta StreamEventType = "delta"
+	// StreamReasoning carries newly generated reasoning ("thinking") text.
+	StreamReasoning StreamEventType = "reasoning"
+	// StreamToolCall is emitted when the agent invokes a tool.
+	StreamToolCall StreamEventType = "tool_call"
+	// StreamToolResult is emitted when a tool returns.
+	StreamToolResult StreamEventType = "tool_result"
+	// StreamUsage reports the token usage of the generation; it is the last event.
+	StreamUsage StreamEventType = "usage"
+	// StreamContextTrimmed reports that older history was left out or shortened to fit
+	// the model's context window; it is sent before the reply.
+	StreamContextTrimmed StreamEventType = "context_trimmed"
+)
+
+// StreamEvent is one incremental piece of a generation as reported by the AI service.
+type StreamEvent struct {
+	Type StreamEventType
+	// Text is the new text of a delta or reasoning event.
+	Text  string
+	Tool  *ToolEvent
+	Usage *TokenUsage
+	Trim  *ContextTrim
+}
+
+// ToolEvent describes a tool invocation; Result is only set on tool_result events.
+type ToolEvent struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments,omitempty"`
+	Result    string `json:"result,omitempty"`
+}
+
+// TokenUsage counts the tokens spent on one generation.
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ContextTrim describes how a history was cut down to fit the context window.
+type ContextTrim struct {
+	// DroppedMessages were left out, CompressedMessages sent shortened.
+	DroppedMessages    int `json:"dropped_messages"`
+	CompressedMessages int `json:"compressed_messages"`
+	// EstimatedTokens is the estimated size of the prompt sent, ContextWindow the limit.
+	EstimatedTokens int `json:"estimated_tokens"`
+	ContextWindow   int `json:"context_window"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// UsageRecord is one priced generation in a user's usage ledger. Records outlive the
+// session they were spent in.
+type UsageRecord struct {
+	ID               int64     `json:"id"`
+	UserID           int64     `json:"user_id"`
+	SessionID        int64     `json:"session_id,omitempty"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// UsageBucket aggregates the ledger of one provider/model over a day ("2006-01-02")
+// or a month ("2006-01").
+type UsageBucket struct {
+	Period           string  `json:"period"`
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// BudgetStatus is a user's spending in the current calendar month (UTC). A zero
+// MonthlyBudget means spending is unlimited.
+type BudgetStatus struct {
+	MonthlyBudget float64 `json:"monthly_budget"`
+	Spent         float64 `json:"spent"`
+	Remaining     float64 `json:"remaining"`
+	SoftLimit     float64 `json:"soft_limit"`
+	Warning       bool    `json:"warning"`
+	Exhausted     bool    `json:"exhausted"`
+}
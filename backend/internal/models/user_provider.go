@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// UserProvider is a provider endpoint a user registered for themselves, e.g. an Azure
+// OpenAI deployment or a company proxy. It is used by name like the providers of the
+// server configuration; its key and header values are stored encrypted and never
+// returned.
+type UserProvider struct {
+	ID         int64  `json:"id"`
+	UserID     int64  `json:"user_id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	BaseURL    string `json:"base_url"`
+	APIVersion string `json:"api_version,omitempty"`
+	// Model is the default model (the deployment name for azure-openai).
+	Model string `json:"model,omitempty"`
+	// ContextWindow of the model in tokens; 0 when unknown, which disables trimming.
+	ContextWindow int               `json:"context_window,omitempty"`
+	Headers       map[string]string `json:"-"`
+	APIKey        string            `json:"-"`
+	// HeaderNames lists the configured headers without their values.
+	HeaderNames []string  `json:"header_names"`
+	HasKey      bool      `json:"has_key"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
@@ -0,0 +1,170 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+
+	"unichatgo/internal/config"
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
+)
+
+// Completer runs stateless chat calls: the caller sends the whole conversation each time
+// and no tools or agent are involved. It backs the OpenAI-compatible gateway.
+type Completer struct {
+	chatModel model.ToolCallingChatModel
+	provider  string
+	model     string
+	// thinkingBudget is set for Claude providers with extended thinking
+	thinkingBudget int
+}
+
+// CompletionOptions are the sampling parameters a caller may override.
+type CompletionOptions struct {
+	Temperature *float32
+	TopP        *float32
+	MaxTokens   *int
+	Stop        []string
+}
+
+// Completion is the reply of a chat call and the usage reported by the provider.
+type Completion struct {
+	Content          string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// ConfiguredProviders returns the providers of the service configuration.
+func ConfiguredProviders() (map[string]config.ProviderConfig, error) {
+	return llm.Default.Providers(), nil
+}
+
+// NewCompleter creates a Completer for a configured provider; an empty modelName uses
+// the provider's default model.
+func NewCompleter(provider, modelName, token string) (*Completer, error) {
+	provCfg, ok := llm.Default.Lookup(provider)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", llm.ErrUnknownProvider, provider)
+	}
+	if modelName == "" {
+		modelName = provCfg.Model
+	}
+	chatModel, err := llm.Default.ChatModel(context.Background(), provider, modelName, token)
+	if err != nil {
+		return nil, err
+	}
+	return &Completer{
+		chatModel:      chatModel,
+		provider:       provider,
+		model:          modelName,
+		thinkingBudget: llm.ClaudeThinkingBudget(provider, provCfg),
+	}, nil
+}
+
+// Complete returns the whole reply at once.
+func (c *Completer) Complete(ctx context.Context, messages []*models.Message, opts CompletionOptions) (*Completion, error) {
+	resp, err := c.chatModel.Generate(ctx, toSchemaMessages(messages), opts.forThinking(c.thinkingBudget).modelOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("generate completion: %w", err)
+	}
+	completion := &Completion{Content: resp.Content}
+	completion.addMeta(resp.ResponseMeta)
+	return completion, nil
+}
+
+// Stream calls onDelta with every new piece of the reply and returns the whole reply.
+func (c *Completer) Stream(ctx context.Context, messages []*models.Message, opts CompletionOptions, onDelta func(string) error) (*Completion, error) {
+	reader, err := c.chatModel.Stream(ctx, toSchemaMessages(messages), opts.forThinking(c.thinkingBudget).modelOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("stream completion: %w", err)
+	}
+	defer reader.Close()
+	completion := &Completion{}
+	for {
+		chunk, err := reader.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return completion, fmt.Errorf("receive completion: %w", err)
+		}
+		completion.addMeta(chunk.ResponseMeta)
+		if chunk.Content == "" {
+			continue
+		}
+		completion.Content += chunk.Content
+		if err := onDelta(chunk.Content); err != nil {
+			return completion, err
+		}
+	}
+	return completion, nil
+}
+
+func (c *Completion) addMeta(meta *schema.ResponseMeta) {
+	if meta == nil {
+		return
+	}
+	if meta.FinishReason != "" {
+		c.FinishReason = meta.FinishReason
+	}
+	if meta.Usage != nil {
+		c.PromptTokens = meta.Usage.PromptTokens
+		c.CompletionTokens = meta.Usage.CompletionTokens
+	}
+}
+
+// forThinking adapts the options to a Claude provider thinking with budget tokens: the
+// budget comes on top of max_tokens, which the provider counts it toward, and the
+// temperature, which it rejects, is dropped.
+func (o CompletionOptions) forThinking(budget int) CompletionOptions {
+	if budget <= 0 {
+		return o
+	}
+	o.Temperature = nil
+	if o.MaxTokens != nil {
+		total := *o.MaxTokens + budget
+		o.MaxTokens = &total
+	}
+	return o
+}
+
+func (o CompletionOptions) modelOptions() []model.Option {
+	var opts []model.Option
+	if o.Temperature != nil {
+		opts = append(opts, model.WithTemperature(*o.Temperature))
+	}
+	if o.TopP != nil {
+		opts = append(opts, model.WithTopP(*o.TopP))
+	}
+	if o.MaxTokens != nil {
+		opts = append(opts, model.WithMaxTokens(*o.MaxTokens))
+	}
+	if len(o.Stop) > 0 {
+		opts = append(opts, model.WithStop(o.Stop))
+	}
+	return opts
+}
+
+func toSchemaMessages(messages []*models.Message) []*schema.Message {
+	converted := make([]*schema.Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg == nil {
+			continue
+		}
+		role := schema.User
+		switch msg.Role {
+		case models.RoleAssistant:
+			role = schema.Assistant
+		case models.RoleSystem:
+			role = schema.System
+		}
+		converted = append(converted, &schema.Message{Role: role, Content: msg.Content})
+	}
+	return converted
+}
@@ -0,0 +1,83 @@
+package ai
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cloudwego/eino/callbacks"
+	"github.com/cloudwego/eino/components/tool"
+	"github.com/cloudwego/eino/compose"
+	"github.com/cloudwego/eino/schema"
+	template "github.com/cloudwego/eino/utils/callbacks"
+
+	"unichatgo/internal/models"
+)
+
+// eventEmitter serialises stream events for one generation. Tool callbacks run on the
+// agent's goroutines and cannot fail the run, so their error is kept and returned by
+// the next send.
+type eventEmitter struct {
+	mu       sync.Mutex
+	callback func(models.StreamEvent) error
+	err      error
+}
+
+func newEventEmitter(callback func(models.StreamEvent) error) *eventEmitter {
+	return &eventEmitter{callback: callback}
+}
+
+func (e *eventEmitter) send(event models.StreamEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	if e.callback == nil {
+		return nil
+	}
+	e.err = e.callback(event)
+	return e.err
+}
+
+// toolCallbacks reports the react agent's tool invocations as tool_call/tool_result events.
+func (e *eventEmitter) toolCallbacks() callbacks.Handler {
+	return template.NewHandlerHelper().Tool(&template.ToolCallbackHandler{
+		OnStart: func(ctx context.Context, info *callbacks.RunInfo, input *tool.CallbackInput) context.Context {
+			_ = e.send(models.StreamEvent{Type: models.StreamToolCall, Tool: &models.ToolEvent{
+				ID:        compose.GetToolCallID(ctx),
+				Name:      toolName(info),
+				Arguments: input.ArgumentsInJSON,
+			}})
+			return ctx
+		},
+		OnEnd: func(ctx context.Context, info *callbacks.RunInfo, output *tool.CallbackOutput) context.Context {
+			_ = e.send(models.StreamEvent{Type: models.StreamToolResult, Tool: &models.ToolEvent{
+				ID:     compose.GetToolCallID(ctx),
+				Name:   toolName(info),
+				Result: output.Response,
+			}})
+			return ctx
+		},
+	}).Handler()
+}
+
+func toolName(info *callbacks.RunInfo) string {
+	if info == nil {
+		return ""
+	}
+	return info.Name
+}
+
+// mergeUsage folds the usage reported by a chunk into the running total. Providers
+// report either cumulative counts on every chunk (Gemini), one final count (OpenAI) or
+// prompt and completion tokens on separate chunks (Claude), so the maximum of each
+// field is the total in every case.
+func mergeUsage(total *models.TokenUsage, usage *schema.TokenUsage) *models.TokenUsage {
+	if total == nil {
+		total = &models.TokenUsage{}
+	}
+	total.PromptTokens = max(total.PromptTokens, usage.PromptTokens)
+	total.CompletionTokens = max(total.CompletionTokens, usage.CompletionTokens)
+	total.TotalTokens = max(total.TotalTokens, usage.TotalTokens, total.PromptTokens+total.CompletionTokens)
+	return total
+}
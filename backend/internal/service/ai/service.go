@@ -5,91 +5,62 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	"unichatgo/internal/config"
 	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
 
-	"github.com/cloudwego/eino-ext/components/model/claude"
-	"github.com/cloudwego/eino-ext/components/model/gemini"
-	"github.com/cloudwego/eino-ext/components/model/openai"
 	"github.com/cloudwego/eino/components/model"
 	"github.com/cloudwego/eino/components/tool"
 	"github.com/cloudwego/eino/compose"
+	"github.com/cloudwego/eino/flow/agent"
 	"github.com/cloudwego/eino/flow/agent/react"
 	"github.com/cloudwego/eino/schema"
-	"google.golang.org/genai"
 )
 
 type aiService struct {
+	provider  string
+	model     string
 	aiModel   model.ToolCallingChatModel
-	config    *config.Config
 	histories map[int64][]*models.Message
 	todoTools []tool.BaseTool
 	agent     *react.Agent
-	mu        sync.RWMutex
+	// modelOptions carry the session's sampling settings into every call
+	modelOptions []model.Option
+	mu           sync.RWMutex
 }
 
 const maxImageInlineBytes = 5 << 20
 
-func NewAiService(provider string, modelType string, token string) (*aiService, error) {
-	var chatModel model.ToolCallingChatModel
-	var err error
-	cfgPath := os.Getenv("UNICHATGO_CONFIG")
-	cfg, err := config.Load(cfgPath)
-	if err != nil {
-		log.Fatalf("load config: %v", err)
-	}
-	provCfg, ok := cfg.Providers[provider]
-	if !ok {
-		return nil, fmt.Errorf("provider %s not configured", provider)
-	}
-	if modelType == "" {
-		modelType = provCfg.Model
-	}
-	todoTools := InitToolsChain()
-	var reactAgent *react.Agent
-
-	switch provider {
-	case "openai":
-		chatModel, err = openai.NewChatModel(context.Background(), &openai.ChatModelConfig{
-			BaseURL: provCfg.BaseURL,
-			Model:   modelType,
-			APIKey:  token})
-	case "gemini":
-		client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
-			APIKey: token,
-		})
-		if err != nil {
-			log.Fatalf("NewClient of gemini failed, err=%v", err)
-		}
-		chatModel, err = gemini.NewChatModel(context.Background(), &gemini.Config{
-			Client: client,
-			Model:  modelType,
-			ThinkingConfig: &genai.ThinkingConfig{
-				IncludeThoughts: true,
-				ThinkingBudget:  nil,
-			},
-		})
-	case "claude":
-		var baseURLPtr *string
-		if provCfg.BaseURL != "" {
-			baseURLPtr = &provCfg.BaseURL
-		}
-		chatModel, err = claude.NewChatModel(context.Background(), &claude.Config{
-			APIKey:    token,
-			Model:     modelType,
-			BaseURL:   baseURLPtr,
-			MaxTokens: 3000,
-		})
-	default:
-		return nil, fmt.Errorf("invalid provider: %s", provider)
+// NewAiService creates the chat service of a session from a resolved provider spec.
+// settings may be nil for the provider defaults with every tool enabled.
+func NewAiService(spec llm.Spec, settings *models.SessionSettings) (*aiService, error) {
+	if spec.Model == "" {
+		spec.Model = llm.DefaultModel(spec.Config)
+	}
+	todoTools := enabledTools(InitToolsChain(), settings)
+	var (
+		reactAgent *react.Agent
+		options    []model.Option
+	)
+	if settings != nil {
+		options = CompletionOptions{
+			Temperature: settings.Temperature,
+			TopP:        settings.TopP,
+			MaxTokens:   settings.MaxTokens,
+			Stop:        settings.Stop,
+		}.forThinking(llm.ClaudeThinkingBudget(spec.Name, spec.Config)).modelOptions()
 	}
+
+	chatModel, err := llm.Default.Build(context.Background(), spec)
 	if err != nil {
-		log.Fatalf("Start Ai Service failed: %v", err)
+		return nil, err
 	}
 
 	if len(todoTools) > 0 {
@@ -105,16 +76,38 @@ func NewAiService(provider string, modelType string, token string) (*aiService,
 	}
 
 	return &aiService{
+		provider:  spec.Name,
+		model:     spec.Model,
 		aiModel:   chatModel,
-		config:    cfg,
 		histories: make(map[int64][]*models.Message),
 		todoTools: todoTools,
 		agent:     reactAgent,
+
+		modelOptions: options,
 	}, nil
 }
 
-// StreamChat Using stream chat to handle Ai output
-func (s *aiService) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(string) error) (*models.Message, error) {
+// enabledTools keeps the tools listed in the session settings, all of them without settings.
+func enabledTools(tools []tool.BaseTool, settings *models.SessionSettings) []tool.BaseTool {
+	if settings == nil || settings.Tools == nil {
+		return tools
+	}
+	enabled := make([]tool.BaseTool, 0, len(tools))
+	for _, t := range tools {
+		info, err := t.Info(context.Background())
+		if err != nil {
+			continue
+		}
+		if slices.Contains(settings.Tools, info.Name) {
+			enabled = append(enabled, t)
+		}
+	}
+	return enabled
+}
+
+// StreamChat Using stream chat to handle Ai output. The callback receives the new text
+// of every chunk, reasoning text, the agent's tool calls and finally the token usage.
+func (s *aiService) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
 	if message == nil {
 		return nil, errors.New("message cannot be nil")
 	}
@@ -125,49 +118,113 @@ func (s *aiService) StreamChat(ctx context.Context, message *models.Message, pre
 	if len(prevHistory) > 0 {
 		s.loadHistory(message.SessionID, prevHistory)
 	}
-	// append latest user message
-	s.appendHistory(message.SessionID, message)
+	// append latest user message unless the given history already ends with it
+	if n := len(prevHistory); n == 0 || prevHistory[n-1] != message {
+		s.appendHistory(message.SessionID, message)
+	}
 	messagesEino := s.convertMessages(message.SessionID, imageFiles)
 
+	emit := newEventEmitter(callback)
+	started := time.Now()
 	var (
 		streamReader *schema.StreamReader[*schema.Message]
 		err          error
 	)
 	if s.agent != nil {
-		streamReader, err = s.agent.Stream(ctx, messagesEino)
+		streamReader, err = s.agent.Stream(ctx, messagesEino,
+			agent.WithComposeOptions(compose.WithCallbacks(emit.toolCallbacks())),
+			react.WithChatModelOptions(s.modelOptions...))
 	} else {
-		streamReader, err = s.aiModel.Stream(ctx, messagesEino)
+		streamReader, err = s.aiModel.Stream(ctx, messagesEino, s.modelOptions...)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("generate Ai stream failed: %w", err)
 	}
-	var fullContent string
+	defer streamReader.Close()
+	var (
+		fullContent  string
+		reasoning    strings.Builder
+		usage        *models.TokenUsage
+		firstToken   time.Duration
+		finishReason string
+	)
+	reply := func() *models.Message {
+		msg := assistantMessage(message, fullContent, reasoning.String())
+		msg.Provider = s.provider
+		msg.Model = s.model
+		msg.TTFTMs = firstToken.Milliseconds()
+		msg.LatencyMs = time.Since(started).Milliseconds()
+		msg.FinishReason = finishReason
+		if usage != nil {
+			msg.PromptTokens = usage.PromptTokens
+			msg.CompletionTokens = usage.CompletionTokens
+		}
+		return msg
+	}
 	for {
+		if ctx.Err() != nil {
+			// cancelled mid-stream: hand back the partial reply with the cause
+			return reply(), context.Cause(ctx)
+		}
 		chunk, err := streamReader.Recv()
 		if err != nil {
+			if ctx.Err() != nil {
+				return reply(), context.Cause(ctx)
+			}
+			// a failure before anything was generated is reported so the caller can
+			// retry or fail over; later ones end the reply with what was received
+			if !errors.Is(err, io.EOF) && fullContent == "" && reasoning.Len() == 0 {
+				return nil, fmt.Errorf("generate Ai stream failed: %w", err)
+			}
 			// flow finished
 			break
 		}
-		content := chunk.Content
-		fullContent += content
-
-		if callback != nil {
-			if err := callback(fullContent); err != nil {
+		if meta := chunk.ResponseMeta; meta != nil {
+			if meta.Usage != nil {
+				usage = mergeUsage(usage, meta.Usage)
+			}
+			if meta.FinishReason != "" {
+				finishReason = meta.FinishReason
+			}
+		}
+		if firstToken == 0 && (chunk.Content != "" || chunk.ReasoningContent != "") {
+			firstToken = time.Since(started)
+		}
+		if chunk.ReasoningContent != "" {
+			reasoning.WriteString(chunk.ReasoningContent)
+			if err := emit.send(models.StreamEvent{Type: models.StreamReasoning, Text: chunk.ReasoningContent}); err != nil {
 				return nil, err
 			}
 		}
+		if chunk.Content == "" {
+			continue
+		}
+		fullContent += chunk.Content
+		if err := emit.send(models.StreamEvent{Type: models.StreamDelta, Text: chunk.Content}); err != nil {
+			return nil, err
+		}
 	}
-	response := &models.Message{
-		UserID:    message.UserID,
-		SessionID: message.SessionID,
-		Role:      models.RoleAssistant,
-		Content:   fullContent,
-		CreatedAt: time.Now(),
+	if usage != nil {
+		if err := emit.send(models.StreamEvent{Type: models.StreamUsage, Usage: usage}); err != nil {
+			return nil, err
+		}
 	}
+	response := reply()
 	s.appendHistory(message.SessionID, response)
 	return response, nil
 }
 
+func assistantMessage(prompt *models.Message, content, reasoning string) *models.Message {
+	return &models.Message{
+		UserID:    prompt.UserID,
+		SessionID: prompt.SessionID,
+		Role:      models.RoleAssistant,
+		Content:   content,
+		Reasoning: reasoning,
+		CreatedAt: time.Now(),
+	}
+}
+
 func (s *aiService) convertMessages(sessionID int64, imageFiles []*models.TempFile) []*schema.Message {
 	s.mu.RLock()
 	history := s.histories[sessionID]
@@ -187,6 +244,7 @@ func (s *aiService) convertMessages(sessionID int64, imageFiles []*models.TempFi
 			role = schema.User
 		}
 
+		// only the answer goes back to the provider, never msg.Reasoning
 		schemaMsg := &schema.Message{Role: role}
 		if idx == len(history)-1 && role == schema.User && len(imageFiles) > 0 {
 			parts := []schema.MessageInputPart{
@@ -242,6 +300,7 @@ func (s *aiService) appendHistory(sessionID int64, msg *models.Message) {
 		return
 	}
 	msgCopy := *msg
+	msgCopy.Reasoning = ""
 	s.mu.Lock()
 	s.histories[sessionID] = append(s.histories[sessionID], &msgCopy)
 	s.mu.Unlock()
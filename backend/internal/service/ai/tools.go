@@ -23,6 +23,17 @@ import (
 	"unichatgo/internal/models"
 )
 
+// Names of the tools the chat agent can call.
+const (
+	ToolWebSearch      = "web_search"
+	ToolTempFileReader = "temp_file_reader"
+)
+
+// KnownTool reports whether name is one of the agent's tools.
+func KnownTool(name string) bool {
+	return name == ToolWebSearch || name == ToolTempFileReader
+}
+
 func InitToolsChain() []tool.BaseTool {
 	var tools []tool.BaseTool
 
@@ -50,7 +61,7 @@ func InitWebSearch() tool.InvokableTool {
 	}
 
 	info := &schema.ToolInfo{
-		Name: "web_search",
+		Name: ToolWebSearch,
 		Desc: "Search the web for information; " +
 			"automatically fallbacks to another provider if needed;" +
 			"can search URL if needed.",
@@ -151,7 +162,7 @@ func initTempFileReader() tool.InvokableTool {
 		loader: loader,
 	}
 	info := &schema.ToolInfo{
-		Name: "temp_file_reader",
+		Name: ToolTempFileReader,
 		Desc: "Read user-uploaded documents in small chunks. Provide the file_id (and optional chunk_index / chunk_size) to fetch a specific segment; limit 3 calls per minute per session.",
 		ParamsOneOf: schema.NewParamsOneOfByParams(map[string]*schema.ParameterInfo{
 			"file_id": {
@@ -0,0 +1,18 @@
+package assistant
+
+import (
+	"slices"
+
+	"unichatgo/internal/config"
+)
+
+// ConfigureAdmins sets the ids of the users allowed to use the admin endpoints.
+// Without it nobody is an admin.
+func (s *Service) ConfigureAdmins(cfg config.AdminConfig) {
+	s.admins = cfg
+}
+
+// IsAdmin reports whether the user is one of the configured admins.
+func (s *Service) IsAdmin(userID int64) bool {
+	return userID > 0 && slices.Contains(s.admins.UserIDs, userID)
+}
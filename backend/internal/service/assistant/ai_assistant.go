@@ -3,87 +3,35 @@ package assistant
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
 
-	"github.com/cloudwego/eino-ext/components/model/claude"
-	"github.com/cloudwego/eino-ext/components/model/gemini"
-	"github.com/cloudwego/eino-ext/components/model/openai"
 	"github.com/cloudwego/eino/components/model"
 	"github.com/cloudwego/eino/schema"
-	"google.golang.org/genai"
 
-	"unichatgo/internal/config"
 	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
 )
 
 type assistantService struct {
 	chatModel model.ToolCallingChatModel
 }
 
-func NewAssistantService(provider, modelName, token string) (*assistantService, error) {
-	var chatModel model.ToolCallingChatModel
-	var err error
-
-	cfgPath := os.Getenv("UNICHATGO_CONFIG")
-	cfg, err := config.Load(cfgPath)
-	if err != nil {
-		log.Fatalf("load config: %v", err)
-	}
-	provCfg, ok := cfg.Providers[provider]
-	if !ok {
-		log.Fatalf("unknown provider: %s", provider)
-	}
-	if modelName == "" {
-		modelName = provCfg.Model
-	}
-
-	switch provider {
-	case "openai":
-		chatModel, err = openai.NewChatModel(context.Background(), &openai.ChatModelConfig{
-			BaseURL: provCfg.BaseURL,
-			Model:   modelName,
-			APIKey:  token})
-	case "gemini":
-		client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
-			APIKey: token,
-		})
-		if err != nil {
-			log.Fatalf("NewClient of gemini failed, err=%v", err)
-		}
-		chatModel, err = gemini.NewChatModel(context.Background(), &gemini.Config{
-			Client: client,
-			Model:  modelName,
-			ThinkingConfig: &genai.ThinkingConfig{
-				IncludeThoughts: true,
-				ThinkingBudget:  nil,
-			},
-		})
-	case "claude":
-		var baseURLPtr *string
-		if provCfg.BaseURL != "" {
-			baseURLPtr = &provCfg.BaseURL
-		}
-		chatModel, err = claude.NewChatModel(context.Background(), &claude.Config{
-			APIKey:    token,
-			Model:     modelName,
-			BaseURL:   baseURLPtr,
-			MaxTokens: 3000,
-		})
-	default:
-		log.Fatalf("unknown provider: %s", provider)
-	}
+// NewAssistantService creates the title and summary generator of a session from a
+// resolved provider spec.
+func NewAssistantService(spec llm.Spec) (*assistantService, error) {
+	chatModel, err := llm.Default.Build(context.Background(), spec)
 	if err != nil {
-		log.Fatalf("Init assistant failed: %v", err)
+		return nil, err
 	}
 	return &assistantService{
 		chatModel: chatModel,
 	}, nil
 }
 
-func (as *assistantService) GenerateTitle(ctx context.Context, messages []*models.Message) (string, error) {
+// GenerateTitle names a conversation after its first messages. The usage is nil when
+// no provider call was made.
+func (as *assistantService) GenerateTitle(ctx context.Context, messages []*models.Message) (string, *models.TokenUsage, error) {
 	if messages == nil || len(messages) == 0 {
-		return "New Conversation", nil
+		return "New Conversation", nil, nil
 	}
 	defaultPrompt := "You are a conversation title generator. " +
 		"Based on the dialogue between the user and the AI, generate a concise and accurate title for the conversation. " +
@@ -113,19 +61,21 @@ func (as *assistantService) GenerateTitle(ctx context.Context, messages []*model
 	}
 	resp, err := as.chatModel.Generate(ctx, schemaMessages)
 	if err != nil {
-		return "", fmt.Errorf("generate title failed: %w", err)
+		return "", nil, fmt.Errorf("generate title failed: %w", err)
 
 	}
 	title := resp.Content
 	if len(title) == 0 {
-		return "New Conversation", nil
+		return "New Conversation", tokenUsage(resp), nil
 	}
-	return title, nil
+	return title, tokenUsage(resp), nil
 }
 
-func (as *assistantService) SummarizeFile(ctx context.Context, content []*models.Message) (string, error) {
+// SummarizeFile summarizes an uploaded document. The usage is nil when no provider
+// call was made.
+func (as *assistantService) SummarizeFile(ctx context.Context, content []*models.Message) (string, *models.TokenUsage, error) {
 	if content == nil || len(content) == 0 {
-		return "", nil
+		return "", nil, nil
 	}
 
 	systemPrompt := "You are a helpful assistant that summarizes user provided documents. " +
@@ -153,7 +103,19 @@ func (as *assistantService) SummarizeFile(ctx context.Context, content []*models
 	}
 	resp, err := as.chatModel.Generate(ctx, schemaMessages)
 	if err != nil {
-		return "", fmt.Errorf("summarize file failed: %w", err)
+		return "", nil, fmt.Errorf("summarize file failed: %w", err)
+	}
+	return resp.Content, tokenUsage(resp), nil
+}
+
+// tokenUsage returns the usage a provider reported for a reply, zero when it reported
+// none.
+func tokenUsage(resp *schema.Message) *models.TokenUsage {
+	usage := &models.TokenUsage{}
+	if resp.ResponseMeta != nil && resp.ResponseMeta.Usage != nil {
+		usage.PromptTokens = resp.ResponseMeta.Usage.PromptTokens
+		usage.CompletionTokens = resp.ResponseMeta.Usage.CompletionTokens
+		usage.TotalTokens = resp.ResponseMeta.Usage.TotalTokens
 	}
-	return resp.Content, nil
+	return usage
 }
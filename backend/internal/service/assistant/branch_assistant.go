@@ -0,0 +1,390 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+// Messages of a session form a tree through parent_id. sessions.active_leaf_id names
+// the branch currently shown, and messages on the path from the root to that leaf
+// carry active = 1 so the branch can be read without walking the tree.
+
+// ErrNoPrompt is returned when a session has no user message that could be answered again.
+var ErrNoPrompt = errors.New("session has no user message to answer")
+
+// LastExchange returns the latest user message of the active branch and the assistant
+// reply that answers it. reply is nil when the prompt has not been answered yet.
+func (s *Service) LastExchange(ctx context.Context, userID, sessionID int64) (*models.Message, *models.Message, error) {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)`,
+		sessionID, userID,
+	).Scan(&exists); err != nil {
+		return nil, nil, fmt.Errorf("verify session: %w", err)
+	}
+	if !exists {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	prompt, err := scanMessage(s.db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM messages WHERE session_id = ? AND role = ? AND active = 1
+			ORDER BY created_at DESC, id DESC LIMIT 1`, messageColumns),
+		sessionID, models.RoleUser,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNoPrompt
+		}
+		return nil, nil, fmt.Errorf("load last prompt: %w", err)
+	}
+	reply, err := scanMessage(s.db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM messages WHERE session_id = ? AND role = ? AND active = 1 AND id > ?
+			ORDER BY created_at DESC, id DESC LIMIT 1`, messageColumns),
+		sessionID, models.RoleAssistant, prompt.ID,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return prompt, nil, nil
+		}
+		return nil, nil, fmt.Errorf("load last reply: %w", err)
+	}
+	return prompt, reply, nil
+}
+
+// AddReplyVariant stores msg as a sibling of the assistant reply replaceID and makes
+// it the active leaf; the replaced reply stays stored on its own branch.
+func (s *Service) AddReplyVariant(ctx context.Context, userID, replaceID int64, msg models.Message) (*models.Message, error) {
+	if strings.TrimSpace(msg.Content) == "" {
+		return nil, errors.New("content cannot be empty")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var node messageNode
+	if node, err = loadMessageNode(ctx, tx, userID, msg.SessionID, replaceID); err != nil {
+		return nil, err
+	}
+	if node.role != models.RoleAssistant {
+		err = errors.New("only assistant replies have variants")
+		return nil, err
+	}
+	msg.UserID = userID
+	msg.ParentID = node.parentID
+	msg.VariantOf = replaceID
+	if node.variantOf > 0 {
+		msg.VariantOf = node.variantOf
+	}
+	var stored *models.Message
+	if stored, err = s.insertMessage(ctx, tx, msg); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit variant: %w", err)
+	}
+	return stored, nil
+}
+
+// EditUserMessage forks the conversation at a user message: the edited text is stored
+// as a sibling of messageID and becomes the active leaf, ready to be answered.
+func (s *Service) EditUserMessage(ctx context.Context, userID, sessionID, messageID int64, content string) (*models.Message, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, errors.New("content cannot be empty")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var node messageNode
+	if node, err = loadMessageNode(ctx, tx, userID, sessionID, messageID); err != nil {
+		return nil, err
+	}
+	if node.role != models.RoleUser {
+		err = errors.New("only user messages can be edited")
+		return nil, err
+	}
+	var stored *models.Message
+	if stored, err = s.insertMessage(ctx, tx, models.Message{
+		UserID:    userID,
+		SessionID: sessionID,
+		Role:      models.RoleUser,
+		Content:   content,
+		ParentID:  node.parentID,
+	}); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit edit: %w", err)
+	}
+	return stored, nil
+}
+
+// ListSiblings returns the alternatives at a node of the tree (messages sharing its
+// parent) in creation order, together with the id of the one on the active branch.
+func (s *Service) ListSiblings(ctx context.Context, userID, sessionID, messageID int64) ([]*models.Message, int64, error) {
+	node, err := loadMessageNode(ctx, s.db, userID, sessionID, messageID)
+	if err != nil {
+		return nil, 0, err
+	}
+	parentCond, args := "parent_id IS NULL", []any{sessionID}
+	if node.parentID > 0 {
+		parentCond = "parent_id = ?"
+		args = append(args, node.parentID)
+	}
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s, active FROM messages WHERE session_id = ? AND %s ORDER BY created_at ASC, id ASC`, messageColumns, parentCond),
+		args...,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list siblings: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		siblings []*models.Message
+		activeID int64
+	)
+	for rows.Next() {
+		var active bool
+		m, err := scanMessage(rows, &active)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scan sibling: %w", err)
+		}
+		if active {
+			activeID = m.ID
+		}
+		siblings = append(siblings, m)
+	}
+	return siblings, activeID, rows.Err()
+}
+
+// ListSessionTree returns every message of the session, all branches included, in creation order.
+func (s *Service) ListSessionTree(ctx context.Context, userID, sessionID int64) ([]*models.Message, error) {
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM messages WHERE session_id = ? AND user_id = ? ORDER BY created_at ASC, id ASC`, messageColumns),
+		sessionID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list message tree: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*models.Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan message: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// SelectBranch switches the active branch to the one running through messageID,
+// continuing down to its most recent leaf.
+func (s *Service) SelectBranch(ctx context.Context, userID, sessionID, messageID int64) (*models.Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = loadMessageNode(ctx, tx, userID, sessionID, messageID); err != nil {
+		return nil, err
+	}
+	var leaf int64
+	if leaf, err = latestLeaf(ctx, tx, sessionID, messageID); err != nil {
+		return nil, err
+	}
+	if err = setActiveLeaf(ctx, tx, sessionID, leaf); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit select branch: %w", err)
+	}
+	return s.GetMessage(ctx, userID, messageID)
+}
+
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type messageNode struct {
+	role      models.Role
+	parentID  int64
+	variantOf int64
+}
+
+func loadMessageNode(ctx context.Context, q rowQuerier, userID, sessionID, messageID int64) (messageNode, error) {
+	var (
+		node                messageNode
+		parentID, variantOf sql.NullInt64
+	)
+	err := q.QueryRowContext(ctx,
+		`SELECT role, parent_id, variant_of FROM messages WHERE id = ? AND session_id = ? AND user_id = ?`,
+		messageID, sessionID, userID,
+	).Scan(&node.role, &parentID, &variantOf)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return node, err
+		}
+		return node, fmt.Errorf("load message: %w", err)
+	}
+	node.parentID = parentID.Int64
+	node.variantOf = variantOf.Int64
+	return node, nil
+}
+
+func activeLeaf(ctx context.Context, tx *sql.Tx, sessionID int64) (int64, error) {
+	var leaf sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT active_leaf_id FROM sessions WHERE id = ?`, sessionID).Scan(&leaf); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("load active leaf: %w", err)
+	}
+	return leaf.Int64, nil
+}
+
+// insertMessage stores msg under msg.ParentID (0 for a new root) and makes it the active leaf.
+func (s *Service) insertMessage(ctx context.Context, tx *sql.Tx, msg models.Message) (*models.Message, error) {
+	leaf, err := activeLeaf(ctx, tx, msg.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Status == "" {
+		msg.Status = models.MessageStatusComplete
+	}
+	now := time.Now().UTC()
+	extendsBranch := msg.ParentID == leaf
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO messages (user_id, session_id, role, content, status, provider, model, parent_id, variant_of, active, created_at,
+			prompt_tokens, completion_tokens, ttft_ms, latency_ms, finish_reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.UserID, msg.SessionID, msg.Role, msg.Content, msg.Status, msg.Provider, msg.Model, nullableID(msg.ParentID), nullableID(msg.VariantOf), extendsBranch, now,
+		msg.PromptTokens, msg.CompletionTokens, msg.TTFTMs, msg.LatencyMs, msg.FinishReason,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("insert message: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("message id: %w", err)
+	}
+	if extendsBranch {
+		if _, err := tx.ExecContext(ctx, `UPDATE sessions SET active_leaf_id = ?, updated_at = ? WHERE id = ?`, id, now, msg.SessionID); err != nil {
+			return nil, fmt.Errorf("touch session: %w", err)
+		}
+	} else if err := setActiveLeaf(ctx, tx, msg.SessionID, id); err != nil {
+		return nil, err
+	}
+	if msg.Reasoning != "" {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO message_reasoning (message_id, content) VALUES (?, ?)`, id, msg.Reasoning); err != nil {
+			return nil, fmt.Errorf("insert reasoning: %w", err)
+		}
+	}
+	msg.ID = id
+	msg.CreatedAt = now
+	if err := s.indexMessage(ctx, tx, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// setActiveLeaf points the session at leafID and re-marks the messages on its path.
+func setActiveLeaf(ctx context.Context, tx *sql.Tx, sessionID, leafID int64) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, parent_id FROM messages WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return fmt.Errorf("load message tree: %w", err)
+	}
+	parents := make(map[int64]int64)
+	for rows.Next() {
+		var (
+			id     int64
+			parent sql.NullInt64
+		)
+		if err := rows.Scan(&id, &parent); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan message tree: %w", err)
+		}
+		parents[id] = parent.Int64
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate message tree: %w", err)
+	}
+
+	var (
+		placeholders []string
+		args         = []any{sessionID}
+		seen         = make(map[int64]bool)
+	)
+	for id := leafID; id > 0 && !seen[id]; id = parents[id] {
+		if _, ok := parents[id]; !ok {
+			break
+		}
+		seen[id] = true
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE messages SET active = 0 WHERE session_id = ? AND active = 1`, sessionID); err != nil {
+		return fmt.Errorf("clear active branch: %w", err)
+	}
+	if len(placeholders) > 0 {
+		if _, err := tx.ExecContext(ctx,
+			fmt.Sprintf(`UPDATE messages SET active = 1 WHERE session_id = ? AND id IN (%s)`, strings.Join(placeholders, ", ")),
+			args...,
+		); err != nil {
+			return fmt.Errorf("mark active branch: %w", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE sessions SET active_leaf_id = ?, updated_at = ? WHERE id = ?`,
+		nullableID(leafID), time.Now().UTC(), sessionID,
+	); err != nil {
+		return fmt.Errorf("update active leaf: %w", err)
+	}
+	return nil
+}
+
+// latestLeaf follows the most recent child from messageID down to a leaf.
+func latestLeaf(ctx context.Context, tx *sql.Tx, sessionID, messageID int64) (int64, error) {
+	leaf := messageID
+	for {
+		var child int64
+		err := tx.QueryRowContext(ctx,
+			`SELECT id FROM messages WHERE session_id = ? AND parent_id = ? ORDER BY created_at DESC, id DESC LIMIT 1`,
+			sessionID, leaf,
+		).Scan(&child)
+		if errors.Is(err, sql.ErrNoRows) {
+			return leaf, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("find branch leaf: %w", err)
+		}
+		leaf = child
+	}
+}
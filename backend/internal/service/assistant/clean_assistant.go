@@ -31,6 +31,9 @@ func (s *Service) cleanupLoop(ctx context.Context, interval time.Duration) {
 			if err := s.cleanupExpiredFiles(); err != nil {
 				log.Printf("cleanup temp files error: %v", err)
 			}
+			if err := s.cleanupExpiredIdempotencyKeys(); err != nil {
+				log.Printf("cleanup idempotency keys error: %v", err)
+			}
 		}
 	}
 }
@@ -0,0 +1,90 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"unichatgo/internal/models"
+)
+
+// ErrInvalidFallbacks is returned for a malformed fallback chain.
+var ErrInvalidFallbacks = errors.New("invalid fallback chain")
+
+// MaxFallbacks is the number of providers a fallback chain may hold.
+const MaxFallbacks = 5
+
+// GetUserFallbacks returns the user's default fallback chain; nil when none is set.
+func (s *Service) GetUserFallbacks(ctx context.Context, userID int64) ([]models.ProviderModel, error) {
+	var raw sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT fallbacks FROM users WHERE id = ?`, userID).Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("load fallbacks: %w", err)
+	}
+	return decodeFallbacks(raw)
+}
+
+// SetUserFallbacks replaces the user's default fallback chain; nil or empty removes it.
+func (s *Service) SetUserFallbacks(ctx context.Context, userID int64, chain []models.ProviderModel) ([]models.ProviderModel, error) {
+	if err := validateFallbacks(chain); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFallbacks, err)
+	}
+	if len(chain) == 0 {
+		chain = nil
+	}
+	raw, err := encodeFallbacks(chain)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET fallbacks = ? WHERE id = ?`, raw, userID)
+	if err != nil {
+		return nil, fmt.Errorf("set fallbacks: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return chain, nil
+}
+
+// validateFallbacks trims the entries of a chain and checks its length.
+func validateFallbacks(chain []models.ProviderModel) error {
+	if len(chain) > MaxFallbacks {
+		return fmt.Errorf("at most %d fallbacks", MaxFallbacks)
+	}
+	for i := range chain {
+		chain[i].Provider = strings.TrimSpace(chain[i].Provider)
+		chain[i].Model = strings.TrimSpace(chain[i].Model)
+		if chain[i].Provider == "" {
+			return errors.New("every fallback needs a provider")
+		}
+	}
+	return nil
+}
+
+// encodeFallbacks stores nil as NULL so "unset" and "empty" stay distinct.
+func encodeFallbacks(chain []models.ProviderModel) (any, error) {
+	if chain == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(chain)
+	if err != nil {
+		return nil, fmt.Errorf("encode fallbacks: %w", err)
+	}
+	return string(raw), nil
+}
+
+func decodeFallbacks(raw sql.NullString) ([]models.ProviderModel, error) {
+	if !raw.Valid {
+		return nil, nil
+	}
+	chain := []models.ProviderModel{}
+	if err := json.Unmarshal([]byte(raw.String), &chain); err != nil {
+		return nil, fmt.Errorf("decode fallbacks: %w", err)
+	}
+	return chain, nil
+}
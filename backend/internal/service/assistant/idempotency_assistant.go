@@ -0,0 +1,191 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// IdempotencyClaimLease is how long a pending claim is honoured. A claim left behind by a
+// crashed instance expires after it and the next retry takes the key over; finished
+// requests are kept for the full retention.
+const IdempotencyClaimLease = 5 * time.Minute
+
+const idempotencyColumns = `
+		id, user_id, session_id, client_msg_id, request_hash, status,
+		user_message_id, ai_message_id, title, error, created_at, expires_at
+	`
+
+// ClaimIdempotencyKey reserves a client_msg_id for the session for IdempotencyClaimLease.
+// When the key was already claimed (by this or another instance) the stored record is
+// returned with claimed=false; a claim whose lease ran out is taken over.
+func (s *Service) ClaimIdempotencyKey(ctx context.Context, userID, sessionID int64, clientMsgID, requestHash string, ttl time.Duration) (*models.IdempotencyRecord, bool, error) {
+	if userID <= 0 || sessionID <= 0 {
+		return nil, false, errors.New("invalid identifiers")
+	}
+	clientMsgID = strings.TrimSpace(clientMsgID)
+	if clientMsgID == "" {
+		return nil, false, errors.New("client_msg_id is required")
+	}
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyRetention
+	}
+	var exists bool
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)`,
+		sessionID, userID,
+	).Scan(&exists); err != nil {
+		return nil, false, fmt.Errorf("verify session: %w", err)
+	}
+	if !exists {
+		return nil, false, sql.ErrNoRows
+	}
+
+	now := time.Now().UTC()
+	// expired keys and abandoned claims may be reused
+	if _, err := s.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE session_id = ? AND client_msg_id = ? AND expires_at <= ?`,
+		sessionID, clientMsgID, now,
+	); err != nil {
+		return nil, false, fmt.Errorf("expire idempotency key: %w", err)
+	}
+	expires := now.Add(min(ttl, IdempotencyClaimLease))
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (user_id, session_id, client_msg_id, request_hash, status, title, error, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, '', '', ?, ?)`,
+		userID, sessionID, clientMsgID, requestHash, models.IdempotencyPending, now, expires,
+	)
+	if err != nil {
+		// most likely a unique conflict: somebody claimed the key first
+		existing, getErr := s.GetIdempotencyKey(ctx, userID, sessionID, clientMsgID)
+		if getErr != nil {
+			return nil, false, fmt.Errorf("claim idempotency key: %w", err)
+		}
+		return existing, false, nil
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, false, fmt.Errorf("idempotency key id: %w", err)
+	}
+	return &models.IdempotencyRecord{
+		ID:          id,
+		UserID:      userID,
+		SessionID:   sessionID,
+		ClientMsgID: clientMsgID,
+		RequestHash: requestHash,
+		Status:      models.IdempotencyPending,
+		CreatedAt:   now,
+		ExpiresAt:   expires,
+	}, true, nil
+}
+
+// GetIdempotencyKey loads the stored record for a client_msg_id.
+func (s *Service) GetIdempotencyKey(ctx context.Context, userID, sessionID int64, clientMsgID string) (*models.IdempotencyRecord, error) {
+	query := fmt.Sprintf(`SELECT %s FROM idempotency_keys
+		WHERE user_id = ? AND session_id = ? AND client_msg_id = ? AND expires_at > ?`, idempotencyColumns)
+	rec, err := scanIdempotencyRecord(s.db.QueryRowContext(ctx, query, userID, sessionID, strings.TrimSpace(clientMsgID), time.Now().UTC()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get idempotency key: %w", err)
+	}
+	return rec, nil
+}
+
+// CompleteIdempotencyKey records the outcome of a claimed key and keeps it for ttl.
+func (s *Service) CompleteIdempotencyKey(ctx context.Context, id, userMessageID, aiMessageID int64, title, errMsg string, ttl time.Duration) error {
+	if id <= 0 {
+		return errors.New("invalid idempotency key id")
+	}
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyRetention
+	}
+	status := models.IdempotencyDone
+	if errMsg != "" {
+		status = models.IdempotencyFailed
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET status = ?, user_message_id = ?, ai_message_id = ?, title = ?, error = ?, expires_at = ? WHERE id = ?`,
+		status, nullableID(userMessageID), nullableID(aiMessageID), title, errMsg, time.Now().UTC().Add(ttl), id,
+	); err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey drops a claim that produced nothing, so the client may retry.
+func (s *Service) ReleaseIdempotencyKey(ctx context.Context, id int64) error {
+	if id <= 0 {
+		return errors.New("invalid idempotency key id")
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// GetMessage returns a single message owned by the user.
+func (s *Service) GetMessage(ctx context.Context, userID, messageID int64) (*models.Message, error) {
+	m, err := scanMessage(s.db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM messages WHERE id = ? AND user_id = ?`, messageColumns),
+		messageID, userID,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get message: %w", err)
+	}
+	return m, nil
+}
+
+func (s *Service) cleanupExpiredIdempotencyKeys() error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, time.Now().UTC())
+	return err
+}
+
+func nullableID(id int64) sql.NullInt64 {
+	if id <= 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: id, Valid: true}
+}
+
+func scanIdempotencyRecord(scanner rowScanner) (*models.IdempotencyRecord, error) {
+	var (
+		rec       models.IdempotencyRecord
+		userMsgID sql.NullInt64
+		aiMsgID   sql.NullInt64
+		title     sql.NullString
+		errMsg    sql.NullString
+	)
+	if err := scanner.Scan(
+		&rec.ID,
+		&rec.UserID,
+		&rec.SessionID,
+		&rec.ClientMsgID,
+		&rec.RequestHash,
+		&rec.Status,
+		&userMsgID,
+		&aiMsgID,
+		&title,
+		&errMsg,
+		&rec.CreatedAt,
+		&rec.ExpiresAt,
+	); err != nil {
+		return nil, err
+	}
+	rec.UserMessageID = userMsgID.Int64
+	rec.AIMessageID = aiMsgID.Int64
+	rec.Title = title.String
+	rec.Error = errMsg.String
+	return &rec, nil
+}
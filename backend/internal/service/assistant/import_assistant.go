@@ -0,0 +1,245 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"unichatgo/internal/archive"
+	"unichatgo/internal/models"
+)
+
+// importStaleAfter is how long a running import may go without progress before it is
+// reported as interrupted (the instance running it stopped).
+const importStaleAfter = 5 * time.Minute
+
+// maxImportTitle keeps imported titles within the sessions.title column.
+const maxImportTitle = 255
+
+// CreateImportJob records a pending import for the user.
+func (s *Service) CreateImportJob(ctx context.Context, userID int64, source string) (*models.ImportJob, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO import_jobs (user_id, source, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, source, models.ImportPending, now, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create import job: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("import job id: %w", err)
+	}
+	return &models.ImportJob{
+		ID:        id,
+		UserID:    userID,
+		Source:    source,
+		Status:    models.ImportPending,
+		Results:   []models.ImportResult{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// SaveImportJob stores the progress, results and state of a job.
+func (s *Service) SaveImportJob(ctx context.Context, job *models.ImportJob) error {
+	results, err := json.Marshal(job.Results)
+	if err != nil {
+		return fmt.Errorf("encode import results: %w", err)
+	}
+	job.UpdatedAt = time.Now().UTC()
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE import_jobs SET status = ?, total = ?, processed = ?, succeeded = ?, failed = ?, results = ?, error = ?, updated_at = ?
+		WHERE id = ? AND user_id = ?`,
+		job.Status, job.Total, job.Processed, job.Succeeded, job.Failed, string(results), job.Error, job.UpdatedAt,
+		job.ID, job.UserID,
+	); err != nil {
+		return fmt.Errorf("save import job: %w", err)
+	}
+	return nil
+}
+
+// GetImportJob returns one import job of the user, or sql.ErrNoRows.
+func (s *Service) GetImportJob(ctx context.Context, userID, jobID int64) (*models.ImportJob, error) {
+	var (
+		job     models.ImportJob
+		results sql.NullString
+		errText sql.NullString
+	)
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, user_id, source, status, total, processed, succeeded, failed, results, error, created_at, updated_at
+		FROM import_jobs WHERE id = ? AND user_id = ?`,
+		jobID, userID,
+	).Scan(&job.ID, &job.UserID, &job.Source, &job.Status, &job.Total, &job.Processed, &job.Succeeded, &job.Failed,
+		&results, &errText, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get import job: %w", err)
+	}
+	job.Error = errText.String
+	job.Results = []models.ImportResult{}
+	if results.String != "" {
+		if err := json.Unmarshal([]byte(results.String), &job.Results); err != nil {
+			return nil, fmt.Errorf("decode import results: %w", err)
+		}
+	}
+	unfinished := job.Status == models.ImportPending || job.Status == models.ImportRunning
+	if unfinished && time.Since(job.UpdatedAt) > importStaleAfter {
+		job.Status = models.ImportFailed
+		job.Error = "import interrupted"
+	}
+	return &job, nil
+}
+
+// ImportSession stores an imported conversation as a new session of the user, keeping
+// its timestamps and message tree. The document's message ids only link messages to
+// their parents; stored messages get new ids.
+func (s *Service) ImportSession(ctx context.Context, userID int64, doc *archive.Document) (*models.Session, error) {
+	if doc == nil || len(doc.Messages) == 0 {
+		return nil, errors.New("conversation has no messages")
+	}
+	ordered, err := parentsFirst(doc.Messages)
+	if err != nil {
+		return nil, err
+	}
+	leaf := *doc
+	if !slices.ContainsFunc(ordered, func(m archive.Message) bool { return m.ID == leaf.Session.ActiveLeafID }) {
+		// without a known leaf show the branch ending at the last message
+		leaf.Session.ActiveLeafID = ordered[len(ordered)-1].ID
+	}
+	active := make(map[int64]bool)
+	for _, m := range leaf.ActivePath() {
+		active[m.ID] = true
+	}
+
+	now := time.Now().UTC()
+	session := &models.Session{
+		UserID:    userID,
+		Title:     strings.TrimSpace(truncateRunes(doc.Session.Title, maxImportTitle-1)),
+		Pinned:    doc.Session.Pinned,
+		Archived:  doc.Session.Archived,
+		CreatedAt: doc.Session.CreatedAt.UTC(),
+		UpdatedAt: doc.Session.UpdatedAt.UTC(),
+	}
+	if session.Title == "" {
+		session.Title = "Imported conversation"
+	}
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
+	}
+	if session.UpdatedAt.IsZero() {
+		session.UpdatedAt = session.CreatedAt
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	var res sql.Result
+	if res, err = tx.ExecContext(ctx,
+		`INSERT INTO sessions (user_id, title, pinned, archived, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, session.Title, session.Pinned, session.Archived, session.CreatedAt, session.UpdatedAt,
+	); err != nil {
+		return nil, fmt.Errorf("create session: %w", err)
+	}
+	if session.ID, err = res.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("session id: %w", err)
+	}
+
+	ids := make(map[int64]int64, len(ordered))
+	for _, m := range ordered {
+		role := m.Role
+		if role != models.RoleUser && role != models.RoleAssistant && role != models.RoleSystem {
+			err = fmt.Errorf("message %d has unknown role %q", m.ID, m.Role)
+			return nil, err
+		}
+		stored := models.Message{
+			UserID:    userID,
+			SessionID: session.ID,
+			Role:      role,
+			Content:   m.Content,
+			Status:    m.Status,
+			Provider:  m.Provider,
+			Model:     m.Model,
+			ParentID:  ids[m.ParentID],
+			CreatedAt: m.CreatedAt.UTC(),
+		}
+		if stored.Status == "" {
+			stored.Status = models.MessageStatusComplete
+		}
+		if stored.CreatedAt.IsZero() {
+			stored.CreatedAt = session.CreatedAt
+		}
+		if res, err = tx.ExecContext(ctx,
+			`INSERT INTO messages (user_id, session_id, role, content, status, provider, model, parent_id, active, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			stored.UserID, stored.SessionID, stored.Role, stored.Content, stored.Status, stored.Provider, stored.Model,
+			nullableID(stored.ParentID), active[m.ID], stored.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("insert message: %w", err)
+		}
+		if stored.ID, err = res.LastInsertId(); err != nil {
+			return nil, fmt.Errorf("message id: %w", err)
+		}
+		ids[m.ID] = stored.ID
+		if err = s.indexMessage(ctx, tx, &stored); err != nil {
+			return nil, err
+		}
+	}
+
+	session.ActiveLeafID = ids[leaf.Session.ActiveLeafID]
+	if _, err = tx.ExecContext(ctx, `UPDATE sessions SET active_leaf_id = ? WHERE id = ?`, session.ActiveLeafID, session.ID); err != nil {
+		return nil, fmt.Errorf("set active leaf: %w", err)
+	}
+	if err = s.indexSessionTitle(ctx, tx, userID, session.ID, session.Title); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit import: %w", err)
+	}
+	return session, nil
+}
+
+// parentsFirst orders messages so that each one follows its parent. A message whose
+// parent is not in the document becomes a root.
+func parentsFirst(messages []archive.Message) ([]archive.Message, error) {
+	byID := make(map[int64]archive.Message, len(messages))
+	children := make(map[int64][]archive.Message)
+	for _, m := range messages {
+		if _, dup := byID[m.ID]; dup {
+			return nil, fmt.Errorf("duplicate message id %d", m.ID)
+		}
+		byID[m.ID] = m
+	}
+	var queue []archive.Message
+	for _, m := range messages {
+		if _, ok := byID[m.ParentID]; ok && m.ParentID != m.ID {
+			children[m.ParentID] = append(children[m.ParentID], m)
+			continue
+		}
+		m.ParentID = 0
+		queue = append(queue, m)
+	}
+	ordered := make([]archive.Message, 0, len(messages))
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		ordered = append(ordered, m)
+		queue = append(queue, children[m.ID]...)
+	}
+	if len(ordered) != len(messages) {
+		return nil, errors.New("message parents form a cycle")
+	}
+	return ordered, nil
+}
@@ -0,0 +1,104 @@
+package assistant
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPageSize is used when a list request does not set a limit.
+	DefaultPageSize = 50
+	// MaxPageSize caps the limit a client may ask for.
+	MaxPageSize = 200
+)
+
+// ErrInvalidCursor is returned when a before/after cursor cannot be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PageRequest selects one page of a keyset-paginated list. Before and After are
+// cursors taken from a previous PageInfo; at most one of them may be set.
+type PageRequest struct {
+	Limit  int
+	Before string
+	After  string
+}
+
+// PageInfo tells the client how to continue from the page it received. HasMore reports
+// whether more items exist in the direction that was requested.
+type PageInfo struct {
+	HasMore bool   `json:"has_more"`
+	Before  string `json:"before_cursor,omitempty"`
+	After   string `json:"after_cursor,omitempty"`
+}
+
+func (p PageRequest) normalize() (PageRequest, error) {
+	if p.Before != "" && p.After != "" {
+		return p, fmt.Errorf("%w: before and after cannot be combined", ErrInvalidCursor)
+	}
+	if p.Limit <= 0 {
+		p.Limit = DefaultPageSize
+	}
+	if p.Limit > MaxPageSize {
+		p.Limit = MaxPageSize
+	}
+	return p, nil
+}
+
+// pageCursor is the position of one row in a list ordered by (pinned, ts, id);
+// pinned is always false for lists that do not group pinned rows first.
+type pageCursor struct {
+	pinned bool
+	ts     time.Time
+	id     int64
+}
+
+func (c pageCursor) encode() string {
+	pinned := 0
+	if c.pinned {
+		pinned = 1
+	}
+	raw := fmt.Sprintf("%d:%d:%d", pinned, c.ts.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return pageCursor{}, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || (parts[0] != "0" && parts[0] != "1") {
+		return pageCursor{}, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return pageCursor{}, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || id <= 0 {
+		return pageCursor{}, ErrInvalidCursor
+	}
+	// timestamps are stored in UTC; compare against the same representation
+	return pageCursor{pinned: parts[0] == "1", ts: time.Unix(0, nanos).UTC(), id: id}, nil
+}
+
+// keysetCondition returns a WHERE clause matching the rows that come after values in a
+// list ordered by columns, descending when desc is set. values pair up with columns.
+func keysetCondition(columns []string, values []any, desc bool) (string, []any) {
+	op := ">"
+	if desc {
+		op = "<"
+	}
+	last := len(columns) - 1
+	clause := fmt.Sprintf("%s %s ?", columns[last], op)
+	args := []any{values[last]}
+	for i := last - 1; i >= 0; i-- {
+		clause = fmt.Sprintf("(%s %s ? OR (%s = ? AND %s))", columns[i], op, columns[i], clause)
+		args = append([]any{values[i], values[i]}, args...)
+	}
+	return clause, args
+}
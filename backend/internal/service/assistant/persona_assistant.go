@@ -0,0 +1,321 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/ai"
+)
+
+// ErrInvalidPersona is returned for a persona with missing or out-of-range fields.
+var ErrInvalidPersona = errors.New("invalid persona")
+
+// ErrPersonaReadOnly is returned when a user changes a persona shared by someone else.
+var ErrPersonaReadOnly = errors.New("persona is read-only")
+
+// ErrPersonaFileLimit is returned when a persona already has MaxPersonaFiles starter files.
+var ErrPersonaFileLimit = errors.New("too many starter files")
+
+// MaxPersonaFiles is the number of starter files a persona can hold.
+const MaxPersonaFiles = 5
+
+const (
+	maxPersonaNameLength = 100
+	personaColumns       = `id, user_id, name, system_prompt, provider, model, tools, shared, created_at, updated_at`
+)
+
+// CreatePersona stores a new persona of the user.
+func (s *Service) CreatePersona(ctx context.Context, userID int64, persona models.Persona) (*models.Persona, error) {
+	if err := validatePersona(&persona); err != nil {
+		return nil, err
+	}
+	tools, err := encodeTools(persona.Tools)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO personas (user_id, name, system_prompt, provider, model, tools, shared, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, persona.Name, persona.SystemPrompt, persona.Provider, persona.Model, tools, persona.Shared, now, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create persona: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("persona id: %w", err)
+	}
+	return s.GetPersona(ctx, userID, id)
+}
+
+// UpdatePersona replaces the fields of one of the user's personas; starter files are
+// managed separately.
+func (s *Service) UpdatePersona(ctx context.Context, userID int64, persona models.Persona) (*models.Persona, error) {
+	if err := validatePersona(&persona); err != nil {
+		return nil, err
+	}
+	if err := s.ownPersona(ctx, userID, persona.ID); err != nil {
+		return nil, err
+	}
+	tools, err := encodeTools(persona.Tools)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE personas SET name = ?, system_prompt = ?, provider = ?, model = ?, tools = ?, shared = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
+		persona.Name, persona.SystemPrompt, persona.Provider, persona.Model, tools, persona.Shared, time.Now().UTC(), persona.ID, userID,
+	); err != nil {
+		return nil, fmt.Errorf("update persona: %w", err)
+	}
+	return s.GetPersona(ctx, userID, persona.ID)
+}
+
+// DeletePersona removes one of the user's personas with its starter files. Sessions
+// started from it keep their copies.
+func (s *Service) DeletePersona(ctx context.Context, userID, personaID int64) error {
+	if err := s.ownPersona(ctx, userID, personaID); err != nil {
+		return err
+	}
+	files, err := s.personaFiles(ctx, personaID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM persona_files WHERE persona_id = ?`, personaID); err != nil {
+		return fmt.Errorf("delete persona files: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM personas WHERE id = ? AND user_id = ?`, personaID, userID); err != nil {
+		return fmt.Errorf("delete persona: %w", err)
+	}
+	for _, f := range files {
+		removeStoredFile(f.StoredPath)
+	}
+	return nil
+}
+
+// GetPersona returns a persona of the user or one shared by another user, or
+// sql.ErrNoRows.
+func (s *Service) GetPersona(ctx context.Context, userID, personaID int64) (*models.Persona, error) {
+	persona, err := scanPersona(s.db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM personas WHERE id = ? AND (user_id = ? OR shared = ?)`, personaColumns),
+		personaID, userID, true,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get persona: %w", err)
+	}
+	if persona.Files, err = s.personaFiles(ctx, persona.ID); err != nil {
+		return nil, err
+	}
+	return persona, nil
+}
+
+// ListPersonas returns the user's personas followed by those other users share, each
+// ordered by name.
+func (s *Service) ListPersonas(ctx context.Context, userID int64) ([]*models.Persona, error) {
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM personas WHERE user_id = ? OR shared = ?
+			ORDER BY CASE WHEN user_id = ? THEN 0 ELSE 1 END, name ASC, id ASC`, personaColumns),
+		userID, true, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list personas: %w", err)
+	}
+	personas := []*models.Persona{}
+	for rows.Next() {
+		persona, err := scanPersona(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan persona: %w", err)
+		}
+		personas = append(personas, persona)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("close personas: %w", err)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate personas: %w", err)
+	}
+	for _, persona := range personas {
+		if persona.Files, err = s.personaFiles(ctx, persona.ID); err != nil {
+			return nil, err
+		}
+	}
+	return personas, nil
+}
+
+// AddPersonaFile records a starter file already saved at storedPath.
+func (s *Service) AddPersonaFile(ctx context.Context, userID, personaID int64, displayName, storedPath, mime string, size int64) (*models.PersonaFile, error) {
+	if displayName == "" || storedPath == "" {
+		return nil, errors.New("invalid file metadata")
+	}
+	if err := s.ownPersona(ctx, userID, personaID); err != nil {
+		return nil, err
+	}
+	var count int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM persona_files WHERE persona_id = ?`, personaID).Scan(&count); err != nil {
+		return nil, fmt.Errorf("count persona files: %w", err)
+	}
+	if count >= MaxPersonaFiles {
+		return nil, ErrPersonaFileLimit
+	}
+	file := &models.PersonaFile{
+		PersonaID:  personaID,
+		FileName:   displayName,
+		StoredPath: storedPath,
+		MimeType:   mime,
+		Size:       size,
+		CreatedAt:  time.Now().UTC(),
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO persona_files (persona_id, file_name, stored_path, mime_type, size, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		personaID, file.FileName, file.StoredPath, file.MimeType, file.Size, file.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("record persona file: %w", err)
+	}
+	if file.ID, err = res.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("persona file id: %w", err)
+	}
+	return file, nil
+}
+
+// DeletePersonaFile removes a starter file from one of the user's personas.
+func (s *Service) DeletePersonaFile(ctx context.Context, userID, personaID, fileID int64) error {
+	if err := s.ownPersona(ctx, userID, personaID); err != nil {
+		return err
+	}
+	var path string
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT stored_path FROM persona_files WHERE id = ? AND persona_id = ?`, fileID, personaID,
+	).Scan(&path); err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("get persona file: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM persona_files WHERE id = ?`, fileID); err != nil {
+		return fmt.Errorf("delete persona file: %w", err)
+	}
+	removeStoredFile(path)
+	return nil
+}
+
+// ownPersona returns nil when the user owns the persona, ErrPersonaReadOnly when it is
+// shared by someone else and sql.ErrNoRows when the user cannot see it.
+func (s *Service) ownPersona(ctx context.Context, userID, personaID int64) error {
+	var (
+		ownerID int64
+		shared  bool
+	)
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT user_id, shared FROM personas WHERE id = ?`, personaID,
+	).Scan(&ownerID, &shared); err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("get persona owner: %w", err)
+	}
+	switch {
+	case ownerID == userID:
+		return nil
+	case shared:
+		return ErrPersonaReadOnly
+	default:
+		return sql.ErrNoRows
+	}
+}
+
+func (s *Service) personaFiles(ctx context.Context, personaID int64) ([]models.PersonaFile, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, persona_id, file_name, stored_path, mime_type, size, created_at FROM persona_files WHERE persona_id = ? ORDER BY id ASC`,
+		personaID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list persona files: %w", err)
+	}
+	defer rows.Close()
+	files := []models.PersonaFile{}
+	for rows.Next() {
+		var f models.PersonaFile
+		if err := rows.Scan(&f.ID, &f.PersonaID, &f.FileName, &f.StoredPath, &f.MimeType, &f.Size, &f.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan persona file: %w", err)
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func scanPersona(scanner rowScanner) (*models.Persona, error) {
+	var (
+		p     models.Persona
+		tools sql.NullString
+	)
+	if err := scanner.Scan(&p.ID, &p.UserID, &p.Name, &p.SystemPrompt, &p.Provider, &p.Model, &tools, &p.Shared, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if tools.Valid {
+		if err := json.Unmarshal([]byte(tools.String), &p.Tools); err != nil {
+			return nil, fmt.Errorf("decode tools: %w", err)
+		}
+		if p.Tools == nil {
+			p.Tools = []string{}
+		}
+	}
+	return &p, nil
+}
+
+func validatePersona(persona *models.Persona) error {
+	persona.Name = strings.TrimSpace(persona.Name)
+	persona.SystemPrompt = strings.TrimSpace(persona.SystemPrompt)
+	persona.Provider = strings.TrimSpace(persona.Provider)
+	persona.Model = strings.TrimSpace(persona.Model)
+	if persona.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidPersona)
+	}
+	if len([]rune(persona.Name)) > maxPersonaNameLength {
+		return fmt.Errorf("%w: name is longer than %d characters", ErrInvalidPersona, maxPersonaNameLength)
+	}
+	if len(persona.SystemPrompt) > maxSystemPromptLength {
+		return fmt.Errorf("%w: system_prompt is longer than %d bytes", ErrInvalidPersona, maxSystemPromptLength)
+	}
+	if persona.Model != "" && persona.Provider == "" {
+		return fmt.Errorf("%w: model requires a provider", ErrInvalidPersona)
+	}
+	for _, name := range persona.Tools {
+		if !ai.KnownTool(name) {
+			return fmt.Errorf("%w: unknown tool %q", ErrInvalidPersona, name)
+		}
+	}
+	return nil
+}
+
+// encodeTools stores a tool list as JSON; nil (every tool) is stored as NULL.
+func encodeTools(tools []string) (any, error) {
+	if tools == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(tools)
+	if err != nil {
+		return nil, fmt.Errorf("encode tools: %w", err)
+	}
+	return string(raw), nil
+}
+
+func removeStoredFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("remove stored file %s failed: %v", path, err)
+	}
+}
@@ -0,0 +1,309 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"unichatgo/internal/models"
+)
+
+// ErrEmptyQuery is returned when a search query has no terms.
+var ErrEmptyQuery = errors.New("search query is empty")
+
+const (
+	maxSearchTerms = 16
+	// snippetRadius is how many characters of context a snippet keeps around the first match.
+	snippetRadius = 60
+	markOpen      = "\x02"
+	markClose     = "\x03"
+)
+
+// searchMode is the full-text backend detected for the database, see storage.setupSearch.
+type searchMode int
+
+const (
+	searchLike     searchMode = iota // sqlite without FTS5: LIKE over content and titles
+	searchFTS5                       // sqlite with the messages_fts/sessions_fts tables
+	searchFullText                   // mysql FULLTEXT indexes
+)
+
+func detectSearchMode(db *sql.DB) searchMode {
+	var version string
+	if err := db.QueryRow(`SELECT sqlite_version()`).Scan(&version); err != nil {
+		return searchFullText
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'`).Scan(&count); err != nil || count == 0 {
+		return searchLike
+	}
+	return searchFTS5
+}
+
+// SearchRequest selects one page of search results, best match first.
+type SearchRequest struct {
+	Query  string
+	Limit  int
+	Offset int
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// indexMessage adds a stored message to the FTS5 index; other backends index by themselves.
+func (s *Service) indexMessage(ctx context.Context, db execer, msg *models.Message) error {
+	if s.search != searchFTS5 {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO messages_fts (rowid, content, session_id, user_id) VALUES (?, ?, ?, ?)`,
+		msg.ID, msg.Content, msg.SessionID, msg.UserID,
+	); err != nil {
+		return fmt.Errorf("index message: %w", err)
+	}
+	return nil
+}
+
+// indexSessionTitle replaces the indexed title of a session.
+func (s *Service) indexSessionTitle(ctx context.Context, db execer, userID, sessionID int64, title string) error {
+	if s.search != searchFTS5 {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM sessions_fts WHERE rowid = ?`, sessionID); err != nil {
+		return fmt.Errorf("unindex session title: %w", err)
+	}
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO sessions_fts (rowid, title, user_id) VALUES (?, ?, ?)`,
+		sessionID, title, userID,
+	); err != nil {
+		return fmt.Errorf("index session title: %w", err)
+	}
+	return nil
+}
+
+// unindexSession drops a session and its messages from the index; run it before the rows are deleted.
+func (s *Service) unindexSession(ctx context.Context, db execer, sessionID int64) error {
+	if s.search != searchFTS5 {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx,
+		`DELETE FROM messages_fts WHERE rowid IN (SELECT id FROM messages WHERE session_id = ?)`, sessionID,
+	); err != nil {
+		return fmt.Errorf("unindex messages: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM sessions_fts WHERE rowid = ?`, sessionID); err != nil {
+		return fmt.Errorf("unindex session: %w", err)
+	}
+	return nil
+}
+
+// unindexUser drops everything indexed for a deleted user.
+func (s *Service) unindexUser(ctx context.Context, userID int64) error {
+	if s.search != searchFTS5 {
+		return nil
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM messages_fts WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("unindex user messages: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM sessions_fts WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("unindex user sessions: %w", err)
+	}
+	return nil
+}
+
+// Search looks for req.Query in the content of the user's messages and in their session
+// titles. It returns one page of hits and whether more follow.
+func (s *Service) Search(ctx context.Context, userID int64, req SearchRequest) ([]models.SearchResult, bool, error) {
+	terms := strings.Fields(req.Query)
+	if len(terms) == 0 {
+		return nil, false, ErrEmptyQuery
+	}
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultPageSize
+	}
+	if req.Limit > MaxPageSize {
+		req.Limit = MaxPageSize
+	}
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+
+	var (
+		query string
+		args  []any
+	)
+	switch s.search {
+	case searchFTS5:
+		match := ftsMatchExpression(terms)
+		query = fmt.Sprintf(`SELECT session_id, message_id, title, role, snippet, score FROM (
+				SELECT m.session_id AS session_id, m.id AS message_id, s.title AS title, m.role AS role,
+					snippet(messages_fts, 0, '%[1]s', '%[2]s', '…', 24) AS snippet, -bm25(messages_fts) AS score
+				FROM messages_fts f JOIN messages m ON m.id = f.rowid JOIN sessions s ON s.id = m.session_id
+				WHERE messages_fts MATCH ? AND f.user_id = ? AND s.user_id = ? AND m.active = 1
+				UNION ALL
+				SELECT s.id, 0, s.title, '', highlight(sessions_fts, 0, '%[1]s', '%[2]s'), -bm25(sessions_fts)
+				FROM sessions_fts f JOIN sessions s ON s.id = f.rowid
+				WHERE sessions_fts MATCH ? AND f.user_id = ? AND s.user_id = ?
+			) ORDER BY score DESC, message_id DESC LIMIT ? OFFSET ?`, markOpen, markClose)
+		args = []any{match, userID, userID, match, userID, userID}
+	case searchFullText:
+		against := strings.Join(terms, " ")
+		query = `SELECT m.session_id AS session_id, m.id AS message_id, s.title AS title, m.role AS role, m.content AS snippet,
+				MATCH(m.content) AGAINST (? IN NATURAL LANGUAGE MODE) AS score
+			FROM messages m JOIN sessions s ON s.id = m.session_id
+			WHERE s.user_id = ? AND m.active = 1 AND MATCH(m.content) AGAINST (? IN NATURAL LANGUAGE MODE)
+			UNION ALL
+			SELECT s.id, 0, s.title, '', s.title, MATCH(s.title) AGAINST (? IN NATURAL LANGUAGE MODE)
+			FROM sessions s
+			WHERE s.user_id = ? AND MATCH(s.title) AGAINST (? IN NATURAL LANGUAGE MODE)
+			ORDER BY score DESC, message_id DESC LIMIT ? OFFSET ?`
+		args = []any{against, userID, against, against, userID, against}
+	default:
+		// no relevance ranking without an index: title hits first, then the newest messages
+		var contentConds, titleConds []string
+		var contentArgs, titleArgs []any
+		for _, term := range terms {
+			pattern := "%" + escapeLike(term) + "%"
+			contentConds = append(contentConds, `m.content LIKE ? ESCAPE '\'`)
+			titleConds = append(titleConds, `s.title LIKE ? ESCAPE '\'`)
+			contentArgs = append(contentArgs, pattern)
+			titleArgs = append(titleArgs, pattern)
+		}
+		query = fmt.Sprintf(`SELECT session_id, message_id, title, role, snippet, score FROM (
+				SELECT m.session_id AS session_id, m.id AS message_id, s.title AS title, m.role AS role, m.content AS snippet, 0 AS score
+				FROM messages m JOIN sessions s ON s.id = m.session_id
+				WHERE s.user_id = ? AND m.active = 1 AND %s
+				UNION ALL
+				SELECT s.id, 0, s.title, '', s.title, 0
+				FROM sessions s
+				WHERE s.user_id = ? AND %s
+			) ORDER BY message_id = 0 DESC, message_id DESC, session_id DESC LIMIT ? OFFSET ?`,
+			strings.Join(contentConds, " AND "), strings.Join(titleConds, " AND "))
+		args = append(append(append([]any{userID}, contentArgs...), userID), titleArgs...)
+	}
+	args = append(args, req.Limit+1, req.Offset)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("search: %w", err)
+	}
+	defer rows.Close()
+	var results []models.SearchResult
+	for rows.Next() {
+		var r models.SearchResult
+		if err := rows.Scan(&r.SessionID, &r.MessageID, &r.SessionTitle, &r.Role, &r.Snippet, &r.Rank); err != nil {
+			return nil, false, fmt.Errorf("scan search result: %w", err)
+		}
+		if s.search == searchFTS5 {
+			r.Snippet = renderMarks(r.Snippet)
+		} else {
+			r.Snippet, r.Rank = highlightSnippet(r.Snippet, terms, r.Rank)
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	hasMore := len(results) > req.Limit
+	if hasMore {
+		results = results[:req.Limit]
+	}
+	return results, hasMore, nil
+}
+
+// ftsMatchExpression quotes every term so user input is never parsed as FTS5 syntax.
+func ftsMatchExpression(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+// renderMarks escapes text for HTML and turns the match markers into <mark> tags.
+func renderMarks(text string) string {
+	escaped := html.EscapeString(text)
+	return strings.NewReplacer(markOpen, "<mark>", markClose, "</mark>").Replace(escaped)
+}
+
+// highlightSnippet cuts text around the first term it contains and marks every term in it.
+// Without an FTS rank (the LIKE fallback) the number of matches is used as the rank.
+func highlightSnippet(text string, terms []string, rank float64) (string, float64) {
+	lower := strings.ToLower(text)
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		needle := strings.ToLower(term)
+		for from := 0; ; {
+			idx := strings.Index(lower[from:], needle)
+			if idx < 0 {
+				break
+			}
+			start := from + idx
+			spans = append(spans, span{start, start + len(needle)})
+			from = start + len(needle)
+		}
+	}
+	if rank == 0 {
+		rank = float64(len(spans))
+	}
+	if len(spans) == 0 || len(lower) != len(text) {
+		// nothing to mark, or case folding changed byte offsets
+		return renderMarks(truncateRunes(text, 2*snippetRadius)), rank
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	from := spans[0].start - snippetRadius
+	to := spans[0].end + snippetRadius
+	if from < 0 {
+		from = 0
+	}
+	if to > len(text) {
+		to = len(text)
+	}
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, sp := range spans {
+		if sp.start < pos || sp.end > to {
+			continue
+		}
+		b.WriteString(text[pos:sp.start])
+		b.WriteString(markOpen + text[sp.start:sp.end] + markClose)
+		pos = sp.end
+	}
+	b.WriteString(text[pos:to])
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return renderMarks(b.String()), rank
+}
+
+func truncateRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return string(runes[:n]) + "…"
+}
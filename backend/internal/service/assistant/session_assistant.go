@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -30,86 +31,323 @@ func (s *Service) CreateSession(ctx context.Context, userID int64, title string)
 	if err != nil {
 		return nil, fmt.Errorf("session id: %w", err)
 	}
+	if err := s.indexSessionTitle(ctx, s.db, userID, id, title); err != nil {
+		return nil, err
+	}
 	return &models.Session{ID: id, UserID: userID, Title: title, CreatedAt: now, UpdatedAt: now}, nil
 }
 
-// ListSessions returns all sessions for a user ordered by last activity.
-func (s *Service) ListSessions(ctx context.Context, userID int64) ([]models.Session, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, user_id, title, created_at, updated_at FROM sessions WHERE user_id = ? ORDER BY updated_at DESC`,
-		userID,
-	)
+// SessionFilter narrows ListSessions. The zero value lists the sessions that are not archived.
+type SessionFilter struct {
+	Archived bool
+	Pinned   *bool
+}
+
+// ListSessions returns one page of the user's sessions matching filter, pinned ones
+// first, then by last activity. page.Before continues further down the list and
+// page.After goes back towards its top.
+func (s *Service) ListSessions(ctx context.Context, userID int64, filter SessionFilter, page PageRequest) ([]models.Session, PageInfo, error) {
+	page, err := page.normalize()
 	if err != nil {
-		return nil, fmt.Errorf("list sessions: %w", err)
+		return nil, PageInfo{}, err
+	}
+	query := fmt.Sprintf(`SELECT %s FROM sessions WHERE user_id = ? AND archived = ?`, sessionColumns)
+	args := []any{userID, filter.Archived}
+	if filter.Pinned != nil {
+		query += ` AND pinned = ?`
+		args = append(args, *filter.Pinned)
+	}
+	backward := page.After != ""
+	if cursor := page.Before + page.After; cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		cond, condArgs := keysetCondition([]string{"pinned", "updated_at", "id"}, []any{c.pinned, c.ts, c.id}, !backward)
+		query += ` AND ` + cond
+		args = append(args, condArgs...)
+	}
+	if backward {
+		query += ` ORDER BY pinned ASC, updated_at ASC, id ASC LIMIT ?`
+	} else {
+		query += ` ORDER BY pinned DESC, updated_at DESC, id DESC LIMIT ?`
+	}
+	args = append(args, page.Limit+1)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, PageInfo{}, fmt.Errorf("list sessions: %w", err)
 	}
 	defer rows.Close()
 
 	var sessions []models.Session
 	for rows.Next() {
-		var s models.Session
-		if err := rows.Scan(&s.ID, &s.UserID, &s.Title, &s.CreatedAt, &s.UpdatedAt); err != nil {
-			return nil, fmt.Errorf("scan session: %w", err)
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, PageInfo{}, fmt.Errorf("scan session: %w", err)
 		}
-		sessions = append(sessions, s)
+		sessions = append(sessions, *session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, PageInfo{}, err
 	}
-	return sessions, rows.Err()
+
+	var info PageInfo
+	if len(sessions) > page.Limit {
+		info.HasMore = true
+		sessions = sessions[:page.Limit]
+	}
+	if backward {
+		slices.Reverse(sessions)
+	}
+	if len(sessions) > 0 {
+		first, last := sessions[0], sessions[len(sessions)-1]
+		info.After = pageCursor{pinned: first.Pinned, ts: first.UpdatedAt, id: first.ID}.encode()
+		info.Before = pageCursor{pinned: last.Pinned, ts: last.UpdatedAt, id: last.ID}.encode()
+	}
+	return sessions, info, nil
 }
 
-// GetSessionWithMessages returns one session and its ordered messages.
+// GetSessionWithMessages returns one session and all ordered messages of its active branch;
+// the worker uses it to load the full history. Clients page through ListMessages instead.
 func (s *Service) GetSessionWithMessages(ctx context.Context, userID, sessionID int64) (*models.Session, []*models.Message, error) {
-	var session models.Session
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, user_id, title, created_at, updated_at FROM sessions WHERE id = ? AND user_id = ?`,
-		sessionID,
-		userID,
-	).Scan(&session.ID, &session.UserID, &session.Title, &session.CreatedAt, &session.UpdatedAt)
+	session, err := s.GetSession(ctx, userID, sessionID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil, err
-		}
-		return nil, nil, fmt.Errorf("get session: %w", err)
+		return nil, nil, err
 	}
 
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, user_id, session_id, role, content, created_at FROM messages WHERE session_id = ? ORDER BY created_at ASC`,
+		fmt.Sprintf(`SELECT %s FROM messages WHERE session_id = ? AND active = 1 ORDER BY created_at ASC, id ASC`, messageColumns),
 		sessionID,
 	)
 	if err != nil {
-		return &session, nil, fmt.Errorf("list messages: %w", err)
+		return session, nil, fmt.Errorf("list messages: %w", err)
 	}
 	defer rows.Close()
 
 	var messages []*models.Message
 	for rows.Next() {
-		m := new(models.Message)
-		if err := rows.Scan(&m.ID, &m.UserID, &m.SessionID, &m.Role, &m.Content, &m.CreatedAt); err != nil {
-			return &session, nil, fmt.Errorf("scan message: %w", err)
+		m, err := scanMessage(rows)
+		if err != nil {
+			return session, nil, fmt.Errorf("scan message: %w", err)
 		}
 		messages = append(messages, m)
 	}
-	return &session, messages, rows.Err()
+	return session, messages, rows.Err()
 }
 
-// AddMessage stores a new message and updates the session's updated_at timestamp.
-func (s *Service) AddMessage(ctx context.Context, msg models.Message) (*models.Message, error) {
-	now := time.Now().UTC()
+// ListMessages returns one page of the session's active branch in conversation order.
+// Without a cursor the latest messages are returned; page.Before pages towards the
+// start of the conversation and page.After towards its end.
+func (s *Service) ListMessages(ctx context.Context, userID, sessionID int64, page PageRequest) ([]*models.Message, PageInfo, error) {
+	page, err := page.normalize()
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	query := fmt.Sprintf(`SELECT %s FROM messages WHERE session_id = ? AND user_id = ? AND active = 1`, messageColumns)
+	args := []any{sessionID, userID}
+	forward := page.After != ""
+	if cursor := page.Before + page.After; cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		cond, condArgs := keysetCondition([]string{"created_at", "id"}, []any{c.ts, c.id}, !forward)
+		query += ` AND ` + cond
+		args = append(args, condArgs...)
+	}
+	if forward {
+		query += ` ORDER BY created_at ASC, id ASC LIMIT ?`
+	} else {
+		query += ` ORDER BY created_at DESC, id DESC LIMIT ?`
+	}
+	args = append(args, page.Limit+1)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, PageInfo{}, fmt.Errorf("list messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*models.Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, PageInfo{}, fmt.Errorf("scan message: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	var info PageInfo
+	if len(messages) > page.Limit {
+		info.HasMore = true
+		messages = messages[:page.Limit]
+	}
+	if !forward {
+		slices.Reverse(messages)
+	}
+	if len(messages) > 0 {
+		first, last := messages[0], messages[len(messages)-1]
+		info.Before = pageCursor{ts: first.CreatedAt, id: first.ID}.encode()
+		info.After = pageCursor{ts: last.CreatedAt, id: last.ID}.encode()
+	}
+	return messages, info, nil
+}
+
+// LoadReasoning fills in the stored reasoning of the assistant messages in messages.
+func (s *Service) LoadReasoning(ctx context.Context, messages []*models.Message) error {
+	byID := make(map[int64]*models.Message)
+	var (
+		placeholders []string
+		args         []any
+	)
+	for _, m := range messages {
+		if m == nil || m.Role != models.RoleAssistant {
+			continue
+		}
+		byID[m.ID] = m
+		placeholders = append(placeholders, "?")
+		args = append(args, m.ID)
+	}
+	if len(placeholders) == 0 {
+		return nil
+	}
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT message_id, content FROM message_reasoning WHERE message_id IN (%s)`, strings.Join(placeholders, ", ")),
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("load reasoning: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id      int64
+			content string
+		)
+		if err := rows.Scan(&id, &content); err != nil {
+			return fmt.Errorf("scan reasoning: %w", err)
+		}
+		byID[id].Reasoning = content
+	}
+	return rows.Err()
+}
+
+// GetSession returns one session of the user, or sql.ErrNoRows.
+func (s *Service) GetSession(ctx context.Context, userID, sessionID int64) (*models.Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM sessions WHERE id = ? AND user_id = ?`, sessionColumns),
+		sessionID, userID,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get session: %w", err)
+	}
+	return session, nil
+}
+
+// SessionUpdate holds the session fields a user may change; nil fields are left untouched.
+type SessionUpdate struct {
+	Title    *string
+	Pinned   *bool
+	Archived *bool
+}
+
+// UpdateSession applies update to the session and returns the stored result.
+// Setting a title locks it, so the worker no longer replaces it with a generated one.
+func (s *Service) UpdateSession(ctx context.Context, userID, sessionID int64, update SessionUpdate) (*models.Session, error) {
+	if sessionID <= 0 {
+		return nil, errors.New("invalid session id")
+	}
+	var (
+		sets []string
+		args []any
+	)
+	if update.Title != nil {
+		title := strings.TrimSpace(*update.Title)
+		if title == "" {
+			return nil, errors.New("title cannot be empty")
+		}
+		sets = append(sets, "title = ?", "title_locked = ?")
+		args = append(args, title, true)
+	}
+	if update.Pinned != nil {
+		sets = append(sets, "pinned = ?")
+		args = append(args, *update.Pinned)
+	}
+	if update.Archived != nil {
+		sets = append(sets, "archived = ?")
+		args = append(args, *update.Archived)
+	}
+	if len(sets) == 0 {
+		return nil, errors.New("nothing to update")
+	}
+	args = append(args, sessionID, userID)
 	res, err := s.db.ExecContext(ctx,
-		`INSERT INTO messages (user_id, session_id, role, content, created_at) VALUES (?, ?, ?, ?, ?)`,
-		msg.UserID, msg.SessionID, msg.Role, msg.Content, now,
+		fmt.Sprintf(`UPDATE sessions SET %s WHERE id = ? AND user_id = ?`, strings.Join(sets, ", ")),
+		args...,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("insert message: %w", err)
+		return nil, fmt.Errorf("update session: %w", err)
 	}
-	id, err := res.LastInsertId()
+	// mysql reports 0 affected rows when nothing changed, so existence is checked by the read below
+	if _, err := res.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("session rows affected: %w", err)
+	}
+	session, err := s.GetSession(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if update.Title != nil {
+		if err := s.indexSessionTitle(ctx, s.db, userID, sessionID, session.Title); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// AddMessage stores a new message at the end of the session's active branch and
+// updates the session's updated_at timestamp.
+func (s *Service) AddMessage(ctx context.Context, msg models.Message) (*models.Message, error) {
+	stored, err := s.AddMessages(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return stored[0], nil
+}
+
+// AddMessages stores messages one after the other at the end of their session's active
+// branch in a single transaction: either all of them are stored or none is.
+func (s *Service) AddMessages(ctx context.Context, msgs ...models.Message) ([]*models.Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("message id: %w", err)
+		return nil, fmt.Errorf("begin tx: %w", err)
 	}
-	if _, err := s.db.ExecContext(ctx, `UPDATE sessions SET updated_at = ? WHERE id = ?`, now, msg.SessionID); err != nil {
-		return nil, fmt.Errorf("touch session: %w", err)
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	stored := make([]*models.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		var leaf int64
+		if leaf, err = activeLeaf(ctx, tx, msg.SessionID); err != nil {
+			return nil, err
+		}
+		msg.ParentID = leaf
+		var added *models.Message
+		if added, err = s.insertMessage(ctx, tx, msg); err != nil {
+			return nil, err
+		}
+		stored = append(stored, added)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit message: %w", err)
 	}
-	msg.ID = id
-	msg.CreatedAt = now
-	return &msg, nil
+	return stored, nil
 }
 
 // DeleteSession removes a session and all related messages for the user.
@@ -131,6 +369,11 @@ func (s *Service) DeleteSession(ctx context.Context, userID, sessionID int64) er
 	if err != nil {
 		return err
 	}
+	// before the delete, which may cascade to the messages the index is looked up by;
+	// the transaction is rolled back if the session is not the user's
+	if err = s.unindexSession(ctx, tx, sessionID); err != nil {
+		return err
+	}
 
 	res, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE id = ? AND user_id = ?`, sessionID, userID)
 	if err != nil {
@@ -150,6 +393,9 @@ func (s *Service) DeleteSession(ctx context.Context, userID, sessionID int64) er
 	if _, err := tx.ExecContext(ctx, `DELETE FROM temp_files WHERE session_id = ?`, sessionID); err != nil {
 		return fmt.Errorf("delete temp files: %w", err)
 	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE session_id = ?`, sessionID); err != nil {
+		return fmt.Errorf("delete idempotency keys: %w", err)
+	}
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("commit delete session: %w", err)
 	}
@@ -162,6 +408,22 @@ func (s *Service) DeleteSession(ctx context.Context, userID, sessionID int64) er
 	return nil
 }
 
+// DeleteSessions removes several sessions of the user and returns the ids that were deleted;
+// ids that do not exist or belong to someone else are skipped.
+func (s *Service) DeleteSessions(ctx context.Context, userID int64, sessionIDs []int64) ([]int64, error) {
+	deleted := make([]int64, 0, len(sessionIDs))
+	for _, id := range sessionIDs {
+		if err := s.DeleteSession(ctx, userID, id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return deleted, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, nil
+}
+
 func (s *Service) collectTempFilePaths(ctx context.Context, tx *sql.Tx, sessionID int64) ([]string, error) {
 	rows, err := tx.QueryContext(ctx, `SELECT stored_path FROM temp_files WHERE session_id = ?`, sessionID)
 	if err != nil {
@@ -184,7 +446,8 @@ func (s *Service) collectTempFilePaths(ctx context.Context, tx *sql.Tx, sessionI
 	return paths, nil
 }
 
-// UpdateSessionTitle sets a session title for the specified user.
+// UpdateSessionTitle stores a generated title for the specified user's session.
+// A title the user set by hand is kept; the call then succeeds without changing it.
 func (s *Service) UpdateSessionTitle(ctx context.Context, userID, sessionID int64, title string) error {
 	if sessionID <= 0 {
 		return errors.New("invalid session id")
@@ -194,7 +457,7 @@ func (s *Service) UpdateSessionTitle(ctx context.Context, userID, sessionID int6
 		return errors.New("title cannot be empty")
 	}
 	res, err := s.db.ExecContext(ctx,
-		`UPDATE sessions SET title = ? WHERE id = ? AND user_id = ?`,
+		`UPDATE sessions SET title = ? WHERE id = ? AND user_id = ? AND title_locked = 0`,
 		title, sessionID, userID,
 	)
 	if err != nil {
@@ -205,9 +468,10 @@ func (s *Service) UpdateSessionTitle(ctx context.Context, userID, sessionID int6
 		return fmt.Errorf("session rows affected: %w", err)
 	}
 	if affected == 0 {
-		return sql.ErrNoRows
+		_, err := s.GetSession(ctx, userID, sessionID)
+		return err
 	}
-	return nil
+	return s.indexSessionTitle(ctx, s.db, userID, sessionID, title)
 }
 
 func (s *Service) RecordTempFile(ctx context.Context, userID, sessionID int64, displayName, storedPath, mime string, size int64, ttl time.Duration) (int64, error) {
@@ -237,16 +501,19 @@ func (s *Service) RecordTempFile(ctx context.Context, userID, sessionID int64, d
 	return fileID, nil
 }
 
-func (s *Service) TempStorageUsage(ctx context.Context, userID int64) (int64, error) {
+// StorageUsage returns the bytes the user stores: active session attachments and the
+// starter files of their personas.
+func (s *Service) StorageUsage(ctx context.Context, userID int64) (int64, error) {
 	if userID <= 0 {
 		return 0, errors.New("invalid user id")
 	}
 	var total sql.NullInt64
 	err := s.db.QueryRowContext(ctx,
-		`SELECT COALESCE(SUM(size),0) FROM temp_files WHERE user_id = ? AND status = 'active'`,
-		userID).Scan(&total)
+		`SELECT (SELECT COALESCE(SUM(size),0) FROM temp_files WHERE user_id = ? AND status = 'active')
+			+ (SELECT COALESCE(SUM(f.size),0) FROM persona_files f JOIN personas p ON p.id = f.persona_id WHERE p.user_id = ?)`,
+		userID, userID).Scan(&total)
 	if err != nil {
-		return 0, fmt.Errorf("temp storage usage: %w", err)
+		return 0, fmt.Errorf("storage usage: %w", err)
 	}
 	return total.Int64, nil
 }
@@ -338,6 +605,36 @@ func (s *Service) UpdateTempFileSummary(ctx context.Context, fileID int64, summa
 	return nil
 }
 
+const sessionColumns = `id, user_id, title, title_locked, pinned, archived, active_leaf_id, created_at, updated_at`
+
+func scanSession(scanner rowScanner) (*models.Session, error) {
+	session := new(models.Session)
+	var leaf sql.NullInt64
+	if err := scanner.Scan(&session.ID, &session.UserID, &session.Title, &session.TitleLocked, &session.Pinned,
+		&session.Archived, &leaf, &session.CreatedAt, &session.UpdatedAt); err != nil {
+		return nil, err
+	}
+	session.ActiveLeafID = leaf.Int64
+	return session, nil
+}
+
+const messageColumns = `id, user_id, session_id, role, content, status, provider, model, parent_id, variant_of, created_at,
+	prompt_tokens, completion_tokens, ttft_ms, latency_ms, finish_reason`
+
+// scanMessage reads the messageColumns of a row; extra receives any columns selected after them.
+func scanMessage(scanner rowScanner, extra ...any) (*models.Message, error) {
+	m := new(models.Message)
+	var parentID, variantOf sql.NullInt64
+	dest := []any{&m.ID, &m.UserID, &m.SessionID, &m.Role, &m.Content, &m.Status, &m.Provider, &m.Model, &parentID, &variantOf, &m.CreatedAt,
+		&m.PromptTokens, &m.CompletionTokens, &m.TTFTMs, &m.LatencyMs, &m.FinishReason}
+	if err := scanner.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	m.ParentID = parentID.Int64
+	m.VariantOf = variantOf.Int64
+	return m, nil
+}
+
 const tempFileColumns = `
 		id, user_id, session_id, file_name, stored_path, mime_type, size,
 		status, summary, summary_message_id, created_at, expires_at
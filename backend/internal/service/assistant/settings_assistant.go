@@ -0,0 +1,166 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/ai"
+)
+
+// ErrInvalidSettings is returned for session settings outside the accepted ranges.
+var ErrInvalidSettings = errors.New("invalid session settings")
+
+const (
+	maxSystemPromptLength = 32 * 1024
+	maxStopSequences      = 4
+)
+
+// GetSessionSettings returns the generation settings of a session, the provider
+// defaults when none were saved, or sql.ErrNoRows when the session is not the user's.
+func (s *Service) GetSessionSettings(ctx context.Context, userID, sessionID int64) (*models.SessionSettings, error) {
+	if _, err := s.GetSession(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+	var (
+		settings          = &models.SessionSettings{SessionID: sessionID}
+		temperature, topP sql.NullFloat64
+		maxTokens         sql.NullInt64
+		stop, tools       sql.NullString
+		fallbacks         sql.NullString
+		updatedAt         time.Time
+	)
+	err := s.db.QueryRowContext(ctx,
+		`SELECT system_prompt, temperature, top_p, max_tokens, stop, tools, fallbacks, updated_at FROM session_settings WHERE session_id = ?`,
+		sessionID,
+	).Scan(&settings.SystemPrompt, &temperature, &topP, &maxTokens, &stop, &tools, &fallbacks, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load session settings: %w", err)
+	}
+	if temperature.Valid {
+		v := float32(temperature.Float64)
+		settings.Temperature = &v
+	}
+	if topP.Valid {
+		v := float32(topP.Float64)
+		settings.TopP = &v
+	}
+	if maxTokens.Valid {
+		v := int(maxTokens.Int64)
+		settings.MaxTokens = &v
+	}
+	if stop.Valid {
+		if err := json.Unmarshal([]byte(stop.String), &settings.Stop); err != nil {
+			return nil, fmt.Errorf("decode stop sequences: %w", err)
+		}
+	}
+	if tools.Valid {
+		if err := json.Unmarshal([]byte(tools.String), &settings.Tools); err != nil {
+			return nil, fmt.Errorf("decode tools: %w", err)
+		}
+		if settings.Tools == nil {
+			settings.Tools = []string{}
+		}
+	}
+	if settings.Fallbacks, err = decodeFallbacks(fallbacks); err != nil {
+		return nil, err
+	}
+	settings.UpdatedAt = &updatedAt
+	return settings, nil
+}
+
+// UpdateSessionSettings replaces the generation settings of a session.
+func (s *Service) UpdateSessionSettings(ctx context.Context, userID int64, settings models.SessionSettings) (*models.SessionSettings, error) {
+	if err := validateSessionSettings(&settings); err != nil {
+		return nil, err
+	}
+	if _, err := s.GetSession(ctx, userID, settings.SessionID); err != nil {
+		return nil, err
+	}
+	var stop any
+	if len(settings.Stop) > 0 {
+		raw, err := json.Marshal(settings.Stop)
+		if err != nil {
+			return nil, fmt.Errorf("encode stop sequences: %w", err)
+		}
+		stop = string(raw)
+	}
+	tools, err := encodeTools(settings.Tools)
+	if err != nil {
+		return nil, err
+	}
+	fallbacks, err := encodeFallbacks(settings.Fallbacks)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM session_settings WHERE session_id = ?`, settings.SessionID); err != nil {
+		return nil, fmt.Errorf("replace session settings: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO session_settings (session_id, system_prompt, temperature, top_p, max_tokens, stop, tools, fallbacks, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		settings.SessionID, settings.SystemPrompt, settings.Temperature, settings.TopP, settings.MaxTokens, stop, tools, fallbacks, time.Now().UTC(),
+	); err != nil {
+		return nil, fmt.Errorf("save session settings: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit session settings: %w", err)
+	}
+	return s.GetSessionSettings(ctx, userID, settings.SessionID)
+}
+
+// DeleteSessionSettings restores the provider defaults of a session.
+func (s *Service) DeleteSessionSettings(ctx context.Context, userID, sessionID int64) error {
+	if _, err := s.GetSession(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM session_settings WHERE session_id = ?`, sessionID); err != nil {
+		return fmt.Errorf("delete session settings: %w", err)
+	}
+	return nil
+}
+
+func validateSessionSettings(settings *models.SessionSettings) error {
+	settings.SystemPrompt = strings.TrimSpace(settings.SystemPrompt)
+	if len(settings.SystemPrompt) > maxSystemPromptLength {
+		return fmt.Errorf("%w: system_prompt is longer than %d bytes", ErrInvalidSettings, maxSystemPromptLength)
+	}
+	if t := settings.Temperature; t != nil && (*t < 0 || *t > 2) {
+		return fmt.Errorf("%w: temperature must be between 0 and 2", ErrInvalidSettings)
+	}
+	if p := settings.TopP; p != nil && (*p < 0 || *p > 1) {
+		return fmt.Errorf("%w: top_p must be between 0 and 1", ErrInvalidSettings)
+	}
+	if n := settings.MaxTokens; n != nil && *n <= 0 {
+		return fmt.Errorf("%w: max_tokens must be positive", ErrInvalidSettings)
+	}
+	if len(settings.Stop) > maxStopSequences {
+		return fmt.Errorf("%w: at most %d stop sequences", ErrInvalidSettings, maxStopSequences)
+	}
+	for _, seq := range settings.Stop {
+		if seq == "" {
+			return fmt.Errorf("%w: stop sequences must not be empty", ErrInvalidSettings)
+		}
+	}
+	for _, name := range settings.Tools {
+		if !ai.KnownTool(name) {
+			return fmt.Errorf("%w: unknown tool %q", ErrInvalidSettings, name)
+		}
+	}
+	if err := validateFallbacks(settings.Fallbacks); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+	}
+	return nil
+}
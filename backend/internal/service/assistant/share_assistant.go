@@ -0,0 +1,215 @@
+package assistant
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+// ErrShareExpiry is returned when a share link would expire before it is created.
+var ErrShareExpiry = errors.New("expires_at must be in the future")
+
+const shareLinkColumns = `id, session_id, token, snapshot IS NOT NULL, expires_at, created_at`
+
+// CreateShareLink creates a read-only link to one of the user's sessions. With snapshot
+// set the link keeps showing the session as it is now; otherwise it shows the current
+// state on every visit. expiresAt may be nil for a link that never expires.
+func (s *Service) CreateShareLink(ctx context.Context, userID, sessionID int64, snapshot bool, expiresAt *time.Time) (*models.ShareLink, error) {
+	now := time.Now().UTC()
+	if expiresAt != nil {
+		if !expiresAt.After(now) {
+			return nil, ErrShareExpiry
+		}
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+	session, err := s.GetSession(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	var stored sql.NullString
+	if snapshot {
+		shared, err := s.sharedSession(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		shared.SharedAt = now
+		shared.Snapshot = true
+		data, err := json.Marshal(shared)
+		if err != nil {
+			return nil, fmt.Errorf("encode snapshot: %w", err)
+		}
+		stored = sql.NullString{String: string(data), Valid: true}
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO share_links (token, user_id, session_id, snapshot, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		token, userID, sessionID, stored, expiresAt, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("share link id: %w", err)
+	}
+	return &models.ShareLink{
+		ID:        id,
+		SessionID: sessionID,
+		Token:     token,
+		Snapshot:  snapshot,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}, nil
+}
+
+// ListShareLinks returns the links of a session, newest first, including expired ones.
+func (s *Service) ListShareLinks(ctx context.Context, userID, sessionID int64) ([]models.ShareLink, error) {
+	if _, err := s.GetSession(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM share_links WHERE user_id = ? AND session_id = ? ORDER BY created_at DESC, id DESC`, shareLinkColumns),
+		userID, sessionID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list share links: %w", err)
+	}
+	defer rows.Close()
+	links := []models.ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan share link: %w", err)
+		}
+		links = append(links, *link)
+	}
+	return links, rows.Err()
+}
+
+// RevokeShareLink deletes a link so its token stops working.
+func (s *Service) RevokeShareLink(ctx context.Context, userID, sessionID, linkID int64) error {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM share_links WHERE id = ? AND user_id = ? AND session_id = ?`,
+		linkID, userID, sessionID,
+	)
+	if err != nil {
+		return fmt.Errorf("revoke share link: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetSharedSession resolves a share token to the public view of its session. Unknown,
+// revoked and expired tokens all return sql.ErrNoRows.
+func (s *Service) GetSharedSession(ctx context.Context, token string) (*models.SharedSession, error) {
+	var (
+		userID    int64
+		sessionID int64
+		snapshot  sql.NullString
+		expiresAt sql.NullTime
+		createdAt time.Time
+	)
+	err := s.db.QueryRowContext(ctx,
+		`SELECT user_id, session_id, snapshot, expires_at, created_at FROM share_links WHERE token = ?`,
+		token,
+	).Scan(&userID, &sessionID, &snapshot, &expiresAt, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get share link: %w", err)
+	}
+	if expiresAt.Valid && !expiresAt.Time.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	if snapshot.Valid {
+		var shared models.SharedSession
+		if err := json.Unmarshal([]byte(snapshot.String), &shared); err != nil {
+			return nil, fmt.Errorf("decode snapshot: %w", err)
+		}
+		return &shared, nil
+	}
+	session, err := s.GetSession(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := s.sharedSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	shared.SharedAt = createdAt
+	return shared, nil
+}
+
+// sharedSession builds the public view of the active branch. System messages hold file
+// summaries and are left out, as are file summaries themselves.
+func (s *Service) sharedSession(ctx context.Context, session *models.Session) (*models.SharedSession, error) {
+	_, messages, err := s.GetSessionWithMessages(ctx, session.UserID, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.ListSessionTempFiles(ctx, session.UserID, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	shared := &models.SharedSession{
+		Title:     session.Title,
+		CreatedAt: session.CreatedAt,
+		UpdatedAt: session.UpdatedAt,
+		Messages:  []models.SharedMessage{},
+	}
+	for _, m := range messages {
+		if m.Role != models.RoleUser && m.Role != models.RoleAssistant {
+			continue
+		}
+		shared.Messages = append(shared.Messages, models.SharedMessage{
+			Role:      m.Role,
+			Content:   m.Content,
+			Status:    m.Status,
+			Provider:  m.Provider,
+			Model:     m.Model,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+	for _, f := range files {
+		shared.Files = append(shared.Files, models.SharedFile{Name: f.FileName, MimeType: f.MimeType, Size: f.Size})
+	}
+	return shared, nil
+}
+
+func scanShareLink(scanner rowScanner) (*models.ShareLink, error) {
+	var (
+		link      models.ShareLink
+		expiresAt sql.NullTime
+	)
+	if err := scanner.Scan(&link.ID, &link.SessionID, &link.Token, &link.Snapshot, &expiresAt, &link.CreatedAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		t := expiresAt.Time
+		link.ExpiresAt = &t
+	}
+	return &link, nil
+}
+
+// newShareToken returns 256 random bits, URL-safe.
+func newShareToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate share token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
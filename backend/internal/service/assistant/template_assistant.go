@@ -0,0 +1,376 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"unichatgo/internal/models"
+)
+
+// ErrInvalidTemplate is returned for a prompt template with missing or oversized fields.
+var ErrInvalidTemplate = errors.New("invalid prompt template")
+
+// ErrTemplateNameTaken is returned when the user already has a template of that name.
+var ErrTemplateNameTaken = errors.New("a prompt template with this name already exists")
+
+// MissingVariablesError lists the placeholders a render call left without a value.
+type MissingVariablesError struct {
+	Names []string
+}
+
+func (e *MissingVariablesError) Error() string {
+	return "missing template variables: " + strings.Join(e.Names, ", ")
+}
+
+// Prompt library documents produced by ExportPromptTemplates.
+const (
+	PromptLibraryFormat  = "unichatgo.prompt_templates"
+	PromptLibraryVersion = 1
+)
+
+// MaxImportTemplates is the number of templates one import may carry.
+const MaxImportTemplates = 500
+
+const (
+	maxTemplateNameLength        = 100
+	maxTemplateDescriptionLength = 1000
+	maxTemplateContentLength     = 32 * 1024
+	maxTemplateTags              = 10
+	maxTemplateTagLength         = 50
+	promptTemplateColumns        = `id, user_id, name, description, content, tags, created_at, updated_at`
+)
+
+// placeholderPattern matches {{name}}, allowing spaces inside the braces.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*\}\}`)
+
+// TemplateVariables returns the placeholder names of content in order of first use.
+func TemplateVariables(content string) []string {
+	names := []string{}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(content, -1) {
+		if !slices.Contains(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// RenderTemplate fills the placeholders of content. Values are inserted as they are and
+// never expanded again; variables the content does not use are ignored. It returns a
+// *MissingVariablesError when a placeholder has no value.
+func RenderTemplate(content string, vars map[string]string) (string, error) {
+	var missing []string
+	for _, name := range TemplateVariables(content) {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", &MissingVariablesError{Names: missing}
+	}
+	return placeholderPattern.ReplaceAllStringFunc(content, func(match string) string {
+		return vars[placeholderPattern.FindStringSubmatch(match)[1]]
+	}), nil
+}
+
+// CreatePromptTemplate adds a template to the user's library.
+func (s *Service) CreatePromptTemplate(ctx context.Context, userID int64, tmpl models.PromptTemplate) (*models.PromptTemplate, error) {
+	if err := validatePromptTemplate(&tmpl); err != nil {
+		return nil, err
+	}
+	if err := s.checkTemplateName(ctx, userID, 0, tmpl.Name); err != nil {
+		return nil, err
+	}
+	id, err := insertPromptTemplate(ctx, s.db, userID, tmpl, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return s.GetPromptTemplate(ctx, userID, id)
+}
+
+// UpdatePromptTemplate replaces the fields of one of the user's templates.
+func (s *Service) UpdatePromptTemplate(ctx context.Context, userID int64, tmpl models.PromptTemplate) (*models.PromptTemplate, error) {
+	if err := validatePromptTemplate(&tmpl); err != nil {
+		return nil, err
+	}
+	if _, err := s.GetPromptTemplate(ctx, userID, tmpl.ID); err != nil {
+		return nil, err
+	}
+	if err := s.checkTemplateName(ctx, userID, tmpl.ID, tmpl.Name); err != nil {
+		return nil, err
+	}
+	if err := updatePromptTemplate(ctx, s.db, userID, tmpl, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return s.GetPromptTemplate(ctx, userID, tmpl.ID)
+}
+
+// DeletePromptTemplate removes a template from the user's library.
+func (s *Service) DeletePromptTemplate(ctx context.Context, userID, templateID int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM prompt_templates WHERE id = ? AND user_id = ?`, templateID, userID)
+	if err != nil {
+		return fmt.Errorf("delete prompt template: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetPromptTemplate returns one of the user's templates, or sql.ErrNoRows.
+func (s *Service) GetPromptTemplate(ctx context.Context, userID, templateID int64) (*models.PromptTemplate, error) {
+	tmpl, err := scanPromptTemplate(s.db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM prompt_templates WHERE id = ? AND user_id = ?`, promptTemplateColumns),
+		templateID, userID,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get prompt template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// ListPromptTemplates returns the user's templates ordered by name, only those carrying
+// tag when it is not empty.
+func (s *Service) ListPromptTemplates(ctx context.Context, userID int64, tag string) ([]*models.PromptTemplate, error) {
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM prompt_templates WHERE user_id = ? ORDER BY name ASC, id ASC`, promptTemplateColumns),
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list prompt templates: %w", err)
+	}
+	defer rows.Close()
+	templates := []*models.PromptTemplate{}
+	for rows.Next() {
+		tmpl, err := scanPromptTemplate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan prompt template: %w", err)
+		}
+		if tag != "" && !slices.Contains(tmpl.Tags, tag) {
+			continue
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, rows.Err()
+}
+
+// RenderPromptTemplate fills one of the user's templates with vars, see RenderTemplate.
+func (s *Service) RenderPromptTemplate(ctx context.Context, userID, templateID int64, vars map[string]string) (string, error) {
+	tmpl, err := s.GetPromptTemplate(ctx, userID, templateID)
+	if err != nil {
+		return "", err
+	}
+	return RenderTemplate(tmpl.Content, vars)
+}
+
+// ExportPromptTemplates returns the user's templates (those carrying tag when it is not
+// empty) as a prompt library document.
+func (s *Service) ExportPromptTemplates(ctx context.Context, userID int64, tag string) (*models.PromptLibrary, error) {
+	templates, err := s.ListPromptTemplates(ctx, userID, tag)
+	if err != nil {
+		return nil, err
+	}
+	lib := &models.PromptLibrary{
+		Format:     PromptLibraryFormat,
+		Version:    PromptLibraryVersion,
+		ExportedAt: time.Now().UTC(),
+		Templates:  make([]models.PromptLibraryEntry, 0, len(templates)),
+	}
+	for _, tmpl := range templates {
+		lib.Templates = append(lib.Templates, models.PromptLibraryEntry{
+			Name:        tmpl.Name,
+			Description: tmpl.Description,
+			Content:     tmpl.Content,
+			Tags:        tmpl.Tags,
+		})
+	}
+	return lib, nil
+}
+
+// TemplateImportResult counts what an import did with the templates it carried.
+type TemplateImportResult struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// ImportPromptTemplates adds the templates of a prompt library to the user's library.
+// A template whose name the user already has is skipped, or replaces the existing one
+// with overwrite. The whole document is validated first and nothing is stored when any
+// template is invalid.
+func (s *Service) ImportPromptTemplates(ctx context.Context, userID int64, lib models.PromptLibrary, overwrite bool) (*TemplateImportResult, error) {
+	if lib.Format != PromptLibraryFormat {
+		return nil, fmt.Errorf("%w: unexpected document format %q", ErrInvalidTemplate, lib.Format)
+	}
+	if lib.Version < 1 || lib.Version > PromptLibraryVersion {
+		return nil, fmt.Errorf("%w: unsupported document version %d", ErrInvalidTemplate, lib.Version)
+	}
+	if len(lib.Templates) > MaxImportTemplates {
+		return nil, fmt.Errorf("%w: at most %d templates per import", ErrInvalidTemplate, MaxImportTemplates)
+	}
+	templates := make([]models.PromptTemplate, 0, len(lib.Templates))
+	seen := make(map[string]int, len(lib.Templates))
+	for i, entry := range lib.Templates {
+		tmpl := models.PromptTemplate{Name: entry.Name, Description: entry.Description, Content: entry.Content, Tags: entry.Tags}
+		if err := validatePromptTemplate(&tmpl); err != nil {
+			return nil, fmt.Errorf("template %d: %w", i+1, err)
+		}
+		// the last template of a name wins, as if they were imported one by one
+		if j, ok := seen[tmpl.Name]; ok {
+			templates[j] = tmpl
+			continue
+		}
+		seen[tmpl.Name] = len(templates)
+		templates = append(templates, tmpl)
+	}
+	existing, err := s.ListPromptTemplates(ctx, userID, "")
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]int64, len(existing))
+	for _, tmpl := range existing {
+		byName[tmpl.Name] = tmpl.ID
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	result := &TemplateImportResult{}
+	for _, tmpl := range templates {
+		id, ok := byName[tmpl.Name]
+		switch {
+		case !ok:
+			if _, err := insertPromptTemplate(ctx, tx, userID, tmpl, now); err != nil {
+				return nil, err
+			}
+			result.Created++
+		case overwrite:
+			tmpl.ID = id
+			if err := updatePromptTemplate(ctx, tx, userID, tmpl, now); err != nil {
+				return nil, err
+			}
+			result.Updated++
+		default:
+			result.Skipped++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit template import: %w", err)
+	}
+	return result, nil
+}
+
+func insertPromptTemplate(ctx context.Context, db execer, userID int64, tmpl models.PromptTemplate, now time.Time) (int64, error) {
+	tags, err := json.Marshal(tmpl.Tags)
+	if err != nil {
+		return 0, fmt.Errorf("encode tags: %w", err)
+	}
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO prompt_templates (user_id, name, description, content, tags, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, tmpl.Name, tmpl.Description, tmpl.Content, string(tags), now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("create prompt template: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("prompt template id: %w", err)
+	}
+	return id, nil
+}
+
+func updatePromptTemplate(ctx context.Context, db execer, userID int64, tmpl models.PromptTemplate, now time.Time) error {
+	tags, err := json.Marshal(tmpl.Tags)
+	if err != nil {
+		return fmt.Errorf("encode tags: %w", err)
+	}
+	if _, err := db.ExecContext(ctx,
+		`UPDATE prompt_templates SET name = ?, description = ?, content = ?, tags = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
+		tmpl.Name, tmpl.Description, tmpl.Content, string(tags), now, tmpl.ID, userID,
+	); err != nil {
+		return fmt.Errorf("update prompt template: %w", err)
+	}
+	return nil
+}
+
+// checkTemplateName reports ErrTemplateNameTaken when another template of the user,
+// other than exceptID, has the name.
+func (s *Service) checkTemplateName(ctx context.Context, userID, exceptID int64, name string) error {
+	var taken bool
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM prompt_templates WHERE user_id = ? AND name = ? AND id <> ?)`,
+		userID, name, exceptID,
+	).Scan(&taken); err != nil {
+		return fmt.Errorf("check template name: %w", err)
+	}
+	if taken {
+		return ErrTemplateNameTaken
+	}
+	return nil
+}
+
+func scanPromptTemplate(scanner rowScanner) (*models.PromptTemplate, error) {
+	var (
+		tmpl models.PromptTemplate
+		tags string
+	)
+	if err := scanner.Scan(&tmpl.ID, &tmpl.UserID, &tmpl.Name, &tmpl.Description, &tmpl.Content, &tags, &tmpl.CreatedAt, &tmpl.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &tmpl.Tags); err != nil {
+		return nil, fmt.Errorf("decode tags: %w", err)
+	}
+	if tmpl.Tags == nil {
+		tmpl.Tags = []string{}
+	}
+	tmpl.Variables = TemplateVariables(tmpl.Content)
+	return &tmpl, nil
+}
+
+func validatePromptTemplate(tmpl *models.PromptTemplate) error {
+	tmpl.Name = strings.TrimSpace(tmpl.Name)
+	tmpl.Description = strings.TrimSpace(tmpl.Description)
+	if tmpl.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidTemplate)
+	}
+	if len([]rune(tmpl.Name)) > maxTemplateNameLength {
+		return fmt.Errorf("%w: name is longer than %d characters", ErrInvalidTemplate, maxTemplateNameLength)
+	}
+	if len([]rune(tmpl.Description)) > maxTemplateDescriptionLength {
+		return fmt.Errorf("%w: description is longer than %d characters", ErrInvalidTemplate, maxTemplateDescriptionLength)
+	}
+	if strings.TrimSpace(tmpl.Content) == "" {
+		return fmt.Errorf("%w: content is required", ErrInvalidTemplate)
+	}
+	if len(tmpl.Content) > maxTemplateContentLength {
+		return fmt.Errorf("%w: content is longer than %d bytes", ErrInvalidTemplate, maxTemplateContentLength)
+	}
+	tags := make([]string, 0, len(tmpl.Tags))
+	for _, tag := range tmpl.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if len([]rune(tag)) > maxTemplateTagLength {
+			return fmt.Errorf("%w: tag %q is longer than %d characters", ErrInvalidTemplate, tag, maxTemplateTagLength)
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTemplateTags {
+		return fmt.Errorf("%w: at most %d tags", ErrInvalidTemplate, maxTemplateTags)
+	}
+	tmpl.Tags = tags
+	return nil
+}
@@ -0,0 +1,171 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"unichatgo/internal/config"
+	"unichatgo/internal/models"
+)
+
+// ErrBudgetExhausted is returned when a user has spent the monthly budget.
+var ErrBudgetExhausted = errors.New("monthly budget exhausted")
+
+// ErrInvalidBudget is returned for a budget a user may not set.
+var ErrInvalidBudget = errors.New("invalid monthly_budget")
+
+// Usage periods accepted by UsageSummary.
+const (
+	UsagePeriodDaily   = "daily"
+	UsagePeriodMonthly = "monthly"
+)
+
+const defaultSoftLimit = 0.8
+
+// ConfigureUsage sets the price table and the default budget. Without it every
+// generation costs nothing and budgets are unlimited unless set per user.
+func (s *Service) ConfigureUsage(cfg config.UsageConfig) {
+	if cfg.SoftLimit <= 0 || cfg.SoftLimit > 1 {
+		cfg.SoftLimit = defaultSoftLimit
+	}
+	s.usage = cfg
+}
+
+// Cost prices a generation with the configured table; unknown models are free.
+func (s *Service) Cost(provider, model string, promptTokens, completionTokens int) float64 {
+	price, ok := s.usage.Prices[provider+"/"+model]
+	if !ok {
+		price = s.usage.Prices[provider+"/*"]
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6
+}
+
+// RecordUsage prices a generation and adds it to the user's ledger.
+func (s *Service) RecordUsage(ctx context.Context, rec models.UsageRecord) (*models.UsageRecord, error) {
+	rec.Cost = s.Cost(rec.Provider, rec.Model, rec.PromptTokens, rec.CompletionTokens)
+	rec.CreatedAt = time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO usage_records (user_id, session_id, provider, model, prompt_tokens, completion_tokens, cost, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.UserID, nullableID(rec.SessionID), rec.Provider, rec.Model, rec.PromptTokens, rec.CompletionTokens, rec.Cost, rec.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("record usage: %w", err)
+	}
+	if rec.ID, err = res.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("usage record id: %w", err)
+	}
+	return &rec, nil
+}
+
+// UsageSummary aggregates the ledger between from (inclusive) and to (exclusive) per
+// day or month and per provider/model, oldest period first.
+func (s *Service) UsageSummary(ctx context.Context, userID int64, period string, from, to time.Time) ([]models.UsageBucket, error) {
+	layout := "2006-01-02"
+	if period == UsagePeriodMonthly {
+		layout = "2006-01"
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT provider, model, prompt_tokens, completion_tokens, cost, created_at FROM usage_records
+			WHERE user_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at ASC, id ASC`,
+		userID, from.UTC(), to.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load usage: %w", err)
+	}
+	defer rows.Close()
+	buckets := []models.UsageBucket{}
+	index := make(map[[3]string]int)
+	for rows.Next() {
+		var rec models.UsageRecord
+		if err := rows.Scan(&rec.Provider, &rec.Model, &rec.PromptTokens, &rec.CompletionTokens, &rec.Cost, &rec.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan usage: %w", err)
+		}
+		key := [3]string{rec.CreatedAt.UTC().Format(layout), rec.Provider, rec.Model}
+		i, ok := index[key]
+		if !ok {
+			i = len(buckets)
+			index[key] = i
+			buckets = append(buckets, models.UsageBucket{Period: key[0], Provider: rec.Provider, Model: rec.Model})
+		}
+		b := &buckets[i]
+		b.Requests++
+		b.PromptTokens += rec.PromptTokens
+		b.CompletionTokens += rec.CompletionTokens
+		b.Cost += rec.Cost
+	}
+	return buckets, rows.Err()
+}
+
+// BudgetStatus reports what the user spent this month against their budget: the
+// user's own budget when set and within the configured default, otherwise the default.
+func (s *Service) BudgetStatus(ctx context.Context, userID int64) (*models.BudgetStatus, error) {
+	var budget sql.NullFloat64
+	if err := s.db.QueryRowContext(ctx, `SELECT monthly_budget FROM users WHERE id = ?`, userID).Scan(&budget); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("load budget: %w", err)
+	}
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var spent float64
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(cost), 0) FROM usage_records WHERE user_id = ? AND created_at >= ?`,
+		userID, monthStart,
+	).Scan(&spent); err != nil {
+		return nil, fmt.Errorf("load monthly spend: %w", err)
+	}
+	status := &models.BudgetStatus{
+		MonthlyBudget: s.usage.MonthlyBudget,
+		Spent:         spent,
+		SoftLimit:     s.usage.SoftLimit,
+	}
+	if status.SoftLimit == 0 {
+		status.SoftLimit = defaultSoftLimit
+	}
+	if budget.Valid {
+		status.MonthlyBudget = s.capBudget(budget.Float64)
+	}
+	if status.MonthlyBudget > 0 {
+		status.Remaining = max(status.MonthlyBudget-spent, 0)
+		status.Warning = spent >= status.MonthlyBudget*status.SoftLimit
+		status.Exhausted = spent >= status.MonthlyBudget
+	}
+	return status, nil
+}
+
+// SetMonthlyBudget sets the user's own budget in USD; nil falls back to the default.
+// With a configured default the user's budget can only lower it: larger values are
+// capped at the default and 0 is rejected. Without one, 0 removes the limit.
+func (s *Service) SetMonthlyBudget(ctx context.Context, userID int64, budget *float64) error {
+	if budget != nil {
+		switch {
+		case *budget < 0:
+			return fmt.Errorf("%w: must not be negative", ErrInvalidBudget)
+		case *budget == 0 && s.usage.MonthlyBudget > 0:
+			return fmt.Errorf("%w: cannot exceed the default of %g USD", ErrInvalidBudget, s.usage.MonthlyBudget)
+		}
+		capped := s.capBudget(*budget)
+		budget = &capped
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET monthly_budget = ? WHERE id = ?`, budget, userID)
+	if err != nil {
+		return fmt.Errorf("set budget: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// capBudget limits a user's budget to the configured default, treating 0 (unlimited)
+// as above it. Budgets stored before the default was lowered are capped on read.
+func (s *Service) capBudget(budget float64) float64 {
+	if s.usage.MonthlyBudget > 0 && (budget == 0 || budget > s.usage.MonthlyBudget) {
+		return s.usage.MonthlyBudget
+	}
+	return budget
+}
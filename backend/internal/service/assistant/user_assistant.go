@@ -10,13 +10,20 @@ import (
 	"strings"
 	"time"
 
+	"unichatgo/internal/config"
 	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
 )
 
 // Service handles user lifecycle and input persistence.
 type Service struct {
 	db     *sql.DB
 	cipher *tokenCipher
+	search searchMode
+	usage  config.UsageConfig
+	// userProviders holds the allowlist of user provider base URLs
+	userProviders config.UserProvidersConfig
+	admins        config.AdminConfig
 }
 
 // TokenInfo describes a stored provider token without exposing the secret value.
@@ -31,7 +38,7 @@ func NewService(db *sql.DB) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Service{db: db, cipher: cipher}, nil
+	return &Service{db: db, cipher: cipher, search: detectSearchMode(db)}, nil
 }
 
 // RegisterUser creates a user with the supplied credentials.
@@ -99,7 +106,7 @@ func (s *Service) DeleteUser(ctx context.Context, id int64) error {
 	if affected == 0 {
 		return sql.ErrNoRows
 	}
-	return nil
+	return s.unindexUser(ctx, id)
 }
 
 // AppendMessageToSession persists a message for an existing session/user pair.
@@ -140,13 +147,22 @@ func hashPassword(input string) string {
 }
 
 // EnsureAIReady verifies that the user has configured a token for the provider.
+// Providers that work without a user key (local openai-compatible endpoints) and the
+// user's own providers, which carry their key, return an empty token instead.
 func (s *Service) EnsureAIReady(ctx context.Context, userID int64, provider string) (string, error) {
 	token, err := s.HasUserToken(ctx, userID, provider)
 	if err != nil {
 		return "", err
 	}
+	if _, configured := llm.Default.Lookup(provider); token == "" && !configured {
+		if _, _, err := s.UserProviderConfig(ctx, userID, provider); err == nil {
+			return "", nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+	}
 	// Must have api token.
-	if token == "" {
+	if token == "" && llm.Default.RequiresUserKey(provider) {
 		return "", errors.New("api token not configured")
 	}
 	return token, nil
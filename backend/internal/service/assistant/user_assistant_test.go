@@ -10,6 +10,7 @@ import (
 
 	"unichatgo/internal/config"
 	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
 	"unichatgo/internal/storage"
 )
 
@@ -109,6 +110,43 @@ func TestListAndDeleteUserTokens(t *testing.T) {
 	}
 }
 
+func TestEnsureAIReadyWithKeylessProvider(t *testing.T) {
+	t.Setenv(apiTokenKeyEnv, strings.Repeat("e", 32))
+	db := openTestDB(t)
+	defer db.Close()
+
+	svc, err := NewService(db)
+	if err != nil {
+		t.Fatalf("new service: %v", err)
+	}
+	if err := llm.RegisterBuiltins(llm.Default); err != nil {
+		t.Fatalf("register providers: %v", err)
+	}
+	if err := llm.Default.Configure(map[string]config.ProviderConfig{
+		"openai": {Model: "gpt-4o"},
+		"ollama": {Type: llm.TypeOpenAICompatible, BaseURL: "http://localhost:11434/v1", Models: []string{"llama3"}},
+	}); err != nil {
+		t.Fatalf("configure providers: %v", err)
+	}
+	t.Cleanup(func() { _ = llm.Default.Configure(nil) })
+
+	ctx := context.Background()
+	userID := insertTestUser(t, db, "erin")
+	if _, err := svc.EnsureAIReady(ctx, userID, "openai"); err == nil {
+		t.Fatalf("expected openai without token to be rejected")
+	}
+	token, err := svc.EnsureAIReady(ctx, userID, "ollama")
+	if err != nil || token != "" {
+		t.Fatalf("expected keyless provider to be ready, got %q, %v", token, err)
+	}
+	if err := svc.SetUserToken(ctx, userID, "ollama", "own-key"); err != nil {
+		t.Fatalf("set token: %v", err)
+	}
+	if token, err = svc.EnsureAIReady(ctx, userID, "ollama"); err != nil || token != "own-key" {
+		t.Fatalf("expected stored token, got %q, %v", token, err)
+	}
+}
+
 func TestTempFileLookupAndSummaryUpdate(t *testing.T) {
 	t.Setenv(apiTokenKeyEnv, strings.Repeat("d", 32))
 	db := openTestDB(t)
@@ -159,6 +197,53 @@ func TestTempFileLookupAndSummaryUpdate(t *testing.T) {
 	}
 }
 
+func TestAbandonedIdempotencyClaimIsTakenOver(t *testing.T) {
+	t.Setenv(apiTokenKeyEnv, strings.Repeat("c", 32))
+	db := openTestDB(t)
+	defer db.Close()
+	svc, err := NewService(db)
+	if err != nil {
+		t.Fatalf("new service: %v", err)
+	}
+	ctx := context.Background()
+	userID := insertTestUser(t, db, "carol")
+	session, err := svc.CreateSession(ctx, userID, "Retries")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	first, claimed, err := svc.ClaimIdempotencyKey(ctx, userID, session.ID, "msg-1", "hash", time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("first claim: claimed=%v err=%v", claimed, err)
+	}
+	if lease := time.Until(first.ExpiresAt); lease > IdempotencyClaimLease {
+		t.Fatalf("pending claim should only hold a lease, expires in %v", lease)
+	}
+	if _, claimed, err := svc.ClaimIdempotencyKey(ctx, userID, session.ID, "msg-1", "hash", time.Hour); err != nil || claimed {
+		t.Fatalf("a live claim must not be taken over: claimed=%v err=%v", claimed, err)
+	}
+
+	// the claiming instance crashed: its lease runs out and a retry takes the key over
+	if _, err := db.Exec(`UPDATE idempotency_keys SET expires_at = ? WHERE id = ?`, time.Now().UTC().Add(-time.Second), first.ID); err != nil {
+		t.Fatalf("expire lease: %v", err)
+	}
+	second, claimed, err := svc.ClaimIdempotencyKey(ctx, userID, session.ID, "msg-1", "hash", time.Hour)
+	if err != nil || !claimed || second.ID == first.ID {
+		t.Fatalf("expected the abandoned claim to be taken over: claimed=%v err=%v", claimed, err)
+	}
+
+	if err := svc.CompleteIdempotencyKey(ctx, second.ID, 0, 0, "", "", time.Hour); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	done, err := svc.GetIdempotencyKey(ctx, userID, session.ID, "msg-1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if done.Status != models.IdempotencyDone || time.Until(done.ExpiresAt) < 50*time.Minute {
+		t.Fatalf("finished request should be kept for the retention, got %+v", done)
+	}
+}
+
 func openTestDB(t *testing.T) *sql.DB {
 	t.Helper()
 	cfg := &config.Config{
@@ -0,0 +1,273 @@
+package assistant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"unichatgo/internal/config"
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
+)
+
+// ErrInvalidUserProvider is returned for a user provider with missing or malformed fields.
+var ErrInvalidUserProvider = errors.New("invalid provider")
+
+// ErrBaseURLNotAllowed is returned for a base URL outside the configured allowlist.
+var ErrBaseURLNotAllowed = errors.New("base_url is not allowed")
+
+// UserProviderTypes are the provider types users may register endpoints of.
+var UserProviderTypes = []string{llm.TypeOpenAI, llm.TypeAzureOpenAI, llm.TypeOpenAICompatible}
+
+const maxUserProviderHeaders = 20
+
+var (
+	userProviderNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	headerNamePattern       = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+)
+
+// ConfigureUserProviders sets the allowlist of user provider base URLs. Without it
+// users cannot register providers.
+func (s *Service) ConfigureUserProviders(cfg config.UserProvidersConfig) {
+	s.userProviders = cfg
+}
+
+// SaveUserProvider creates or replaces the user's provider of the same name. A nil
+// apiKey keeps the stored key and nil Headers keep the stored headers.
+func (s *Service) SaveUserProvider(ctx context.Context, userID int64, p models.UserProvider, apiKey *string) (*models.UserProvider, error) {
+	if err := s.validateUserProvider(&p); err != nil {
+		return nil, err
+	}
+	existing, err := s.GetUserProvider(ctx, userID, p.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if existing != nil {
+		if apiKey == nil {
+			p.APIKey = existing.APIKey
+		}
+		if p.Headers == nil {
+			p.Headers = existing.Headers
+		}
+	}
+	if apiKey != nil {
+		p.APIKey = strings.TrimSpace(*apiKey)
+	}
+	key, err := s.encryptSecret(p.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	var headers string
+	if len(p.Headers) > 0 {
+		raw, err := json.Marshal(p.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("encode headers: %w", err)
+		}
+		if headers, err = s.encryptSecret(string(raw)); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now().UTC()
+	if existing != nil {
+		_, err = s.db.ExecContext(ctx,
+			`UPDATE user_providers SET type = ?, base_url = ?, api_version = ?, model = ?, context_window = ?, headers = ?, api_key = ?, updated_at = ? WHERE id = ?`,
+			p.Type, p.BaseURL, p.APIVersion, p.Model, p.ContextWindow, headers, key, now, existing.ID,
+		)
+	} else {
+		_, err = s.db.ExecContext(ctx,
+			`INSERT INTO user_providers (user_id, name, type, base_url, api_version, model, context_window, headers, api_key, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, p.Name, p.Type, p.BaseURL, p.APIVersion, p.Model, p.ContextWindow, headers, key, now, now,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("save provider: %w", err)
+	}
+	return s.GetUserProvider(ctx, userID, p.Name)
+}
+
+// GetUserProvider returns one of the user's providers including its secrets.
+func (s *Service) GetUserProvider(ctx context.Context, userID int64, name string) (*models.UserProvider, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, user_id, name, type, base_url, api_version, model, context_window, headers, api_key, created_at, updated_at FROM user_providers WHERE user_id = ? AND name = ?`,
+		userID, strings.TrimSpace(name),
+	)
+	p, err := s.scanUserProvider(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("load provider: %w", err)
+	}
+	return p, nil
+}
+
+// ListUserProviders returns the user's providers ordered by name.
+func (s *Service) ListUserProviders(ctx context.Context, userID int64) ([]*models.UserProvider, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, user_id, name, type, base_url, api_version, model, context_window, headers, api_key, created_at, updated_at FROM user_providers WHERE user_id = ? ORDER BY name ASC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list providers: %w", err)
+	}
+	defer rows.Close()
+	providers := []*models.UserProvider{}
+	for rows.Next() {
+		p, err := s.scanUserProvider(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan provider: %w", err)
+		}
+		providers = append(providers, p)
+	}
+	return providers, rows.Err()
+}
+
+// DeleteUserProvider removes one of the user's providers.
+func (s *Service) DeleteUserProvider(ctx context.Context, userID int64, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM user_providers WHERE user_id = ? AND name = ?`, userID, strings.TrimSpace(name))
+	if err != nil {
+		return fmt.Errorf("delete provider: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UserProviderConfig resolves one of the user's providers into a provider configuration
+// and its key. The base URL is checked again so narrowing the allowlist takes effect
+// for stored providers.
+func (s *Service) UserProviderConfig(ctx context.Context, userID int64, name string) (config.ProviderConfig, string, error) {
+	p, err := s.GetUserProvider(ctx, userID, name)
+	if err != nil {
+		return config.ProviderConfig{}, "", err
+	}
+	if !baseURLAllowed(p.BaseURL, s.userProviders.AllowedBaseURLs) {
+		return config.ProviderConfig{}, "", fmt.Errorf("provider %s: %w", p.Name, ErrBaseURLNotAllowed)
+	}
+	return config.ProviderConfig{
+		Type:          p.Type,
+		BaseURL:       p.BaseURL,
+		APIVersion:    p.APIVersion,
+		Model:         p.Model,
+		ContextWindow: p.ContextWindow,
+		Headers:       p.Headers,
+	}, p.APIKey, nil
+}
+
+func (s *Service) scanUserProvider(row rowScanner) (*models.UserProvider, error) {
+	var (
+		p       models.UserProvider
+		headers string
+		key     string
+	)
+	if err := row.Scan(&p.ID, &p.UserID, &p.Name, &p.Type, &p.BaseURL, &p.APIVersion, &p.Model, &p.ContextWindow, &headers, &key, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.APIKey, err = s.decryptToken(key); err != nil {
+		return nil, fmt.Errorf("decrypt provider key: %w", err)
+	}
+	p.HasKey = p.APIKey != ""
+	p.HeaderNames = []string{}
+	if headers != "" {
+		raw, err := s.decryptToken(headers)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt provider headers: %w", err)
+		}
+		if err := json.Unmarshal([]byte(raw), &p.Headers); err != nil {
+			return nil, fmt.Errorf("decode provider headers: %w", err)
+		}
+		for name := range p.Headers {
+			p.HeaderNames = append(p.HeaderNames, name)
+		}
+		slices.Sort(p.HeaderNames)
+	}
+	return &p, nil
+}
+
+// encryptSecret encrypts a non-empty secret; empty secrets are stored as is.
+func (s *Service) encryptSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	return s.encryptToken(secret)
+}
+
+func (s *Service) validateUserProvider(p *models.UserProvider) error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Type = strings.TrimSpace(p.Type)
+	p.BaseURL = strings.TrimSpace(p.BaseURL)
+	p.APIVersion = strings.TrimSpace(p.APIVersion)
+	p.Model = strings.TrimSpace(p.Model)
+	if !userProviderNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("%w: name must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidUserProvider)
+	}
+	if _, ok := llm.Default.Lookup(p.Name); ok {
+		return fmt.Errorf("%w: name %s is used by a server provider", ErrInvalidUserProvider, p.Name)
+	}
+	if !slices.Contains(UserProviderTypes, p.Type) {
+		return fmt.Errorf("%w: type must be one of %s", ErrInvalidUserProvider, strings.Join(UserProviderTypes, ", "))
+	}
+	if err := llm.ValidateConfig(p.Type, config.ProviderConfig{BaseURL: p.BaseURL, APIVersion: p.APIVersion}); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUserProvider, err)
+	}
+	if p.BaseURL == "" {
+		return fmt.Errorf("%w: base_url is required", ErrInvalidUserProvider)
+	}
+	if !baseURLAllowed(p.BaseURL, s.userProviders.AllowedBaseURLs) {
+		return ErrBaseURLNotAllowed
+	}
+	if p.ContextWindow < 0 {
+		return fmt.Errorf("%w: context_window must not be negative", ErrInvalidUserProvider)
+	}
+	if len(p.Headers) > maxUserProviderHeaders {
+		return fmt.Errorf("%w: at most %d headers", ErrInvalidUserProvider, maxUserProviderHeaders)
+	}
+	for name, value := range p.Headers {
+		if !headerNamePattern.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%w: invalid header %q", ErrInvalidUserProvider, name)
+		}
+	}
+	return nil
+}
+
+// baseURLAllowed reports whether an http(s) URL starts with one of the allowlist
+// entries: same scheme, same host (or a subdomain of a "*." host) and a path below the
+// entry's path. Paths with dot segments are rejected, as they could climb out of it.
+func baseURLAllowed(raw string, allowlist []string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return false
+	}
+	if p := strings.TrimRight(u.Path, "/"); p != "" && path.Clean(p) != p {
+		return false
+	}
+	for _, entry := range allowlist {
+		allowed, err := url.Parse(strings.TrimSpace(entry))
+		if err != nil || allowed.Host == "" || !strings.EqualFold(u.Scheme, allowed.Scheme) {
+			continue
+		}
+		host, allowedHost := strings.ToLower(u.Host), strings.ToLower(allowed.Host)
+		if suffix, ok := strings.CutPrefix(allowedHost, "*."); ok {
+			if !strings.HasSuffix(host, "."+suffix) {
+				continue
+			}
+		} else if host != allowedHost {
+			continue
+		}
+		prefix := strings.TrimSuffix(allowed.Path, "/")
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
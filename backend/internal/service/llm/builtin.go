@@ -0,0 +1,124 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cloudwego/eino-ext/components/model/claude"
+	"github.com/cloudwego/eino-ext/components/model/gemini"
+	"github.com/cloudwego/eino-ext/components/model/openai"
+	"github.com/cloudwego/eino/components/model"
+	"google.golang.org/genai"
+
+	"unichatgo/internal/config"
+)
+
+// Built-in provider types.
+const (
+	TypeOpenAI = "openai"
+	TypeGemini = "gemini"
+	TypeClaude = "claude"
+	// TypeAzureOpenAI serves Azure OpenAI deployments: base_url is the resource
+	// endpoint, model the deployment name and api_version is required.
+	TypeAzureOpenAI = "azure-openai"
+)
+
+// RegisterBuiltins registers the providers shipped with the service.
+func RegisterBuiltins(r *Registry) error {
+	for typ, p := range map[string]Provider{
+		TypeOpenAI:           ProviderFunc(newOpenAI),
+		TypeGemini:           ProviderFunc(newGemini),
+		TypeClaude:           ProviderFunc(newClaude),
+		TypeAzureOpenAI:      ProviderFunc(newAzureOpenAI),
+		TypeOpenAICompatible: openAICompatible{},
+	} {
+		if err := r.Register(typ, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newOpenAI(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	return openai.NewChatModel(ctx, &openai.ChatModelConfig{
+		BaseURL:         spec.Config.BaseURL,
+		Model:           spec.Model,
+		APIKey:          spec.APIKey,
+		ReasoningEffort: openai.ReasoningEffortLevel(spec.Config.ReasoningEffort),
+		HTTPClient:      providerClient(spec.Config.Headers),
+	})
+}
+
+func newAzureOpenAI(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	if spec.Config.BaseURL == "" || spec.Config.APIVersion == "" {
+		return nil, errors.New("base_url and api_version are required")
+	}
+	return openai.NewChatModel(ctx, &openai.ChatModelConfig{
+		ByAzure:         true,
+		BaseURL:         spec.Config.BaseURL,
+		APIVersion:      spec.Config.APIVersion,
+		Model:           spec.Model,
+		APIKey:          spec.APIKey,
+		ReasoningEffort: openai.ReasoningEffortLevel(spec.Config.ReasoningEffort),
+		HTTPClient:      providerClient(spec.Config.Headers),
+	})
+}
+
+func newGemini(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	client, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:     spec.APIKey,
+		HTTPClient: providerClient(nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new gemini client: %w", err)
+	}
+	var budget *int32
+	if spec.Config.ThinkingBudget > 0 {
+		b := int32(spec.Config.ThinkingBudget)
+		budget = &b
+	}
+	return gemini.NewChatModel(ctx, &gemini.Config{
+		Client: client,
+		Model:  spec.Model,
+		ThinkingConfig: &genai.ThinkingConfig{
+			IncludeThoughts: true,
+			ThinkingBudget:  budget,
+		},
+	})
+}
+
+// ClaudeThinkingBudget returns the extended thinking budget of a Claude provider, 0 for
+// other providers or without thinking. While thinking, Claude counts the budget toward
+// max_tokens and rejects a temperature.
+func ClaudeThinkingBudget(name string, cfg config.ProviderConfig) int {
+	if TypeOf(name, cfg) != TypeClaude {
+		return 0
+	}
+	return max(cfg.ThinkingBudget, 0)
+}
+
+func newClaude(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	var baseURLPtr *string
+	if spec.Config.BaseURL != "" {
+		baseURL := spec.Config.BaseURL
+		baseURLPtr = &baseURL
+	}
+	maxTokens := spec.Config.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = config.DefaultMaxTokens
+	}
+	cfg := &claude.Config{
+		APIKey:     spec.APIKey,
+		Model:      spec.Model,
+		BaseURL:    baseURLPtr,
+		MaxTokens:  maxTokens,
+		HTTPClient: providerClient(nil),
+	}
+	if spec.Config.ThinkingBudget > 0 {
+		// thinking tokens count towards max_tokens, keep the usual room for the answer
+		cfg.Thinking = &claude.Thinking{Enable: true, BudgetTokens: spec.Config.ThinkingBudget}
+		cfg.MaxTokens += spec.Config.ThinkingBudget
+	}
+	return claude.NewChatModel(ctx, cfg)
+}
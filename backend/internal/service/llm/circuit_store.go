@@ -0,0 +1,191 @@
+package llm
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// CircuitRecord is the stored state of a provider's circuit.
+type CircuitRecord struct {
+	Failures  int
+	OpenedAt  time.Time // zero while the circuit is closed
+	LastError string
+	LastFail  time.Time
+}
+
+// CircuitStore keeps the circuits of a Breaker. The in-process store serves a single
+// instance; NewRedisCircuitStore shares the circuits between instances.
+type CircuitStore interface {
+	// Load returns the circuit of key, the zero record when none was stored.
+	Load(ctx context.Context, key string) (CircuitRecord, error)
+	// Probe claims the single call let through an expired open circuit for ttl. It
+	// reports false while another call holds the claim.
+	Probe(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error)
+	// Fail counts a failure at the given time. The circuit opens when the failures
+	// reach threshold or when a probe was in progress, which the failure ends.
+	Fail(ctx context.Context, key, lastError string, at time.Time, threshold int) error
+	// Reset closes the circuit of key and ends its probe.
+	Reset(ctx context.Context, key string) error
+	// Keys lists the circuits stored so far.
+	Keys(ctx context.Context) ([]string, error)
+}
+
+// memoryCircuits keeps the circuits in the process. It is safe for concurrent use.
+type memoryCircuits struct {
+	mu       sync.Mutex
+	circuits map[string]*memoryCircuit
+}
+
+type memoryCircuit struct {
+	CircuitRecord
+	probeUntil time.Time
+}
+
+func newMemoryCircuits() *memoryCircuits {
+	return &memoryCircuits{circuits: make(map[string]*memoryCircuit)}
+}
+
+func (m *memoryCircuits) circuit(key string) *memoryCircuit {
+	c, ok := m.circuits[key]
+	if !ok {
+		c = &memoryCircuit{}
+		m.circuits[key] = c
+	}
+	return c
+}
+
+func (m *memoryCircuits) Load(ctx context.Context, key string) (CircuitRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.circuits[key]; ok {
+		return c.CircuitRecord, nil
+	}
+	return CircuitRecord{}, nil
+}
+
+func (m *memoryCircuits) Probe(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.circuit(key)
+	if c.probeUntil.After(now) {
+		return false, nil
+	}
+	c.probeUntil = now.Add(ttl)
+	return true, nil
+}
+
+func (m *memoryCircuits) Fail(ctx context.Context, key, lastError string, at time.Time, threshold int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.circuit(key)
+	c.Failures++
+	c.LastError = lastError
+	c.LastFail = at
+	if c.probeUntil.After(at) || c.Failures >= threshold {
+		c.OpenedAt = at
+	}
+	c.probeUntil = time.Time{}
+	return nil
+}
+
+func (m *memoryCircuits) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.circuit(key)
+	c.Failures = 0
+	c.OpenedAt = time.Time{}
+	c.probeUntil = time.Time{}
+	return nil
+}
+
+func (m *memoryCircuits) Keys(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.circuits))
+	for key := range m.circuits {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+const (
+	redisCircuitPrefix = "llm:circuit:"
+	redisCircuitSet    = "llm:circuits"
+)
+
+// redisFailScript counts a failure and opens the circuit once the failures reach the
+// threshold or when it ends a probe.
+// KEYS: circuit hash, probe key, set of circuits. ARGV: last error, time in ms,
+// threshold, circuit key.
+var redisFailScript = goredis.NewScript(`
+local probing = redis.call('DEL', KEYS[2]) == 1
+local failures = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+redis.call('HSET', KEYS[1], 'last_error', ARGV[1], 'last_fail', ARGV[2])
+if probing or failures >= tonumber(ARGV[3]) then
+	redis.call('HSET', KEYS[1], 'opened_at', ARGV[2])
+end
+redis.call('SADD', KEYS[3], ARGV[4])
+return failures
+`)
+
+// redisCircuits keeps every circuit in a hash, so that all instances count the same
+// failures and see the same open circuits; the probe claim is a key expiring on its own.
+type redisCircuits struct {
+	client *goredis.Client
+}
+
+// NewRedisCircuitStore shares circuits through Redis; nil without a client.
+func NewRedisCircuitStore(client *goredis.Client) CircuitStore {
+	if client == nil {
+		return nil
+	}
+	return &redisCircuits{client: client}
+}
+
+func (r *redisCircuits) Load(ctx context.Context, key string) (CircuitRecord, error) {
+	fields, err := r.client.HGetAll(ctx, redisCircuitPrefix+key).Result()
+	if err != nil {
+		return CircuitRecord{}, err
+	}
+	rec := CircuitRecord{LastError: fields["last_error"]}
+	rec.Failures, _ = strconv.Atoi(fields["failures"])
+	rec.OpenedAt = unixMilli(fields["opened_at"])
+	rec.LastFail = unixMilli(fields["last_fail"])
+	return rec, nil
+}
+
+func (r *redisCircuits) Probe(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, redisCircuitPrefix+key+":probe", 1, ttl).Result()
+}
+
+func (r *redisCircuits) Fail(ctx context.Context, key, lastError string, at time.Time, threshold int) error {
+	keys := []string{redisCircuitPrefix + key, redisCircuitPrefix + key + ":probe", redisCircuitSet}
+	return redisFailScript.Run(ctx, r.client, keys, lastError, at.UnixMilli(), threshold, key).Err()
+}
+
+func (r *redisCircuits) Reset(ctx context.Context, key string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.HSet(ctx, redisCircuitPrefix+key, "failures", 0)
+		pipe.HDel(ctx, redisCircuitPrefix+key, "opened_at")
+		pipe.Del(ctx, redisCircuitPrefix+key+":probe")
+		pipe.SAdd(ctx, redisCircuitSet, key)
+		return nil
+	})
+	return err
+}
+
+func (r *redisCircuits) Keys(ctx context.Context) ([]string, error) {
+	return r.client.SMembers(ctx, redisCircuitSet).Result()
+}
+
+func unixMilli(value string) time.Time {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
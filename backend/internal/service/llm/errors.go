@@ -0,0 +1,66 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	einoopenai "github.com/cloudwego/eino-ext/components/model/openai"
+	openai "github.com/meguminnnnnnnnn/go-openai"
+	"google.golang.org/genai"
+)
+
+// StatusCode returns the HTTP status of a provider API error, 0 when err carries none.
+func StatusCode(err error) int {
+	var (
+		einoErr      *einoopenai.APIError
+		openaiErr    *openai.APIError
+		requestErr   *openai.RequestError
+		anthropicErr *anthropic.Error
+		geminiErr    genai.APIError
+		geminiPtrErr *genai.APIError
+	)
+	switch {
+	case errors.As(err, &einoErr):
+		return einoErr.HTTPStatusCode
+	case errors.As(err, &openaiErr):
+		return openaiErr.HTTPStatusCode
+	case errors.As(err, &requestErr):
+		return requestErr.HTTPStatusCode
+	case errors.As(err, &anthropicErr):
+		return anthropicErr.StatusCode
+	case errors.As(err, &geminiErr):
+		return geminiErr.Code
+	case errors.As(err, &geminiPtrErr):
+		return geminiPtrErr.Code
+	}
+	return 0
+}
+
+// Retryable reports whether a failed call may succeed when repeated or sent to another
+// provider: rate limits, server errors, timeouts and dropped connections. Cancellation
+// and client errors such as a rejected key or an invalid request are not retryable.
+// An open circuit is worth failing over, though calls to the same provider fail fast.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	if code := StatusCode(err); code != 0 {
+		switch code {
+		case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooEarly, http.StatusTooManyRequests:
+			return true
+		}
+		return code >= http.StatusInternalServerError
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
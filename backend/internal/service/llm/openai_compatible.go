@@ -0,0 +1,68 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/cloudwego/eino-ext/components/model/openai"
+	"github.com/cloudwego/eino/components/model"
+)
+
+// TypeOpenAICompatible serves self-hosted endpoints speaking the OpenAI chat API
+// (Ollama, vLLM, LM Studio, ...). They usually need no key, so users can chat without
+// storing a token; a stored token still takes precedence over the configured api_key.
+const TypeOpenAICompatible = "openai-compatible"
+
+// KeyOptional is implemented by providers that work without a user's API key.
+type KeyOptional interface {
+	UserKeyOptional() bool
+}
+
+type openAICompatible struct{}
+
+func (openAICompatible) UserKeyOptional() bool { return true }
+
+func (openAICompatible) NewChatModel(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	if spec.Config.BaseURL == "" {
+		return nil, errors.New("base_url is required")
+	}
+	apiKey := spec.APIKey
+	if apiKey == "" {
+		apiKey = spec.Config.APIKey
+	}
+	return openai.NewChatModel(ctx, &openai.ChatModelConfig{
+		BaseURL:    spec.Config.BaseURL,
+		Model:      spec.Model,
+		APIKey:     apiKey,
+		HTTPClient: providerClient(spec.Config.Headers),
+	})
+}
+
+// providerClient returns the client of provider requests: it sends the given headers
+// and reports a Retry-After to the retry policy.
+func providerClient(headers map[string]string) *http.Client {
+	return &http.Client{Transport: &providerTransport{headers: headers}}
+}
+
+// providerTransport adds static headers to every request and passes a Retry-After on.
+type providerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *providerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) > 0 {
+		req = req.Clone(req.Context())
+		for k, v := range t.headers {
+			req.Header.Set(k, v)
+		}
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	recordRetryAfter(req, resp)
+	return resp, err
+}
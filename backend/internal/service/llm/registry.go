@@ -0,0 +1,237 @@
+// Package llm builds the chat models of the configured providers. Provider kinds
+// (openai, gemini, claude, ...) register a Provider once at startup; the chat, title and
+// summary services then ask the registry for models by configured provider name.
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cloudwego/eino/components/model"
+
+	"unichatgo/internal/config"
+)
+
+// ErrUnknownProvider is returned for a provider name missing from the configuration.
+var ErrUnknownProvider = errors.New("provider not configured")
+
+// ErrUnknownType is returned for a provider type no Provider was registered for.
+var ErrUnknownType = errors.New("unknown provider type")
+
+// Provider builds chat models for one kind of provider API.
+type Provider interface {
+	NewChatModel(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error)
+}
+
+// ProviderFunc adapts a function to Provider.
+type ProviderFunc func(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error)
+
+func (f ProviderFunc) NewChatModel(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	return f(ctx, spec)
+}
+
+// Spec is the model a Provider is asked to build.
+type Spec struct {
+	// Name is the configured provider name, Config its configuration.
+	Name   string
+	Config config.ProviderConfig
+	Model  string
+	APIKey string
+}
+
+// Registry maps provider types to their Provider and provider names to their
+// configuration. It is safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	types      map[string]Provider
+	providers  map[string]config.ProviderConfig
+	resilience *Resilience
+}
+
+// Default is the registry filled by main at startup.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		types:     make(map[string]Provider),
+		providers: make(map[string]config.ProviderConfig),
+	}
+}
+
+// Register adds the Provider of a provider type; a type can be registered once.
+func (r *Registry) Register(typ string, p Provider) error {
+	if typ == "" || p == nil {
+		return errors.New("provider type and implementation are required")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.types[typ]; ok {
+		return fmt.Errorf("provider type %s already registered", typ)
+	}
+	r.types[typ] = p
+	return nil
+}
+
+// Configure replaces the configured providers. Every provider must have a registered
+// type; a provider without a type uses its name as type.
+func (r *Registry) Configure(providers map[string]config.ProviderConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, cfg := range providers {
+		typ := TypeOf(name, cfg)
+		if _, ok := r.types[typ]; !ok {
+			return fmt.Errorf("provider %s: %w %q", name, ErrUnknownType, typ)
+		}
+		if err := ValidateConfig(typ, cfg); err != nil {
+			return fmt.Errorf("provider %s: %w", name, err)
+		}
+	}
+	r.providers = maps.Clone(providers)
+	if r.providers == nil {
+		r.providers = make(map[string]config.ProviderConfig)
+	}
+	return nil
+}
+
+// ConfigureResilience makes the models built from now on retry failed calls and share
+// a circuit breaker per provider. The circuits are kept in store, so that instances
+// sharing it trip together, or in the process when store is nil.
+func (r *Registry) ConfigureResilience(cfg config.ResilienceConfig, store CircuitStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resilience = NewResilience(cfg, store)
+}
+
+// Resilience returns the retry policy and circuit breaker, nil when not configured.
+func (r *Registry) Resilience() *Resilience {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.resilience
+}
+
+// Lookup returns the configuration of a provider name.
+func (r *Registry) Lookup(name string) (config.ProviderConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cfg, ok := r.providers[name]
+	return cfg, ok
+}
+
+// Providers returns a copy of the configured providers.
+func (r *Registry) Providers() map[string]config.ProviderConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return maps.Clone(r.providers)
+}
+
+// Names returns the configured provider names in order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RequiresUserKey reports whether chatting with a provider needs the user's API key.
+// Unknown providers require one.
+func (r *Registry) RequiresUserKey(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cfg, ok := r.providers[name]
+	if !ok {
+		return true
+	}
+	p, ok := r.types[TypeOf(name, cfg)].(KeyOptional)
+	return !ok || !p.UserKeyOptional()
+}
+
+// ChatModel builds a chat model of a configured provider; an empty modelName uses the
+// provider's default model.
+func (r *Registry) ChatModel(ctx context.Context, name, modelName, token string) (model.ToolCallingChatModel, error) {
+	cfg, ok := r.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+	return r.Build(ctx, Spec{Name: name, Config: cfg, Model: modelName, APIKey: token})
+}
+
+// Build builds a chat model from an explicit spec.
+func (r *Registry) Build(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+	typ := TypeOf(spec.Name, spec.Config)
+	r.mu.RLock()
+	p, ok := r.types[typ]
+	resilience := r.resilience
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, typ)
+	}
+	if spec.Model == "" {
+		spec.Model = DefaultModel(spec.Config)
+	}
+	if spec.Model == "" {
+		return nil, fmt.Errorf("provider %s: no model given and no default configured", spec.Name)
+	}
+	if len(spec.Config.Models) > 0 && !slices.Contains(spec.Config.Models, spec.Model) && spec.Model != spec.Config.Model {
+		return nil, fmt.Errorf("provider %s: model %s not offered", spec.Name, spec.Model)
+	}
+	chatModel, err := p.NewChatModel(ctx, spec)
+	if err != nil {
+		return nil, fmt.Errorf("init %s model: %w", spec.Name, err)
+	}
+	return resilience.Wrap(chatModel, r.circuitKey(spec)), nil
+}
+
+// circuitKey names the circuit of a spec: the provider name for configured providers
+// and the endpoint host for user providers, whose names are only unique per user.
+func (r *Registry) circuitKey(spec Spec) string {
+	if _, ok := r.Lookup(spec.Name); ok || spec.Config.BaseURL == "" {
+		return spec.Name
+	}
+	u, err := url.Parse(spec.Config.BaseURL)
+	if err != nil || u.Host == "" {
+		return spec.Name
+	}
+	return "user:" + u.Host
+}
+
+// DefaultModel returns the model used when none is requested: the configured model,
+// otherwise the first of the configured model list.
+func DefaultModel(cfg config.ProviderConfig) string {
+	if cfg.Model == "" && len(cfg.Models) > 0 {
+		return cfg.Models[0]
+	}
+	return cfg.Model
+}
+
+// ValidateConfig checks the settings a provider type cannot work without.
+func ValidateConfig(typ string, cfg config.ProviderConfig) error {
+	switch typ {
+	case TypeOpenAICompatible:
+		if cfg.BaseURL == "" {
+			return errors.New("base_url is required")
+		}
+	case TypeAzureOpenAI:
+		if cfg.BaseURL == "" || cfg.APIVersion == "" {
+			return errors.New("base_url and api_version are required")
+		}
+	}
+	return nil
+}
+
+// TypeOf returns the provider type of a configured provider; it defaults to the name.
+func TypeOf(name string, cfg config.ProviderConfig) string {
+	if cfg.Type != "" {
+		return cfg.Type
+	}
+	return name
+}
@@ -0,0 +1,400 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	einoopenai "github.com/cloudwego/eino-ext/components/model/openai"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+	openai "github.com/meguminnnnnnnnn/go-openai"
+	"google.golang.org/genai"
+
+	"unichatgo/internal/config"
+)
+
+func TestRegistryBuildsConfiguredProviders(t *testing.T) {
+	r := NewRegistry()
+	var got Spec
+	fake := ProviderFunc(func(ctx context.Context, spec Spec) (model.ToolCallingChatModel, error) {
+		got = spec
+		return nil, nil
+	})
+	if err := r.Register("fake", fake); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := r.Register("fake", fake); err == nil {
+		t.Fatalf("expected duplicate registration to fail")
+	}
+	if err := r.Configure(map[string]config.ProviderConfig{"other": {Model: "m"}}); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("expected unknown type error, got %v", err)
+	}
+	if err := r.Configure(map[string]config.ProviderConfig{
+		"fake":  {Model: "default-model"},
+		"local": {Type: "fake", Model: "local-model", BaseURL: "http://localhost:11434/v1"},
+	}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+
+	if _, err := r.ChatModel(context.Background(), "fake", "", "tok"); err != nil {
+		t.Fatalf("chat model: %v", err)
+	}
+	if got.Name != "fake" || got.Model != "default-model" || got.APIKey != "tok" {
+		t.Fatalf("unexpected spec: %+v", got)
+	}
+	if _, err := r.ChatModel(context.Background(), "local", "llama3", ""); err != nil {
+		t.Fatalf("chat model: %v", err)
+	}
+	if got.Name != "local" || got.Model != "llama3" || got.Config.BaseURL != "http://localhost:11434/v1" {
+		t.Fatalf("unexpected spec: %+v", got)
+	}
+	if _, err := r.ChatModel(context.Background(), "missing", "", "tok"); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("expected unknown provider error, got %v", err)
+	}
+}
+
+func TestOpenAICompatibleProvider(t *testing.T) {
+	var gotHeader, gotAuth, gotModel string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHeader = req.Header.Get("X-Team")
+		gotAuth = req.Header.Get("Authorization")
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		gotModel = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","model":"`+body.Model+`","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+
+	r := NewRegistry()
+	if err := RegisterBuiltins(r); err != nil {
+		t.Fatalf("register builtins: %v", err)
+	}
+	if err := r.Configure(map[string]config.ProviderConfig{"ollama": {Type: TypeOpenAICompatible}}); err == nil {
+		t.Fatalf("expected missing base_url to fail")
+	}
+	if err := r.Configure(map[string]config.ProviderConfig{
+		"openai": {Model: "gpt-4o"},
+		"ollama": {
+			Type:    TypeOpenAICompatible,
+			BaseURL: srv.URL,
+			Headers: map[string]string{"X-Team": "ml"},
+			Models:  []string{"llama3", "qwen2.5"},
+		},
+	}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if !r.RequiresUserKey("openai") || r.RequiresUserKey("ollama") || !r.RequiresUserKey("missing") {
+		t.Fatalf("unexpected key requirements")
+	}
+	if _, err := r.ChatModel(context.Background(), "ollama", "mistral", ""); err == nil {
+		t.Fatalf("expected model outside the model list to be rejected")
+	}
+
+	chatModel, err := r.ChatModel(context.Background(), "ollama", "", "")
+	if err != nil {
+		t.Fatalf("chat model: %v", err)
+	}
+	msg, err := chatModel.Generate(context.Background(), []*schema.Message{schema.UserMessage("hello")})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if msg.Content != "hi" || gotModel != "llama3" || gotHeader != "ml" {
+		t.Fatalf("unexpected call: content=%q model=%q header=%q", msg.Content, gotModel, gotHeader)
+	}
+
+	if chatModel, err = r.ChatModel(context.Background(), "ollama", "qwen2.5", "user-key"); err != nil {
+		t.Fatalf("chat model: %v", err)
+	}
+	if _, err := chatModel.Generate(context.Background(), []*schema.Message{schema.UserMessage("hello")}); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if gotModel != "qwen2.5" || gotAuth != "Bearer user-key" {
+		t.Fatalf("unexpected call: model=%q auth=%q", gotModel, gotAuth)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, true},
+		{fmt.Errorf("stream: %w", &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}), true},
+		{&openai.APIError{HTTPStatusCode: http.StatusUnauthorized}, false},
+		{&einoopenai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, true},
+		{&openai.RequestError{HTTPStatusCode: http.StatusBadGateway}, true},
+		{genai.APIError{Code: http.StatusBadRequest}, false},
+		{fmt.Errorf("gemini: %w", genai.APIError{Code: http.StatusInternalServerError}), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{errors.New("invalid request"), false},
+	} {
+		if got := Retryable(tc.err); got != tc.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestResilienceRetriesAndBreaks(t *testing.T) {
+	calls, fails := 0, 2
+	status := http.StatusTooManyRequests
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if fails > 0 {
+			fails--
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, `{"error":{"message":"slow down","type":"rate_limit"}}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+
+	r := NewRegistry()
+	if err := RegisterBuiltins(r); err != nil {
+		t.Fatalf("register builtins: %v", err)
+	}
+	if err := r.Configure(map[string]config.ProviderConfig{"local": {Type: TypeOpenAICompatible, BaseURL: srv.URL, Model: "m"}}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	r.ConfigureResilience(config.ResilienceConfig{
+		Retry:          config.RetryConfig{MaxAttempts: 3, InitialBackoffMS: 100, MaxBackoffMS: 5000},
+		CircuitBreaker: config.CircuitBreakerConfig{FailureThreshold: 3, OpenSeconds: 30},
+	}, nil)
+	res := r.Resilience()
+	var waits []time.Duration
+	res.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	now := time.Now()
+	res.Breaker.now = func() time.Time { return now }
+
+	chatModel, err := r.ChatModel(context.Background(), "local", "", "")
+	if err != nil {
+		t.Fatalf("chat model: %v", err)
+	}
+	msg, err := chatModel.Generate(context.Background(), []*schema.Message{schema.UserMessage("hello")})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if msg.Content != "hi" || calls != 3 || len(waits) != 2 || waits[0] < 2*time.Second || waits[1] < 2*time.Second {
+		t.Fatalf("unexpected retries: content=%q calls=%d waits=%v", msg.Content, calls, waits)
+	}
+
+	// three failures in a row open the circuit and later calls fail fast
+	res.Retry.MaxAttempts = 1
+	status, fails = http.StatusBadGateway, 3
+	for i := 0; i < 3; i++ {
+		if _, err := chatModel.Generate(context.Background(), []*schema.Message{schema.UserMessage("hello")}); !Retryable(err) {
+			t.Fatalf("expected retryable error, got %v", err)
+		}
+	}
+	before := calls
+	_, err = chatModel.Generate(context.Background(), []*schema.Message{schema.UserMessage("hello")})
+	if !errors.Is(err, ErrCircuitOpen) || calls != before || !Retryable(err) {
+		t.Fatalf("expected open circuit, got %v after %d calls", err, calls-before)
+	}
+	states := res.Breaker.States()
+	if len(states) != 1 || states[0].Provider != "local" || states[0].State != CircuitOpen || states[0].RetryIn != 30 {
+		t.Fatalf("unexpected states: %+v", states)
+	}
+
+	// after the open period a successful probe closes the circuit
+	now = now.Add(31 * time.Second)
+	if got := res.Breaker.States(); got[0].State != CircuitHalfOpen {
+		t.Fatalf("expected half-open circuit, got %+v", got)
+	}
+	if _, err := chatModel.Generate(context.Background(), []*schema.Message{schema.UserMessage("hello")}); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if got := res.Breaker.States(); got[0].State != CircuitClosed || got[0].Failures != 0 {
+		t.Fatalf("expected closed circuit, got %+v", got)
+	}
+}
+
+// lazyModel opens every stream at once and fails on the first read while fails is
+// positive, like Gemini streams.
+type lazyModel struct {
+	calls, fails int
+}
+
+func (m *lazyModel) Generate(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	return nil, errors.New("not used")
+}
+
+func (m *lazyModel) Stream(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	m.calls++
+	sr, sw := schema.Pipe[*schema.Message](2)
+	if m.fails > 0 {
+		m.fails--
+		sw.Send(nil, genai.APIError{Code: http.StatusServiceUnavailable})
+	} else {
+		sw.Send(schema.AssistantMessage("hel", nil), nil)
+		sw.Send(schema.AssistantMessage("lo", nil), nil)
+	}
+	sw.Close()
+	return sr, nil
+}
+
+func (m *lazyModel) WithTools(tools []*schema.ToolInfo) (model.ToolCallingChatModel, error) {
+	return m, nil
+}
+
+func TestResilienceRetriesLazyStreams(t *testing.T) {
+	res := NewResilience(config.ResilienceConfig{
+		Retry:          config.RetryConfig{MaxAttempts: 3, InitialBackoffMS: 10, MaxBackoffMS: 100},
+		CircuitBreaker: config.CircuitBreakerConfig{FailureThreshold: 3, OpenSeconds: 30},
+	}, nil)
+	res.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	inner := &lazyModel{fails: 2}
+	chatModel := res.Wrap(inner, "gemini")
+
+	stream, err := chatModel.Stream(context.Background(), []*schema.Message{schema.UserMessage("hello")})
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	var content string
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		content += chunk.Content
+	}
+	if content != "hello" || inner.calls != 3 {
+		t.Fatalf("unexpected stream: content=%q calls=%d", content, inner.calls)
+	}
+
+	// failures on the first read count toward the circuit
+	res.Retry.MaxAttempts = 1
+	inner.fails = 3
+	for i := 0; i < 3; i++ {
+		if _, err := chatModel.Stream(context.Background(), []*schema.Message{schema.UserMessage("hello")}); !Retryable(err) {
+			t.Fatalf("expected retryable error, got %v", err)
+		}
+	}
+	if _, err := chatModel.Stream(context.Background(), []*schema.Message{schema.UserMessage("hello")}); !errors.Is(err, ErrCircuitOpen) || inner.calls != 6 {
+		t.Fatalf("expected open circuit, got %v after %d calls", err, inner.calls)
+	}
+}
+
+// brokenCircuits fails every call like an unreachable Redis.
+type brokenCircuits struct{ *memoryCircuits }
+
+func (brokenCircuits) Load(ctx context.Context, key string) (CircuitRecord, error) {
+	return CircuitRecord{}, errors.New("connection refused")
+}
+
+func (brokenCircuits) Fail(ctx context.Context, key, lastError string, at time.Time, threshold int) error {
+	return errors.New("connection refused")
+}
+
+func (brokenCircuits) Keys(ctx context.Context) ([]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestBreakerSharesCircuits(t *testing.T) {
+	// two instances sharing a store trip and recover together
+	shared := newMemoryCircuits()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	first, second := NewBreaker(2, time.Minute, shared), NewBreaker(2, time.Minute, shared)
+	first.now, second.now = clock, clock
+	first.Record("p", context.DeadlineExceeded)
+	second.Record("p", context.DeadlineExceeded)
+	for _, b := range []*Breaker{first, second} {
+		if err := b.Allow("p"); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected the shared circuit open, got %v", err)
+		}
+	}
+	if states := second.States(); len(states) != 1 || states[0].State != CircuitOpen || states[0].Failures != 2 || !second.Shared() {
+		t.Fatalf("unexpected shared states: %+v", states)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := first.Allow("p"); err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	if err := second.Allow("p"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a single probe across instances, got %v", err)
+	}
+	first.Record("p", nil)
+	if err := second.Allow("p"); err != nil {
+		t.Fatalf("expected the circuit closed by the probe, got %v", err)
+	}
+
+	// a failing store falls back to the circuits of the instance
+	local := NewBreaker(1, time.Minute, brokenCircuits{newMemoryCircuits()})
+	local.Record("p", context.DeadlineExceeded)
+	if err := local.Allow("p"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the local circuit open, got %v", err)
+	}
+	if states := local.States(); len(states) != 1 || states[0].State != CircuitOpen {
+		t.Fatalf("unexpected local states: %+v", states)
+	}
+}
+
+func TestRetryAfterBeyondMaxBackoffStopsRetrying(t *testing.T) {
+	res := NewResilience(config.ResilienceConfig{
+		Retry:          config.RetryConfig{MaxAttempts: 5, InitialBackoffMS: 10, MaxBackoffMS: 1000},
+		CircuitBreaker: config.CircuitBreakerConfig{Disabled: true},
+	}, nil)
+	res.sleep = func(ctx context.Context, d time.Duration) error {
+		t.Fatalf("unexpected wait of %v", d)
+		return nil
+	}
+	calls := 0
+	err := res.do(context.Background(), "p", func(ctx context.Context) error {
+		calls++
+		ctx.Value(retryAfterKey{}).(*retryAfterHint).set(time.Minute)
+		return &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}
+	})
+	if err == nil || calls != 1 || res.Breaker != nil {
+		t.Fatalf("expected a single call, got %d: %v", calls, err)
+	}
+
+	if d, ok := parseRetryAfter(http.Header{"Retry-After": {"Wed, 21 Oct 2015 07:28:10 GMT"}}, time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)); !ok || d != 10*time.Second {
+		t.Fatalf("unexpected http-date retry-after: %v %v", d, ok)
+	}
+	if d, ok := parseRetryAfter(http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"1"}}, time.Now()); !ok || d != 250*time.Millisecond {
+		t.Fatalf("unexpected retry-after-ms: %v %v", d, ok)
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	if got := EstimateTokens("hello world!"); got != 3 {
+		t.Fatalf("expected 3 tokens for 12 ascii characters, got %d", got)
+	}
+	if got := EstimateTokens("你好世界"); got != 4 {
+		t.Fatalf("expected a token per CJK character, got %d", got)
+	}
+	text := "abcd你好efgh"
+	if got := TruncateToTokens(text, 3); got != "abcd你好" {
+		t.Fatalf("unexpected truncation %q", got)
+	}
+	if got := TruncateToTokens(text, 100); got != text {
+		t.Fatalf("short text must stay whole, got %q", got)
+	}
+
+	cfg := config.ProviderConfig{Model: "gpt-4o", ContextWindow: 8192, ContextWindows: map[string]int{"gpt-4o": 128000}}
+	if ContextWindow(cfg, "") != 128000 || ContextWindow(cfg, "gpt-3.5-turbo") != 8192 {
+		t.Fatalf("unexpected context windows")
+	}
+}
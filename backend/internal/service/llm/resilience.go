@@ -0,0 +1,442 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/eino/components"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+
+	"unichatgo/internal/config"
+)
+
+// ErrCircuitOpen is returned without calling a provider whose circuit is open.
+var ErrCircuitOpen = errors.New("provider temporarily unavailable")
+
+// Resilience defaults applied to unset configuration values.
+const (
+	DefaultRetryAttempts    = 3
+	DefaultInitialBackoff   = 500 * time.Millisecond
+	DefaultMaxBackoff       = 8 * time.Second
+	DefaultFailureThreshold = 5
+	DefaultOpenDuration     = 30 * time.Second
+)
+
+// RetryPolicy retries retryable provider errors with exponential backoff and jitter.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// backoff returns the wait before the attempt following the given one: the doubled
+// initial backoff capped at MaxBackoff, of which a random half is jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// Resilience wraps the chat models a Registry builds in a retry policy and a circuit
+// breaker shared by every model of the same provider.
+type Resilience struct {
+	Retry   RetryPolicy
+	Breaker *Breaker // nil when circuit breaking is disabled
+
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewResilience applies the defaults to cfg. The circuits are kept in store, or in
+// the process when store is nil.
+func NewResilience(cfg config.ResilienceConfig, store CircuitStore) *Resilience {
+	policy := RetryPolicy{
+		MaxAttempts:    cfg.Retry.MaxAttempts,
+		InitialBackoff: time.Duration(cfg.Retry.InitialBackoffMS) * time.Millisecond,
+		MaxBackoff:     time.Duration(cfg.Retry.MaxBackoffMS) * time.Millisecond,
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultInitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultMaxBackoff
+	}
+	policy.MaxBackoff = max(policy.MaxBackoff, policy.InitialBackoff)
+	res := &Resilience{Retry: policy, sleep: sleepContext}
+	if !cfg.CircuitBreaker.Disabled {
+		threshold := cfg.CircuitBreaker.FailureThreshold
+		if threshold <= 0 {
+			threshold = DefaultFailureThreshold
+		}
+		openFor := time.Duration(cfg.CircuitBreaker.OpenSeconds) * time.Second
+		if openFor <= 0 {
+			openFor = DefaultOpenDuration
+		}
+		res.Breaker = NewBreaker(threshold, openFor, store)
+	}
+	return res
+}
+
+// Wrap returns m calling through the retry policy and the circuit of key.
+func (r *Resilience) Wrap(m model.ToolCallingChatModel, key string) model.ToolCallingChatModel {
+	if r == nil || m == nil {
+		return m
+	}
+	return &resilientModel{inner: m, key: key, res: r}
+}
+
+// do runs call until it succeeds, fails with an error not worth repeating or runs out
+// of attempts. A Retry-After longer than the maximum backoff ends the retries so the
+// caller can fail over instead of waiting.
+func (r *Resilience) do(ctx context.Context, key string, call func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := r.Breaker.Allow(key); err != nil {
+			return err
+		}
+		callCtx, hint := withRetryAfterHint(ctx)
+		err := call(callCtx)
+		r.Breaker.Record(key, err)
+		if err == nil || attempt >= r.Retry.MaxAttempts || !Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		wait := r.Retry.backoff(attempt)
+		if after := hint.get(); after > 0 {
+			if after > r.Retry.MaxBackoff {
+				return err
+			}
+			wait = max(wait, after)
+		}
+		if r.sleep(ctx, wait) != nil {
+			return err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// resilientModel retries the calls that start a generation, up to the first chunk of
+// a stream since some providers only report errors once it is read; a stream failing
+// after that is left to the caller, which may already have shown part of the reply.
+type resilientModel struct {
+	inner model.ToolCallingChatModel
+	key   string
+	res   *Resilience
+}
+
+func (m *resilientModel) Generate(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	var out *schema.Message
+	err := m.res.do(ctx, m.key, func(ctx context.Context) error {
+		var err error
+		out, err = m.inner.Generate(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (m *resilientModel) Stream(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	var out *schema.StreamReader[*schema.Message]
+	err := m.res.do(ctx, m.key, func(ctx context.Context) error {
+		stream, err := m.inner.Stream(ctx, input, opts...)
+		if err != nil {
+			return err
+		}
+		first, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			stream.Close()
+			out = schema.StreamReaderFromArray([]*schema.Message{})
+			return nil
+		}
+		if err != nil {
+			stream.Close()
+			return err
+		}
+		out = replayFirst(first, stream)
+		return nil
+	})
+	return out, err
+}
+
+// replayFirst returns a stream yielding first and then the rest of stream.
+func replayFirst(first *schema.Message, stream *schema.StreamReader[*schema.Message]) *schema.StreamReader[*schema.Message] {
+	sr, sw := schema.Pipe[*schema.Message](1)
+	go func() {
+		defer stream.Close()
+		defer sw.Close()
+		if sw.Send(first, nil) {
+			return
+		}
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if sw.Send(msg, err) || err != nil {
+				return
+			}
+		}
+	}()
+	return sr
+}
+
+func (m *resilientModel) WithTools(tools []*schema.ToolInfo) (model.ToolCallingChatModel, error) {
+	inner, err := m.inner.WithTools(tools)
+	if err != nil {
+		return nil, err
+	}
+	return &resilientModel{inner: inner, key: m.key, res: m.res}, nil
+}
+
+// GetType and IsCallbacksEnabled forward to the wrapped model so eino keeps running
+// its callbacks exactly once.
+func (m *resilientModel) GetType() string {
+	typ, _ := components.GetType(m.inner)
+	return typ
+}
+
+func (m *resilientModel) IsCallbacksEnabled() bool {
+	return components.IsCallbacksEnabled(m.inner)
+}
+
+// Circuit states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// Breaker keeps a circuit per provider. A circuit opens after threshold consecutive
+// retryable failures and rejects calls for openFor; then a single probe call is let
+// through, closing the circuit on success and reopening it on failure. With a shared
+// store every instance sees the same circuits; when the store fails, the circuits of
+// this process are used instead. It is safe for concurrent use.
+type Breaker struct {
+	threshold int
+	openFor   time.Duration
+	now       func() time.Time
+
+	store CircuitStore // nil keeps the circuits in this process only
+	local *memoryCircuits
+}
+
+// CircuitState describes a provider's circuit.
+type CircuitState struct {
+	Provider  string     `json:"provider"`
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	RetryIn   int        `json:"retry_in_seconds,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	LastFail  *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// circuitStoreTimeout bounds a call to the shared store before falling back to the
+// circuits of this process.
+const circuitStoreTimeout = time.Second
+
+// NewBreaker keeps its circuits in store, or in the process when store is nil.
+func NewBreaker(threshold int, openFor time.Duration, store CircuitStore) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		openFor:   openFor,
+		now:       time.Now,
+		store:     store,
+		local:     newMemoryCircuits(),
+	}
+}
+
+// Threshold returns the consecutive failures that open a circuit.
+func (b *Breaker) Threshold() int { return b.threshold }
+
+// OpenFor returns how long an open circuit rejects calls.
+func (b *Breaker) OpenFor() time.Duration { return b.openFor }
+
+// Shared reports whether the circuits are shared with the other instances.
+func (b *Breaker) Shared() bool { return b.store != nil }
+
+// circuits runs fn with the shared store, or with the circuits of this process when
+// there is none or it fails.
+func (b *Breaker) circuits(fn func(ctx context.Context, store CircuitStore) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), circuitStoreTimeout)
+	defer cancel()
+	if b.store != nil {
+		err := fn(ctx, b.store)
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			return err
+		}
+		log.Printf("circuit store failed, using the circuits of this instance: %v", err)
+	}
+	return fn(ctx, b.local)
+}
+
+// Allow returns ErrCircuitOpen while key's circuit rejects calls.
+func (b *Breaker) Allow(key string) error {
+	if b == nil {
+		return nil
+	}
+	return b.circuits(func(ctx context.Context, store CircuitStore) error {
+		c, err := store.Load(ctx, key)
+		if err != nil || c.OpenedAt.IsZero() {
+			return err
+		}
+		now := b.now()
+		if wait := c.OpenedAt.Add(b.openFor).Sub(now); wait > 0 {
+			return fmt.Errorf("%w: %s, retry in %ds", ErrCircuitOpen, key, int((wait+time.Second-1)/time.Second))
+		}
+		probe, err := store.Probe(ctx, key, now, b.openFor)
+		if err != nil {
+			return err
+		}
+		if !probe {
+			return fmt.Errorf("%w: %s, recovery check in progress", ErrCircuitOpen, key)
+		}
+		return nil
+	})
+}
+
+// Record reports the outcome of a call Allow let through. Only retryable errors count
+// as failures; a cancelled call tells nothing about the provider, so a cancelled probe
+// keeps its claim until it expires after openFor.
+func (b *Breaker) Record(key string, err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	_ = b.circuits(func(ctx context.Context, store CircuitStore) error {
+		if !Retryable(err) {
+			return store.Reset(ctx, key)
+		}
+		return store.Fail(ctx, key, err.Error(), b.now(), b.threshold)
+	})
+}
+
+// States returns the circuits seen so far ordered by provider.
+func (b *Breaker) States() []CircuitState {
+	if b == nil {
+		return nil
+	}
+	var states []CircuitState
+	_ = b.circuits(func(ctx context.Context, store CircuitStore) error {
+		keys, err := store.Keys(ctx)
+		if err != nil {
+			return err
+		}
+		now := b.now()
+		states = make([]CircuitState, 0, len(keys))
+		for _, key := range keys {
+			c, err := store.Load(ctx, key)
+			if err != nil {
+				return err
+			}
+			states = append(states, b.state(key, c, now))
+		}
+		return nil
+	})
+	sort.Slice(states, func(i, j int) bool { return states[i].Provider < states[j].Provider })
+	return states
+}
+
+func (b *Breaker) state(key string, c CircuitRecord, now time.Time) CircuitState {
+	state := CircuitState{Provider: key, State: CircuitClosed, Failures: c.Failures, LastError: c.LastError}
+	if !c.LastFail.IsZero() {
+		lastFail := c.LastFail
+		state.LastFail = &lastFail
+	}
+	if !c.OpenedAt.IsZero() {
+		openedAt := c.OpenedAt
+		state.OpenedAt = &openedAt
+		if wait := openedAt.Add(b.openFor).Sub(now); wait > 0 {
+			state.State = CircuitOpen
+			state.RetryIn = int((wait + time.Second - 1) / time.Second)
+		} else {
+			state.State = CircuitHalfOpen
+		}
+	}
+	return state
+}
+
+type retryAfterKey struct{}
+
+// retryAfterHint carries the Retry-After of a rejected request from the HTTP
+// transport back to the retry loop, as provider errors do not expose headers.
+type retryAfterHint struct {
+	mu    sync.Mutex
+	after time.Duration
+}
+
+func withRetryAfterHint(ctx context.Context) (context.Context, *retryAfterHint) {
+	hint := &retryAfterHint{}
+	return context.WithValue(ctx, retryAfterKey{}, hint), hint
+}
+
+func (h *retryAfterHint) set(d time.Duration) {
+	h.mu.Lock()
+	h.after = d
+	h.mu.Unlock()
+}
+
+func (h *retryAfterHint) get() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.after
+}
+
+// recordRetryAfter passes the Retry-After of a 429 or 503 response to the hint of the
+// request's context.
+func recordRetryAfter(req *http.Request, resp *http.Response) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return
+	}
+	hint, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHint)
+	if !ok {
+		return
+	}
+	if d, ok := parseRetryAfter(resp.Header, time.Now()); ok {
+		hint.set(d)
+	}
+}
+
+// parseRetryAfter reads Retry-After in seconds or as an HTTP date, preferring the
+// millisecond retry-after-ms some OpenAI-style APIs send.
+func parseRetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(h.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	value := h.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
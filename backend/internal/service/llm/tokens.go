@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"unicode/utf8"
+
+	"unichatgo/internal/config"
+)
+
+// MessageTokenOverhead approximates the tokens a chat API adds around every message
+// for its role and separators.
+const MessageTokenOverhead = 4
+
+// ContextWindow returns the context length of a provider's model, 0 when unknown.
+func ContextWindow(cfg config.ProviderConfig, model string) int {
+	if model == "" {
+		model = DefaultModel(cfg)
+	}
+	if window, ok := cfg.ContextWindows[model]; ok {
+		return window
+	}
+	return cfg.ContextWindow
+}
+
+// EstimateTokens approximates the token count of text without the provider's
+// tokenizer: about four ASCII characters make a token, while other characters, CJK
+// scripts in particular, are counted as one token each to stay on the safe side.
+func EstimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// TruncateToTokens cuts text to about maxTokens tokens as counted by EstimateTokens.
+func TruncateToTokens(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	ascii, other := 0, 0
+	for i, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+		if (ascii+3)/4+other > maxTokens {
+			return text[:i]
+		}
+	}
+	return text
+}
@@ -70,12 +70,18 @@ func Migrate(db *sql.DB, driver string) error {
 				id INTEGER PRIMARY KEY AUTOINCREMENT,
 				username TEXT NOT NULL UNIQUE,
 				password_hash TEXT NOT NULL,
+				monthly_budget REAL,
+				fallbacks TEXT,
 				created_at DATETIME NOT NULL
 			)`,
 			`CREATE TABLE IF NOT EXISTS sessions (
 				id INTEGER PRIMARY KEY AUTOINCREMENT,
 				user_id INTEGER NOT NULL,
 				title TEXT NOT NULL,
+				title_locked INTEGER NOT NULL DEFAULT 0,
+				pinned INTEGER NOT NULL DEFAULT 0,
+				archived INTEGER NOT NULL DEFAULT 0,
+				active_leaf_id INTEGER,
 				created_at DATETIME NOT NULL,
 				updated_at DATETIME NOT NULL,
 				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
@@ -86,6 +92,17 @@ func Migrate(db *sql.DB, driver string) error {
 				session_id INTEGER NOT NULL,
 				role TEXT NOT NULL,
 				content TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'complete',
+				provider TEXT NOT NULL DEFAULT '',
+				model TEXT NOT NULL DEFAULT '',
+				parent_id INTEGER,
+				variant_of INTEGER,
+				active INTEGER NOT NULL DEFAULT 1,
+				prompt_tokens INTEGER NOT NULL DEFAULT 0,
+				completion_tokens INTEGER NOT NULL DEFAULT 0,
+				ttft_ms INTEGER NOT NULL DEFAULT 0,
+				latency_ms INTEGER NOT NULL DEFAULT 0,
+				finish_reason TEXT NOT NULL DEFAULT '',
 				created_at DATETIME NOT NULL,
 				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
 				FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
@@ -128,6 +145,135 @@ func Migrate(db *sql.DB, driver string) error {
 			)`,
 			`CREATE INDEX IF NOT EXISTS idx_temp_files_user ON temp_files(user_id)`,
 			`CREATE INDEX IF NOT EXISTS idx_temp_files_expiry ON temp_files(expires_at)`,
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				session_id INTEGER NOT NULL,
+				client_msg_id TEXT NOT NULL,
+				request_hash TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				user_message_id INTEGER,
+				ai_message_id INTEGER,
+				title TEXT NOT NULL DEFAULT '',
+				error TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				UNIQUE(session_id, client_msg_id),
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expiry ON idempotency_keys(expires_at)`,
+			`CREATE TABLE IF NOT EXISTS import_jobs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				source TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				total INTEGER NOT NULL DEFAULT 0,
+				processed INTEGER NOT NULL DEFAULT 0,
+				succeeded INTEGER NOT NULL DEFAULT 0,
+				failed INTEGER NOT NULL DEFAULT 0,
+				results TEXT,
+				error TEXT,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_import_jobs_user ON import_jobs(user_id)`,
+			`CREATE TABLE IF NOT EXISTS share_links (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				token TEXT NOT NULL UNIQUE,
+				user_id INTEGER NOT NULL,
+				session_id INTEGER NOT NULL,
+				snapshot TEXT,
+				expires_at DATETIME,
+				created_at DATETIME NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_share_links_session ON share_links(session_id)`,
+			`CREATE TABLE IF NOT EXISTS message_reasoning (
+				message_id INTEGER PRIMARY KEY,
+				content TEXT NOT NULL,
+				FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+			)`,
+			`CREATE TABLE IF NOT EXISTS usage_records (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				session_id INTEGER,
+				provider TEXT NOT NULL,
+				model TEXT NOT NULL,
+				prompt_tokens INTEGER NOT NULL,
+				completion_tokens INTEGER NOT NULL,
+				cost REAL NOT NULL,
+				created_at DATETIME NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_records_user_time ON usage_records(user_id, created_at)`,
+			`CREATE TABLE IF NOT EXISTS session_settings (
+				session_id INTEGER PRIMARY KEY,
+				system_prompt TEXT NOT NULL DEFAULT '',
+				temperature REAL,
+				top_p REAL,
+				max_tokens INTEGER,
+				stop TEXT,
+				tools TEXT,
+				fallbacks TEXT,
+				updated_at DATETIME NOT NULL,
+				FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			)`,
+			`CREATE TABLE IF NOT EXISTS personas (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				system_prompt TEXT NOT NULL DEFAULT '',
+				provider TEXT NOT NULL DEFAULT '',
+				model TEXT NOT NULL DEFAULT '',
+				tools TEXT,
+				shared INTEGER NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_personas_user ON personas(user_id)`,
+			`CREATE TABLE IF NOT EXISTS persona_files (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				persona_id INTEGER NOT NULL,
+				file_name TEXT NOT NULL,
+				stored_path TEXT NOT NULL,
+				mime_type TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				created_at DATETIME NOT NULL,
+				FOREIGN KEY(persona_id) REFERENCES personas(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_persona_files_persona ON persona_files(persona_id)`,
+			`CREATE TABLE IF NOT EXISTS prompt_templates (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				content TEXT NOT NULL,
+				tags TEXT NOT NULL DEFAULT '[]',
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uniq_prompt_templates_name ON prompt_templates(user_id, name)`,
+			`CREATE TABLE IF NOT EXISTS user_providers (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				type TEXT NOT NULL,
+				base_url TEXT NOT NULL,
+				api_version TEXT NOT NULL DEFAULT '',
+				model TEXT NOT NULL DEFAULT '',
+				context_window INTEGER NOT NULL DEFAULT 0,
+				headers TEXT NOT NULL DEFAULT '',
+				api_key TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uniq_user_providers_name ON user_providers(user_id, name)`,
 		}
 	case "mysql":
 		stmts = []string{
@@ -135,6 +281,8 @@ func Migrate(db *sql.DB, driver string) error {
 				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
 				username VARCHAR(255) NOT NULL UNIQUE,
 				password_hash VARCHAR(255) NOT NULL,
+				monthly_budget DECIMAL(12,4) NULL,
+				fallbacks TEXT NULL,
 				created_at DATETIME NOT NULL,
 				PRIMARY KEY (id)
 			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
@@ -142,6 +290,10 @@ func Migrate(db *sql.DB, driver string) error {
 				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
 				user_id BIGINT UNSIGNED NOT NULL,
 				title VARCHAR(255) NOT NULL,
+				title_locked TINYINT(1) NOT NULL DEFAULT 0,
+				pinned TINYINT(1) NOT NULL DEFAULT 0,
+				archived TINYINT(1) NOT NULL DEFAULT 0,
+				active_leaf_id BIGINT UNSIGNED NULL,
 				created_at DATETIME NOT NULL,
 				updated_at DATETIME NOT NULL,
 				PRIMARY KEY (id),
@@ -155,6 +307,17 @@ func Migrate(db *sql.DB, driver string) error {
 				session_id BIGINT UNSIGNED NOT NULL,
 				role VARCHAR(50) NOT NULL,
 				content MEDIUMTEXT NOT NULL,
+				status VARCHAR(20) NOT NULL DEFAULT 'complete',
+				provider VARCHAR(100) NOT NULL DEFAULT '',
+				model VARCHAR(191) NOT NULL DEFAULT '',
+				parent_id BIGINT UNSIGNED NULL,
+				variant_of BIGINT UNSIGNED NULL,
+				active TINYINT(1) NOT NULL DEFAULT 1,
+				prompt_tokens INT NOT NULL DEFAULT 0,
+				completion_tokens INT NOT NULL DEFAULT 0,
+				ttft_ms BIGINT NOT NULL DEFAULT 0,
+				latency_ms BIGINT NOT NULL DEFAULT 0,
+				finish_reason VARCHAR(50) NOT NULL DEFAULT '',
 				created_at DATETIME NOT NULL,
 				PRIMARY KEY (id),
 				INDEX idx_messages_user (user_id),
@@ -200,6 +363,146 @@ func Migrate(db *sql.DB, driver string) error {
 				CONSTRAINT fk_temp_files_session FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
 				CONSTRAINT fk_temp_files_summary_msg FOREIGN KEY (summary_message_id) REFERENCES messages(id) ON DELETE SET NULL
 			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				user_id BIGINT UNSIGNED NOT NULL,
+				session_id BIGINT UNSIGNED NOT NULL,
+				client_msg_id VARCHAR(191) NOT NULL,
+				request_hash CHAR(64) NOT NULL,
+				status VARCHAR(20) NOT NULL DEFAULT 'pending',
+				user_message_id BIGINT UNSIGNED,
+				ai_message_id BIGINT UNSIGNED,
+				title VARCHAR(255) NOT NULL DEFAULT '',
+				error TEXT,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY uniq_idempotency_session_client (session_id, client_msg_id),
+				INDEX idx_idempotency_keys_expiry (expires_at),
+				CONSTRAINT fk_idempotency_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+				CONSTRAINT fk_idempotency_session FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS import_jobs (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				user_id BIGINT UNSIGNED NOT NULL,
+				source VARCHAR(20) NOT NULL,
+				status VARCHAR(20) NOT NULL DEFAULT 'pending',
+				total INT NOT NULL DEFAULT 0,
+				processed INT NOT NULL DEFAULT 0,
+				succeeded INT NOT NULL DEFAULT 0,
+				failed INT NOT NULL DEFAULT 0,
+				results MEDIUMTEXT,
+				error TEXT,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				INDEX idx_import_jobs_user (user_id),
+				CONSTRAINT fk_import_jobs_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS share_links (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				token VARCHAR(64) NOT NULL,
+				user_id BIGINT UNSIGNED NOT NULL,
+				session_id BIGINT UNSIGNED NOT NULL,
+				snapshot MEDIUMTEXT NULL,
+				expires_at DATETIME NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY uniq_share_links_token (token),
+				INDEX idx_share_links_session (session_id),
+				CONSTRAINT fk_share_links_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+				CONSTRAINT fk_share_links_session FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS message_reasoning (
+				message_id BIGINT UNSIGNED NOT NULL,
+				content MEDIUMTEXT NOT NULL,
+				PRIMARY KEY (message_id),
+				CONSTRAINT fk_message_reasoning_message FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS usage_records (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				user_id BIGINT UNSIGNED NOT NULL,
+				session_id BIGINT UNSIGNED NULL,
+				provider VARCHAR(100) NOT NULL,
+				model VARCHAR(191) NOT NULL,
+				prompt_tokens INT NOT NULL,
+				completion_tokens INT NOT NULL,
+				cost DECIMAL(14,6) NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				INDEX idx_usage_records_user_time (user_id, created_at),
+				CONSTRAINT fk_usage_records_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS session_settings (
+				session_id BIGINT UNSIGNED NOT NULL,
+				system_prompt MEDIUMTEXT NOT NULL,
+				temperature FLOAT NULL,
+				top_p FLOAT NULL,
+				max_tokens INT NULL,
+				stop TEXT NULL,
+				tools TEXT NULL,
+				fallbacks TEXT NULL,
+				updated_at DATETIME NOT NULL,
+				PRIMARY KEY (session_id),
+				CONSTRAINT fk_session_settings_session FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS personas (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				user_id BIGINT UNSIGNED NOT NULL,
+				name VARCHAR(100) NOT NULL,
+				system_prompt MEDIUMTEXT NOT NULL,
+				provider VARCHAR(100) NOT NULL DEFAULT '',
+				model VARCHAR(191) NOT NULL DEFAULT '',
+				tools TEXT NULL,
+				shared TINYINT(1) NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				INDEX idx_personas_user (user_id),
+				CONSTRAINT fk_personas_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS persona_files (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				persona_id BIGINT UNSIGNED NOT NULL,
+				file_name VARCHAR(255) NOT NULL,
+				stored_path TEXT NOT NULL,
+				mime_type VARCHAR(255) NOT NULL,
+				size BIGINT NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				INDEX idx_persona_files_persona (persona_id),
+				CONSTRAINT fk_persona_files_persona FOREIGN KEY (persona_id) REFERENCES personas(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS prompt_templates (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				user_id BIGINT UNSIGNED NOT NULL,
+				name VARCHAR(191) NOT NULL,
+				description TEXT NOT NULL,
+				content MEDIUMTEXT NOT NULL,
+				tags TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY uniq_prompt_templates_name (user_id, name),
+				CONSTRAINT fk_prompt_templates_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS user_providers (
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				user_id BIGINT UNSIGNED NOT NULL,
+				name VARCHAR(191) NOT NULL,
+				type VARCHAR(64) NOT NULL,
+				base_url VARCHAR(2048) NOT NULL,
+				api_version VARCHAR(64) NOT NULL DEFAULT '',
+				model VARCHAR(255) NOT NULL DEFAULT '',
+				context_window INT NOT NULL DEFAULT 0,
+				headers TEXT NOT NULL,
+				api_key TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY uniq_user_providers_name (user_id, name),
+				CONSTRAINT fk_user_providers_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
 		}
 	default:
 		return fmt.Errorf("unsupported driver for migration: %s", driver)
@@ -210,5 +513,196 @@ func Migrate(db *sql.DB, driver string) error {
 			return fmt.Errorf("migrate (%s): %w", driver, err)
 		}
 	}
+	if err := addMissingColumns(db, driver); err != nil {
+		return err
+	}
+	if err := addMissingIndexes(db, driver); err != nil {
+		return err
+	}
+	return setupSearch(db, driver)
+}
+
+// indexMigration describes an index over columns that older databases only have after
+// addMissingColumns, so it cannot be part of the CREATE TABLE statements above.
+type indexMigration struct {
+	table   string
+	name    string
+	columns string
+}
+
+var indexMigrations = []indexMigration{
+	{table: "messages", name: "idx_messages_parent", columns: "session_id, parent_id"},
+	{table: "messages", name: "idx_messages_session_created", columns: "session_id, created_at, id"},
+	{table: "sessions", name: "idx_sessions_list", columns: "user_id, archived, pinned, updated_at, id"},
+}
+
+func addMissingIndexes(db *sql.DB, driver string) error {
+	mysql := strings.ToLower(driver) == "mysql"
+	for _, idx := range indexMigrations {
+		if !mysql {
+			if _, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(%s)", idx.name, idx.table, idx.columns)); err != nil {
+				return fmt.Errorf("create index %s: %w", idx.name, err)
+			}
+			continue
+		}
+		// mysql has no CREATE INDEX IF NOT EXISTS
+		var count int
+		if err := db.QueryRow(
+			`SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`,
+			idx.table, idx.name,
+		).Scan(&count); err != nil {
+			return fmt.Errorf("inspect index %s: %w", idx.name, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s(%s)", idx.name, idx.table, idx.columns)); err != nil {
+			return fmt.Errorf("create index %s: %w", idx.name, err)
+		}
+	}
 	return nil
 }
+
+// columnMigration describes a column added after the table was first released;
+// CREATE TABLE IF NOT EXISTS does not touch existing tables, so older databases get it via ALTER TABLE.
+// backfill runs once, right after the column was added.
+type columnMigration struct {
+	table     string
+	column    string
+	sqliteDef string
+	mysqlDef  string
+	backfill  func(db *sql.DB) error
+}
+
+var columnMigrations = []columnMigration{
+	{table: "messages", column: "status", sqliteDef: "TEXT NOT NULL DEFAULT 'complete'", mysqlDef: "VARCHAR(20) NOT NULL DEFAULT 'complete'"},
+	{table: "messages", column: "provider", sqliteDef: "TEXT NOT NULL DEFAULT ''", mysqlDef: "VARCHAR(100) NOT NULL DEFAULT ''"},
+	{table: "messages", column: "model", sqliteDef: "TEXT NOT NULL DEFAULT ''", mysqlDef: "VARCHAR(191) NOT NULL DEFAULT ''"},
+	{table: "messages", column: "variant_of", sqliteDef: "INTEGER", mysqlDef: "BIGINT UNSIGNED NULL"},
+	{table: "messages", column: "active", sqliteDef: "INTEGER NOT NULL DEFAULT 1", mysqlDef: "TINYINT(1) NOT NULL DEFAULT 1"},
+	{table: "messages", column: "parent_id", sqliteDef: "INTEGER", mysqlDef: "BIGINT UNSIGNED NULL"},
+	{table: "messages", column: "prompt_tokens", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "INT NOT NULL DEFAULT 0"},
+	{table: "messages", column: "completion_tokens", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "INT NOT NULL DEFAULT 0"},
+	{table: "messages", column: "ttft_ms", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "BIGINT NOT NULL DEFAULT 0"},
+	{table: "messages", column: "latency_ms", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "BIGINT NOT NULL DEFAULT 0"},
+	{table: "messages", column: "finish_reason", sqliteDef: "TEXT NOT NULL DEFAULT ''", mysqlDef: "VARCHAR(50) NOT NULL DEFAULT ''"},
+	{table: "users", column: "monthly_budget", sqliteDef: "REAL", mysqlDef: "DECIMAL(12,4) NULL"},
+	{table: "users", column: "fallbacks", sqliteDef: "TEXT", mysqlDef: "TEXT NULL"},
+	{table: "session_settings", column: "fallbacks", sqliteDef: "TEXT", mysqlDef: "TEXT NULL"},
+	{table: "sessions", column: "title_locked", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "TINYINT(1) NOT NULL DEFAULT 0"},
+	{table: "sessions", column: "pinned", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "TINYINT(1) NOT NULL DEFAULT 0"},
+	{table: "sessions", column: "archived", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "TINYINT(1) NOT NULL DEFAULT 0"},
+	{table: "sessions", column: "active_leaf_id", sqliteDef: "INTEGER", mysqlDef: "BIGINT UNSIGNED NULL", backfill: backfillMessageTree},
+	{table: "user_providers", column: "context_window", sqliteDef: "INTEGER NOT NULL DEFAULT 0", mysqlDef: "INT NOT NULL DEFAULT 0"},
+}
+
+func addMissingColumns(db *sql.DB, driver string) error {
+	mysql := strings.ToLower(driver) == "mysql"
+	for _, col := range columnMigrations {
+		exists, err := columnExists(db, mysql, col.table, col.column)
+		if err != nil {
+			return fmt.Errorf("inspect %s.%s: %w", col.table, col.column, err)
+		}
+		if exists {
+			continue
+		}
+		def := col.sqliteDef
+		if mysql {
+			def = col.mysqlDef
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.column, def)); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", col.table, col.column, err)
+		}
+		if col.backfill != nil {
+			if err := col.backfill(db); err != nil {
+				return fmt.Errorf("backfill %s.%s: %w", col.table, col.column, err)
+			}
+		}
+	}
+	return nil
+}
+
+// backfillMessageTree links the messages of existing sessions into a single chain
+// (each message's parent is the previous active one) and points active_leaf_id at
+// the last one. Reply variants hang off the same parent as the reply they replaced.
+func backfillMessageTree(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, session_id, variant_of, active FROM messages ORDER BY session_id, created_at, id`)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id, sessionID, group int64
+		active               bool
+	}
+	var all []row
+	for rows.Next() {
+		var (
+			r         row
+			variantOf sql.NullInt64
+		)
+		if err := rows.Scan(&r.id, &r.sessionID, &variantOf, &r.active); err != nil {
+			rows.Close()
+			return err
+		}
+		r.group = r.id
+		if variantOf.Valid && variantOf.Int64 > 0 {
+			r.group = variantOf.Int64
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	parents := make(map[int64]int64)     // message id -> parent id
+	groupParent := make(map[int64]int64) // variant group -> parent of its active member
+	leaves := make(map[int64]int64)      // session id -> last active message
+	for _, r := range all {
+		if !r.active {
+			continue
+		}
+		parents[r.id] = leaves[r.sessionID]
+		groupParent[r.group] = leaves[r.sessionID]
+		leaves[r.sessionID] = r.id
+	}
+	for _, r := range all {
+		if !r.active {
+			parents[r.id] = groupParent[r.group]
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, parent := range parents {
+		if parent <= 0 {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE messages SET parent_id = ? WHERE id = ?`, parent, id); err != nil {
+			return err
+		}
+	}
+	for sessionID, leaf := range leaves {
+		if _, err := tx.Exec(`UPDATE sessions SET active_leaf_id = ? WHERE id = ?`, leaf, sessionID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func columnExists(db *sql.DB, mysql bool, table, column string) (bool, error) {
+	var count int
+	var err error
+	if mysql {
+		err = db.QueryRow(
+			`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+			table, column,
+		).Scan(&count)
+	} else {
+		err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	}
+	return count > 0, err
+}
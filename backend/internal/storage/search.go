@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// setupSearch prepares full-text search over message content and session titles.
+// MySQL uses FULLTEXT indexes that follow the tables by themselves. SQLite uses FTS5
+// tables keyed by the message/session id, which the assistant service keeps in sync;
+// FTS5 needs the sqlite_fts5 build tag, and without it search falls back to LIKE.
+func setupSearch(db *sql.DB, driver string) error {
+	if strings.ToLower(driver) == "mysql" {
+		return addFullTextIndexes(db)
+	}
+	tables := []struct {
+		name     string
+		create   string
+		backfill string
+	}{
+		{
+			name:     "messages_fts",
+			create:   `CREATE VIRTUAL TABLE messages_fts USING fts5(content, session_id UNINDEXED, user_id UNINDEXED)`,
+			backfill: `INSERT INTO messages_fts (rowid, content, session_id, user_id) SELECT id, content, session_id, user_id FROM messages`,
+		},
+		{
+			name:     "sessions_fts",
+			create:   `CREATE VIRTUAL TABLE sessions_fts USING fts5(title, user_id UNINDEXED)`,
+			backfill: `INSERT INTO sessions_fts (rowid, title, user_id) SELECT id, title, user_id FROM sessions`,
+		},
+	}
+	for _, table := range tables {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table.name).Scan(&count); err != nil {
+			return fmt.Errorf("inspect %s: %w", table.name, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(table.create); err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				log.Printf("sqlite built without FTS5 (build tag sqlite_fts5); search falls back to LIKE")
+				return nil
+			}
+			return fmt.Errorf("create %s: %w", table.name, err)
+		}
+		if _, err := db.Exec(table.backfill); err != nil {
+			return fmt.Errorf("backfill %s: %w", table.name, err)
+		}
+	}
+	return nil
+}
+
+func addFullTextIndexes(db *sql.DB) error {
+	indexes := []struct {
+		table, name, column string
+	}{
+		{table: "messages", name: "ft_messages_content", column: "content"},
+		{table: "sessions", name: "ft_sessions_title", column: "title"},
+	}
+	for _, idx := range indexes {
+		var count int
+		if err := db.QueryRow(
+			`SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`,
+			idx.table, idx.name,
+		).Scan(&count); err != nil {
+			return fmt.Errorf("inspect index %s: %w", idx.name, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD FULLTEXT INDEX %s (%s)", idx.table, idx.name, idx.column)); err != nil {
+			return fmt.Errorf("create fulltext index %s: %w", idx.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrStreamCancelled is the cancellation cause of a stream stopped through Manager.Cancel.
+var ErrStreamCancelled = errors.New("generation cancelled")
+
+// activeStream tracks one Stream call from enqueue until it returns, so it can be
+// cancelled whether it is still waiting in the dispatcher or already generating.
+type activeStream struct {
+	userID      int64
+	clientMsgID string
+	cancel      context.CancelCauseFunc
+
+	mu      sync.Mutex
+	started bool
+	skipped bool
+}
+
+// begin is called by the worker before running the job; it reports false when the
+// stream was cancelled while queued.
+func (a *activeStream) begin(ctx context.Context) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.skipped || ctx.Err() != nil {
+		return false
+	}
+	a.started = true
+	return true
+}
+
+// skip marks a queued job as abandoned; it reports false when a worker already picked it up.
+func (a *activeStream) skip() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.started {
+		return false
+	}
+	a.skipped = true
+	return true
+}
+
+func (m *Manager) trackStream(userID, sessionID int64, clientMsgID string, cancel context.CancelCauseFunc) *activeStream {
+	run := &activeStream{userID: userID, clientMsgID: strings.TrimSpace(clientMsgID), cancel: cancel}
+	m.activeMu.Lock()
+	m.active[sessionID] = append(m.active[sessionID], run)
+	m.activeMu.Unlock()
+	return run
+}
+
+func (m *Manager) untrackStream(sessionID int64, run *activeStream) {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	runs := m.active[sessionID]
+	for i, r := range runs {
+		if r == run {
+			runs = append(runs[:i], runs[i+1:]...)
+			break
+		}
+	}
+	if len(runs) == 0 {
+		delete(m.active, sessionID)
+		return
+	}
+	m.active[sessionID] = runs
+}
+
+// Cancel stops the user's in-flight streams of a session, or only the one started
+// for clientMsgID when it is set. Other instances are asked to do the same; the
+// returned count covers streams running on this instance.
+func (m *Manager) Cancel(userID, sessionID int64, clientMsgID string) int {
+	n := m.cancelLocal(userID, sessionID, clientMsgID)
+	m.rdb.publishInvalidation(invalidateMessage{
+		UserID:      userID,
+		SessionID:   sessionID,
+		Scope:       scopeCancel,
+		ClientMsgID: clientMsgID,
+	})
+	return n
+}
+
+func (m *Manager) cancelLocal(userID, sessionID int64, clientMsgID string) int {
+	clientMsgID = strings.TrimSpace(clientMsgID)
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	var n int
+	for _, run := range m.active[sessionID] {
+		if run.userID != userID {
+			continue
+		}
+		if clientMsgID != "" && run.clientMsgID != clientMsgID {
+			continue
+		}
+		run.cancel(ErrStreamCancelled)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,151 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"unichatgo/internal/config"
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
+)
+
+const (
+	// contextMarginPercent of the window is kept free for estimation errors and the
+	// tool definitions sent with the prompt.
+	contextMarginPercent = 10
+	// recentMessages of the history are sent whole as long as they fit.
+	recentMessages = 4
+	// compressedMessageTokens is the length older messages are shortened to.
+	compressedMessageTokens = 200
+	// imageTokens approximates the cost of an inline image.
+	imageTokens = 1000
+)
+
+// contextBudget returns the context window of the session's model and the tokens its
+// prompt may use: the window less the room for the reply and a safety margin. Both are
+// 0 when the window is not configured.
+func contextBudget(spec llm.Spec, settings *models.SessionSettings) (window, budget int) {
+	window = llm.ContextWindow(spec.Config, spec.Model)
+	if window <= 0 {
+		return 0, 0
+	}
+	reserve := spec.Config.MaxTokens
+	if settings != nil && settings.MaxTokens != nil && *settings.MaxTokens > 0 {
+		reserve = *settings.MaxTokens
+	}
+	if reserve <= 0 {
+		reserve = config.DefaultMaxTokens
+	}
+	// a window too small for the configured reply still leaves half for the prompt
+	reserve = min(reserve, window/2)
+	return window, window - reserve - window*contextMarginPercent/100
+}
+
+// fitHistory joins the leading instructions, the history and the trailing messages
+// (attachment instructions and the new prompt) into the messages sent to the model,
+// cutting the history to fit budget tokens. Messages older than the latest few are
+// shortened first, oldest first; if that is not enough the oldest are dropped and a
+// note tells the model that earlier messages are missing. head and tail are always
+// sent. The returned trim is nil when the history was sent unchanged, even if head and
+// tail alone exceed the budget.
+func fitHistory(head, history, tail []*models.Message, extraTokens, budget int) ([]*models.Message, *models.ContextTrim) {
+	fixed := countTokens(head) + countTokens(tail) + extraTokens
+	tokens := countTokens(history)
+	if budget <= 0 || fixed+tokens <= budget {
+		return joinHistory(head, nil, history, tail), nil
+	}
+	available := budget - fixed
+	kept := append([]*models.Message{}, history...)
+	shortened := make([]bool, len(kept))
+	for i := 0; i < len(kept)-recentMessages && tokens > available; i++ {
+		if short := compressMessage(kept[i]); short != nil {
+			tokens += messageTokens(short) - messageTokens(kept[i])
+			kept[i] = short
+			shortened[i] = true
+		}
+	}
+
+	var note *models.Message
+	dropped := 0
+	for dropped < len(kept) && tokens > available {
+		tokens -= messageTokens(kept[dropped])
+		dropped++
+	}
+	// the conversation must not open with the answer to a dropped question
+	for dropped > 0 && dropped < len(kept) && kept[dropped] != nil && kept[dropped].Role == models.RoleAssistant {
+		tokens -= messageTokens(kept[dropped])
+		dropped++
+	}
+	if dropped > 0 {
+		first := kept[0]
+		note = &models.Message{
+			Role:      models.RoleSystem,
+			Content:   fmt.Sprintf("The %d earliest messages of this conversation were left out to fit the context window.", dropped),
+			CreatedAt: time.Now(),
+		}
+		if first != nil {
+			note.UserID, note.SessionID = first.UserID, first.SessionID
+		}
+		tokens += messageTokens(note)
+	}
+
+	trim := &models.ContextTrim{DroppedMessages: dropped, EstimatedTokens: fixed + tokens}
+	for i := dropped; i < len(kept); i++ {
+		if shortened[i] {
+			trim.CompressedMessages++
+		}
+	}
+	if dropped == 0 && trim.CompressedMessages == 0 {
+		// only head and tail are over budget, and they are sent whole anyway
+		return joinHistory(head, nil, history, tail), nil
+	}
+	return joinHistory(head, note, kept[dropped:], tail), trim
+}
+
+// promptParts are the pieces fitHistory joins into a prompt, kept so that a fallback
+// model with a different context window can refit them.
+type promptParts struct {
+	head, history, tail []*models.Message
+	extraTokens         int
+}
+
+func (p promptParts) fit(budget int) ([]*models.Message, *models.ContextTrim) {
+	return fitHistory(p.head, p.history, p.tail, p.extraTokens, budget)
+}
+
+// compressMessage returns a copy of msg shortened to compressedMessageTokens, or nil
+// when it is short already.
+func compressMessage(msg *models.Message) *models.Message {
+	if msg == nil || llm.EstimateTokens(msg.Content) <= compressedMessageTokens {
+		return nil
+	}
+	short := *msg
+	short.Content = llm.TruncateToTokens(msg.Content, compressedMessageTokens) + " [...]"
+	short.Reasoning = ""
+	return &short
+}
+
+func joinHistory(head []*models.Message, note *models.Message, history, tail []*models.Message) []*models.Message {
+	joined := make([]*models.Message, 0, len(head)+1+len(history)+len(tail))
+	joined = append(joined, head...)
+	if note != nil {
+		joined = append(joined, note)
+	}
+	joined = append(joined, history...)
+	return append(joined, tail...)
+}
+
+func messageTokens(msg *models.Message) int {
+	if msg == nil {
+		return 0
+	}
+	return llm.EstimateTokens(msg.Content) + llm.MessageTokenOverhead
+}
+
+func countTokens(messages []*models.Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += messageTokens(msg)
+	}
+	return total
+}
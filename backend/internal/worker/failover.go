@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync/atomic"
+
+	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
+)
+
+// streamChat generates the reply with the session's provider from history, the prompt
+// fitted to its context window. When it fails with a retryable error before any event
+// was sent, the reply is generated by the next provider of the fallback chain the user
+// can use, with the prompt refitted to that model's window; the returned message names
+// the provider and model that answered.
+func (m *Manager) streamChat(ctx context.Context, req StreamRequest, res *sessionResources, prompt promptParts, history []*models.Message, imageFiles []*models.TempFile) (*models.Message, error) {
+	var emitted atomic.Bool
+	eventFn := func(event models.StreamEvent) error {
+		emitted.Store(true)
+		if req.EventFn == nil {
+			return nil
+		}
+		return req.EventFn(event)
+	}
+	canFailOver := func(err error) bool {
+		return err != nil && ctx.Err() == nil && !emitted.Load() && llm.Retryable(err)
+	}
+	aiMsg, err := res.ai.StreamChat(ctx, req.Message, history, imageFiles, eventFn)
+	if !canFailOver(err) {
+		return aiMsg, err
+	}
+	tried := []models.ProviderModel{{Provider: res.provider, Model: res.model}}
+	for _, next := range m.fallbackChain(ctx, req.UserID, res.settings) {
+		if slices.Contains(tried, next) {
+			continue
+		}
+		tried = append(tried, next)
+		// providers the user has no key for are skipped
+		token, tokenErr := m.asst.EnsureAIReady(ctx, req.UserID, next.Provider)
+		if tokenErr != nil {
+			continue
+		}
+		fallback := req.SessionRequest
+		fallback.Provider, fallback.Model, fallback.Token = next.Provider, next.Model, token
+		spec, specErr := m.providerSpec(ctx, fallback)
+		if specErr != nil {
+			continue
+		}
+		aiSvc, buildErr := aiFactory(spec, res.settings)
+		if buildErr != nil {
+			log.Printf("worker failover to %s/%s failed: %v", next.Provider, next.Model, buildErr)
+			continue
+		}
+		log.Printf("worker session %d: %s/%s failed (%v), failing over to %s/%s",
+			req.SessionID, res.provider, res.model, err, next.Provider, next.Model)
+		fallbackHistory := history
+		if window, budget := contextBudget(spec, res.settings); budget != res.contextBudget {
+			var trim *models.ContextTrim
+			fallbackHistory, trim = prompt.fit(budget)
+			if trim != nil && req.EventFn != nil {
+				trim.ContextWindow = window
+				if err := req.EventFn(models.StreamEvent{Type: models.StreamContextTrimmed, Trim: trim}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		aiMsg, err = aiSvc.StreamChat(ctx, req.Message, fallbackHistory, imageFiles, eventFn)
+		if aiMsg != nil {
+			if aiMsg.Provider == "" {
+				aiMsg.Provider = spec.Name
+			}
+			if aiMsg.Model == "" {
+				aiMsg.Model = spec.Model
+			}
+		}
+		if !canFailOver(err) {
+			return aiMsg, err
+		}
+	}
+	return aiMsg, err
+}
+
+// fallbackChain returns the session's fallback chain, or the user's when the session
+// has none.
+func (m *Manager) fallbackChain(ctx context.Context, userID int64, settings *models.SessionSettings) []models.ProviderModel {
+	if settings != nil && settings.Fallbacks != nil {
+		return settings.Fallbacks
+	}
+	chain, err := m.asst.GetUserFallbacks(ctx, userID)
+	if err != nil {
+		log.Printf("worker load fallbacks of user %d: %v", userID, err)
+		return nil
+	}
+	return chain
+}
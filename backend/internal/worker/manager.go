@@ -2,17 +2,21 @@ package worker
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"unichatgo/internal/config"
 	"unichatgo/internal/models"
 	"unichatgo/internal/redis"
 	"unichatgo/internal/service/ai"
 	"unichatgo/internal/service/assistant"
+	"unichatgo/internal/service/llm"
 
 	"github.com/cloudwego/eino-ext/components/document/loader/file"
 	"github.com/cloudwego/eino/components/document"
@@ -32,7 +36,12 @@ type SessionRequest struct {
 
 type StreamRequest struct {
 	SessionRequest
-	ChunkFn func(string) error
+	ClientMsgID string
+	// Regenerate answers Message again: it is already stored, so the cached history is
+	// cut back to just before it, dropping the reply being replaced.
+	Regenerate bool
+	// EventFn receives the incremental events of the generation.
+	EventFn func(models.StreamEvent) error
 }
 
 type sessionTask struct {
@@ -42,6 +51,7 @@ type sessionTask struct {
 
 type streamTask struct {
 	req      StreamRequest
+	run      *activeStream
 	resultCh chan workerReturn
 }
 
@@ -66,6 +76,11 @@ type Assistant interface {
 	ListSessionTempFiles(ctx context.Context, userID, sessionID int64) ([]*models.TempFile, error)
 	AddMessage(ctx context.Context, msg models.Message) (*models.Message, error)
 	UpdateTempFileSummary(ctx context.Context, fileID int64, summary string, messageID int64) error
+	GetSessionSettings(ctx context.Context, userID, sessionID int64) (*models.SessionSettings, error)
+	UserProviderConfig(ctx context.Context, userID int64, name string) (config.ProviderConfig, string, error)
+	GetUserFallbacks(ctx context.Context, userID int64) ([]models.ProviderModel, error)
+	EnsureAIReady(ctx context.Context, userID int64, provider string) (string, error)
+	RecordUsage(ctx context.Context, rec models.UsageRecord) (*models.UsageRecord, error)
 }
 
 type Manager struct {
@@ -76,6 +91,9 @@ type Manager struct {
 	fileLoader     *file.FileLoader
 	rdb            *stateRedis
 	enqueueTimeout time.Duration
+
+	activeMu sync.Mutex
+	active   map[int64][]*activeStream
 }
 
 var pendingSeq int64
@@ -84,11 +102,11 @@ var ErrDispatcherBusy = errors.New("dispatcher is busy")
 
 // for mock test
 var (
-	aiFactory = func(provider, model, token string) (AICalling, error) {
-		return ai.NewAiService(provider, model, token)
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		return ai.NewAiService(spec, settings)
 	}
-	titleFactory = func(provider, model, token string) (AsCalling, error) {
-		return assistant.NewAssistantService(provider, model, token)
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return assistant.NewAssistantService(spec)
 	}
 )
 
@@ -150,6 +168,7 @@ func NewManager(asst Assistant, cfg DispatcherConfig, cacheClient *redis.Client)
 		fileLoader:     fileLoader,
 		rdb:            cacheHelper,
 		enqueueTimeout: cfg.EnqueueTimeout,
+		active:         make(map[int64][]*activeStream),
 	}
 	// cfg.WorkerIdleTimeout check in pool.go
 	m.dispatcher = NewDispatcher(cfg.MinWorkers, cfg.MaxWorkers, cfg.QueueSize, m, cfg.WorkerIdleTimeout)
@@ -224,6 +243,16 @@ func (m *Manager) InitSession(req SessionRequest) (*models.Session, error) {
 }
 
 func (m *Manager) Stream(req StreamRequest) (*models.Message, string, error) {
+	ctx := req.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	req.Context = ctx
+	run := m.trackStream(req.UserID, req.SessionID, req.ClientMsgID, cancel)
+	defer m.untrackStream(req.SessionID, run)
+
 	state := m.getState(req.UserID)
 	if !state.isReady(req.SessionID) {
 		if _, err := m.InitSession(req.SessionRequest); err != nil {
@@ -236,13 +265,27 @@ func (m *Manager) Stream(req StreamRequest) (*models.Message, string, error) {
 		Type: Stream,
 		StreamTask: streamTask{
 			req:      req,
+			run:      run,
 			resultCh: resultCh,
 		},
 	}
 	if err := m.enqueueJob(job); err != nil {
 		return nil, "", err
 	}
-	ret := <-resultCh
+	var ret workerReturn
+	select {
+	case ret = <-resultCh:
+	case <-ctx.Done():
+		if run.skip() {
+			// still queued, the worker will drop it
+			return nil, "", context.Cause(ctx)
+		}
+		// already generating, wait for the partial reply
+		ret = <-resultCh
+	}
+	if ret.err != nil && errors.Is(context.Cause(ctx), ErrStreamCancelled) {
+		ret.err = ErrStreamCancelled
+	}
 	return ret.aiMessage, ret.title, ret.err
 }
 
@@ -261,6 +304,32 @@ func (m *Manager) Purge(userID, sessionID int64) {
 	})
 }
 
+// InvalidateSettings drops the cached AI resources of a session so the next reply is
+// generated with its new settings.
+func (m *Manager) InvalidateSettings(userID, sessionID int64) {
+	if state := m.getStateIfExists(userID); state != nil {
+		state.dropResources(sessionID)
+	}
+	m.rdb.publishInvalidation(invalidateMessage{
+		UserID:    userID,
+		SessionID: sessionID,
+		Scope:     scopeSettings,
+	})
+}
+
+// InvalidateProvider drops the cached AI resources of the user's sessions using a
+// provider so they are rebuilt with its new endpoint or key.
+func (m *Manager) InvalidateProvider(userID int64, provider string) {
+	if state := m.getStateIfExists(userID); state != nil {
+		state.dropProviderResources(provider)
+	}
+	m.rdb.publishInvalidation(invalidateMessage{
+		UserID:   userID,
+		Scope:    scopeProvider,
+		Provider: provider,
+	})
+}
+
 func (m *Manager) InvalidateTempFiles(userID, sessionID int64) {
 	state := m.getStateIfExists(userID)
 	if state == nil {
@@ -371,6 +440,12 @@ func (m *Manager) handleStream(task streamTask) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	if !task.run.begin(ctx) {
+		if task.resultCh != nil {
+			task.resultCh <- workerReturn{err: context.Cause(ctx)}
+		}
+		return
+	}
 	forcedAttachments := len(req.Files) > 0
 	attachments := req.Files
 	if forcedAttachments {
@@ -412,8 +487,13 @@ func (m *Manager) handleStream(task streamTask) {
 	}
 
 	history := state.getHistory(req.SessionID)
+	if req.Regenerate && req.Message != nil {
+		history = historyBefore(history, req.Message.ID)
+		state.setHistory(req.SessionID, history)
+		m.rdb.cacheHistory(req.SessionID, history)
+	}
 	var title string
-	if !hasUserMessage(history) {
+	if !req.Regenerate && !hasUserMessage(history) && !titleLocked(state.getSession(req.SessionID)) {
 		var titleMsgs []*models.Message
 		if req.Message != nil {
 			titleMsgs = []*models.Message{req.Message}
@@ -424,7 +504,9 @@ func (m *Manager) handleStream(task streamTask) {
 			}
 			return
 		}
-		title, err = res.as.GenerateTitle(ctx, titleMsgs)
+		var usage *models.TokenUsage
+		title, usage, err = res.as.GenerateTitle(ctx, titleMsgs)
+		m.recordUsage(ctx, req.UserID, req.SessionID, res, usage)
 		if err != nil {
 			if task.resultCh != nil {
 				task.resultCh <- workerReturn{err: err}
@@ -462,9 +544,20 @@ func (m *Manager) handleStream(task streamTask) {
 		m.rdb.cacheHistory(req.SessionID, history)
 	}
 
-	chatHistory := append([]*models.Message{}, history...)
+	// the system prompt, attachment instructions and the new message are always sent;
+	// the history in between is cut to the model's context window
+	var instructionMsgs, pendingMsgs []*models.Message
+	if res.settings != nil && res.settings.SystemPrompt != "" {
+		instructionMsgs = append(instructionMsgs, &models.Message{
+			UserID:    req.UserID,
+			SessionID: req.SessionID,
+			Role:      models.RoleSystem,
+			Content:   res.settings.SystemPrompt,
+			CreatedAt: time.Now(),
+		})
+	}
 	if instructions := buildAttachmentInstruction(textFiles, imageFiles, forcedAttachments); instructions != "" {
-		chatHistory = append(chatHistory, &models.Message{
+		pendingMsgs = append(pendingMsgs, &models.Message{
 			UserID:    req.UserID,
 			SessionID: req.SessionID,
 			Role:      models.RoleSystem,
@@ -473,26 +566,49 @@ func (m *Manager) handleStream(task streamTask) {
 		})
 	}
 	if req.Message != nil {
-		chatHistory = append(chatHistory, req.Message)
+		pendingMsgs = append(pendingMsgs, req.Message)
+	}
+	prompt := promptParts{head: instructionMsgs, history: history, tail: pendingMsgs, extraTokens: imageTokens * len(imageFiles)}
+	chatHistory, trim := prompt.fit(res.contextBudget)
+	if req.Message != nil {
 		history = append(history, req.Message)
 		state.setHistory(req.SessionID, history)
 		m.rdb.cacheHistory(req.SessionID, history)
 	}
-
-	var cb func(string) error
-	if req.ChunkFn != nil {
-		cb = func(chunk string) error { return req.ChunkFn(chunk) }
+	if trim != nil {
+		trim.ContextWindow = res.contextWindow
+		if req.EventFn != nil {
+			if err := req.EventFn(models.StreamEvent{Type: models.StreamContextTrimmed, Trim: trim}); err != nil {
+				if task.resultCh != nil {
+					task.resultCh <- workerReturn{title: title, err: err}
+				}
+				return
+			}
+		}
 	}
+
 	if res.ai == nil {
 		if task.resultCh != nil {
 			task.resultCh <- workerReturn{err: errors.New("ai service unavailable")}
 		}
 		return
 	}
-	aiMsg, err := res.ai.StreamChat(ctx, req.Message, chatHistory, imageFiles, cb)
+	aiMsg, err := m.streamChat(ctx, req, res, prompt, chatHistory, imageFiles)
 	if err != nil {
+		var partial *models.Message
+		if aiMsg != nil && errors.Is(context.Cause(ctx), ErrStreamCancelled) {
+			// keep what was generated before the cancel
+			partial = aiMsg
+			partial.Status = models.MessageStatusCancelled
+			// a cancel before the first token leaves nothing to keep; providers
+			// reject empty assistant messages
+			if strings.TrimSpace(partial.Content) != "" {
+				state.appendHistory(req.SessionID, partial)
+				m.rdb.cacheHistory(req.SessionID, state.getHistory(req.SessionID))
+			}
+		}
 		if task.resultCh != nil {
-			task.resultCh <- workerReturn{err: err}
+			task.resultCh <- workerReturn{aiMessage: partial, title: title, err: err}
 		}
 		return
 	}
@@ -512,6 +628,21 @@ func hasUserMessage(history []*models.Message) bool {
 	return false
 }
 
+// titleLocked reports whether the user named the session, in which case no title is generated.
+func titleLocked(session *models.Session) bool {
+	return session != nil && session.TitleLocked
+}
+
+// historyBefore returns the messages preceding messageID, or the whole history when it is not cached.
+func historyBefore(history []*models.Message, messageID int64) []*models.Message {
+	for i, msg := range history {
+		if msg != nil && messageID > 0 && msg.ID == messageID {
+			return append([]*models.Message{}, history[:i]...)
+		}
+	}
+	return history
+}
+
 func isImageFile(mime string) bool {
 	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(mime)), "image/")
 }
@@ -580,11 +711,24 @@ func (m *Manager) ensureResources(state *userState, req SessionRequest) (*sessio
 	if res != nil && res.provider == req.Provider && res.model == req.Model && res.token == req.Token {
 		return res, nil
 	}
-	aiSvc, err := aiFactory(req.Provider, req.Model, req.Token)
+	ctx := req.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// a session that is not stored yet has no settings
+	settings, err := m.asst.GetSessionSettings(ctx, req.UserID, req.SessionID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	spec, err := m.providerSpec(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	aiSvc, err := aiFactory(spec, settings)
 	if err != nil {
 		return nil, err
 	}
-	asSvc, err := titleFactory(req.Provider, req.Model, req.Token)
+	asSvc, err := titleFactory(spec)
 	if err != nil {
 		return nil, err
 	}
@@ -594,11 +738,35 @@ func (m *Manager) ensureResources(state *userState, req SessionRequest) (*sessio
 		provider: req.Provider,
 		model:    req.Model,
 		token:    req.Token,
+		settings: settings,
 	}
+	res.contextWindow, res.contextBudget = contextBudget(spec, settings)
 	state.setResources(req.SessionID, res)
 	return res, nil
 }
 
+// providerSpec resolves the provider of a session: a provider of the server
+// configuration, otherwise one the user registered, which brings its own key.
+func (m *Manager) providerSpec(ctx context.Context, req SessionRequest) (llm.Spec, error) {
+	spec := llm.Spec{Name: req.Provider, Model: req.Model, APIKey: req.Token}
+	if cfg, ok := llm.Default.Lookup(req.Provider); ok {
+		spec.Config = cfg
+		return spec, nil
+	}
+	cfg, key, err := m.asst.UserProviderConfig(ctx, req.UserID, req.Provider)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return spec, fmt.Errorf("%w: %s", llm.ErrUnknownProvider, req.Provider)
+		}
+		return spec, err
+	}
+	spec.Config = cfg
+	if key != "" {
+		spec.APIKey = key
+	}
+	return spec, nil
+}
+
 func (m *Manager) attachFileSummaries(ctx context.Context, state *userState, req StreamRequest, res *sessionResources, history *[]*models.Message) error {
 	for _, tempFile := range req.Files {
 		if tempFile == nil || tempFile.StoredPath == "" {
@@ -610,7 +778,8 @@ func (m *Manager) attachFileSummaries(ctx context.Context, state *userState, req
 		if tempFile.Summary != "" {
 			continue
 		}
-		summary, err := m.generateFileSummary(ctx, res, tempFile)
+		summary, usage, err := m.generateFileSummary(ctx, res, tempFile)
+		m.recordUsage(ctx, req.UserID, req.SessionID, res, usage)
 		if err != nil {
 			return err
 		}
@@ -638,10 +807,10 @@ func (m *Manager) attachFileSummaries(ctx context.Context, state *userState, req
 	return nil
 }
 
-func (m *Manager) generateFileSummary(ctx context.Context, res *sessionResources, file *models.TempFile) (string, error) {
+func (m *Manager) generateFileSummary(ctx context.Context, res *sessionResources, file *models.TempFile) (string, *models.TokenUsage, error) {
 	docs, err := m.fileLoader.Load(ctx, document.Source{URI: file.StoredPath})
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	var builder strings.Builder
 	builder.WriteString(fmt.Sprintf("File name: %s\n\n", file.FileName))
@@ -655,7 +824,7 @@ func (m *Manager) generateFileSummary(ctx context.Context, res *sessionResources
 	}
 	payload := strings.TrimSpace(builder.String())
 	if payload == "" {
-		return "", errors.New("file content empty")
+		return "", nil, errors.New("file content empty")
 	}
 	messages := []*models.Message{
 		{
@@ -666,6 +835,24 @@ func (m *Manager) generateFileSummary(ctx context.Context, res *sessionResources
 	return res.as.SummarizeFile(ctx, messages)
 }
 
+// recordUsage adds a title or summary generation to the user's usage ledger; usage is
+// nil when no provider call was made.
+func (m *Manager) recordUsage(ctx context.Context, userID, sessionID int64, res *sessionResources, usage *models.TokenUsage) {
+	if usage == nil {
+		return
+	}
+	if _, err := m.asst.RecordUsage(ctx, models.UsageRecord{
+		UserID:           userID,
+		SessionID:        sessionID,
+		Provider:         res.provider,
+		Model:            res.model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}); err != nil {
+		log.Printf("worker record usage of user %d: %v", userID, err)
+	}
+}
+
 func (m *Manager) applyInvalidation(msg invalidateMessage) {
 	switch msg.Scope {
 	case scopeUser:
@@ -679,6 +866,16 @@ func (m *Manager) applyInvalidation(msg invalidateMessage) {
 	case scopeFiles:
 		m.clearSessionFiles(msg.UserID, msg.SessionID)
 		m.rdb.invalidateFiles(msg.SessionID)
+	case scopeCancel:
+		m.cancelLocal(msg.UserID, msg.SessionID, msg.ClientMsgID)
+	case scopeSettings:
+		if state := m.getStateIfExists(msg.UserID); state != nil {
+			state.dropResources(msg.SessionID)
+		}
+	case scopeProvider:
+		if state := m.getStateIfExists(msg.UserID); state != nil {
+			state.dropProviderResources(msg.Provider)
+		}
 	}
 }
 
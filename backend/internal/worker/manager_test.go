@@ -2,11 +2,17 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"unichatgo/internal/config"
 	"unichatgo/internal/models"
+	"unichatgo/internal/service/llm"
 )
 
 func TestWorkerStateCacheOperations(t *testing.T) {
@@ -88,10 +94,10 @@ func TestDispatcherInitAndStream(t *testing.T) {
 		aiFactory = origAI
 		titleFactory = origTitle
 	}()
-	aiFactory = func(provider, model, token string) (AICalling, error) {
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
 		return &fakeAI{}, nil
 	}
-	titleFactory = func(provider, model, token string) (AsCalling, error) {
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
 		return &fakeAS{}, nil
 	}
 
@@ -128,6 +134,14 @@ func TestDispatcherInitAndStream(t *testing.T) {
 	if title != "fake-title" {
 		t.Fatalf("unexpected title: %s", title)
 	}
+	mockAsst.mu.Lock()
+	defer mockAsst.mu.Unlock()
+	if len(mockAsst.usage) != 1 {
+		t.Fatalf("expected the title generation to be metered, got %#v", mockAsst.usage)
+	}
+	if rec := mockAsst.usage[0]; rec.UserID != 1 || rec.SessionID != session.ID || rec.Provider != "mock" || rec.Model != "m1" || rec.PromptTokens != 30 || rec.CompletionTokens != 3 {
+		t.Fatalf("unexpected usage record: %#v", rec)
+	}
 }
 
 func TestDispatcherJobOrder(t *testing.T) {
@@ -143,14 +157,14 @@ func TestDispatcherJobOrder(t *testing.T) {
 
 	var mu sync.Mutex
 	order := make([]string, 0, 2)
-	aiFactory = func(provider, model, token string) (AICalling, error) {
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
 		return &labeledAI{onRun: func(label string) {
 			mu.Lock()
 			order = append(order, label)
 			mu.Unlock()
 		}}, nil
 	}
-	titleFactory = func(provider, model, token string) (AsCalling, error) {
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
 		return &fakeAS{}, nil
 	}
 
@@ -206,10 +220,10 @@ func TestDispatcherQueuesWhenWorkerBusy(t *testing.T) {
 
 	block := make(chan struct{})
 	started := make(chan struct{})
-	aiFactory = func(provider, model, token string) (AICalling, error) {
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
 		return &fakeBlockingAI{block: block, started: started}, nil
 	}
-	titleFactory = func(provider, model, token string) (AsCalling, error) {
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
 		return &fakeAS{}, nil
 	}
 
@@ -270,6 +284,183 @@ func TestDispatcherQueuesWhenWorkerBusy(t *testing.T) {
 	}
 }
 
+func TestManagerCancelStream(t *testing.T) {
+	mockAsst := newMockAssistant()
+	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+
+	started := make(chan struct{})
+	partial := "partial"
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		return &cancellableAI{started: started, partial: partial}, nil
+	}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+
+	session, err := manager.InitSession(SessionRequest{UserID: 31, Provider: "mock", Model: "m", Token: "tok"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+
+	type result struct {
+		msg *models.Message
+		err error
+	}
+	stream := func(sessionID int64, clientID, content string) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			msg, _, err := manager.Stream(StreamRequest{
+				SessionRequest: SessionRequest{
+					Context:   context.Background(),
+					UserID:    31,
+					SessionID: sessionID,
+					Provider:  "mock",
+					Model:     "m",
+					Token:     "tok",
+					Message:   &models.Message{Content: content},
+				},
+				ClientMsgID: clientID,
+			})
+			ch <- result{msg: msg, err: err}
+		}()
+		return ch
+	}
+
+	running := stream(session.ID, "running", "first")
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("first stream did not start")
+	}
+	// the only worker is busy, so the second job waits in the dispatcher
+	queued := stream(session.ID, "queued", "second")
+	deadline := time.Now().Add(time.Second)
+	for {
+		manager.activeMu.Lock()
+		n := len(manager.active[session.ID])
+		manager.activeMu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("second stream was not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := manager.Cancel(31, session.ID, "queued"); n != 1 {
+		t.Fatalf("expected one queued stream cancelled, got %d", n)
+	}
+	select {
+	case res := <-queued:
+		if !errors.Is(res.err, ErrStreamCancelled) || res.msg != nil {
+			t.Fatalf("unexpected queued result: %#v %v", res.msg, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("queued stream was not cancelled")
+	}
+
+	if n := manager.Cancel(31, session.ID, ""); n != 1 {
+		t.Fatalf("expected running stream cancelled, got %d", n)
+	}
+	select {
+	case res := <-running:
+		if !errors.Is(res.err, ErrStreamCancelled) {
+			t.Fatalf("expected cancelled error, got %v", res.err)
+		}
+		if res.msg == nil || res.msg.Content != "partial" || res.msg.Status != models.MessageStatusCancelled {
+			t.Fatalf("unexpected partial message: %#v", res.msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("running stream was not cancelled")
+	}
+
+	// a cancel before the first chunk keeps nothing in the history
+	started = make(chan struct{})
+	partial = ""
+	empty, err := manager.InitSession(SessionRequest{UserID: 31, Provider: "mock", Model: "m", Token: "tok"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+	early := stream(empty.ID, "early", "third")
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("early stream did not start")
+	}
+	if n := manager.Cancel(31, empty.ID, ""); n != 1 {
+		t.Fatalf("expected early stream cancelled, got %d", n)
+	}
+	select {
+	case res := <-early:
+		if !errors.Is(res.err, ErrStreamCancelled) {
+			t.Fatalf("expected cancelled error, got %v", res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("early stream was not cancelled")
+	}
+	history := manager.getState(31).getHistory(empty.ID)
+	if len(history) != 1 || history[0].Content != "third" {
+		t.Fatalf("expected only the prompt in history, got %#v", history)
+	}
+}
+
+func TestManagerRegenerateTrimsHistory(t *testing.T) {
+	mockAsst := newMockAssistant()
+	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		return &fakeAI{}, nil
+	}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+
+	session, err := manager.InitSession(SessionRequest{UserID: 41, Provider: "mock", Model: "m", Token: "tok"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+	prompt := &models.Message{ID: 7, Role: models.RoleUser, Content: "again"}
+	state := manager.getState(41)
+	state.setHistory(session.ID, []*models.Message{prompt, {ID: 8, Role: models.RoleAssistant, Content: "bad answer"}})
+
+	msg, title, err := manager.Stream(StreamRequest{
+		SessionRequest: SessionRequest{
+			Context:   context.Background(),
+			UserID:    41,
+			SessionID: session.ID,
+			Provider:  "mock",
+			Model:     "m",
+			Token:     "tok",
+			Message:   prompt,
+		},
+		Regenerate: true,
+	})
+	if err != nil {
+		t.Fatalf("Stream error: %v", err)
+	}
+	if title != "" {
+		t.Fatalf("regenerate should not retitle the session, got %q", title)
+	}
+	hist := state.getHistory(session.ID)
+	if len(hist) != 2 || hist[0].ID != 7 || hist[1] != msg {
+		t.Fatalf("expected prompt followed by the new reply, got %#v", hist)
+	}
+}
+
 func TestManagerHighLoadAllowsOtherUsers(t *testing.T) {
 	mockAsst := newMockAssistant()
 	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 3, QueueSize: 10}, nil)
@@ -283,13 +474,13 @@ func TestManagerHighLoadAllowsOtherUsers(t *testing.T) {
 		aiFactory = origAI
 		titleFactory = origTitle
 	}()
-	aiFactory = func(provider, model, token string) (AICalling, error) {
-		if provider == "slow" {
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		if spec.Name == "slow" {
 			return &fakeBlockingAI{block: block, started: started}, nil
 		}
 		return &fakeAI{}, nil
 	}
-	titleFactory = func(provider, model, token string) (AsCalling, error) {
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
 		return &fakeAS{}, nil
 	}
 
@@ -417,12 +608,22 @@ type mockAssistant struct {
 	nextMsgID   int64
 	sessions    map[int64]*models.Session
 	sessionMsgs map[int64][]*models.Message
+	settings    map[int64]*models.SessionSettings
+	providers   map[string]config.ProviderConfig
+	keys        map[string]string
+	fallbacks   []models.ProviderModel
+	// tokens lists the providers the user can use; nil allows every provider
+	tokens map[string]string
+	usage  []models.UsageRecord
 }
 
 func newMockAssistant() *mockAssistant {
 	return &mockAssistant{
 		sessions:    make(map[int64]*models.Session),
 		sessionMsgs: make(map[int64][]*models.Message),
+		settings:    make(map[int64]*models.SessionSettings),
+		providers:   make(map[string]config.ProviderConfig),
+		keys:        make(map[string]string),
 	}
 }
 
@@ -468,23 +669,89 @@ func (m *mockAssistant) UpdateTempFileSummary(ctx context.Context, fileID int64,
 	return nil
 }
 
+func (m *mockAssistant) GetSessionSettings(ctx context.Context, userID, sessionID int64) (*models.SessionSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.settings[sessionID], nil
+}
+
+// UserProviderConfig resolves providers added with setProvider; any other provider
+// resolves to an empty configuration.
+func (m *mockAssistant) UserProviderConfig(ctx context.Context, userID int64, name string) (config.ProviderConfig, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.providers[name], m.keys[name], nil
+}
+
+func (m *mockAssistant) setProvider(name string, cfg config.ProviderConfig, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.providers[name] = cfg
+	m.keys[name] = key
+}
+
+func (m *mockAssistant) GetUserFallbacks(ctx context.Context, userID int64) ([]models.ProviderModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fallbacks, nil
+}
+
+func (m *mockAssistant) RecordUsage(ctx context.Context, rec models.UsageRecord) (*models.UsageRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage = append(m.usage, rec)
+	return &rec, nil
+}
+
+func (m *mockAssistant) EnsureAIReady(ctx context.Context, userID int64, provider string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		return "tok", nil
+	}
+	token, ok := m.tokens[provider]
+	if !ok {
+		return "", errors.New("api token not configured")
+	}
+	return token, nil
+}
+
+func (m *mockAssistant) setSettings(sessionID int64, settings *models.SessionSettings) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings[sessionID] = settings
+}
+
+// historyAI records the history it is asked to answer.
+type historyAI struct {
+	mu      sync.Mutex
+	history []*models.Message
+}
+
+func (f *historyAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
+	f.mu.Lock()
+	f.history = append([]*models.Message{}, prevHistory...)
+	f.mu.Unlock()
+	return &models.Message{Content: "ai: " + message.Content}, nil
+}
+
 type fakeAI struct{}
 
-func (f *fakeAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(string) error) (*models.Message, error) {
+func (f *fakeAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
 	if callback != nil {
-		_ = callback("chunk")
+		_ = callback(models.StreamEvent{Type: models.StreamDelta, Text: "chunk"})
 	}
 	return &models.Message{Content: "ai: " + message.Content}, nil
 }
 
 type fakeAS struct{}
 
-func (f *fakeAS) GenerateTitle(ctx context.Context, messages []*models.Message) (string, error) {
-	return "fake-title", nil
+func (f *fakeAS) GenerateTitle(ctx context.Context, messages []*models.Message) (string, *models.TokenUsage, error) {
+	return "fake-title", &models.TokenUsage{PromptTokens: 30, CompletionTokens: 3, TotalTokens: 33}, nil
 }
 
-func (f *fakeAS) SummarizeFile(ctx context.Context, content []*models.Message) (string, error) {
-	return "fake-summary", nil
+func (f *fakeAS) SummarizeFile(ctx context.Context, content []*models.Message) (string, *models.TokenUsage, error) {
+	return "fake-summary", &models.TokenUsage{}, nil
 }
 
 type fakeBlockingAI struct {
@@ -493,7 +760,7 @@ type fakeBlockingAI struct {
 	once    sync.Once
 }
 
-func (f *fakeBlockingAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(string) error) (*models.Message, error) {
+func (f *fakeBlockingAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
 	f.once.Do(func() {
 		if f.started != nil {
 			close(f.started)
@@ -503,13 +770,447 @@ func (f *fakeBlockingAI) StreamChat(ctx context.Context, message *models.Message
 	return &models.Message{Content: "ai: " + message.Content}, nil
 }
 
+type cancellableAI struct {
+	started chan struct{}
+	partial string
+	once    sync.Once
+}
+
+func (f *cancellableAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
+	f.once.Do(func() { close(f.started) })
+	<-ctx.Done()
+	return &models.Message{Role: models.RoleAssistant, Content: f.partial}, context.Cause(ctx)
+}
+
 type labeledAI struct {
 	onRun func(label string)
 }
 
-func (f *labeledAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(string) error) (*models.Message, error) {
+func (f *labeledAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
 	if f.onRun != nil {
 		f.onRun(message.Content)
 	}
 	return &models.Message{Content: "ai: " + message.Content}, nil
 }
+
+func TestSessionSettingsApplied(t *testing.T) {
+	mockAsst := newMockAssistant()
+	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+	var (
+		built    []*models.SessionSettings
+		builtMu  sync.Mutex
+		recorder = &historyAI{}
+	)
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		builtMu.Lock()
+		built = append(built, settings)
+		builtMu.Unlock()
+		return recorder, nil
+	}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+
+	session, err := manager.InitSession(SessionRequest{UserID: 1, Provider: "mock", Model: "m1", Token: "tok"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+	stream := func(content string) {
+		t.Helper()
+		if _, _, err := manager.Stream(StreamRequest{SessionRequest: SessionRequest{
+			Context:   context.Background(),
+			UserID:    1,
+			SessionID: session.ID,
+			Provider:  "mock",
+			Model:     "m1",
+			Token:     "tok",
+			Message:   &models.Message{Role: models.RoleUser, Content: content},
+		}}); err != nil {
+			t.Fatalf("Stream error: %v", err)
+		}
+	}
+
+	stream("first")
+	recorder.mu.Lock()
+	if len(recorder.history) == 0 || recorder.history[0].Role == models.RoleSystem {
+		t.Fatalf("expected no system prompt without settings, got %#v", recorder.history)
+	}
+	recorder.mu.Unlock()
+
+	mockAsst.setSettings(session.ID, &models.SessionSettings{SessionID: session.ID, SystemPrompt: "Answer in French."})
+	stream("cached")
+	builtMu.Lock()
+	if len(built) != 1 {
+		t.Fatalf("expected cached resources before invalidation, built %d times", len(built))
+	}
+	builtMu.Unlock()
+
+	manager.InvalidateSettings(1, session.ID)
+	stream("second")
+	builtMu.Lock()
+	if len(built) != 2 || built[1] == nil || built[1].SystemPrompt != "Answer in French." {
+		t.Fatalf("expected resources rebuilt with new settings, got %#v", built)
+	}
+	builtMu.Unlock()
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if first := recorder.history[0]; first.Role != models.RoleSystem || first.Content != "Answer in French." {
+		t.Fatalf("expected system prompt first in history, got %#v", first)
+	}
+	if last := recorder.history[len(recorder.history)-1]; last.Content != "second" {
+		t.Fatalf("expected user message last, got %#v", last)
+	}
+}
+
+func TestUserProviderResolved(t *testing.T) {
+	mockAsst := newMockAssistant()
+	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+	var (
+		specs   []llm.Spec
+		specsMu sync.Mutex
+	)
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		specsMu.Lock()
+		specs = append(specs, spec)
+		specsMu.Unlock()
+		return &fakeAI{}, nil
+	}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+
+	mockAsst.setProvider("corp", config.ProviderConfig{Type: llm.TypeAzureOpenAI, BaseURL: "https://corp.openai.azure.com", APIVersion: "2024-06-01"}, "corp-key")
+	session, err := manager.InitSession(SessionRequest{UserID: 1, Provider: "corp", Model: "gpt-4o"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+	stream := func() {
+		t.Helper()
+		if _, _, err := manager.Stream(StreamRequest{SessionRequest: SessionRequest{
+			Context:   context.Background(),
+			UserID:    1,
+			SessionID: session.ID,
+			Provider:  "corp",
+			Model:     "gpt-4o",
+			Message:   &models.Message{Role: models.RoleUser, Content: "hello"},
+		}}); err != nil {
+			t.Fatalf("Stream error: %v", err)
+		}
+	}
+	stream()
+	specsMu.Lock()
+	if len(specs) != 1 || specs[0].Config.BaseURL != "https://corp.openai.azure.com" || specs[0].APIKey != "corp-key" || specs[0].Model != "gpt-4o" {
+		t.Fatalf("unexpected spec: %#v", specs)
+	}
+	specsMu.Unlock()
+
+	mockAsst.setProvider("corp", config.ProviderConfig{Type: llm.TypeAzureOpenAI, BaseURL: "https://corp2.openai.azure.com", APIVersion: "2024-06-01"}, "new-key")
+	manager.InvalidateProvider(1, "corp")
+	stream()
+	specsMu.Lock()
+	defer specsMu.Unlock()
+	if len(specs) != 2 || specs[1].Config.BaseURL != "https://corp2.openai.azure.com" || specs[1].APIKey != "new-key" {
+		t.Fatalf("expected resources rebuilt with the new endpoint, got %#v", specs)
+	}
+}
+
+// failingAI fails every generation, optionally after sending a delta.
+type failingAI struct {
+	err        error
+	afterDelta bool
+	calls      atomic.Int32
+}
+
+func (f *failingAI) StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error) {
+	f.calls.Add(1)
+	if f.afterDelta && callback != nil {
+		_ = callback(models.StreamEvent{Type: models.StreamDelta, Text: "partial"})
+	}
+	return nil, f.err
+}
+
+func TestProviderFailover(t *testing.T) {
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+	outage := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+
+	run := func(t *testing.T, primary *failingAI, mockAsst *mockAssistant) (*models.Message, []llm.Spec, error) {
+		t.Helper()
+		var (
+			mu    sync.Mutex
+			specs []llm.Spec
+		)
+		aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+			mu.Lock()
+			specs = append(specs, spec)
+			mu.Unlock()
+			if spec.Name == "openai" {
+				return primary, nil
+			}
+			return &fakeAI{}, nil
+		}
+		manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+		session, err := manager.InitSession(SessionRequest{UserID: 1, Provider: "openai", Model: "gpt-4o", Token: "tok"})
+		if err != nil {
+			t.Fatalf("InitSession error: %v", err)
+		}
+		reply, _, err := manager.Stream(StreamRequest{SessionRequest: SessionRequest{
+			Context:   context.Background(),
+			UserID:    1,
+			SessionID: session.ID,
+			Provider:  "openai",
+			Model:     "gpt-4o",
+			Token:     "tok",
+			Message:   &models.Message{Role: models.RoleUser, Content: "hello"},
+		}})
+		mu.Lock()
+		defer mu.Unlock()
+		return reply, specs, err
+	}
+
+	t.Run("skips providers without a key", func(t *testing.T) {
+		mockAsst := newMockAssistant()
+		mockAsst.fallbacks = []models.ProviderModel{{Provider: "openai", Model: "gpt-4o"}, {Provider: "gemini"}, {Provider: "claude", Model: "claude-haiku"}}
+		mockAsst.tokens = map[string]string{"openai": "tok", "claude": "claude-key"}
+		reply, specs, err := run(t, &failingAI{err: outage}, mockAsst)
+		if err != nil {
+			t.Fatalf("expected failover to succeed, got %v", err)
+		}
+		if reply.Provider != "claude" || reply.Model != "claude-haiku" || reply.Content != "ai: hello" {
+			t.Fatalf("unexpected reply: %#v", reply)
+		}
+		last := specs[len(specs)-1]
+		if last.Name != "claude" || last.APIKey != "claude-key" {
+			t.Fatalf("unexpected fallback spec: %#v", last)
+		}
+	})
+
+	t.Run("session chain overrides the user's", func(t *testing.T) {
+		mockAsst := newMockAssistant()
+		mockAsst.fallbacks = []models.ProviderModel{{Provider: "claude"}}
+		mockAsst.setSettings(1, &models.SessionSettings{SessionID: 1, Fallbacks: []models.ProviderModel{}})
+		_, _, err := run(t, &failingAI{err: outage}, mockAsst)
+		if err == nil {
+			t.Fatalf("expected no failover with an empty session chain")
+		}
+	})
+
+	t.Run("no failover on client errors or after output", func(t *testing.T) {
+		for _, primary := range []*failingAI{
+			{err: errors.New("invalid api key")},
+			{err: outage, afterDelta: true},
+		} {
+			mockAsst := newMockAssistant()
+			mockAsst.fallbacks = []models.ProviderModel{{Provider: "claude"}}
+			_, specs, err := run(t, primary, mockAsst)
+			if err == nil || len(specs) != 1 || primary.calls.Load() != 1 {
+				t.Fatalf("expected the error without failover, got err=%v specs=%d", err, len(specs))
+			}
+		}
+	})
+}
+
+func TestHistoryTrimmedToContextWindow(t *testing.T) {
+	mockAsst := newMockAssistant()
+	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+	recorder := &historyAI{}
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		return recorder, nil
+	}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+	// 2000 tokens less 500 for the reply and the margin leave 1300 for the prompt
+	mockAsst.setProvider("local", config.ProviderConfig{Type: llm.TypeOpenAICompatible, Model: "m", ContextWindow: 2000, MaxTokens: 500}, "")
+
+	session, err := manager.InitSession(SessionRequest{UserID: 5, Provider: "local"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+	mockAsst.setSettings(session.ID, &models.SessionSettings{SessionID: session.ID, SystemPrompt: "Be brief."})
+	manager.InvalidateSettings(5, session.ID)
+	var history []*models.Message
+	for i := 0; i < 30; i++ {
+		role := models.RoleUser
+		if i%2 == 1 {
+			role = models.RoleAssistant
+		}
+		history = append(history, &models.Message{ID: int64(i + 1), Role: role, Content: strings.Repeat("x", 400)})
+	}
+	state := manager.getState(5)
+	state.setHistory(session.ID, history)
+
+	var events []models.StreamEvent
+	prompt := &models.Message{Role: models.RoleUser, Content: "latest question"}
+	if _, _, err := manager.Stream(StreamRequest{
+		SessionRequest: SessionRequest{
+			Context:   context.Background(),
+			UserID:    5,
+			SessionID: session.ID,
+			Provider:  "local",
+			Message:   prompt,
+		},
+		EventFn: func(event models.StreamEvent) error {
+			events = append(events, event)
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("Stream error: %v", err)
+	}
+
+	recorder.mu.Lock()
+	sent := recorder.history
+	recorder.mu.Unlock()
+	if len(sent) < 3 || sent[0].Content != "Be brief." || sent[len(sent)-1] != prompt {
+		t.Fatalf("expected system prompt first and the prompt last, got %#v", sent)
+	}
+	if sent[1].Role != models.RoleSystem || !strings.Contains(sent[1].Content, "left out") || sent[2].Role != models.RoleUser {
+		t.Fatalf("expected a note followed by a user turn, got %#v %#v", sent[1], sent[2])
+	}
+	if got := countTokens(sent); got > 1300 {
+		t.Fatalf("prompt of %d tokens exceeds the budget", got)
+	}
+	if len(events) == 0 || events[0].Type != models.StreamContextTrimmed {
+		t.Fatalf("expected a context_trimmed event first, got %#v", events)
+	}
+	trim := events[0].Trim
+	if trim.DroppedMessages != 30-(len(sent)-3) || trim.ContextWindow != 2000 || trim.EstimatedTokens != countTokens(sent) {
+		t.Fatalf("unexpected trim: %+v for %d messages sent", trim, len(sent))
+	}
+	if cached := state.getHistory(session.ID); len(cached) < 31 {
+		t.Fatalf("trimming must not shorten the stored history, got %d messages", len(cached))
+	}
+}
+
+func TestFailoverRefitsHistory(t *testing.T) {
+	mockAsst := newMockAssistant()
+	manager := NewManager(mockAsst, DispatcherConfig{MinWorkers: 1, MaxWorkers: 1, QueueSize: 10}, nil)
+
+	origAI := aiFactory
+	origTitle := titleFactory
+	defer func() {
+		aiFactory = origAI
+		titleFactory = origTitle
+	}()
+	outage := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	recorder := &historyAI{}
+	aiFactory = func(spec llm.Spec, settings *models.SessionSettings) (AICalling, error) {
+		if spec.Name == "big" {
+			return &failingAI{err: outage}, nil
+		}
+		return recorder, nil
+	}
+	titleFactory = func(spec llm.Spec) (AsCalling, error) {
+		return &fakeAS{}, nil
+	}
+	// the whole history fits the primary model; the fallback leaves 1300 tokens
+	mockAsst.setProvider("big", config.ProviderConfig{Type: llm.TypeOpenAICompatible, Model: "m", ContextWindow: 100000}, "")
+	mockAsst.setProvider("small", config.ProviderConfig{Type: llm.TypeOpenAICompatible, Model: "m", ContextWindow: 2000, MaxTokens: 500}, "")
+	mockAsst.fallbacks = []models.ProviderModel{{Provider: "small", Model: "m"}}
+
+	session, err := manager.InitSession(SessionRequest{UserID: 6, Provider: "big"})
+	if err != nil {
+		t.Fatalf("InitSession error: %v", err)
+	}
+	var history []*models.Message
+	for i := 0; i < 30; i++ {
+		role := models.RoleUser
+		if i%2 == 1 {
+			role = models.RoleAssistant
+		}
+		history = append(history, &models.Message{ID: int64(i + 1), Role: role, Content: strings.Repeat("x", 400)})
+	}
+	manager.getState(6).setHistory(session.ID, history)
+
+	var events []models.StreamEvent
+	reply, _, err := manager.Stream(StreamRequest{
+		SessionRequest: SessionRequest{
+			Context:   context.Background(),
+			UserID:    6,
+			SessionID: session.ID,
+			Provider:  "big",
+			Message:   &models.Message{Role: models.RoleUser, Content: "latest question"},
+		},
+		EventFn: func(event models.StreamEvent) error {
+			events = append(events, event)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Stream error: %v", err)
+	}
+	if reply.Provider != "small" {
+		t.Fatalf("expected the fallback to answer, got %#v", reply)
+	}
+	recorder.mu.Lock()
+	sent := recorder.history
+	recorder.mu.Unlock()
+	if got := countTokens(sent); got > 1300 {
+		t.Fatalf("fallback prompt of %d tokens exceeds its budget", got)
+	}
+	if len(events) != 1 || events[0].Type != models.StreamContextTrimmed || events[0].Trim.ContextWindow != 2000 {
+		t.Fatalf("expected one context_trimmed event for the fallback, got %#v", events)
+	}
+}
+
+func TestFitHistoryCompressesOlderMessages(t *testing.T) {
+	long := &models.Message{Role: models.RoleUser, Content: strings.Repeat("word ", 400)}
+	history := []*models.Message{
+		long,
+		{Role: models.RoleAssistant, Content: "short answer"},
+		{Role: models.RoleUser, Content: "a"},
+		{Role: models.RoleAssistant, Content: "b"},
+		{Role: models.RoleUser, Content: "c"},
+		{Role: models.RoleAssistant, Content: "d"},
+	}
+	tail := []*models.Message{{Role: models.RoleUser, Content: "now"}}
+
+	sent, trim := fitHistory(nil, history, tail, 0, 10000)
+	if trim != nil || len(sent) != 7 {
+		t.Fatalf("expected the history unchanged, got %d messages and %+v", len(sent), trim)
+	}
+
+	sent, trim = fitHistory(nil, history, tail, 0, 300)
+	if trim == nil || trim.DroppedMessages != 0 || trim.CompressedMessages != 1 || len(sent) != 7 {
+		t.Fatalf("expected one compressed message, got %d messages and %+v", len(sent), trim)
+	}
+	if sent[0] == long || !strings.HasSuffix(sent[0].Content, " [...]") || messageTokens(sent[0]) > compressedMessageTokens+10 {
+		t.Fatalf("expected a shortened copy, got %q", sent[0].Content)
+	}
+	if len(long.Content) != 2000 {
+		t.Fatalf("the stored message must not change")
+	}
+	// nothing to cut when only the instructions and the prompt are too long
+	head := []*models.Message{{Role: models.RoleSystem, Content: strings.Repeat("rule ", 400)}}
+	if sent, trim := fitHistory(head, nil, tail, 0, 100); trim != nil || len(sent) != 2 {
+		t.Fatalf("expected no trim without a history, got %d messages and %+v", len(sent), trim)
+	}
+}
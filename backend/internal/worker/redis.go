@@ -17,15 +17,20 @@ const (
 )
 
 const (
-	scopeUser    = "user"
-	scopeSession = "session"
-	scopeFiles   = "files"
+	scopeUser     = "user"
+	scopeSession  = "session"
+	scopeFiles    = "files"
+	scopeCancel   = "cancel"
+	scopeSettings = "settings"
+	scopeProvider = "provider"
 )
 
 type invalidateMessage struct {
-	UserID    int64  `json:"user_id"`
-	SessionID int64  `json:"session_id"`
-	Scope     string `json:"scope"`
+	UserID      int64  `json:"user_id"`
+	SessionID   int64  `json:"session_id"`
+	Scope       string `json:"scope"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Provider    string `json:"provider,omitempty"`
 }
 
 type stateRedis struct {
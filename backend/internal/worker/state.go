@@ -16,12 +16,12 @@ type userState struct {
 }
 
 type AsCalling interface {
-	GenerateTitle(ctx context.Context, messages []*models.Message) (string, error)
-	SummarizeFile(ctx context.Context, content []*models.Message) (string, error)
+	GenerateTitle(ctx context.Context, messages []*models.Message) (string, *models.TokenUsage, error)
+	SummarizeFile(ctx context.Context, content []*models.Message) (string, *models.TokenUsage, error)
 }
 
 type AICalling interface {
-	StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(string) error) (*models.Message, error)
+	StreamChat(ctx context.Context, message *models.Message, prevHistory []*models.Message, imageFiles []*models.TempFile, callback func(models.StreamEvent) error) (*models.Message, error)
 }
 type sessionResources struct {
 	ai       AICalling
@@ -29,6 +29,10 @@ type sessionResources struct {
 	provider string
 	model    string
 	token    string
+	settings *models.SessionSettings
+	// contextWindow of the model and the token budget of its prompts; 0 when unknown
+	contextWindow int
+	contextBudget int
 }
 
 func newUserState() *userState {
@@ -99,6 +103,12 @@ func (s *userState) appendHistory(sessionID int64, msg *models.Message) {
 	if msg == nil {
 		return
 	}
+	if msg.Reasoning != "" {
+		// the history is replayed to providers and cached in Redis, keep reasoning out of it
+		stripped := *msg
+		stripped.Reasoning = ""
+		msg = &stripped
+	}
 	s.mu.Lock()
 	s.history[sessionID] = append(s.history[sessionID], msg)
 	s.mu.Unlock()
@@ -139,6 +149,24 @@ func (s *userState) setResources(sessionID int64, res *sessionResources) {
 	s.mu.Unlock()
 }
 
+// dropResources forgets the AI services of a session; they are rebuilt on the next request.
+func (s *userState) dropResources(sessionID int64) {
+	s.mu.Lock()
+	delete(s.resources, sessionID)
+	s.mu.Unlock()
+}
+
+// dropProviderResources forgets the AI services of every session using a provider.
+func (s *userState) dropProviderResources(provider string) {
+	s.mu.Lock()
+	for sessionID, res := range s.resources {
+		if res.provider == provider {
+			delete(s.resources, sessionID)
+		}
+	}
+	s.mu.Unlock()
+}
+
 func (s *userState) getResources(sessionID int64) *sessionResources {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
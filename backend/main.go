@@ -11,6 +11,7 @@ import (
 	"unichatgo/internal/config"
 	"unichatgo/internal/redis"
 	"unichatgo/internal/service/assistant"
+	"unichatgo/internal/service/llm"
 	"unichatgo/internal/storage"
 	"unichatgo/internal/worker"
 
@@ -24,6 +25,13 @@ func main() {
 		log.Fatalf("load config: %v", err)
 	}
 
+	if err := llm.RegisterBuiltins(llm.Default); err != nil {
+		log.Fatalf("register providers: %v", err)
+	}
+	if err := llm.Default.Configure(cfg.Providers); err != nil {
+		log.Fatalf("configure providers: %v", err)
+	}
+
 	dbType := os.Getenv("UNICHATGO_DB")
 	if dbType == "" {
 		dbType = "sqlite3"
@@ -39,6 +47,7 @@ func main() {
 		log.Fatalf("create redis client: %v", err)
 	}
 	defer rdb.Close()
+	llm.Default.ConfigureResilience(cfg.Resilience, llm.NewRedisCircuitStore(rdb.Raw()))
 
 	// Create necessary tables: users, apiKeys, sessions, messages
 	if err := storage.Migrate(db, dbType); err != nil {
@@ -62,6 +71,9 @@ func main() {
 		cleanInterval = assistant.DefaultTempFileCleanupInterval
 	}
 	assistantService.StartTempFileCleaner(cleanCtx, cleanInterval)
+	assistantService.ConfigureUsage(cfg.Usage)
+	assistantService.ConfigureUserProviders(cfg.UserProviders)
+	assistantService.ConfigureAdmins(cfg.Admin)
 	authService := auth.NewService(db, rdb, 24*time.Hour)
 	fileBase := cfg.BasicConfig.FileBaseDir
 	if fileBase == "" {
@@ -71,7 +83,11 @@ func main() {
 	if tempTTL <= 0 {
 		tempTTL = assistant.DefaultTempFileTTL
 	}
-	handlers := api.NewHandler(assistantService, authService, workerCfg, fileBase, tempTTL, rdb)
+	idempotencyTTL := time.Duration(cfg.BasicConfig.IdempotencyRetention) * time.Minute
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = assistant.DefaultIdempotencyRetention
+	}
+	handlers := api.NewHandler(assistantService, authService, workerCfg, fileBase, tempTTL, idempotencyTTL, rdb)
 
 	router := gin.Default()
 	handlers.RegisterRoutes(router)